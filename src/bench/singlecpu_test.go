@@ -88,7 +88,9 @@ func newProc(b *testing.B) *gofs.ProcState {
   // runtime.GC()
   gofs.InitGlobalState()
 
-  return gofs.InitProc()
+  p := gofs.InitProc()
+  b.Cleanup(func() { p.Exit() })
+  return p
 }
 
 func BenchmarkOC1(b *testing.B) {
@@ -0,0 +1,251 @@
+package gofs
+
+import (
+  "sort"
+)
+
+/**
+* POSIX ACLs grant permissions to named users and groups beyond the owner,
+* group and other bits of the mode. An access ACL always has one ACL_USER_OBJ,
+* ACL_GROUP_OBJ and ACL_OTHER entry, which are the mode's three sets of bits,
+* and may have ACL_USER and ACL_GROUP entries naming others; with those, an
+* ACL_MASK caps what they and ACL_GROUP_OBJ grant, and it is the mask that the
+* mode's group bits show. Inodes with nothing but the three base entries keep
+* no ACL at all; their mode says everything.
+*
+* Permission checks then go as acl(5) says: the owner gets ACL_USER_OBJ, a
+* named user their ACL_USER entry, and anyone in the owning group or a named
+* group whatever one of those entries grants; all of these but the first are
+* capped by the mask. Anyone else gets ACL_OTHER.
+*
+* Directories may also have a default ACL, which new entries in them inherit
+* instead of having the umask applied: files and directories get it as their
+* access ACL, capped by the mode they were created with, and directories get
+* it as their default ACL too.
+*/
+
+type ACLTag int
+const (
+  ACL_USER_OBJ ACLTag = 1 << iota
+  ACL_USER
+  ACL_GROUP_OBJ
+  ACL_GROUP
+  ACL_MASK
+  ACL_OTHER
+)
+
+type ACLType int
+const (
+  ACL_TYPE_ACCESS ACLType = iota
+  ACL_TYPE_DEFAULT
+)
+
+type ACLEntry struct {
+  Tag ACLTag
+  Id uint // the user or group, for ACL_USER and ACL_GROUP entries only
+  Perms FileMode
+}
+
+type ACL []ACLEntry
+
+// Returns the perms of the entry tagged tag, which must be in acl.
+func (acl ACL) perms(tag ACLTag) FileMode {
+  for _, entry := range acl {
+    if entry.Tag == tag { return entry.Perms }
+  }
+
+  panic("ACL entry missing!")
+}
+
+func (acl ACL) has(tag ACLTag) bool {
+  for _, entry := range acl {
+    if entry.Tag == tag { return true }
+  }
+
+  return false
+}
+
+func (acl ACL) setPerms(tag ACLTag, perms FileMode) {
+  for i := range acl {
+    if acl[i].Tag == tag { acl[i].Perms = perms }
+  }
+}
+
+// The entry whose perms the mode's group bits show.
+func (acl ACL) groupTag() ACLTag {
+  if acl.has(ACL_MASK) { return ACL_MASK }
+  return ACL_GROUP_OBJ
+}
+
+// Returns a sorted copy of acl, or EINVAL if it isn't a valid ACL.
+func (acl ACL) validate() (ACL, error) {
+  sorted := append(ACL(nil), acl...)
+  counts := make(map[ACLTag]int)
+  for i, entry := range sorted {
+    if (entry.Perms & ^(M_READ | M_WRITE | M_EXEC)) != 0 { return nil, EINVAL }
+    if entry.Tag != ACL_USER && entry.Tag != ACL_GROUP { sorted[i].Id = 0 }
+    counts[entry.Tag]++
+  }
+
+  sort.Slice(sorted, func(i, j int) bool {
+    if sorted[i].Tag != sorted[j].Tag { return sorted[i].Tag < sorted[j].Tag }
+    return sorted[i].Id < sorted[j].Id
+  })
+
+  // No entry may be given twice, not even a named one with other perms.
+  for i := 1; i < len(sorted); i++ {
+    if sorted[i - 1].Tag == sorted[i].Tag && sorted[i - 1].Id == sorted[i].Id {
+      return nil, EINVAL
+    }
+  }
+
+  for tag := range counts {
+    if tag < ACL_USER_OBJ || tag > ACL_OTHER || (tag & (tag - 1)) != 0 { return nil, EINVAL }
+  }
+
+  for _, tag := range []ACLTag{ACL_USER_OBJ, ACL_GROUP_OBJ, ACL_OTHER} {
+    if counts[tag] != 1 { return nil, EINVAL }
+  }
+
+  named := counts[ACL_USER] + counts[ACL_GROUP] > 0
+  if named && counts[ACL_MASK] == 0 { return nil, EINVAL }
+  return sorted, nil
+}
+
+// Returns the minimal ACL the mode bits perms amount to.
+func modeACL(perms uint) ACL {
+  return ACL{
+    {Tag: ACL_USER_OBJ, Perms: FileMode(perms >> 6 & 7)},
+    {Tag: ACL_GROUP_OBJ, Perms: FileMode(perms >> 3 & 7)},
+    {Tag: ACL_OTHER, Perms: FileMode(perms & 7)},
+  }
+}
+
+// Returns inode's access ACL, whether it keeps one or not.
+func (inode *Inode) accessACL() ACL {
+  if inode.acl == nil { return modeACL(inode.perms) }
+  return append(ACL(nil), inode.acl...)
+}
+
+// Makes acl inode's access ACL, and its mode bits match.
+func (inode *Inode) setAccessACL(acl ACL) {
+  inode.perms = inode.perms &^ 0777 |
+    uint(acl.perms(ACL_USER_OBJ)) << 6 |
+    uint(acl.perms(acl.groupTag())) << 3 |
+    uint(acl.perms(ACL_OTHER))
+
+  inode.acl = nil
+  if len(acl) > 3 { inode.acl = acl }
+}
+
+// Brings inode's ACL in line with a change to its mode bits.
+func (inode *Inode) chmodACL() {
+  if inode.acl == nil { return }
+
+  inode.acl.setPerms(ACL_USER_OBJ, FileMode(inode.perms >> 6 & 7))
+  inode.acl.setPerms(inode.acl.groupTag(), FileMode(inode.perms >> 3 & 7))
+  inode.acl.setPerms(ACL_OTHER, FileMode(inode.perms & 7))
+}
+
+// What acl grants proc, by the POSIX algorithm, for an inode proc doesn't own.
+func (proc *ProcState) aclGrants(acl ACL, inode *Inode, want FileMode) bool {
+  mask := FileMode(7)
+  if acl.has(ACL_MASK) { mask = acl.perms(ACL_MASK) }
+
+  for _, entry := range acl {
+    if entry.Tag == ACL_USER && entry.Id == proc.uid { return entry.Perms & mask & want == want }
+  }
+
+  matched := false
+  for _, entry := range acl {
+    inGroup := (entry.Tag == ACL_GROUP_OBJ && proc.inGroup(inode.groupId)) ||
+      (entry.Tag == ACL_GROUP && proc.inGroup(entry.Id))
+    if !inGroup { continue }
+
+    matched = true
+    if entry.Perms & mask & want == want { return true }
+  }
+
+  if matched { return false }
+  return acl.perms(ACL_OTHER) & want == want
+}
+
+// Gives an inode proc is creating in dir its ACLs, as dir's default ACL says,
+// and returns true, or returns false if dir has none.
+func inheritACL(inode *Inode, dir Directory, mode uint, isDir bool) bool {
+  inherited := dir.inode().defaultACL
+  if inherited == nil { return false }
+
+  acl := append(ACL(nil), inherited...)
+  acl.setPerms(ACL_USER_OBJ, acl.perms(ACL_USER_OBJ) & FileMode(mode >> 6 & 7))
+  acl.setPerms(acl.groupTag(), acl.perms(acl.groupTag()) & FileMode(mode >> 3 & 7))
+  acl.setPerms(ACL_OTHER, acl.perms(ACL_OTHER) & FileMode(mode & 7))
+  inode.setAccessACL(acl)
+
+  if isDir { inode.defaultACL = append(ACL(nil), inherited...) }
+  return true
+}
+
+func (proc *ProcState) getACL(inode *Inode, kind ACLType) (ACL, error) {
+  switch kind {
+  case ACL_TYPE_ACCESS:
+    return inode.accessACL(), nil
+  case ACL_TYPE_DEFAULT:
+    if !inode.isDir() { return nil, EACCES }
+    return append(ACL(nil), inode.defaultACL...), nil
+  }
+
+  return nil, EINVAL
+}
+
+func (proc *ProcState) setACL(ref pathRef, inode *Inode, kind ACLType, acl ACL) error {
+  if kind != ACL_TYPE_ACCESS && kind != ACL_TYPE_DEFAULT { return EINVAL }
+  if kind == ACL_TYPE_DEFAULT && !inode.isDir() { return EACCES }
+  if !proc.isOwner(inode) { return EPERM }
+  if err := inode.fs.checkWrite(); err != nil { return err }
+
+  // An empty default ACL removes it.
+  if kind == ACL_TYPE_DEFAULT && len(acl) == 0 {
+    inode.defaultACL = nil
+    return changedAttrs(ref, inode)
+  }
+
+  acl, err := acl.validate()
+  if err != nil { return err }
+
+  if kind == ACL_TYPE_DEFAULT {
+    inode.defaultACL = acl
+  } else {
+    inode.setAccessACL(acl)
+  }
+
+  return changedAttrs(ref, inode)
+}
+
+// Returns the ACL of the given type of what path names. Inodes without an
+// access ACL of their own give the one their mode amounts to.
+func (proc *ProcState) GetACL(path string, kind ACLType) (ACL, error) {
+  _, inode, err := proc.inodeAt(path, true)
+  if err != nil { return nil, err }
+  return proc.getACL(inode, kind)
+}
+
+func (proc *ProcState) FgetACL(fd FileDescriptor, kind ACLType) (ACL, error) {
+  _, inode, err := proc.inodeOfFd(fd)
+  if err != nil { return nil, err }
+  return proc.getACL(inode, kind)
+}
+
+// Sets the ACL of the given type of what path names, updating its mode bits to
+// match an access ACL. Only its owner or root may.
+func (proc *ProcState) SetACL(path string, kind ACLType, acl ACL) error {
+  ref, inode, err := proc.changeableAt(path, true)
+  if err != nil { return err }
+  return proc.setACL(ref, inode, kind, acl)
+}
+
+func (proc *ProcState) FsetACL(fd FileDescriptor, kind ACLType, acl ACL) error {
+  ref, inode, err := proc.changeableOfFd(fd)
+  if err != nil { return err }
+  return proc.setACL(ref, inode, kind, acl)
+}
@@ -0,0 +1,136 @@
+package gofs
+
+import (
+  "testing"
+)
+
+// Grants user 1000 read and write, group 300 read, and others nothing.
+var testACL = ACL{
+  {Tag: ACL_USER_OBJ, Perms: M_READ | M_WRITE | M_EXEC},
+  {Tag: ACL_USER, Id: 1000, Perms: M_READ | M_WRITE},
+  {Tag: ACL_GROUP_OBJ, Perms: M_READ},
+  {Tag: ACL_GROUP, Id: 300, Perms: M_READ},
+  {Tag: ACL_MASK, Perms: M_READ | M_WRITE | M_EXEC},
+  {Tag: ACL_OTHER},
+}
+
+func TestACLPermissions(t *testing.T) {
+  root := InitProc()
+  root.writeFile(t, "/acl", []byte("acl"))
+  AssertNoErr(t, root.Chown("/acl", 0, 200))
+  AssertNoErr(t, root.SetACL("/acl", ACL_TYPE_ACCESS, testACL))
+  AssertTrue(t, root.perms(t, "/acl") == 0770, "Mode doesn't show the mask.")
+
+  named, err := NewProc(ProcOptions{Uid: 1000, Gid: 100})
+  AssertNoErr(t, err)
+  grouped, err := NewProc(ProcOptions{Uid: 1001, Gid: 100, Groups: []uint{300}})
+  AssertNoErr(t, err)
+  owning, err := NewProc(ProcOptions{Uid: 1002, Gid: 200})
+  AssertNoErr(t, err)
+  other, err := NewProc(ProcOptions{Uid: 1003, Gid: 100})
+  AssertNoErr(t, err)
+
+  AssertNoErr(t, named.Access("/acl", R_OK|W_OK))
+  AssertTrue(t, named.Access("/acl", X_OK) == EACCES, "Named user may execute.")
+  AssertNoErr(t, grouped.Access("/acl", R_OK))
+  AssertTrue(t, grouped.Access("/acl", W_OK) == EACCES, "Named group may write.")
+  AssertNoErr(t, owning.Access("/acl", R_OK))
+  AssertTrue(t, other.Access("/acl", R_OK) == EACCES, "Others may read.")
+
+  // the mask caps named entries, and chmod's group bits set it
+  AssertNoErr(t, root.Chmod("/acl", 0740))
+  AssertTrue(t, named.Access("/acl", W_OK) == EACCES, "Mask didn't cap the named user.")
+  AssertNoErr(t, named.Access("/acl", R_OK))
+  acl, err := root.GetACL("/acl", ACL_TYPE_ACCESS)
+  AssertNoErr(t, err)
+  AssertTrue(t, acl[4].Tag == ACL_MASK && acl[4].Perms == M_READ, "Chmod didn't set the mask.")
+  AssertTrue(t, acl[1].Perms == M_READ | M_WRITE, "Chmod changed a named entry.")
+
+  // only the owner may set an ACL
+  AssertTrue(t, named.SetACL("/acl", ACL_TYPE_ACCESS, testACL) == EPERM, "Non-owner set an ACL.")
+
+  // the three base entries alone leave no ACL behind
+  AssertNoErr(t, root.SetACL("/acl", ACL_TYPE_ACCESS, modeACL(0604)))
+  AssertTrue(t, root.perms(t, "/acl") == 0604, "Mode doesn't match the ACL.")
+  AssertTrue(t, inodeOf(globalState.root["acl"]).acl == nil, "Kept a minimal ACL.")
+  AssertTrue(t, named.Access("/acl", R_OK) == nil, "Others can't read.")
+
+  for _, proc := range []*ProcState{named, grouped, owning, other} { proc.Exit() }
+  root.safeUnlink(t, "/acl")
+  root.Exit()
+}
+
+func TestACLValidation(t *testing.T) {
+  p := InitProc()
+  p.writeFile(t, "/acl", []byte("acl"))
+
+  invalid := []ACL{
+    nil,
+    modeACL(0644)[:2],
+    append(modeACL(0644), ACLEntry{Tag: ACL_USER, Id: 7, Perms: M_READ}),
+    append(modeACL(0644), ACLEntry{Tag: ACL_OTHER}),
+    append(modeACL(0644), ACLEntry{Tag: ACL_MASK, Perms: 8}),
+    append(append(ACL(nil), testACL...), ACLEntry{Tag: ACL_USER, Id: 1000}),
+    append(modeACL(0644), ACLEntry{Tag: ACL_MASK}, ACLEntry{Tag: ACL_MASK}),
+    append(modeACL(0644), ACLEntry{Tag: 3}),
+  }
+
+  for _, acl := range invalid {
+    AssertTrue(t, p.SetACL("/acl", ACL_TYPE_ACCESS, acl) == EINVAL, "Set an invalid ACL.")
+  }
+
+  // entries may come in any order
+  shuffled := ACL{testACL[5], testACL[3], testACL[0], testACL[4], testACL[1], testACL[2]}
+  AssertNoErr(t, p.SetACL("/acl", ACL_TYPE_ACCESS, shuffled))
+  acl, err := p.GetACL("/acl", ACL_TYPE_ACCESS)
+  AssertNoErr(t, err)
+  for i := range testACL {
+    AssertTrue(t, acl[i] == testACL[i], "ACL not stored in order.")
+  }
+
+  AssertTrue(t, p.SetACL("/acl", ACL_TYPE_DEFAULT, testACL) == EACCES, "Default ACL on a file.")
+  _, err = p.GetACL("/acl", ACL_TYPE_DEFAULT)
+  AssertTrue(t, err == EACCES, "Got a default ACL of a file.")
+  p.safeUnlink(t, "/acl")
+  p.Exit()
+}
+
+func TestDefaultACL(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/inherit")
+  AssertNoErr(t, p.SetACL("/inherit", ACL_TYPE_DEFAULT, testACL))
+
+  // new files get the default ACL, capped by their mode but not the umask
+  p.Umask(077)
+  rw := M_READ | M_WRITE
+  fd := p.safeOpen(t, "/inherit/file", O_RDWR|O_CREAT, [3]FileMode{rw, rw, rw})
+  p.safeClose(t, fd)
+  AssertTrue(t, p.perms(t, "/inherit/file") == 0660, "Umask applied under a default ACL.")
+  acl, err := p.GetACL("/inherit/file", ACL_TYPE_ACCESS)
+  AssertNoErr(t, err)
+  AssertTrue(t, len(acl) == len(testACL) && acl[0].Perms == rw,
+    "File didn't inherit the default ACL.")
+  _, err = p.GetACL("/inherit/file", ACL_TYPE_DEFAULT)
+  AssertTrue(t, err == EACCES, "File inherited a default ACL.")
+
+  // new directories get it as their default ACL too
+  p.safeMkdir(t, "/inherit/dir")
+  AssertTrue(t, p.perms(t, "/inherit/dir") == 0770, "Directory didn't inherit the ACL.")
+  acl, err = p.GetACL("/inherit/dir", ACL_TYPE_DEFAULT)
+  AssertNoErr(t, err)
+  AssertTrue(t, len(acl) == len(testACL), "Directory didn't inherit the default ACL.")
+
+  // an empty default ACL removes it
+  AssertNoErr(t, p.SetACL("/inherit", ACL_TYPE_DEFAULT, nil))
+  p.safeMkdir(t, "/inherit/plain")
+  AssertTrue(t, p.perms(t, "/inherit/plain") == 0700, "Umask not applied.")
+  acl, err = p.GetACL("/inherit/plain", ACL_TYPE_DEFAULT)
+  AssertTrue(t, err == nil && len(acl) == 0, "Removed default ACL still inherited.")
+
+  p.Umask(DEFAULT_UMASK)
+  for _, path := range []string{"/inherit/plain", "/inherit/dir", "/inherit/file", "/inherit"} {
+    p.safeUnlink(t, path)
+  }
+
+  p.Exit()
+}
@@ -0,0 +1,269 @@
+package gofs
+
+import (
+  "time"
+)
+
+/**
+* An inode's attributes are its mode bits, its owner and group, and its times.
+* The mode bits are the Unix ones: read, write and execute for the owner, the
+* group and others, plus three more:
+*   S_ISUID - run as the owner; cleared when the owner or group changes, or
+*             when anyone but root writes to the file
+*   S_ISGID - run as the group; on a directory, entries made in it take its
+*             group, and directories made in it are S_ISGID too
+*   S_ISVTX - on a directory, entries in it can only be unlinked or renamed
+*             away by their owner, the directory's owner or root
+*
+* New files get the mode asked for and new directories 0777, less the bits in
+* the process's umask, unless their directory has a default ACL (see acl.go).
+* Only root or the owner may change the mode or the times, and only root the
+* owner; the owner may change the group to one of their own, and anyone who
+* may write to a file may set its times to now. As with extended attributes,
+* entries other than files and directories have no inode, so calls on them
+* fail with EPERM. Symlinks are the exception for owners: they have their own,
+* which Lchown changes and the sticky bit goes by. Other entries belong to
+* root.
+*/
+
+const (
+  S_ISUID uint = 04000
+  S_ISGID uint = 02000
+  S_ISVTX uint = 01000
+)
+
+const DEFAULT_UMASK uint = 022
+
+// Special values for Timespec.Nsec, as for utimensat(2).
+const (
+  UTIME_NOW = (1 << 30) - 1 // set the time to now
+  UTIME_OMIT = (1 << 30) - 2 // leave the time as it is
+)
+
+type Timespec struct {
+  Sec int64
+  Nsec int64
+}
+
+func TimespecOf(t time.Time) Timespec {
+  return Timespec{Sec: t.Unix(), Nsec: int64(t.Nanosecond())}
+}
+
+// Returns mode as permission bits, the owner's in the highest three.
+func modeBits(mode [3]FileMode) uint {
+  return uint(mode[0]) << 6 | uint(mode[1]) << 3 | uint(mode[2])
+}
+
+// Returns the entry at path and its inode, following a final symlink if follow.
+func (proc *ProcState) inodeAt(path string, follow bool) (pathRef, *Inode, error) {
+  ref, err := proc.resolve(path, follow)
+  if err != nil { return ref, nil, err }
+  if ref.entry == nil { return ref, nil, ENOENT }
+
+  inode := inodeOf(ref.entry)
+  if inode == nil { return ref, nil, EPERM }
+  return ref, inode, nil
+}
+
+// Returns the entry open at fd, where it was opened through, and its inode.
+func (proc *ProcState) inodeOfFd(fd FileDescriptor) (pathRef, *Inode, error) {
+  file, err := proc.getFile(fd)
+  if err != nil { return pathRef{}, nil, err }
+
+  switch file := file.(type) {
+  case *DataFile:
+    return file.ref(), file.inode, nil
+  case *DirFile:
+    ref := pathRef{dir: file.dir.parent(), name: file.dir.header().name, entry: file.dir}
+    return ref, file.dir.inode(), nil
+  }
+
+  return pathRef{}, nil, EPERM
+}
+
+// Sets the mode bits and owner of an inode proc is creating in dir, asked to
+// have mode.
+func (proc *ProcState) setupNew(inode *Inode, dir Directory, mode uint, isDir bool) {
+  if !inheritACL(inode, dir, mode, isDir) { inode.perms = mode &^ proc.umask }
+  inode.fs = dir.inode().fs
+  inode.ownerId, inode.groupId = proc.uid, proc.gid
+
+  parent := dir.inode()
+  if (parent.perms & S_ISGID) == 0 { return }
+  inode.groupId = parent.groupId
+  if isDir { inode.perms |= S_ISGID }
+}
+
+func (proc *ProcState) isOwner(inode *Inode) bool {
+  return proc.uid == 0 || proc.uid == inode.ownerId
+}
+
+// Records a change to an inode's attributes.
+func changedAttrs(ref pathRef, inode *Inode) error {
+  inode.changeTime = time.Now()
+  notify(ref.dir, ref.name, ref.entry, IN_ATTRIB, 0)
+  return logSetattr(inode)
+}
+
+// Clears the setuid and setgid bits of a file anyone but root writes to, so that
+// it can't be made to run someone else's code as its owner.
+func (proc *ProcState) dropPrivileges(ref pathRef, inode *Inode) error {
+  setgid := (inode.perms & (S_ISGID | 0010)) == S_ISGID | 0010
+  if proc.uid == 0 || ((inode.perms & S_ISUID) == 0 && !setgid) { return nil }
+
+  inode.perms &^= S_ISUID
+  if setgid { inode.perms &^= S_ISGID }
+  return changedAttrs(ref, inode)
+}
+
+// Sets proc's umask and returns the old one.
+func (proc *ProcState) Umask(mask uint) uint {
+  old := proc.umask
+  proc.umask = mask & 0777
+  return old
+}
+
+func (proc *ProcState) chmod(ref pathRef, inode *Inode, mode uint) error {
+  if !proc.isOwner(inode) { return EPERM }
+  if err := inode.fs.checkWrite(); err != nil { return err }
+
+  // Only root can give a file to a group it isn't in.
+  if proc.uid != 0 && !proc.inGroup(inode.groupId) { mode &^= S_ISGID }
+  inode.perms = mode & 07777
+  inode.chmodACL()
+  return changedAttrs(ref, inode)
+}
+
+// Sets the mode bits of what path names.
+func (proc *ProcState) Chmod(path string, mode uint) error {
+  ref, inode, err := proc.changeableAt(path, true)
+  if err != nil { return err }
+  return proc.chmod(ref, inode, mode)
+}
+
+func (proc *ProcState) Fchmod(fd FileDescriptor, mode uint) error {
+  ref, inode, err := proc.changeableOfFd(fd)
+  if err != nil { return err }
+  return proc.chmod(ref, inode, mode)
+}
+
+// Returns the owner and group that a chown to uid and gid gives something now
+// owned by owner and group, if proc may make the change.
+func (proc *ProcState) newOwner(owner uint, group uint, uid int, gid int) (uint, uint, error) {
+  if uid < -1 || gid < -1 { return 0, 0, EINVAL }
+
+  newOwner, newGroup := owner, group
+  if uid != -1 { newOwner = uint(uid) }
+  if gid != -1 { newGroup = uint(gid) }
+
+  if proc.uid != 0 {
+    if newOwner != owner || proc.uid != owner { return 0, 0, EPERM }
+    if newGroup != group && !proc.inGroup(newGroup) { return 0, 0, EPERM }
+  }
+
+  return newOwner, newGroup, nil
+}
+
+func (proc *ProcState) chown(ref pathRef, inode *Inode, uid int, gid int) error {
+  owner, group, err := proc.newOwner(inode.ownerId, inode.groupId, uid, gid)
+  if err != nil { return err }
+  if err := inode.fs.checkWrite(); err != nil { return err }
+
+  inode.ownerId, inode.groupId = owner, group
+  if _, isDir := ref.entry.(Directory); !isDir {
+    inode.perms &^= S_ISUID
+    // Without group execute, S_ISGID marks mandatory locking instead.
+    if (inode.perms & 0010) != 0 { inode.perms &^= S_ISGID }
+  }
+
+  return changedAttrs(ref, inode)
+}
+
+// Sets the owner and group of what path names; -1 leaves either as it is.
+func (proc *ProcState) Chown(path string, uid int, gid int) error {
+  ref, inode, err := proc.changeableAt(path, true)
+  if err != nil { return err }
+  return proc.chown(ref, inode, uid, gid)
+}
+
+func (proc *ProcState) Fchown(fd FileDescriptor, uid int, gid int) error {
+  ref, inode, err := proc.changeableOfFd(fd)
+  if err != nil { return err }
+  return proc.chown(ref, inode, uid, gid)
+}
+
+// Chown, but on a symlink itself rather than what it points to.
+func (proc *ProcState) Lchown(path string, uid int, gid int) error {
+  ref, err := proc.resolve(path, false)
+  if err != nil { return err }
+  if link, isLink := ref.entry.(*Symlink); isLink { return proc.chownLink(ref, link, uid, gid) }
+
+  ref, inode, err := proc.changeableAt(path, false)
+  if err != nil { return err }
+  return proc.chown(ref, inode, uid, gid)
+}
+
+// Lchown of the symlink ref names. An overlay's symlink from its lower layer is
+// copied up first.
+func (proc *ProcState) chownLink(ref pathRef, link *Symlink, uid int, gid int) error {
+  owner, group, err := proc.newOwner(link.ownerId, link.groupId, uid, gid)
+  if err != nil { return err }
+  if err := ref.dir.inode().fs.checkWrite(); err != nil { return err }
+
+  if _, inUpper := ref.dir[ref.name]; !inUpper {
+    link = &Symlink{target: link.target}
+    ref.dir[ref.name], ref.entry = link, link
+  }
+  link.ownerId, link.groupId = owner, group
+  notify(ref.dir, ref.name, ref.entry, IN_ATTRIB, 0)
+  return logLinkOwner(ref, link)
+}
+
+// Returns the time ts asks for, and whether it asks for one at all.
+func (ts Timespec) resolve(now time.Time) (time.Time, bool, error) {
+  switch {
+  case ts.Nsec == UTIME_OMIT:
+    return time.Time{}, false, nil
+  case ts.Nsec == UTIME_NOW:
+    return now, true, nil
+  case ts.Nsec < 0 || ts.Nsec >= int64(time.Second):
+    return time.Time{}, false, EINVAL
+  }
+
+  return time.Unix(ts.Sec, ts.Nsec), true, nil
+}
+
+func (proc *ProcState) utimes(ref pathRef, inode *Inode, times [2]Timespec) error {
+  now := time.Now()
+  atime, setAtime, err := times[0].resolve(now)
+  if err != nil { return err }
+  mtime, setMtime, err := times[1].resolve(now)
+  if err != nil { return err }
+
+  // Anyone who may write to the file may touch it, but only its owner may
+  // set other times.
+  explicit := times[0].Nsec != UTIME_NOW && times[0].Nsec != UTIME_OMIT ||
+    times[1].Nsec != UTIME_NOW && times[1].Nsec != UTIME_OMIT
+  if !proc.isOwner(inode) {
+    if explicit { return EPERM }
+    if !proc.permitted(inode, M_WRITE) { return EACCES }
+  }
+  if err := inode.fs.checkWrite(); err != nil { return err }
+
+  if setAtime { inode.lastAccessTime = atime }
+  if setMtime { inode.lastModTime = mtime }
+  return changedAttrs(ref, inode)
+}
+
+// Sets the access and modification times of what path names, in that order.
+func (proc *ProcState) Utimes(path string, times [2]Timespec) error {
+  ref, inode, err := proc.changeableAt(path, true)
+  if err != nil { return err }
+  return proc.utimes(ref, inode, times)
+}
+
+func (proc *ProcState) Futimens(fd FileDescriptor, times [2]Timespec) error {
+  ref, inode, err := proc.changeableOfFd(fd)
+  if err != nil { return err }
+  return proc.utimes(ref, inode, times)
+}
@@ -0,0 +1,162 @@
+package gofs
+
+import (
+  "testing"
+  "time"
+)
+
+func (p *ProcState) perms(t *testing.T, path string) uint {
+  _, inode, err := p.inodeAt(path, true)
+  AssertNoErr(t, err)
+  return inode.perms
+}
+
+func TestUmaskAndChmod(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  AssertTrue(t, p.Umask(027) == DEFAULT_UMASK, "Wrong default umask.")
+
+  fd := p.safeOpen(t, "/masked", O_RDWR|O_CREAT, UserMode())
+  AssertTrue(t, p.perms(t, "/masked") == 0740, "Umask not applied to file.")
+  p.safeMkdir(t, "/maskdir")
+  AssertTrue(t, p.perms(t, "/maskdir") == 0750, "Umask not applied to directory.")
+
+  AssertNoErr(t, p.Chmod("/masked", 0600))
+  AssertTrue(t, p.perms(t, "/masked") == 0600, "Chmod didn't set mode.")
+  AssertNoErr(t, p.Fchmod(fd, 04755 | 0170000))
+  AssertTrue(t, p.perms(t, "/masked") == 04755, "Fchmod didn't set mode.")
+
+  // only the owner may change the mode
+  p.uid = 1000
+  AssertTrue(t, p.Chmod("/masked", 0777) == EPERM, "Expected EPERM.")
+  p.uid = 0
+
+  // forks share the umask
+  child, err := Fork(p)
+  AssertNoErr(t, err)
+  AssertTrue(t, child.Umask(0) == 027, "Umask not inherited.")
+  child.Exit()
+
+  p.safeClose(t, fd)
+  p.safeUnlink(t, "/masked")
+  p.safeUnlink(t, "/maskdir")
+}
+
+func TestChownAndSetgid(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  p.safeMkdir(t, "/shared")
+  AssertNoErr(t, p.Chown("/shared", -1, 50))
+  AssertNoErr(t, p.Chmod("/shared", 02775))
+
+  // entries in a setgid directory take its group
+  p.safeMkdir(t, "/shared/sub")
+  fd := p.safeOpen(t, "/shared/file", O_RDWR|O_CREAT, UserMode())
+  _, sub, _ := p.inodeAt("/shared/sub", true)
+  _, file, _ := p.inodeAt("/shared/file", true)
+  AssertTrue(t, sub.groupId == 50 && (sub.perms & S_ISGID) != 0, "Subdirectory not setgid.")
+  AssertTrue(t, file.groupId == 50 && (file.perms & S_ISGID) == 0, "File didn't take group.")
+
+  // changing owners clears setuid, and setgid with group execute
+  AssertNoErr(t, p.Fchmod(fd, 06750))
+  AssertNoErr(t, p.Fchown(fd, 1000, -1))
+  AssertTrue(t, file.ownerId == 1000 && file.perms == 0750, "Chown didn't clear bits.")
+  AssertNoErr(t, p.Chmod("/shared/sub", 02755))
+  AssertNoErr(t, p.Lchown("/shared/sub", 1000, -1))
+  AssertTrue(t, sub.perms == 02755, "Chown cleared a directory's setgid.")
+
+  // the owner may only change the group, to their own
+  p.uid, p.gid = 1000, 100
+  AssertTrue(t, p.Fchown(fd, 0, -1) == EPERM, "Gave a file away.")
+  AssertTrue(t, p.Fchown(fd, -1, 7) == EPERM, "Changed to another group.")
+  AssertNoErr(t, p.Fchown(fd, -1, 100))
+  AssertTrue(t, file.groupId == 100, "Group not changed.")
+  p.uid, p.gid = 0, 0
+
+  AssertTrue(t, p.Lchown("/dev/null", 1, 1) == EPERM, "Expected EPERM on a device.")
+
+  // symlinks have owners of their own, which Lchown changes
+  AssertNoErr(t, p.Chmod("/shared", 02777))
+  p.uid, p.gid = 1000, 100
+  AssertNoErr(t, p.Symlink("file", "/shared/link"))
+  stat, err := p.Lstat("/shared/link")
+  AssertTrue(t, err == nil && stat.Uid == 1000 && stat.Gid == 50, "Symlink not owned by its maker.")
+  AssertTrue(t, p.Lchown("/shared/link", 0, -1) == EPERM, "Gave a symlink away.")
+  AssertNoErr(t, p.Lchown("/shared/link", -1, 100))
+  p.uid, p.gid = 0, 0
+  AssertNoErr(t, p.Lchown("/shared/link", 7, 8))
+  stat, err = p.Lstat("/shared/link")
+  AssertTrue(t, err == nil && stat.Uid == 7 && stat.Gid == 8, "Lchown didn't change the symlink.")
+  AssertTrue(t, file.ownerId == 1000 && file.groupId == 100, "Lchown changed the target.")
+
+  p.safeClose(t, fd)
+  p.safeUnlink(t, "/shared/link")
+  p.safeUnlink(t, "/shared/file")
+  p.safeUnlink(t, "/shared/sub")
+  p.safeUnlink(t, "/shared")
+}
+
+func TestUtimes(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  before := time.Now()
+  fd := p.safeOpen(t, "/timed", O_RDWR|O_CREAT, UserMode())
+  _, inode, _ := p.inodeAt("/timed", true)
+  AssertTrue(t, !inode.createTime.Before(before), "Creation time not set.")
+
+  atime, mtime := time.Unix(100, 1), time.Unix(200, 2)
+  AssertNoErr(t, p.Utimes("/timed", [2]Timespec{TimespecOf(atime), TimespecOf(mtime)}))
+  AssertTrue(t, inode.lastAccessTime.Equal(atime) && inode.lastModTime.Equal(mtime),
+    "Times not set.")
+
+  AssertNoErr(t, p.Futimens(fd, [2]Timespec{{0, UTIME_NOW}, {0, UTIME_OMIT}}))
+  AssertTrue(t, !inode.lastAccessTime.Before(before) && inode.lastModTime.Equal(mtime),
+    "UTIME_NOW or UTIME_OMIT not honoured.")
+  AssertTrue(t, p.Futimens(fd, [2]Timespec{{0, -1}, {0, 0}}) == EINVAL, "Expected EINVAL.")
+
+  p.uid = 1000
+  AssertTrue(t, p.Futimens(fd, [2]Timespec{TimespecOf(atime), {0, UTIME_OMIT}}) == EPERM,
+    "Expected EPERM setting times.")
+  AssertTrue(t, p.Futimens(fd, [2]Timespec{{0, UTIME_NOW}, {0, UTIME_NOW}}) == EACCES,
+    "Expected EACCES touching.")
+  p.uid = 0
+
+  p.safeClose(t, fd)
+  p.safeUnlink(t, "/timed")
+}
+
+func TestStickyDirectory(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  p.safeMkdir(t, "/tmp")
+  AssertNoErr(t, p.Chmod("/tmp", 01777))
+
+  alice, err := Fork(p)
+  AssertNoErr(t, err)
+  alice.uid = 1000
+  bob, err := Fork(p)
+  AssertNoErr(t, err)
+  bob.uid = 1001
+
+  fd := alice.safeOpen(t, "/tmp/alice", O_RDWR|O_CREAT, UserMode())
+  alice.safeClose(t, fd)
+  AssertTrue(t, bob.Unlink("/tmp/alice") == EPERM, "Unlinked another's file.")
+  AssertTrue(t, bob.Rename("/tmp/alice", "/tmp/bob") == EPERM, "Renamed another's file.")
+
+  fd = bob.safeOpen(t, "/tmp/bob", O_RDWR|O_CREAT, UserMode())
+  bob.safeClose(t, fd)
+  AssertTrue(t, bob.Rename("/tmp/bob", "/tmp/alice") == EPERM, "Replaced another's file.")
+  alice.safeRename(t, "/tmp/alice", "/tmp/moved")
+  alice.safeUnlink(t, "/tmp/moved")
+
+  // symlinks go by their own owner
+  AssertNoErr(t, alice.Symlink("bob", "/tmp/link"))
+  AssertTrue(t, bob.Unlink("/tmp/link") == EPERM, "Unlinked another's symlink.")
+  alice.safeUnlink(t, "/tmp/link")
+
+  // the directory's owner may remove anything in it
+  p.safeUnlink(t, "/tmp/bob")
+  p.safeUnlink(t, "/tmp")
+  alice.Exit()
+  bob.Exit()
+}
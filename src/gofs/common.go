@@ -25,6 +25,7 @@ type File interface {
 
 type Inode struct {
   data interface{dstore.DataStore}
+  ino uint64
 
   perms uint
   ownerId uint
@@ -32,26 +33,59 @@ type Inode struct {
 
   lastModTime time.Time
   lastAccessTime time.Time
+  changeTime time.Time
   createTime time.Time
 
   linkCount int
   fileCount int
+
+  // Advisory locks held on the inode; see lock.go.
+  locks []*heldLock
+  watches []*Watch
+  xattrs map[string][]byte
+  acl ACL // nil if the mode says it all; see acl.go
+  defaultACL ACL // for directories only
+  fs *fsMount // the mount it's on; see mount.go
+}
+
+// Symlinks are directory entries naming another path, which is resolved
+// relative to the directory holding the symlink. They have an owner and group,
+// which only Lchown changes, but no inode.
+type Symlink struct {
+  target string
+  ownerId uint
+  groupId uint
 }
 
+type Pid int
+
 const MAX_DESCRIPTORS = 1024;
 type ProcState struct {
+  pid Pid
+  ppid Pid
   fileDescriptorTable FileDescriptorTable
   freeDescriptors [MAX_DESCRIPTORS]FileDescriptor
   lastFd FileDescriptor
+  closeOnExec [MAX_DESCRIPTORS]bool
   cwd Directory
+  root Directory // what '/' names for it; see Chroot
+  uid uint
+  gid uint
+  groups []uint
+  umask uint
 }
 
 type GlobalState struct {
   root Directory
+  mounts []*fsMount // the root's first
+  nextIno uint64
+  journal *journal
+  procs map[Pid]*ProcState
+  lastPid Pid
   // fileTable FileTable
-  stdIn interface{File}
-  stdOut interface{File}
-  stdErr interface{File}
+  stdIn io.Reader
+  stdOut io.Writer
+  stdErr io.Writer
 }
 
 type FileMode uint
@@ -84,3 +118,9 @@ const (
   O_EVTONLY
   O_CLOEXEC
 )
+
+type RenameFlag uint
+const (
+  RENAME_NOREPLACE RenameFlag = 1 << iota
+  RENAME_EXCHANGE
+)
@@ -0,0 +1,137 @@
+package gofs
+
+/**
+* Every process acts for a user: a uid, a primary gid and any number of
+* supplementary groups, given to NewProc and inherited by Fork. There is no
+* split between real, effective and saved ids; a process has one of each.
+*
+* Permission checks pick the owner's, the group's or others' bits of an inode's
+* mode, in that order, by whether the process is the owner or in the group, and
+* grant what those bits grant, or what its ACL grants if it has one (see
+* acl.go). Looking up a name in a directory needs execute on it, so every
+* directory a path passes through must be searchable; adding or removing
+* entries needs write on the directory; opening needs read or write as the
+* flags ask. Root (uid 0) is allowed all of these, as with
+* CAP_DAC_OVERRIDE, except executing a file no one may execute. Entries without
+* an inode act as if their mode were 0666 and root owned them.
+*/
+
+const (
+  F_OK FileMode = 0
+  X_OK = M_EXEC
+  W_OK = M_WRITE
+  R_OK = M_READ
+)
+
+func (proc *ProcState) inGroup(gid uint) bool {
+  if gid == proc.gid { return true }
+  for _, group := range proc.groups {
+    if group == gid { return true }
+  }
+
+  return false
+}
+
+// Reports whether proc may do all of want to inode.
+func (proc *ProcState) permitted(inode *Inode, want FileMode) bool {
+  if proc.uid == 0 {
+    return (want & M_EXEC) == 0 || inode.isDir() || (inode.perms & 0111) != 0
+  }
+
+  if proc.uid == inode.ownerId { return FileMode(inode.perms >> 6) & want == want }
+  return proc.aclGrants(inode.accessACL(), inode, want)
+}
+
+// Like permitted, but for any entry, and failing with EACCES.
+func (proc *ProcState) checkPermission(entry interface{}, want FileMode) error {
+  inode := inodeOf(entry)
+  if inode == nil && (want & M_EXEC) == 0 { return nil }
+  if inode == nil || !proc.permitted(inode, want) { return EACCES }
+  return nil
+}
+
+// Checks that proc may add entries to dir.
+func (proc *ProcState) checkCreate(dir Directory) error {
+  if err := dir.inode().fs.checkWrite(); err != nil { return err }
+  return proc.checkPermission(dir, M_WRITE)
+}
+
+// Checks that proc may unlink or rename away entry from dir: it needs write
+// on dir, and if dir is sticky, to own dir or entry.
+func (proc *ProcState) checkRemove(dir Directory, entry interface{}) error {
+  if err := proc.checkCreate(dir); err != nil { return err }
+  if (dir.inode().perms & S_ISVTX) == 0 || proc.isOwner(dir.inode()) { return nil }
+
+  if link, isLink := entry.(*Symlink); isLink {
+    if proc.uid != link.ownerId { return EPERM }
+    return nil
+  }
+  inode := inodeOf(entry)
+  if inode == nil || !proc.isOwner(inode) { return EPERM }
+  return nil
+}
+
+// Returns what opening with flags needs to be permitted.
+func openWants(flags AccessFlag) FileMode {
+  switch {
+  case (flags & O_RDWR) != 0:
+    return M_READ | M_WRITE
+  case (flags & O_WRONLY) != 0:
+    return M_WRITE
+  case (flags & O_RDONLY) != 0:
+    return M_READ
+  }
+
+  // Without access flags, a file can be both read and written.
+  return M_READ | M_WRITE
+}
+
+// Checks whether proc may do mode (R_OK, W_OK and X_OK together, or F_OK) to
+// what path names.
+func (proc *ProcState) Access(path string, mode FileMode) error {
+  if (mode & ^(R_OK | W_OK | X_OK)) != 0 { return EINVAL }
+
+  ref, err := proc.resolve(path, true)
+  if err != nil { return err }
+  if ref.entry == nil { return ENOENT }
+
+  // Nothing on a noexec mount may be run, whatever its mode says.
+  _, isDir := ref.entry.(Directory)
+  noexec := (mountOf(ref.entry, ref.dir).flags & MS_NOEXEC) != 0
+  if (mode & X_OK) != 0 && noexec && !isDir { return EACCES }
+  return proc.checkPermission(ref.entry, mode)
+}
+
+func (proc *ProcState) Getuid() uint {
+  return proc.uid
+}
+
+func (proc *ProcState) Getgid() uint {
+  return proc.gid
+}
+
+// Returns proc's supplementary groups.
+func (proc *ProcState) Getgroups() []uint {
+  return append([]uint(nil), proc.groups...)
+}
+
+// Makes proc act for uid. Only root may become someone else.
+func (proc *ProcState) Setuid(uid uint) error {
+  if proc.uid != 0 && uid != proc.uid { return EPERM }
+  proc.uid = uid
+  return nil
+}
+
+// Sets proc's primary group. Only root may join a group it isn't in.
+func (proc *ProcState) Setgid(gid uint) error {
+  if proc.uid != 0 && !proc.inGroup(gid) { return EPERM }
+  proc.gid = gid
+  return nil
+}
+
+// Replaces proc's supplementary groups. Only root may.
+func (proc *ProcState) Setgroups(groups []uint) error {
+  if proc.uid != 0 { return EPERM }
+  proc.groups = append([]uint(nil), groups...)
+  return nil
+}
@@ -0,0 +1,114 @@
+package gofs
+
+import (
+  "testing"
+)
+
+func TestCredentials(t *testing.T) {
+  root := InitProc()
+  defer root.Exit()
+  root.safeMkdir(t, "/home")
+  AssertNoErr(t, root.Chown("/home", 1000, 100))
+  root.safeMkdir(t, "/secret")
+  AssertNoErr(t, root.Chmod("/secret", 0700))
+  root.writeFile(t, "/secret/key", []byte("key"))
+  root.writeFile(t, "/shared", []byte("shared"))
+  AssertNoErr(t, root.Chown("/shared", 0, 200))
+  AssertNoErr(t, root.Chmod("/shared", 0640))
+
+  user, err := NewProc(ProcOptions{Uid: 1000, Gid: 100, Groups: []uint{200}})
+  AssertNoErr(t, err)
+  AssertTrue(t, user.Getuid() == 1000 && user.Getgid() == 100, "Wrong ids.")
+
+  // every directory on the way must be searchable
+  _, err = user.Open("/secret/key", O_RDONLY, UserMode())
+  AssertTrue(t, err == EACCES, "Traversed a directory without execute.")
+  AssertTrue(t, user.Chdir("/secret") == EACCES, "Chdir without execute.")
+  AssertTrue(t, user.Access("/secret", X_OK) == EACCES, "Access allowed search.")
+  AssertTrue(t, user.Access("/secret/key", F_OK) == EACCES, "Access traversed.")
+
+  // supplementary groups count for the group bits
+  fd := user.safeOpen(t, "/shared", O_RDONLY, UserMode())
+  user.safeClose(t, fd)
+  _, err = user.Open("/shared", O_RDWR, UserMode())
+  AssertTrue(t, err == EACCES, "Opened a read-only file to write.")
+  AssertNoErr(t, user.Access("/shared", R_OK))
+  AssertTrue(t, user.Access("/shared", R_OK|W_OK) == EACCES, "Access allowed write.")
+
+  // creating and removing entries needs write on the directory
+  AssertTrue(t, user.Mkdir("/mine") == EACCES, "Created in a directory without write.")
+  AssertTrue(t, user.Unlink("/shared") == EACCES, "Unlinked without write.")
+  user.safeMkdir(t, "/home/mine")
+  user.writeFile(t, "/home/mine/file", []byte("mine"))
+  AssertTrue(t, user.Rename("/home/mine/file", "/file") == EACCES, "Renamed into /.")
+
+  // root may do anything but execute what no one may
+  AssertNoErr(t, root.Chmod("/shared", 0))
+  AssertNoErr(t, root.Access("/shared", R_OK|W_OK))
+  AssertTrue(t, root.Access("/shared", X_OK) == EACCES, "Root executed a 0 file.")
+  AssertNoErr(t, root.Chmod("/shared", 0100))
+  AssertNoErr(t, root.Access("/shared", X_OK))
+
+  // forks act for the same user
+  child, err := Fork(user)
+  AssertNoErr(t, err)
+  AssertTrue(t, child.Getuid() == 1000 && child.Getgroups()[0] == 200, "Creds not inherited.")
+  child.Exit()
+
+  user.Exit()
+  root.safeUnlink(t, "/home/mine/file")
+  root.safeUnlink(t, "/home/mine")
+  root.safeUnlink(t, "/home")
+  root.safeUnlink(t, "/secret/key")
+  root.safeUnlink(t, "/secret")
+  root.safeUnlink(t, "/shared")
+}
+
+func TestSetuidSetgid(t *testing.T) {
+  user, err := NewProc(ProcOptions{Uid: 1000, Gid: 100, Groups: []uint{200}})
+  AssertNoErr(t, err)
+  AssertTrue(t, user.Setuid(0) == EPERM, "Became root.")
+  AssertNoErr(t, user.Setuid(1000))
+  AssertTrue(t, user.Setgid(300) == EPERM, "Joined another group.")
+  AssertNoErr(t, user.Setgid(200))
+  AssertTrue(t, user.Setgroups(nil) == EPERM, "Set groups without root.")
+  user.Exit()
+
+  root := InitProc()
+  AssertNoErr(t, root.Setgroups([]uint{5, 6}))
+  AssertNoErr(t, root.Setgid(7))
+  AssertNoErr(t, root.Setuid(1000))
+  AssertTrue(t, root.Setuid(0) == EPERM, "Root again after giving it up.")
+  root.Exit()
+}
+
+func TestPrivilegedBits(t *testing.T) {
+  root := InitProc()
+  defer root.Exit()
+  root.writeFile(t, "/program", []byte("#!"))
+  AssertNoErr(t, root.Chmod("/program", 06777))
+  AssertNoErr(t, root.Setxattr("/program", "trusted.sig", []byte("ok"), 0))
+  AssertNoErr(t, root.Setxattr("/program", "user.note", []byte("hi"), 0))
+
+  user, err := NewProc(ProcOptions{Uid: 1000, Gid: 100})
+  AssertNoErr(t, err)
+
+  // the trusted namespace is root's alone
+  _, err = user.Getxattr("/program", "trusted.sig")
+  AssertTrue(t, err == ENODATA, "Read a trusted attribute.")
+  AssertTrue(t, user.Setxattr("/program", "trusted.sig", nil, 0) == EPERM,
+    "Set a trusted attribute.")
+  names, err := user.Listxattr("/program")
+  AssertNoErr(t, err)
+  AssertTrue(t, len(names) == 1 && names[0] == "user.note", "Listed trusted attributes.")
+
+  // anyone who may write may touch, and writing drops setuid and setgid
+  AssertNoErr(t, user.Utimes("/program", [2]Timespec{{0, UTIME_NOW}, {0, UTIME_NOW}}))
+  fd := user.safeOpen(t, "/program", O_WRONLY, UserMode())
+  user.safeWrite(t, fd, []byte("#!/bin/sh"))
+  user.safeClose(t, fd)
+  AssertTrue(t, root.perms(t, "/program") == 0777, "Write kept setuid or setgid.")
+
+  user.Exit()
+  root.safeUnlink(t, "/program")
+}
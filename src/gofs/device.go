@@ -0,0 +1,162 @@
+package gofs
+
+import (
+  "errors"
+  "io"
+  "math/rand"
+  "sync"
+  "time"
+)
+
+/**
+* Devices are the other kind of File the essay in file.go allows for. A device
+* node is a Directory entry naming a driver; opening the node asks the driver
+* for a File. Drivers are registered by name, once for the whole program, so
+* they outlive ClearGlobalState and can be found again when a journal brings
+* back a tree holding nodes for them. Opening a node whose driver isn't
+* registered fails with ENXIO.
+*
+* Every file system is created with a /dev holding the usual devices:
+*   null    - reads nothing, swallows writes
+*   zero    - reads zeroes, swallows writes
+*   full    - reads zeroes, fails writes with ENOSPC
+*   urandom - reads pseudo-random bytes; SeedURandom makes them reproducible
+*/
+
+type Driver interface {
+  Open(flags AccessFlag) (File, error)
+}
+
+// Lets a plain function be a Driver.
+type DriverFunc func(flags AccessFlag) (File, error)
+
+func (f DriverFunc) Open(flags AccessFlag) (File, error) {
+  return f(flags)
+}
+
+// A character device node, as made by Mknod.
+type Device struct {
+  driver string
+}
+
+var drivers = make(map[string]Driver)
+
+// Registers driver under name so device nodes can be made for it.
+func RegisterDriver(name string, driver Driver) error {
+  if _, exists := drivers[name]; exists {
+    return errors.New("Driver already registered.")
+  }
+
+  drivers[name] = driver
+  return nil
+}
+
+func (dev *Device) open(flags AccessFlag) (File, error) {
+  driver, ok := drivers[dev.driver]
+  if !ok { return nil, ENXIO }
+  return driver.Open(flags)
+}
+
+// Creates a device node at path for the driver registered under name. Only
+// root can, as a node gets whatever access its driver gives.
+func (proc *ProcState) Mknod(path string, name string) error {
+  ref, err := proc.resolve(path, false)
+  if err != nil { return err }
+  if ref.entry != nil { return EEXIST }
+  if ref.slash { return ENOENT }
+  if err := proc.checkCreate(ref.dir); err != nil { return err }
+  if proc.uid != 0 { return EPERM }
+
+  ref.dir[ref.name] = &Device{driver: name}
+  notify(ref.dir, ref.name, nil, IN_CREATE, 0)
+  return logWithPath(recMknod, name, ref)
+}
+
+// Creates /dev with a node for each of the standard devices.
+func initDevDirectory(root Directory) {
+  dev := initDirectory(root, "dev")
+  for _, name := range []string{"null", "zero", "full", "urandom"} {
+    dev[name] = &Device{driver: name}
+  }
+
+  root["dev"] = dev
+}
+
+// The standard devices keep no state of their own, so every descriptor for
+// one can share a single value and closing it does nothing.
+type stdDevice struct{}
+
+func (stdDevice) Seek(offset int64, whence int) (int64, error) {
+  return 0, nil
+}
+
+func (stdDevice) Close() error {
+  return nil
+}
+
+func (stdDevice) retain() {
+}
+
+type nullDevice struct{ stdDevice }
+type zeroDevice struct{ stdDevice }
+type fullDevice struct{ stdDevice }
+type urandomDevice struct{ stdDevice }
+
+func (nullDevice) Read(p []byte) (int, error) {
+  return 0, io.EOF
+}
+
+func (nullDevice) Write(p []byte) (int, error) {
+  return len(p), nil
+}
+
+func (zeroDevice) Read(p []byte) (int, error) {
+  for i := range p { p[i] = 0 }
+  return len(p), nil
+}
+
+func (zeroDevice) Write(p []byte) (int, error) {
+  return len(p), nil
+}
+
+func (fullDevice) Read(p []byte) (int, error) {
+  return zeroDevice{}.Read(p)
+}
+
+func (fullDevice) Write(p []byte) (int, error) {
+  return 0, ENOSPC
+}
+
+var urandom = struct {
+  sync.Mutex
+  source *rand.Rand
+}{source: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Reseeds /dev/urandom so that what it reads from now on is reproducible.
+func SeedURandom(seed int64) {
+  urandom.Lock()
+  urandom.source = rand.New(rand.NewSource(seed))
+  urandom.Unlock()
+}
+
+func (urandomDevice) Read(p []byte) (int, error) {
+  urandom.Lock()
+  defer urandom.Unlock()
+  return urandom.source.Read(p)
+}
+
+// As on Linux, anyone may write to urandom; it just doesn't matter here.
+func (urandomDevice) Write(p []byte) (int, error) {
+  return len(p), nil
+}
+
+func stdDriver(file File) Driver {
+  return DriverFunc(func(flags AccessFlag) (File, error) { return file, nil })
+}
+
+func init() {
+  RegisterDriver("null", stdDriver(nullDevice{}))
+  RegisterDriver("zero", stdDriver(zeroDevice{}))
+  RegisterDriver("full", stdDriver(fullDevice{}))
+  RegisterDriver("urandom", stdDriver(urandomDevice{}))
+}
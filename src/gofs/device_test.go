@@ -0,0 +1,107 @@
+package gofs
+
+import (
+  "bytes"
+  "io"
+  "testing"
+)
+
+func TestStandardDevices(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  buffer := randBytes(64)
+
+  null := p.safeOpen(t, "/dev/null", O_RDWR, UserMode())
+  AssertTrue(t, p.safeWrite(t, null, buffer) == 64, "Short write to null.")
+  _, err := p.Read(null, buffer)
+  AssertTrue(t, err == io.EOF, "Expected EOF from null.")
+  p.safeClose(t, null)
+
+  zero := p.safeOpen(t, "/dev/zero", O_RDONLY, UserMode())
+  AssertTrue(t, p.safeRead(t, zero, buffer) == 64, "Short read from zero.")
+  AssertEqualBytes(t, buffer, make([]byte, 64))
+  p.safeClose(t, zero)
+
+  full := p.safeOpen(t, "/dev/full", O_RDWR, UserMode())
+  _, err = p.Write(full, buffer)
+  AssertTrue(t, err == ENOSPC, "Expected ENOSPC from full.")
+  p.safeRead(t, full, buffer)
+  p.safeClose(t, full)
+
+  // a seeded urandom reads the same bytes every time
+  read := func() []byte {
+    out := make([]byte, 64)
+    fd := p.safeOpen(t, "/dev/urandom", O_RDONLY, UserMode())
+    p.safeRead(t, fd, out)
+    p.safeClose(t, fd)
+    return out
+  }
+
+  SeedURandom(42)
+  first := read()
+  SeedURandom(42)
+  AssertEqualBytes(t, read(), first)
+  AssertTrue(t, !bytes.Equal(read(), first), "urandom repeated itself.")
+}
+
+// Counts the bytes written to it and reads the count back as a byte.
+type counterDevice struct {
+  count *int
+}
+
+func (dev counterDevice) Read(p []byte) (int, error) {
+  return copy(p, []byte{byte(*dev.count)}), nil
+}
+
+func (dev counterDevice) Write(p []byte) (int, error) {
+  *dev.count += len(p)
+  return len(p), nil
+}
+
+func (dev counterDevice) Seek(offset int64, whence int) (int64, error) {
+  return 0, nil
+}
+
+func (dev counterDevice) Close() error {
+  return nil
+}
+
+func TestCustomDriver(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  count := 0
+  driver := DriverFunc(func(flags AccessFlag) (File, error) {
+    return counterDevice{&count}, nil
+  })
+
+  AssertNoErr(t, RegisterDriver("test-counter", driver))
+  defer delete(drivers, "test-counter")
+  AssertTrue(t, RegisterDriver("test-counter", driver) != nil,
+    "Registered a driver twice.")
+
+  AssertNoErr(t, p.Mknod("/dev/counter", "test-counter"))
+  AssertTrue(t, p.Mknod("/dev/counter", "test-counter") == EEXIST, "Expected EEXIST.")
+  user, err := NewProc(ProcOptions{Uid: 1000, Gid: 1000})
+  AssertNoErr(t, err)
+  p.safeMkdir(t, "/mknod")
+  AssertNoErr(t, p.Chown("/mknod", 1000, 1000))
+  AssertTrue(t, user.Mknod("/mknod/counter", "test-counter") == EPERM, "Expected EPERM.")
+  user.Exit()
+  p.safeUnlink(t, "/mknod")
+
+  fd := p.safeOpen(t, "/dev/counter", O_RDWR, UserMode())
+  p.safeWrite(t, fd, randBytes(12))
+  p.safeWrite(t, fd, randBytes(8))
+  buffer := make([]byte, 1)
+  p.safeRead(t, fd, buffer)
+  AssertTrue(t, buffer[0] == 20, "Driver didn't see the writes.")
+  p.safeClose(t, fd)
+
+  // nodes for unknown drivers exist but can't be opened
+  AssertNoErr(t, p.Mknod("/dev/nothing", "no-such-driver"))
+  _, err = p.Open("/dev/nothing", O_RDONLY, UserMode())
+  AssertTrue(t, err == ENXIO, "Expected ENXIO.")
+
+  p.safeUnlink(t, "/dev/counter")
+  p.safeUnlink(t, "/dev/nothing")
+}
@@ -7,4 +7,7 @@ type DataStore interface {
 
   // Returns the number of bytes stored
   Size() int
+
+  // Drops the bytes past size, or extends the store to size with zeroes
+  Truncate(size int)
 }
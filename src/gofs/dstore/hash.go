@@ -62,6 +62,17 @@ func (s *HashStore) Write(o int, p []byte) (n int, err error) {
   return 0, nil
 }
 
+func (s *HashStore) Truncate(size int) {
+  if size > s.Size() {
+    s.Write(s.Size(), make([]byte, size - s.Size()))
+    return
+  }
+
+  blocks := (size + s.blockSize - 1) / s.blockSize
+  s.data = s.data[:blocks]
+  if blocks > 0 { s.data[blocks - 1] = s.data[blocks - 1][:size - (blocks - 1) * s.blockSize] }
+}
+
 func (s *HashStore) expandTo(length int) {
   if cap(s.data) < length {
     panic("HashStore:expandTo: callers must ensure array has enough capacity.")
@@ -33,8 +33,21 @@ func (s *PageStore) getEntry(num int) *[]byte {
   return &s.double[slot][entryOffset]
 }
 
+// Returns page num, or nil if it's a hole, without allocating tables for it.
+func (s *PageStore) peek(num int) []byte {
+  if num < ENTRIES {
+    if s.single == nil { return nil }
+    return s.single[num]
+  }
+
+  doubleEntry := num - ENTRIES
+  if s.double == nil || s.double[doubleEntry / ENTRIES] == nil { return nil }
+  return s.double[doubleEntry / ENTRIES][doubleEntry % ENTRIES]
+}
+
 func (s *PageStore) Read(o int, p []byte) (int, error) {
   if o >= s.Size() { return 0, errors.New("EOF") }
+  if len(p) > s.Size() - o { p = p[:s.Size() - o] }
 
   offset := o % PAGE_SIZE
   start := o / PAGE_SIZE
@@ -42,9 +55,14 @@ func (s *PageStore) Read(o int, p []byte) (int, error) {
 
   read := 0
   for entry := 0; entry < entriesToRead; entry++ {
-    page := *s.getEntry(start + entry)
-    if (page == nil) { panic("Page is nil?") }
-    read += copy(p[read:], page[offset:])
+    n := min(PAGE_SIZE - offset, len(p) - read)
+    if page := s.peek(start + entry); page != nil {
+      copy(p[read:read + n], page[offset:])
+    } else {
+      clear(p[read:read + n])
+    }
+
+    read += n
     if offset != 0 { offset = 0 }
   }
 
@@ -52,6 +70,9 @@ func (s *PageStore) Read(o int, p []byte) (int, error) {
 }
 
 func (s *PageStore) Write(o int, p []byte) (int, error) {
+  // Writing past the end leaves a hole, as Truncate does.
+  if o > s.Size() && len(p) > 0 { s.Truncate(o) }
+
   offset := o % PAGE_SIZE
   start := o / PAGE_SIZE
   entriesToWrite := ceilDiv(len(p) + offset, PAGE_SIZE)
@@ -59,16 +80,21 @@ func (s *PageStore) Write(o int, p []byte) (int, error) {
   written := 0
   for entry := 0; entry < entriesToWrite; entry++ {
     page := s.getEntry(start + entry)
-    if *page == nil { *page = GlobalPageArena.AllocatePage() }
-    if *page == nil { panic("Page was not allocated!") }
+    if *page == nil {
+      // Arena pages aren't zeroed, and what isn't written of one in a hole
+      // must read as zeroes.
+      *page = GlobalPageArena.AllocatePage()
+      if *page == nil { panic("Page was not allocated!") }
+      clear(*page)
+    }
 
     written += copy((*page)[offset:], p[written:])
     if offset != 0 { offset = 0 }
   }
 
-  if (start + entriesToWrite) >= s.pagesUsed {
-    s.pagesUsed = start + entriesToWrite
-    s.lastEntryBytesUsed = (len(p) + offset) % PAGE_SIZE
+  if end := o + len(p); end > s.Size() {
+    s.pagesUsed = ceilDiv(end, PAGE_SIZE)
+    s.lastEntryBytesUsed = end - (s.pagesUsed - 1) * PAGE_SIZE
   }
 
   return written, nil
@@ -79,6 +105,41 @@ func (s *PageStore) Size() int {
   return (s.pagesUsed - 1) * PAGE_SIZE + s.lastEntryBytesUsed
 }
 
+// Growing leaves a hole: the pages past the old end aren't allocated until
+// they're written, and read as zeroes until then.
+func (s *PageStore) Truncate(size int) {
+  if size > s.Size() {
+    // The last page may still hold what an earlier Truncate cut off.
+    if end := s.Size(); end % PAGE_SIZE != 0 {
+      if page := s.peek(end / PAGE_SIZE); page != nil { clear(page[end % PAGE_SIZE:]) }
+    }
+
+    s.pagesUsed = ceilDiv(size, PAGE_SIZE)
+    s.lastEntryBytesUsed = size - (s.pagesUsed - 1) * PAGE_SIZE
+    return
+  }
+
+  for num := ceilDiv(size, PAGE_SIZE); num < s.pagesUsed; num++ {
+    page := s.getEntry(num)
+    if *page != nil { GlobalPageArena.ReturnPage(*page) }
+    *page = nil
+  }
+
+  s.pagesUsed = ceilDiv(size, PAGE_SIZE)
+  s.lastEntryBytesUsed = size - (s.pagesUsed - 1) * PAGE_SIZE
+  if s.pagesUsed == 0 { s.lastEntryBytesUsed = 0 }
+}
+
+// Returns how many pages hold data; holes take none.
+func (s *PageStore) Allocated() int {
+  allocated := 0
+  for num := 0; num < s.pagesUsed; num++ {
+    if s.peek(num) != nil { allocated++ }
+  }
+
+  return allocated
+}
+
 // Releases all pages in a singly-indirect block of pages
 func (s *PageStore) ReleaseSinglePages(index int, pages *[ENTRIES][]byte) {
   for i, value := range pages {
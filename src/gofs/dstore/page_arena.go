@@ -1,6 +1,7 @@
 package dstore
 
 // import "fmt"
+import "sync"
 
 var GlobalPageArena *PageArena
 const USE_PAGE_ARENA = true
@@ -11,7 +12,9 @@ const EXP_GROW_LIMIT = 65536 // 65,536 pages = 256MB
 // const EXP_GROW_LIMIT = 262144 // 262,144 pages = 1GB
 // const EXP_GROW_LIMIT = 1048576 // 4GB
 
+// Pipes and files take pages from the arena concurrently, so mu guards it.
 type PageArena struct {
+  mu sync.Mutex
   alloc int       // number of allocated pages
   size int        // size in num of pages
   pages [][]byte
@@ -54,6 +57,8 @@ func (a *PageArena) AllocatePage() []byte {
   // fmt.Println("Allocating page. Pages so far:", a.alloc)
   if (!USE_PAGE_ARENA) { return make([]byte, PAGE_SIZE, PAGE_SIZE) }
 
+  a.mu.Lock()
+  defer a.mu.Unlock()
   if a.alloc >= a.size { a.grow() }
   if a.alloc >= a.size { panic("Out of memory @ pageArena!") }
 
@@ -64,12 +69,22 @@ func (a *PageArena) AllocatePage() []byte {
 
 func (a *PageArena) ReturnPage(page []byte) {
   if (!USE_PAGE_ARENA) { return }
+
+  a.mu.Lock()
+  defer a.mu.Unlock()
   if a.alloc <= 0 { panic("Over-freeing pages!") }
 
   a.alloc -= 1
   a.pages[a.alloc] = page
 }
 
+// Returns the number of pages handed out and not yet returned.
+func (a *PageArena) Used() int {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  return a.alloc
+}
+
 func InitPageArena(size int) *PageArena {
   // fmt.Println("New arena with size", size)
 
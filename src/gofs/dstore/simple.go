@@ -13,6 +13,7 @@ func (s *ArrayStore) Read(o int, p []byte) (int, error) {
 }
 
 func (s *ArrayStore) Write(o int, p []byte) (int, error) {
+  if o > len(s.data) && len(p) > 0 { s.Truncate(o) }
   needed := o + len(p)
 
   if needed - cap(s.data) > 0 {
@@ -25,6 +26,16 @@ func (s *ArrayStore) Write(o int, p []byte) (int, error) {
   return copy(s.data[o:], p), nil
 }
 
+func (s *ArrayStore) Truncate(size int) {
+  if size < len(s.data) {
+    clear(s.data[size:])
+    s.data = s.data[:size]
+    return
+  }
+
+  s.Write(len(s.data), make([]byte, size - len(s.data)))
+}
+
 func (s *ArrayStore) Size() int {
   return len(s.data)
 }
@@ -0,0 +1,38 @@
+package gofs
+
+import (
+  "syscall"
+)
+
+// Calls fail with the host's errno values so that callers can check for a
+// particular failure (err == ENOENT) and pass it along unchanged.
+const (
+  EPERM     = syscall.EPERM
+  EACCES    = syscall.EACCES
+  ENOENT    = syscall.ENOENT
+  EEXIST    = syscall.EEXIST
+  ENOTDIR   = syscall.ENOTDIR
+  EISDIR    = syscall.EISDIR
+  EINVAL    = syscall.EINVAL
+  ENOTEMPTY = syscall.ENOTEMPTY
+  ELOOP     = syscall.ELOOP
+  EBADF     = syscall.EBADF
+  ESRCH     = syscall.ESRCH
+  EAGAIN    = syscall.EAGAIN
+  EPIPE     = syscall.EPIPE
+  ESPIPE    = syscall.ESPIPE
+  ENXIO     = syscall.ENXIO
+  ENOSPC    = syscall.ENOSPC
+  EDEADLK   = syscall.EDEADLK
+  ENODATA   = syscall.ENODATA
+  ENOTSUP   = syscall.ENOTSUP
+  ERANGE    = syscall.ERANGE
+  E2BIG     = syscall.E2BIG
+  EXDEV     = syscall.EXDEV
+  EROFS     = syscall.EROFS
+  EBUSY     = syscall.EBUSY
+  ENODEV    = syscall.ENODEV
+  EIO       = syscall.EIO
+  EMFILE    = syscall.EMFILE
+  ENFILE    = syscall.ENFILE
+)
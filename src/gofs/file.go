@@ -3,6 +3,7 @@ package gofs
 import (
   // "fmt"
   "errors"
+  "io"
   "gofs/dstore"
   "time"
 )
@@ -30,6 +31,9 @@ import (
 * underlying file contents, two different open calls for the same file share
 * nothing (file pointer, permissions, etc). However, by sharing the file
 * descriptor, two processes can modify the same entry in the file table.
+*
+* Sharing is done with Dup and friends: every descriptor for a DataFile counts
+* as a reference to it, and only the last Close() really closes it.
  */
 
 type FileStatus uint
@@ -51,13 +55,32 @@ type DataFile struct {
   inode  *Inode
   seek   int
   status FileStatus
+  flags  AccessFlag
+  refs   int
+
+  // Where the file was opened through, for watches on the directory.
+  dir    Directory
+  name   string
+}
+
+// Returns where the file was opened through.
+func (file *DataFile) ref() pathRef {
+  return pathRef{dir: file.dir, name: file.name, entry: file.inode}
 }
 
+// Files opened without any of O_RDONLY, O_WRONLY or O_RDWR allow everything.
 func (file *DataFile) checkAccess(acc FileAccess) error {
   switch file.status {
   case Closed:
     return errors.New("File is closed.")
   }
+
+  switch {
+  case acc == Read && (file.flags & O_WRONLY) != 0:
+    return EBADF
+  case acc == Write && (file.flags & O_RDONLY) != 0:
+    return EBADF
+  }
   return nil
 }
 
@@ -66,30 +89,81 @@ func (file *DataFile) Size() int {
 }
 
 func (file *DataFile) Read(p []byte) (int, error) {
-  if err := file.checkAccess(Read); err != nil { return 0, err }
-  if file.seek >= file.Size() { return 0, errors.New("EOF") }
-
-  read, err := file.inode.data.Read(file.seek, p)
-  file.inode.lastAccessTime = time.Now()
+  read, err := file.ReadAt(p, int64(file.seek))
   file.seek += read
   return read, err
 }
 
 func (file *DataFile) Write(p []byte) (int, error) {
   if err := file.checkAccess(Write); err != nil { return 0, err }
+  if (file.flags & O_APPEND) != 0 { file.seek = file.Size() }
 
-  wrote, err := file.inode.data.Write(file.seek, p)
-  file.inode.lastAccessTime = time.Now()
-  file.inode.lastModTime = time.Now()
+  wrote, err := file.WriteAt(p, int64(file.seek))
   file.seek += wrote
+  return wrote, err
+}
+
+// Reads from offset off without moving the seek offset, as pread(2) does; a
+// short read is not an error.
+func (file *DataFile) ReadAt(p []byte, off int64) (int, error) {
+  if err := file.checkAccess(Read); err != nil { return 0, err }
+  if off < 0 { return 0, EINVAL }
+  if off >= int64(file.Size()) { return 0, io.EOF }
+
+  read, err := file.inode.data.Read(int(off), p)
+  file.inode.lastAccessTime = time.Now()
+  return read, err
+}
+
+// Writes at offset off without moving the seek offset, even with O_APPEND.
+// Writing past the end leaves a hole of zeroes.
+func (file *DataFile) WriteAt(p []byte, off int64) (int, error) {
+  if err := file.checkAccess(Write); err != nil { return 0, err }
+  if off < 0 { return 0, EINVAL }
 
+  // What doesn't fit on the mount isn't written.
+  if grow := off + int64(len(p)) - int64(file.Size()); len(p) > 0 && grow > 0 {
+    if room := file.inode.fs.room(grow); room < grow {
+      p = p[:max(0, int64(len(p)) - (grow - room))]
+      if len(p) == 0 { return 0, ENOSPC }
+    }
+  }
+
+  wrote, err := file.inode.write(int(off), p)
+  now := time.Now()
+  file.inode.lastAccessTime = now
+  file.inode.lastModTime = now
+  file.inode.changeTime = now
+
+  if wrote > 0 { notify(file.dir, file.name, file.inode, IN_MODIFY, 0) }
   return wrote, err
 }
 
-// Open and Close should simply increment and decrement a reference count for
-// when file descriptors are shared between processes so that each can Close()
-// without affecting the other, and so that when all of them Close(), the handle
-// is disgarded.
+// Writes p to the inode's data at off, counting what it grows by as used on its
+// mount.
+func (inode *Inode) write(off int, p []byte) (int, error) {
+  size := inode.data.Size()
+  wrote, err := inode.data.Write(off, p)
+  inode.fs.used += int64(inode.data.Size() - size)
+  return wrote, err
+}
+
+// Cuts the file off at size, or extends it there with zeroes.
+func (inode *Inode) truncate(size int64) {
+  inode.fs.used += size - int64(inode.data.Size())
+  inode.data.Truncate(int(size))
+  now := time.Now()
+  inode.lastModTime = now
+  inode.changeTime = now
+}
+
+// Open and Close simply increment and decrement a reference count for when
+// file descriptors are shared so that each can Close() without affecting the
+// others, and so that when all of them Close(), the handle is disgarded.
+
+func (file *DataFile) retain() {
+  file.refs++
+}
 
 func (file *DataFile) Open() error {
   file.seek = 0
@@ -99,11 +173,17 @@ func (file *DataFile) Open() error {
 }
 
 func (file *DataFile) Close() error {
+  file.refs--
+  if file.refs > 0 { return nil }
+
+  writable := file.checkAccess(Write) == nil
   file.seek = 0
   file.inode.lastAccessTime = time.Now()
   file.status = Closed
 
   file.inode.decrementFileCount()
+  if writable { notify(file.dir, file.name, file.inode, IN_CLOSE_WRITE, 0) }
+  file.releaseFlock()
   if USE_FILE_ARENA { return ArenaReturnDataFile(file) }
   return nil
 }
@@ -125,27 +205,61 @@ func (file *DataFile) Seek(offset int64, whence int) (int64, error) {
   return int64(file.seek), nil
 }
 
-func initDataFile(inode *Inode) *DataFile {
-  inode.incrementFileCount()
+// A handle on an open directory. It isn't a file, as argued above, and it can't
+// be read, written or seeked; it only lets a directory be held by a descriptor,
+// as for Fchdir.
+type DirFile struct {
+  dir Directory
+}
+
+func (file *DirFile) Read(p []byte) (int, error) {
+  return 0, EISDIR
+}
 
+func (file *DirFile) Write(p []byte) (int, error) {
+  return 0, EISDIR
+}
+
+func (file *DirFile) Seek(offset int64, whence int) (int64, error) {
+  return 0, EISDIR
+}
+
+func (file *DirFile) retain() {
+}
+
+func (file *DirFile) Close() error {
+  return nil
+}
+
+// Opens inode as a DataFile, or fails with ENFILE if the arena is out of them.
+func initDataFile(inode *Inode, flags AccessFlag) (*DataFile, error) {
   if USE_FILE_ARENA {
     file, err := ArenaAllocateDataFile(inode)
-    if err != nil { panic("Out of arena memory!") }
-    return file
+    if err != nil { return nil, err }
+    inode.incrementFileCount()
+    file.flags = flags
+    return file, nil
   }
 
+  inode.incrementFileCount()
   return &DataFile{
     inode:  inode,
     seek:   0,
     status: Open,
-  }
+    flags:  flags,
+    refs:   1,
+  }, nil
 }
 
 func (inode *Inode) destroyIfNeeded() {
   if inode.linkCount == 0 && inode.fileCount == 0 {
+    inode.fs.used -= int64(inode.data.Size())
     switch data := inode.data.(type) {
     case *dstore.PageStore:
       data.ReleasePages()
+    case *zipData:
+      if data.pages != nil { data.pages.ReleasePages() }
+      data.pages = nil
     }
     // fmt.Println("Destroy!")
   }
@@ -173,12 +287,32 @@ func (inode *Inode) incrementFileCount() {
   inode.fileCount++
 }
 
+func (inode *Inode) isDir() bool {
+  return inode.data == nil
+}
+
+// Directories keep their metadata in an Inode too, one without data.
+func initDirInode() *Inode {
+  inode := initInode()
+  inode.data = nil
+  inode.perms = 0755
+  return inode
+}
+
 func initInode() *Inode {
   store := dstore.InitPageStore()
   // store := dstore.InitArrayStore(0)
 
+  now := time.Now()
+  globalState.nextIno++
   return &Inode{
     data: store,
+    ino: globalState.nextIno,
+    perms: 0644,
+    lastModTime: now,
+    lastAccessTime: now,
+    changeTime: now,
+    createTime: now,
     linkCount: 1,
     fileCount: 0,
   }
@@ -0,0 +1,113 @@
+package gofs
+
+import (
+  "sort"
+)
+
+/**
+* The process table keeps every live ProcState by pid. Processes come from
+* InitProc or NewProc, which make one with nothing but the standard streams
+* open, or from Fork, which copies a live one. A forked child shares its
+* parent's open files, seek offsets and all, just as Dup'd descriptors do, and
+* starts in the same cwd and root, with the same umask and credentials. Exec
+* closes the descriptors marked O_CLOEXEC, and Exit closes the rest and takes
+* the process out of the table. Every process has to Exit once it's done with,
+* however it was made: until then its cwd, root and descriptors keep the mounts
+* they're on busy, and it stays in the table.
+*/
+
+func registerProc(proc *ProcState) {
+  globalState.lastPid++
+  proc.pid = globalState.lastPid
+  globalState.procs[proc.pid] = proc
+}
+
+// Returns the live process with the given pid, if there is one.
+func FindProc(pid Pid) (*ProcState, bool) {
+  proc, ok := globalState.procs[pid]
+  return proc, ok
+}
+
+func (proc *ProcState) alive() bool {
+  live, ok := globalState.procs[proc.pid]
+  return ok && live == proc
+}
+
+func (proc *ProcState) Getpid() Pid {
+  return proc.pid
+}
+
+// Returns the pid of the process proc was forked from, or 0 if none.
+func (proc *ProcState) Getppid() Pid {
+  return proc.ppid
+}
+
+// Returns a new process with a copy of parent's descriptor table, cwd and root.
+func Fork(parent *ProcState) (*ProcState, error) {
+  if !parent.alive() { return nil, ESRCH }
+
+  child := new(ProcState)
+  child.ppid = parent.pid
+  child.cwd, child.root = parent.cwd, parent.root
+  child.fileDescriptorTable = make(FileDescriptorTable)
+  for fd := range parent.fileDescriptorTable {
+    file, err := parent.shareFile(fd)
+    if err != nil {
+      // What the child already shares is let go, so nothing leaks.
+      for _, shared := range child.fileDescriptorTable {
+        shared.Close()
+      }
+      return nil, err
+    }
+    child.fileDescriptorTable[fd] = file
+  }
+
+  child.freeDescriptors = parent.freeDescriptors
+  child.lastFd = parent.lastFd
+  child.closeOnExec = parent.closeOnExec
+  child.uid, child.gid, child.umask = parent.uid, parent.gid, parent.umask
+  child.groups = parent.Getgroups()
+  registerProc(child)
+  return child, nil
+}
+
+// Returns the open descriptors of proc in order.
+func (proc *ProcState) openFds() []FileDescriptor {
+  fds := make([]FileDescriptor, 0, len(proc.fileDescriptorTable))
+  for fd := range proc.fileDescriptorTable {
+    fds = append(fds, fd)
+  }
+
+  sort.Slice(fds, func(i, j int) bool { return fds[i] < fds[j] })
+  return fds
+}
+
+// Closes the descriptors marked O_CLOEXEC, as execve(2) does.
+func (proc *ProcState) Exec() error {
+  if !proc.alive() { return ESRCH }
+
+  var err error
+  for _, fd := range proc.openFds() {
+    if !proc.closeOnExec[fd] { continue }
+    if cerr := proc.Close(fd); err == nil { err = cerr }
+  }
+
+  return err
+}
+
+// Closes every descriptor proc still has open and removes it from the process
+// table. Returns the descriptors that were left open, besides the standard
+// streams, so callers can report leaks.
+func (proc *ProcState) Exit() ([]FileDescriptor, error) {
+  if !proc.alive() { return nil, ESRCH }
+
+  var err error
+  leaked := make([]FileDescriptor, 0)
+  for _, fd := range proc.openFds() {
+    if fd > 2 { leaked = append(leaked, fd) }
+    if cerr := proc.Close(fd); err == nil { err = cerr }
+  }
+
+  delete(globalState.procs, proc.pid)
+  return leaked, err
+}
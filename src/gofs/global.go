@@ -4,6 +4,8 @@ import (
   "errors"
   "gofs/dstore"
   "os"
+  "reflect"
+  "sort"
 )
 
 const USE_FILE_ARENA = true
@@ -18,7 +20,17 @@ type FileArena struct {
   size  int
 }
 
-func initDirectory(parent Directory) Directory {
+// Besides its entries, '.' and '..', every Directory keeps a header under
+// "/", the one name no entry can have, so that it knows its own name.
+const dirHeaderKey = "/"
+
+type dirHeader struct {
+  name string
+  inode *Inode
+  watches []*Watch
+}
+
+func initDirectory(parent Directory, name string) Directory {
   dir := make(Directory)
   dir["."] = dir
   if parent == nil {
@@ -26,34 +38,138 @@ func initDirectory(parent Directory) Directory {
   } else {
     dir[".."] = parent
   }
+  dir[dirHeaderKey] = &dirHeader{name: name, inode: initDirInode()}
+  if parent != nil { dir.inode().fs = parent.inode().fs }
   return dir
 }
 
+func (dir Directory) header() *dirHeader {
+  return dir[dirHeaderKey].(*dirHeader)
+}
+
+func (dir Directory) inode() *Inode {
+  return dir.header().inode
+}
+
 func (dir Directory) parent() Directory {
   return dir[".."].(Directory)
 }
 
+// Directories are maps, which Go won't compare, so identity is by map pointer.
+func sameDirectory(a Directory, b Directory) bool {
+  return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// Returns true if dir is other or one of its ancestors.
+func (dir Directory) isAncestorOf(other Directory) bool {
+  for {
+    if sameDirectory(dir, other) { return true }
+
+    parent := other.parent()
+    if sameDirectory(parent, other) { return false }
+    other = parent
+  }
+}
+
+// Returns true if both entries are the same directory or inode.
+func sameEntry(a interface{}, b interface{}) bool {
+  switch a := a.(type) {
+  case Directory:
+    b, ok := b.(Directory)
+    return ok && sameDirectory(a, b)
+  case *Inode:
+    b, ok := b.(*Inode)
+    return ok && a == b
+  case *Symlink:
+    b, ok := b.(*Symlink)
+    return ok && a == b
+  case *Fifo:
+    b, ok := b.(*Fifo)
+    return ok && a == b
+  case *Device:
+    b, ok := b.(*Device)
+    return ok && a == b
+  case *HostDir:
+    b, ok := b.(*HostDir)
+    return ok && a == b
+  }
+
+  return false
+}
+
+// Returns false for names that can't be given to or taken from an entry.
+func isEntryName(name string) bool {
+  return name != "" && name != "." && name != ".."
+}
+
+// Returns the names of the entries in dir, sorted, without '.' and '..'.
+func (dir Directory) names() []string {
+  names := make([]string, 0, len(dir))
+  for name := range dir {
+    if name == "." || name == ".." || name == dirHeaderKey { continue }
+    names = append(names, name)
+  }
+
+  sort.Strings(names)
+  return names
+}
+
+// Returns the absolute path of dir by following the names and parents of it
+// and its ancestors. Fails if dir is no longer reachable from the root, ie: it
+// or one of its ancestors was unlinked.
+func (dir Directory) absPath() (string, bool) {
+  return dir.pathFrom(globalState.root)
+}
+
+// Returns the path of dir from root, as absPath would for a process whose root
+// it is. Fails if dir isn't under root as well.
+func (dir Directory) pathFrom(root Directory) (string, bool) {
+  path := ""
+  for !sameDirectory(dir, root) {
+    parent, name := dir.parent(), dir.header().name
+    if child, ok := parent[name].(Directory); !ok || !sameDirectory(child, dir) {
+      return "", false
+    }
+
+    path = "/" + name + path
+    dir = parent
+  }
+
+  if path == "" { return "/", true }
+  return path, true
+}
+
 func ClearGlobalState() {
+  if globalState != nil && globalState.journal != nil {
+    globalState.journal.close()
+  }
+
   globalState = nil
   fileArena = nil
   dstore.GlobalPageArena = nil
 }
 
+// Takes a DataFile from the arena for inode, failing with ENFILE once every
+// one of them is open.
 func ArenaAllocateDataFile(inode *Inode) (*DataFile, error) {
-  if fileArena.used >= fileArena.size {
-    panic("Out of arena memory!")
-    return nil, errors.New("Out Of Memory!")
-  }
+  if err := checkFileArena(); err != nil { return nil, err }
 
   file := fileArena.files[fileArena.used]
   file.seek = 0
   file.inode = inode
   file.status = Open
+  file.refs = 1
 
   fileArena.used += 1
   return file, nil
 }
 
+// Fails with ENFILE if there's no DataFile left to open a file with.
+func checkFileArena() error {
+  if USE_FILE_ARENA && fileArena.used >= fileArena.size { return ENFILE }
+  return nil
+}
+
 func ArenaReturnDataFile(file *DataFile) error {
   if fileArena.used <= 0 {
     return errors.New("Over-Freeing")
@@ -70,7 +186,11 @@ func ArenaReturnDataFile(file *DataFile) error {
 func InitGlobalState() {
   if globalState == nil {
     globalState = new(GlobalState)
-    globalState.root = initDirectory(nil)
+    root := &fsMount{fstype: "memfs", source: "none"}
+    globalState.root = root.newRoot(0755)
+    globalState.mounts = []*fsMount{root}
+    initDevDirectory(globalState.root)
+    globalState.procs = make(map[Pid]*ProcState)
     globalState.stdIn = os.Stdin
     globalState.stdOut = os.Stdout
     globalState.stdErr = os.Stderr
@@ -3,6 +3,7 @@ package gofs
 import (
   "bytes"
   "fmt"
+  "io"
   "math/rand"
   "path/filepath"
   "runtime"
@@ -66,8 +67,13 @@ func AssertTrue(t *testing.T, val bool, msg string) {
 
 func AssertEqualBytes(t *testing.T, b1 []byte, b2 []byte) {
   equal := bytes.Equal(b1, b2)
+  head := func(b []byte) []byte {
+    if len(b) > 10 { return b[:10] }
+    return b
+  }
+
   str := fmt.Sprintf("b1[%d] != b2[%d]\nb1[:10]: %v...\nb2[:10]: %v...",
-    len(b1), len(b2), b1[:10], b2[:10])
+    len(b1), len(b2), head(b1), head(b2))
   AssertTrue(t, equal, str)
 }
 
@@ -129,6 +135,7 @@ func (p *ProcState) safeRename(t *testing.T, s string, s2 string) {
 
 func TestEmptyRead(t *testing.T) {
   p := InitProc()
+  defer p.Exit()
   filename := "file"
   buffer := make([]byte, 24)
 
@@ -147,6 +154,7 @@ func TestEmptyRead(t *testing.T) {
 
 func TestWriteRead(t *testing.T) {
   p := InitProc()
+  defer p.Exit()
   filename := "file"
   content := []byte("Hello, world!")
   buffer := make([]byte, 24)
@@ -166,6 +174,7 @@ func TestWriteRead(t *testing.T) {
 
 func TestReadWriteSeek(t *testing.T) {
   p := InitProc()
+  defer p.Exit()
   filename := "file"
   size := 9240
   content := randBytes(size)
@@ -193,6 +202,7 @@ func TestReadWriteSeek(t *testing.T) {
 
 func TestReadWriteLargeSeek(t *testing.T) {
   p := InitProc()
+  defer p.Exit()
   filename := "file"
   size := 4096 * 256 * 4 // 4MB
   content := randBytes(size)
@@ -219,8 +229,57 @@ func TestReadWriteLargeSeek(t *testing.T) {
   p.safeUnlink(t, filename)
 }
 
+func TestPositionalIOAndTruncate(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  content := randBytes(4096 + 8)
+  fd := p.safeOpen(t, "file", O_RDWR|O_CREAT, UserMode())
+  p.safeWrite(t, fd, content)
+
+  // pread and pwrite leave the offset alone
+  buf := make([]byte, 8)
+  n, err := p.Pread(fd, buf, 4096)
+  AssertTrue(t, err == nil && n == 8, "Short pread.")
+  AssertEqualBytes(t, content[4096:], buf)
+  n, err = p.Pwrite(fd, []byte("abcd"), 10)
+  AssertTrue(t, err == nil && n == 4, "Short pwrite.")
+  AssertTrue(t, p.safeSeek(t, fd, 0, SEEK_CUR) == int64(len(content)), "Offset moved.")
+
+  // writing past the end leaves a hole of zeroes, even over recycled pages
+  AssertNoErr(t, p.Ftruncate(fd, 100))
+  _, err = p.Pwrite(fd, []byte("end"), 3 * 4096)
+  AssertNoErr(t, err)
+  hole := make([]byte, 3 * 4096 - 100)
+  n, err = p.Pread(fd, hole, 100)
+  AssertTrue(t, err == nil && n == len(hole), "Short read of the hole.")
+  AssertEqualBytes(t, make([]byte, len(hole)), hole)
+
+  // truncating extends with zeroes too
+  AssertNoErr(t, p.Truncate("file", 10))
+  AssertNoErr(t, p.Truncate("file", 20))
+  buf = make([]byte, 20)
+  n, _ = p.Pread(fd, buf, 0)
+  AssertTrue(t, n == 20, "Truncate didn't extend.")
+  AssertEqualBytes(t, append(append([]byte(nil), content[:10]...), make([]byte, 10)...), buf)
+  _, err = p.Pread(fd, buf, 20)
+  AssertTrue(t, err == io.EOF, "Read past the end.")
+
+  // O_TRUNC empties a file opened to write
+  p.safeClose(t, fd)
+  fd = p.safeOpen(t, "file", O_RDONLY|O_TRUNC, UserMode())
+  AssertTrue(t, p.Ftruncate(fd, 0) == EINVAL, "Truncated a read-only descriptor.")
+  p.safeClose(t, fd)
+  fd = p.safeOpen(t, "file", O_WRONLY|O_TRUNC, UserMode())
+  stat, err := p.Fstat(fd)
+  AssertTrue(t, err == nil && stat.Size == 0, "O_TRUNC didn't truncate.")
+
+  p.safeClose(t, fd)
+  p.safeUnlink(t, "file")
+}
+
 func TestMkDirAndLink(t *testing.T) {
   p := InitProc()
+  defer p.Exit()
   filename := "file"
   size := 24
 
@@ -269,6 +328,7 @@ func TestMkDirAndLink(t *testing.T) {
 
 func TestRename(t *testing.T) {
   p := InitProc()
+  defer p.Exit()
   filename := "file"
   filename2 := "another"
   size := 24
@@ -290,3 +350,429 @@ func TestRename(t *testing.T) {
   p.safeClose(t, fd)
   p.safeUnlink(t, filename2)
 }
+
+func (p *ProcState) writeFile(t *testing.T, s string, content []byte) {
+  fd := p.safeOpen(t, s, O_RDWR|O_CREAT, UserMode())
+  p.safeWrite(t, fd, content)
+  p.safeClose(t, fd)
+}
+
+func (p *ProcState) readFile(t *testing.T, s string, size int) []byte {
+  buffer := make([]byte, size)
+  fd := p.safeOpen(t, s, O_RDONLY, UserMode())
+  n := p.safeRead(t, fd, buffer)
+  p.safeClose(t, fd)
+  return buffer[:n]
+}
+
+func TestRenameReplace(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  content := randBytes(24)
+
+  p.writeFile(t, "/src", content)
+  p.writeFile(t, "/dst", randBytes(48))
+  dst := globalState.root["dst"].(*Inode)
+
+  // dst is replaced, and its inode loses its only link
+  p.safeRename(t, "/src", "/dst")
+  AssertEqualBytes(t, p.readFile(t, "/dst", 48), content)
+  AssertTrue(t, dst.linkCount == 0, "Replaced inode still linked.")
+  _, err := p.Open("/src", O_RDONLY, UserMode())
+  AssertTrue(t, err != nil, "Expected src to be gone.")
+
+  // renaming onto itself or another link to the same inode does nothing
+  p.safeLink(t, "/dst", "/other")
+  p.safeRename(t, "/dst", "/dst")
+  p.safeRename(t, "/dst", "/other")
+  AssertEqualBytes(t, p.readFile(t, "/dst", 24), content)
+  AssertEqualBytes(t, p.readFile(t, "/other", 24), content)
+
+  p.safeUnlink(t, "/dst")
+  p.safeUnlink(t, "/other")
+}
+
+func TestRenameDirectory(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  content := randBytes(24)
+
+  p.safeMkdir(t, "/rdA")
+  p.safeMkdir(t, "/rdA/sub")
+  p.safeMkdir(t, "/rdB")
+  p.writeFile(t, "/rdA/sub/file", content)
+
+  p.safeRename(t, "/rdA/sub", "/rdB/moved")
+  AssertEqualBytes(t, p.readFile(t, "/rdB/moved/file", 24), content)
+  AssertEqualBytes(t, p.readFile(t, "/rdB/moved/../moved/file", 24), content)
+
+  // '..' follows the directory to its new parent
+  p.safeChdir(t, "/rdB/moved/")
+  p.safeChdir(t, "../")
+  AssertEqualBytes(t, p.readFile(t, "moved/file", 24), content)
+  p.safeChdir(t, "/")
+
+  AssertTrue(t, p.Rename("/rdB", "/rdB/moved/inside") == EINVAL,
+    "Expected EINVAL moving a directory under itself.")
+  AssertTrue(t, p.Rename("/rdA", "/rdB") == ENOTEMPTY, "Expected ENOTEMPTY.")
+  AssertTrue(t, p.Rename("/rdB/moved/file", "/rdA") == EISDIR, "Expected EISDIR.")
+  AssertTrue(t, p.Rename("/rdA", "/rdB/moved/file") == ENOTDIR, "Expected ENOTDIR.")
+
+  // an empty directory can be replaced by another
+  p.safeRename(t, "/rdB/moved", "/rdA")
+  AssertEqualBytes(t, p.readFile(t, "/rdA/file", 24), content)
+
+  p.safeUnlink(t, "/rdA/file")
+  p.safeUnlink(t, "/rdA")
+  p.safeUnlink(t, "/rdB")
+}
+
+func TestRenameFlags(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  content1 := randBytes(24)
+  content2 := randBytes(24)
+
+  p.writeFile(t, "/one", content1)
+  p.writeFile(t, "/two", content2)
+  p.safeMkdir(t, "/three")
+
+  err := p.Rename2("/one", "/two", RENAME_NOREPLACE)
+  AssertTrue(t, err == EEXIST, "Expected EEXIST with RENAME_NOREPLACE.")
+  err = p.Rename2("/one", "/missing", RENAME_EXCHANGE)
+  AssertTrue(t, err == ENOENT, "Expected ENOENT exchanging with nothing.")
+  err = p.Rename2("/one", "/two", RENAME_EXCHANGE|RENAME_NOREPLACE)
+  AssertTrue(t, err == EINVAL, "Expected EINVAL with both flags.")
+
+  AssertNoErr(t, p.Rename2("/one", "/two", RENAME_EXCHANGE))
+  AssertEqualBytes(t, p.readFile(t, "/one", 24), content2)
+  AssertEqualBytes(t, p.readFile(t, "/two", 24), content1)
+
+  // exchanging a file with a directory swaps them, '..' included
+  AssertNoErr(t, p.Rename2("/one", "/three", RENAME_EXCHANGE))
+  AssertEqualBytes(t, p.readFile(t, "/three", 24), content2)
+  p.safeChdir(t, "/one/")
+  AssertEqualBytes(t, p.readFile(t, "../two", 24), content1)
+  p.safeChdir(t, "/")
+
+  AssertNoErr(t, p.Rename2("/two", "/four", RENAME_NOREPLACE))
+  p.safeUnlink(t, "/three")
+  p.safeUnlink(t, "/four")
+  p.safeUnlink(t, "/one")
+}
+
+func (p *ProcState) assertCwd(t *testing.T, expected string) {
+  cwd, err := p.Getcwd()
+  AssertNoErr(t, err)
+  AssertTrue(t, cwd == expected, "Expected cwd " + expected + ", got " + cwd)
+}
+
+func TestGetcwdAndFchdir(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  p.assertCwd(t, "/")
+
+  p.safeMkdir(t, "/cwdA")
+  p.safeMkdir(t, "/cwdA/b")
+  p.safeMkdir(t, "/cwdA/b/c")
+
+  // Chdir enters the final component, slash or not
+  p.safeChdir(t, "/cwdA/b")
+  p.assertCwd(t, "/cwdA/b")
+  p.safeChdir(t, "c")
+  p.assertCwd(t, "/cwdA/b/c")
+  p.safeChdir(t, "../..")
+  p.assertCwd(t, "/cwdA")
+
+  // the path follows renames of the cwd and its ancestors
+  fd := p.safeOpen(t, "b/c", O_RDONLY, UserMode())
+  p.safeRename(t, "/cwdA", "/cwdZ")
+  p.assertCwd(t, "/cwdZ")
+  p.safeRename(t, "/cwdZ/b", "/cwdZ/y")
+
+  AssertNoErr(t, p.Fchdir(fd))
+  p.assertCwd(t, "/cwdZ/y/c")
+  p.safeClose(t, fd)
+
+  _, err := p.Open("/cwdZ/y/c", O_RDWR|O_CREAT, UserMode())
+  AssertTrue(t, err == EISDIR, "Expected EISDIR opening a directory to write.")
+  fd = p.safeOpen(t, "/cwdZ/file", O_RDWR|O_CREAT, UserMode())
+  AssertTrue(t, p.Fchdir(fd) == ENOTDIR, "Expected ENOTDIR from Fchdir on a file.")
+  AssertTrue(t, p.Fchdir(fd + 100) == EBADF, "Expected EBADF from Fchdir.")
+  p.safeClose(t, fd)
+  p.safeUnlink(t, "/cwdZ/file")
+
+  // once unlinked, the cwd has no path
+  p.safeUnlink(t, "/cwdZ/y/c")
+  _, err = p.Getcwd()
+  AssertTrue(t, err == ENOENT, "Expected ENOENT for an unlinked cwd.")
+
+  p.safeChdir(t, "/")
+  p.safeUnlink(t, "/cwdZ/y")
+  p.safeUnlink(t, "/cwdZ")
+}
+
+func TestChroot(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  p.safeMkdir(t, "/jail")
+  p.safeMkdir(t, "/jail/etc")
+  p.writeFile(t, "/jail/etc/conf", []byte("inside"))
+  p.writeFile(t, "/secret", []byte("outside"))
+  AssertNoErr(t, p.Symlink("/etc/conf", "/jail/abs"))
+  AssertNoErr(t, p.Symlink("../../../secret", "/jail/etc/up"))
+
+  worker, err := Fork(p)
+  AssertNoErr(t, err)
+  AssertTrue(t, worker.Chroot("/jail/etc/conf") == ENOTDIR, "Chrooted to a file.")
+  AssertTrue(t, worker.Chroot("/nowhere") == ENOENT, "Chrooted to nothing.")
+  AssertNoErr(t, worker.Chroot("/jail"))
+
+  // the cwd stays outside until changed
+  _, err = worker.Getcwd()
+  AssertTrue(t, err == ENOENT, "Cwd outside the root had a path.")
+  worker.safeChdir(t, "/etc")
+  worker.assertCwd(t, "/etc")
+
+  // '..' and symlinks stop at the root
+  worker.safeChdir(t, "../../..")
+  worker.assertCwd(t, "/")
+  AssertTrue(t, string(worker.readFile(t, "/abs", 16)) == "inside", "Symlink left the root.")
+  _, err = worker.Open("/etc/up", O_RDONLY, UserMode())
+  AssertTrue(t, err == ENOENT, "Symlink climbed out of the root.")
+  _, err = worker.Stat("/secret")
+  AssertTrue(t, err == ENOENT, "Saw outside the root.")
+  path, err := worker.Realpath("etc/../etc/conf")
+  AssertTrue(t, err == nil && path == "/etc/conf", "Bad Realpath in a chroot: " + path)
+
+  // new entries land under the root, and children stay in it
+  worker.writeFile(t, "/made", []byte("made"))
+  AssertTrue(t, string(p.readFile(t, "/jail/made", 16)) == "made", "Created outside the root.")
+  child, err := Fork(worker)
+  AssertNoErr(t, err)
+  AssertTrue(t, string(child.readFile(t, "/etc/conf", 16)) == "inside", "Child left the root.")
+  child.Exit()
+
+  mounts := worker.Mounts()
+  AssertTrue(t, len(mounts) == 0, "Listed mounts outside the root.")
+  worker.Setuid(1000)
+  AssertTrue(t, worker.Chroot("/etc") == EPERM, "Non-root chrooted.")
+  worker.Exit()
+
+  for _, path := range []string{"/jail/made", "/jail/abs", "/jail/etc/up", "/jail/etc/conf",
+    "/jail/etc", "/jail", "/secret"} {
+    p.safeUnlink(t, path)
+  }
+}
+
+func TestDupSharesOffset(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  filename := "dupfile"
+  used := fileArena.used
+
+  fd := p.safeOpen(t, filename, O_RDWR|O_CREAT, UserMode())
+  dup, err := p.Dup(fd)
+  AssertNoErr(t, err)
+  AssertTrue(t, dup != fd, "Dup returned the same fd.")
+
+  p.safeWrite(t, fd, []byte("Hello"))
+  p.safeWrite(t, dup, []byte(", world!"))
+  p.safeSeek(t, dup, 0, SEEK_SET)
+  buffer := make([]byte, 24)
+  n := p.safeRead(t, fd, buffer)
+  AssertEqualBytes(t, buffer[:n], []byte("Hello, world!"))
+
+  // closing one leaves the other working
+  p.safeClose(t, fd)
+  AssertTrue(t, fileArena.used == used + 1, "DataFile released too early.")
+  p.safeSeek(t, dup, 0, SEEK_SET)
+  p.safeRead(t, dup, buffer)
+
+  // Dup2 onto an open fd closes it first, onto itself does nothing
+  other := p.safeOpen(t, filename, O_RDONLY, UserMode())
+  AssertTrue(t, fileArena.used == used + 2, "Expected two open DataFiles.")
+  res, err := p.Dup2(dup, other)
+  AssertNoErr(t, err)
+  AssertTrue(t, res == other, "Dup2 returned the wrong fd.")
+  AssertTrue(t, fileArena.used == used + 1, "Dup2 didn't close the old file.")
+  res, err = p.Dup2(other, other)
+  AssertTrue(t, err == nil && res == other, "Dup2 onto itself failed.")
+
+  // the write flags come along: other is now writable
+  p.safeWrite(t, other, []byte("!"))
+
+  p.safeClose(t, dup)
+  p.safeClose(t, other)
+  AssertTrue(t, fileArena.used == used, "DataFile not released on last close.")
+  p.safeUnlink(t, filename)
+}
+
+func TestDup2AndDup3(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  fd := p.safeOpen(t, "dupfile", O_RDONLY|O_CREAT, UserMode())
+
+  // a free fd can be the target
+  res, err := p.Dup2(fd, 700)
+  AssertTrue(t, err == nil && res == 700, "Dup2 to an unused fd failed.")
+  AssertTrue(t, !p.closeOnExec[700], "Dup2 set O_CLOEXEC.")
+  _, err = p.Write(700, []byte("x"))
+  AssertTrue(t, err == EBADF, "Expected EBADF writing a read-only file.")
+
+  res, err = p.Dup3(fd, 701, O_CLOEXEC)
+  AssertTrue(t, err == nil && res == 701, "Dup3 failed.")
+  AssertTrue(t, p.closeOnExec[701], "Dup3 didn't set O_CLOEXEC.")
+
+  _, err = p.Dup3(fd, fd, O_CLOEXEC)
+  AssertTrue(t, err == EINVAL, "Expected EINVAL from Dup3 onto itself.")
+  _, err = p.Dup3(fd, 702, O_APPEND)
+  AssertTrue(t, err == EINVAL, "Expected EINVAL from Dup3 with bad flags.")
+  _, err = p.Dup2(fd, MAX_DESCRIPTORS)
+  AssertTrue(t, err == EBADF, "Expected EBADF from Dup2 out of range.")
+  _, err = p.Dup(1000)
+  AssertTrue(t, err == EBADF, "Expected EBADF from Dup of a closed fd.")
+
+  // the standard streams are shared without being closed
+  in, err := p.Dup(0)
+  AssertNoErr(t, err)
+  p.safeClose(t, in)
+
+  p.safeClose(t, 700)
+  p.safeClose(t, 701)
+  p.safeClose(t, fd)
+  p.safeUnlink(t, "dupfile")
+}
+
+func TestDescriptorLimit(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  used := fileArena.used
+  fd := p.safeOpen(t, "limited", O_RDWR|O_CREAT, UserMode())
+
+  var dups []FileDescriptor
+  for {
+    dup, err := p.Dup(fd)
+    if err == EMFILE { break }
+    AssertNoErr(t, err)
+    dups = append(dups, dup)
+  }
+
+  // running out fails the call, rather than taking anything
+  _, _, err := p.Pipe()
+  AssertTrue(t, err == EMFILE, "Expected EMFILE from Pipe.")
+  _, err = p.Open("unmade", O_RDWR|O_CREAT, UserMode())
+  AssertTrue(t, err == EMFILE, "Expected EMFILE from Open.")
+  _, err = p.Stat("unmade")
+  AssertTrue(t, err == ENOENT, "Open made a file without a descriptor.")
+
+  p.safeClose(t, dups[0])
+  r, w, err := p.Pipe()
+  AssertTrue(t, err == EMFILE, "Pipe took one descriptor of two.")
+  dups[0], err = p.Dup(fd)
+  AssertNoErr(t, err)
+
+  for _, dup := range dups {
+    p.safeClose(t, dup)
+  }
+  p.safeClose(t, fd)
+  AssertTrue(t, fileArena.used == used, "A failed Dup kept the file open.")
+  r, w, err = p.Pipe()
+  AssertNoErr(t, err)
+  p.safeClose(t, r)
+  p.safeClose(t, w)
+  p.safeUnlink(t, "limited")
+}
+
+func TestFileArenaLimit(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  lastFd := p.lastFd
+  p.writeFile(t, "/full", []byte("full"))
+  _, inode, _ := p.inodeAt("/full", true)
+
+  var fds []FileDescriptor
+  for {
+    fd, err := p.Open("/full", O_RDWR, UserMode())
+    if err == ENFILE { break }
+    AssertNoErr(t, err)
+    fds = append(fds, fd)
+  }
+
+  // running out of DataFiles fails the open, and takes nothing with it
+  AssertTrue(t, inode.fileCount == len(fds), "A failed open counted on the inode.")
+  AssertTrue(t, int(p.lastFd) == int(lastFd) + len(fds), "A failed open kept its descriptor.")
+  _, err := p.Open("/full", O_RDWR|O_TRUNC, UserMode())
+  AssertTrue(t, err == ENFILE, "Expected ENFILE truncating.")
+  AssertTrue(t, inode.data.Size() == 4, "A failed open truncated the file.")
+  _, err = p.Open("/unmade", O_RDWR|O_CREAT, UserMode())
+  AssertTrue(t, err == ENFILE, "Expected ENFILE creating.")
+  _, err = p.Stat("/unmade")
+  AssertTrue(t, err == ENOENT, "A failed open made a file.")
+
+  // descriptors that share a DataFile don't need another
+  dup, err := p.Dup(fds[0])
+  AssertNoErr(t, err)
+  p.safeClose(t, dup)
+
+  for _, fd := range fds {
+    p.safeClose(t, fd)
+  }
+  AssertTrue(t, inode.fileCount == 0, "Files left open.")
+  p.safeUnlink(t, "/full")
+}
+
+func TestForkExecExit(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/forkdir")
+  p.safeChdir(t, "/forkdir")
+
+  fd := p.safeOpen(t, "file", O_RDWR|O_CREAT, UserMode())
+  cloexec := p.safeOpen(t, "file", O_RDONLY|O_CLOEXEC, UserMode())
+  p.safeWrite(t, fd, []byte("abc"))
+
+  child, err := Fork(p)
+  AssertNoErr(t, err)
+  AssertTrue(t, child.Getppid() == p.Getpid(), "Bad parent pid.")
+  found, ok := FindProc(child.Getpid())
+  AssertTrue(t, ok && found == child, "Child not in the process table.")
+
+  // the child shares the parent's offset and starts in its cwd
+  child.safeWrite(t, fd, []byte("def"))
+  p.safeSeek(t, fd, 0, SEEK_SET)
+  buffer := make([]byte, 6)
+  p.safeRead(t, fd, buffer)
+  AssertEqualBytes(t, buffer, []byte("abcdef"))
+  child.assertCwd(t, "/forkdir")
+  child.safeChdir(t, "/")
+  p.assertCwd(t, "/forkdir")
+
+  // exec only closes the child's O_CLOEXEC descriptors
+  AssertNoErr(t, child.Exec())
+  _, err = child.Read(cloexec, buffer)
+  AssertTrue(t, err == EBADF, "O_CLOEXEC fd survived Exec.")
+  p.safeSeek(t, cloexec, 0, SEEK_SET)
+  p.safeRead(t, cloexec, buffer)
+
+  leaked, err := child.Exit()
+  AssertNoErr(t, err)
+  AssertTrue(t, len(leaked) == 1 && leaked[0] == fd, "Bad leaked fds from Exit.")
+  _, ok = FindProc(child.Getpid())
+  AssertTrue(t, !ok, "Exited child still in the process table.")
+  _, err = child.Exit()
+  AssertTrue(t, err == ESRCH, "Expected ESRCH exiting twice.")
+  _, err = Fork(child)
+  AssertTrue(t, err == ESRCH, "Expected ESRCH forking an exited process.")
+
+  // the parent's files are still open
+  p.safeSeek(t, fd, 0, SEEK_SET)
+  p.safeRead(t, fd, buffer)
+  AssertEqualBytes(t, buffer, []byte("abcdef"))
+
+  p.safeUnlink(t, "file")
+  p.safeChdir(t, "/")
+  p.safeUnlink(t, "/forkdir")
+  leaked, err = p.Exit()
+  AssertNoErr(t, err)
+  AssertTrue(t, len(leaked) == 2, "Expected both parent fds to leak.")
+}
@@ -0,0 +1,329 @@
+package gofs
+
+import (
+  "errors"
+  "io"
+  "io/fs"
+  "os"
+  "path"
+  "sort"
+  "strings"
+  "syscall"
+)
+
+/**
+* A host mount puts a directory of the real file system into the GoFS tree: its
+* root is a HostDir, and names below it are looked up on the host, under the
+* directory it names, rather than in GoFS. Open, Mkdir, Unlink, Stat, Lstat and
+* ReadDir are forwarded to the os package; the files Open returns are
+* *os.Files, read and written and closed on the host. Other calls on paths
+* below a mount fail with EXDEV, as calls across file systems do.
+*
+* Lookups stay within the mounted directory: '..' stops at its top, as at the
+* root, and symlinks on the host that lead out of it fail with EXDEV, like
+* openat2's RESOLVE_BENEATH. Inside, the host's permissions apply, not the
+* process's credentials; a read-only mount refuses anything that would change
+* the host with EROFS.
+*
+* Mounts are journaled and checkpointed by host path, so recovery mounts the
+* same directories again; what's on the host is the host's to keep.
+*/
+
+type HostDir struct {
+  root string // the host path mounted
+  fs *fsMount
+}
+
+// A path below a host mount, relative to its root.
+type hostEntry struct {
+  mount *HostDir
+  rel string
+  slash bool
+}
+
+// Returns the host path below a mount that entry is, if it is one. A HostDir
+// is the top of its mount.
+func hostOf(entry interface{}) (*hostEntry, bool) {
+  switch entry := entry.(type) {
+  case *hostEntry:
+    return entry, true
+  case *HostDir:
+    return &hostEntry{mount: entry, rel: "."}, true
+  }
+
+  return nil, false
+}
+
+// Returns the ref for names below mount, which was found at dir[name]. Names
+// are taken one at a time, as the host would: '..' after a symlink leaves what
+// the link leads to, not the directory holding it. Like '..' at the root, '..'
+// at the top of the mount stays there, unless a symlink's target climbs it.
+func hostRef(dir Directory, name string, mount *HostDir, rel string,
+  names []string, slash bool, links *int) (pathRef, error) {
+  root, err := os.OpenRoot(mount.root)
+  if err != nil { return pathRef{}, hostError(err) }
+  defer root.Close()
+
+  var parts []string
+  if rel != "." { parts = strings.Split(rel, "/") }
+  fromLink := 0 // how many of the names ahead came from symlink targets
+  for len(names) > 0 {
+    next, inLink := names[0], fromLink > 0
+    names = names[1:]
+    if inLink { fromLink-- }
+
+    switch next {
+    case "", ".":
+      continue
+    case "..":
+    default:
+      parts = append(parts, next)
+      continue
+    }
+
+    if len(parts) == 0 {
+      if inLink { return pathRef{}, EXDEV }
+      continue
+    }
+
+    // os.Root follows symlinks on the way to the last part itself.
+    last := strings.Join(parts, "/")
+    info, err := root.Lstat(last)
+    if err != nil { return pathRef{}, hostError(err) }
+    parts = parts[:len(parts) - 1]
+    if info.IsDir() { continue }
+    if (info.Mode() & fs.ModeSymlink) == 0 { return pathRef{}, ENOTDIR }
+
+    *links++
+    if *links > MAXSYMLINKS { return pathRef{}, ELOOP }
+    target, err := root.Readlink(last)
+    if err != nil { return pathRef{}, hostError(err) }
+    if path.IsAbs(target) { return pathRef{}, EXDEV }
+
+    // The '..' is looked up again, from where the link leads.
+    spliced := strings.Split(target, "/")
+    fromLink += len(spliced)
+    if inLink { fromLink++ }
+    names = append(append(spliced, ".."), names...)
+  }
+
+  rel = strings.Join(parts, "/")
+  if rel == "" { rel = "." }
+  return pathRef{dir, name, &hostEntry{mount: mount, rel: rel, slash: slash}, slash}, nil
+}
+
+// Returns the GoFS errno for an error from the host. Errors other than errnos
+// come from os.Root refusing a path that leaves the mount.
+func hostError(err error) error {
+  if err == nil { return nil }
+
+  var errno syscall.Errno
+  if errors.As(err, &errno) { return errno }
+  return EXDEV
+}
+
+// A file open on the host through a mount, its errors made errnos. Like
+// DataFiles, its descriptors are counted.
+type hostFile struct {
+  file *os.File
+  mount *HostDir
+  refs int
+}
+
+// Returns the GoFS errno for an error from a host file: an errno, io.EOF, or
+// EINVAL for what the os package refuses itself, like WriteAt with O_APPEND.
+func fileError(err error) error {
+  var errno syscall.Errno
+  switch {
+  case err == nil || err == io.EOF:
+    return err
+  case errors.As(err, &errno):
+    return errno
+  case errors.Is(err, fs.ErrClosed):
+    return EBADF
+  }
+
+  return EINVAL
+}
+
+func (f *hostFile) Read(p []byte) (int, error) {
+  n, err := f.file.Read(p)
+  return n, fileError(err)
+}
+
+func (f *hostFile) Write(p []byte) (int, error) {
+  n, err := f.file.Write(p)
+  return n, fileError(err)
+}
+
+func (f *hostFile) Seek(offset int64, whence int) (int64, error) {
+  offset, err := f.file.Seek(offset, whence)
+  return offset, fileError(err)
+}
+
+// Reads as pread(2) does, a short read not being an error.
+func (f *hostFile) ReadAt(p []byte, off int64) (int, error) {
+  n, err := f.file.ReadAt(p, off)
+  if err == io.EOF && n > 0 { err = nil }
+  return n, fileError(err)
+}
+
+func (f *hostFile) WriteAt(p []byte, off int64) (int, error) {
+  n, err := f.file.WriteAt(p, off)
+  return n, fileError(err)
+}
+
+func (f *hostFile) retain() {
+  f.refs++
+}
+
+func (f *hostFile) Close() error {
+  f.refs--
+  if f.refs > 0 { return nil }
+  return fileError(f.file.Close())
+}
+
+func (host *hostEntry) name() string {
+  if host.slash { return host.rel + "/" }
+  return host.rel
+}
+
+// Calls f with the mounted directory opened as an os.Root.
+func (host *hostEntry) withRoot(f func(root *os.Root) error) error {
+  root, err := os.OpenRoot(host.mount.root)
+  if err != nil { return hostError(err) }
+  defer root.Close()
+  return hostError(f(root))
+}
+
+func (proc *ProcState) openHost(host *hostEntry, flags AccessFlag,
+  mode [3]FileMode) (interface{File}, error) {
+  osFlags := os.O_RDWR
+  switch openWants(flags) {
+  case M_WRITE:
+    osFlags = os.O_WRONLY
+  case M_READ:
+    osFlags = os.O_RDONLY
+  }
+
+  if (flags & O_APPEND) != 0 { osFlags |= os.O_APPEND }
+  if (flags & O_CREAT) != 0 { osFlags |= os.O_CREATE }
+  if (flags & O_EXCL) != 0 { osFlags |= os.O_EXCL }
+  if (flags & O_TRUNC) != 0 { osFlags |= os.O_TRUNC }
+
+  var file *os.File
+  err := host.withRoot(func(root *os.Root) error {
+    if host.mount.fs.readOnly() {
+      _, err := root.Stat(host.name())
+      create := (flags & O_CREAT) != 0 && errors.Is(err, fs.ErrNotExist)
+      if osFlags & (os.O_WRONLY | os.O_RDWR | os.O_TRUNC) != 0 || create { return EROFS }
+    }
+
+    var err error
+    perm := fs.FileMode(modeBits(mode) &^ proc.umask)
+    file, err = root.OpenFile(host.name(), osFlags, perm)
+    return err
+  })
+
+  if err != nil { return nil, err }
+  return &hostFile{file: file, mount: host.mount, refs: 1}, nil
+}
+
+func (proc *ProcState) mkdirHost(host *hostEntry) error {
+  if err := host.mount.fs.checkWrite(); err != nil { return err }
+  return host.withRoot(func(root *os.Root) error {
+    return root.Mkdir(host.rel, fs.FileMode(0777 &^ proc.umask))
+  })
+}
+
+func (host *hostEntry) remove() error {
+  if err := host.mount.fs.checkWrite(); err != nil { return err }
+  if host.rel == "." { return EBUSY }
+  return host.withRoot(func(root *os.Root) error { return root.Remove(host.rel) })
+}
+
+// Returns the Stat_t for a host file's info.
+func hostStat(info fs.FileInfo) Stat_t {
+  mode := info.Mode()
+  stat := Stat_t{Mode: uint(mode.Perm()), Nlink: 1, Size: info.Size(),
+    Atime: info.ModTime(), Mtime: info.ModTime(), Ctime: info.ModTime(),
+    Btime: info.ModTime()}
+
+  switch {
+  case mode.IsDir():
+    stat.Mode |= S_IFDIR
+  case (mode & fs.ModeSymlink) != 0:
+    stat.Mode |= S_IFLNK
+  case (mode & fs.ModeNamedPipe) != 0:
+    stat.Mode |= S_IFIFO
+  case (mode & fs.ModeDevice) != 0:
+    stat.Mode |= S_IFCHR
+  default:
+    stat.Mode |= S_IFREG
+  }
+
+  if (mode & fs.ModeSetuid) != 0 { stat.Mode |= S_ISUID }
+  if (mode & fs.ModeSetgid) != 0 { stat.Mode |= S_ISGID }
+  if (mode & fs.ModeSticky) != 0 { stat.Mode |= S_ISVTX }
+
+  if sys, ok := info.Sys().(*syscall.Stat_t); ok {
+    stat.Ino, stat.Nlink = uint64(sys.Ino), int(sys.Nlink)
+    stat.Uid, stat.Gid = uint(sys.Uid), uint(sys.Gid)
+    stat.Blocks = int64(sys.Blocks)
+  }
+
+  return stat
+}
+
+func (host *hostEntry) stat(follow bool) (Stat_t, error) {
+  var stat Stat_t
+  err := host.withRoot(func(root *os.Root) error {
+    lstat := root.Lstat
+    if follow || host.slash { lstat = root.Stat }
+
+    info, err := lstat(host.name())
+    if err == nil { stat = hostStat(info) }
+    return err
+  })
+
+  return stat, err
+}
+
+func (host *hostEntry) readDir() ([]Dirent, error) {
+  var entries []Dirent
+  err := host.withRoot(func(root *os.Root) error {
+    dir, err := root.Open(host.rel)
+    if err != nil { return err }
+    defer dir.Close()
+
+    infos, err := dir.Readdir(-1)
+    if err != nil { return err }
+    entries, _ = hostListing(infos)
+    return nil
+  })
+
+  return entries, err
+}
+
+// Lists the host directory f is open on, from its start.
+func (f *hostFile) readDir() ([]Dirent, []Stat_t, error) {
+  if _, err := f.file.Seek(0, io.SeekStart); err != nil { return nil, nil, fileError(err) }
+  infos, err := f.file.Readdir(-1)
+  if err != nil { return nil, nil, fileError(err) }
+
+  entries, stats := hostListing(infos)
+  return entries, stats, nil
+}
+
+// Returns the entries and attributes of a host directory's infos, sorted by
+// name.
+func hostListing(infos []fs.FileInfo) ([]Dirent, []Stat_t) {
+  sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+  entries, stats := make([]Dirent, len(infos)), make([]Stat_t, len(infos))
+  for i, info := range infos {
+    stats[i] = hostStat(info)
+    entries[i] = Dirent{Name: info.Name(), Ino: stats[i].Ino, Type: stats[i].Mode & S_IFMT}
+  }
+
+  return entries, stats
+}
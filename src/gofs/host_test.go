@@ -0,0 +1,126 @@
+package gofs
+
+import (
+  "io"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+func TestHostMount(t *testing.T) {
+  outside := t.TempDir()
+  AssertNoErr(t, os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644))
+  host := t.TempDir()
+  AssertNoErr(t, os.Mkdir(filepath.Join(host, "sub"), 0755))
+  AssertNoErr(t, os.WriteFile(filepath.Join(host, "sub", "hello"), []byte("hello"), 0644))
+  AssertNoErr(t, os.Symlink(filepath.Join(outside, "secret"), filepath.Join(host, "escape")))
+
+  p := InitProc()
+  p.safeMkdir(t, "/mnt")
+  p.safeMkdir(t, "/mnt/host")
+  p.safeMkdir(t, "/mnt/ro")
+  AssertTrue(t, p.MountHost("/mnt/missing", host, false) == ENOENT, "Mounted on nothing.")
+  AssertNoErr(t, p.MountHost("/mnt/host", host, false))
+
+  // reads and writes go to the host
+  fd := p.safeOpen(t, "/mnt/host/sub/hello", O_RDWR, UserMode())
+  buf := make([]byte, 5)
+  AssertTrue(t, p.safeRead(t, fd, buf) == 5 && string(buf) == "hello", "Bad host read.")
+  _, err := p.Pwrite(fd, []byte("J"), 0)
+  AssertNoErr(t, err)
+  stat, err := p.Fstat(fd)
+  AssertTrue(t, err == nil && stat.Size == 5 && (stat.Mode & S_IFMT) == S_IFREG, "Bad Fstat.")
+  dup, err := p.Dup(fd)
+  AssertNoErr(t, err)
+  p.safeClose(t, fd)
+  p.safeClose(t, dup)
+  data, err := os.ReadFile(filepath.Join(host, "sub", "hello"))
+  AssertTrue(t, err == nil && string(data) == "Jello", "Write didn't reach the host.")
+
+  fd = p.safeOpen(t, "/mnt/host/new", O_WRONLY|O_CREAT, UserMode())
+  p.safeWrite(t, fd, []byte("new"))
+  p.safeClose(t, fd)
+  AssertNoErr(t, p.Mkdir("/mnt/host/made"))
+  entries, err := p.ReadDir("/mnt/host")
+  AssertNoErr(t, err)
+  names := ""
+  for _, entry := range entries { names += entry.Name + " " }
+  AssertTrue(t, names == "escape made new sub ", "Bad host listing: " + names)
+  fd = p.safeOpen(t, "/mnt/host", O_RDONLY, UserMode())
+  entries, stats, err := p.FreadDir(fd)
+  AssertTrue(t, err == nil && len(entries) == 4 && entries[3].Name == "sub" &&
+    (stats[0].Mode & S_IFMT) == S_IFLNK && (stats[3].Mode & S_IFMT) == S_IFDIR, "Bad host listing by fd.")
+  p.safeClose(t, fd)
+  stat, err = p.Stat("/mnt/host/made/")
+  AssertTrue(t, err == nil && (stat.Mode & S_IFMT) == S_IFDIR, "Bad host Stat.")
+  stat, err = p.Lstat("/mnt/host/escape")
+  AssertTrue(t, err == nil && (stat.Mode & S_IFMT) == S_IFLNK, "Bad host Lstat.")
+
+  // lookups can't leave the mount
+  fd = p.safeOpen(t, "/mnt/host/sub/../../../new", O_RDONLY, UserMode())
+  p.safeClose(t, fd)
+  _, err = p.Open("/mnt/host/escape", O_RDONLY, UserMode())
+  AssertTrue(t, err == EXDEV, "Followed a symlink out of the mount.")
+  _, err = p.Open("/mnt/host/missing", O_RDONLY, UserMode())
+  AssertTrue(t, err == ENOENT, "Opened a missing host file.")
+
+  // '..' leaves where a symlink leads, not the link
+  AssertNoErr(t, os.Mkdir(filepath.Join(host, "sub", "deep"), 0755))
+  AssertNoErr(t, os.Symlink("sub/deep", filepath.Join(host, "jump")))
+  AssertNoErr(t, os.Symlink("..", filepath.Join(host, "up")))
+  fd = p.safeOpen(t, "/mnt/host/jump/../hello", O_RDONLY, UserMode())
+  p.safeClose(t, fd)
+  _, err = p.Stat("/mnt/host/missing/../new")
+  AssertTrue(t, err == ENOENT, "Went through a missing directory.")
+  _, err = p.Stat("/mnt/host/up/../new")
+  AssertTrue(t, err == EXDEV, "Followed a symlink's '..' out of the mount.")
+  AssertNoErr(t, os.Remove(filepath.Join(host, "up")))
+  AssertNoErr(t, os.Remove(filepath.Join(host, "jump")))
+  AssertNoErr(t, os.Remove(filepath.Join(host, "sub", "deep")))
+
+  // calls that aren't forwarded fail as across file systems
+  AssertTrue(t, p.Rename("/mnt/host/new", "/new") == EXDEV, "Renamed off the host.")
+  AssertTrue(t, p.Symlink("x", "/mnt/host/link") == EXDEV, "Symlinked on the host.")
+  AssertNoErr(t, p.Unlink("/mnt/host/new"))
+  AssertNoErr(t, p.Unlink("/mnt/host/made"))
+  _, err = os.Stat(filepath.Join(host, "new"))
+  AssertTrue(t, os.IsNotExist(err), "Unlink didn't reach the host.")
+
+  // read-only mounts refuse changes, and only root mounts
+  AssertNoErr(t, p.MountHost("/mnt/ro", host, true))
+  _, err = p.Open("/mnt/ro/sub/hello", O_RDWR, UserMode())
+  AssertTrue(t, err == EROFS, "Opened a read-only file to write.")
+  _, err = p.Open("/mnt/ro/created", O_RDONLY|O_CREAT, UserMode())
+  AssertTrue(t, err == EROFS, "Created on a read-only mount.")
+  AssertTrue(t, p.Mkdir("/mnt/ro/dir") == EROFS, "Made a directory on a read-only mount.")
+  AssertTrue(t, p.Unlink("/mnt/ro/sub/hello") == EROFS, "Unlinked on a read-only mount.")
+  AssertTrue(t, p.Unlink("/mnt/ro") == EBUSY, "Unlinked a mount point.")
+  fd = p.safeOpen(t, "/mnt/ro/sub/hello", O_RDONLY, UserMode())
+  data, err = io.ReadAll(hostReader{p, fd})
+  AssertTrue(t, err == nil && string(data) == "Jello", "Bad read-only read.")
+  p.safeClose(t, fd)
+
+  user, err := NewProc(ProcOptions{Uid: 1000, Gid: 1000})
+  AssertNoErr(t, err)
+  AssertTrue(t, user.MountHost("/mnt/mine", host, false) == EPERM, "Non-root mounted.")
+  user.Exit()
+
+  // unmounting leaves the host as it was
+  AssertNoErr(t, p.Unmount("/mnt/ro"))
+  AssertNoErr(t, p.Unmount("/mnt/host"))
+  _, err = os.Stat(filepath.Join(host, "sub", "hello"))
+  AssertNoErr(t, err)
+  entries, err = p.ReadDir("/mnt/host")
+  AssertTrue(t, err == nil && len(entries) == 0, "Unmount didn't uncover the mount point.")
+  p.Exit()
+}
+
+// Reads fd as an io.Reader.
+type hostReader struct {
+  p *ProcState
+  fd FileDescriptor
+}
+
+func (r hostReader) Read(b []byte) (int, error) {
+  return r.p.Read(r.fd, b)
+}
@@ -0,0 +1,250 @@
+package gofs
+
+import (
+  "io"
+  "io/fs"
+  "path"
+  "sync"
+  "time"
+)
+
+/**
+* IOFS presents a GoFS tree as an io/fs.FS, for html/template.ParseFS,
+* http.FS, fs.WalkDir and anything else that takes one. It works through a
+* ProcState like any other caller: names are looked up as that process, with
+* its permissions, and files are opened on its descriptors, which the fs.Files
+* hold until they're closed.
+*
+* io/fs names are unrooted and slash-separated, without '.' or '..' elements;
+* IOFS joins them onto the directory it serves, "/" or whatever Sub narrowed it
+* to. Symlinks are followed as GoFS follows them, so one may lead out of a Sub.
+* Every call through an IOFS, or the Subs and files it hands out, is made under
+* one lock, so an http.FileServer may serve it from many goroutines; other users
+* of the same ProcState must not use it meanwhile.
+*/
+
+type IOFS struct {
+  proc *ProcState
+  dir string
+  mu *sync.Mutex
+}
+
+var _ interface {
+  fs.ReadDirFS
+  fs.StatFS
+  fs.ReadFileFS
+  fs.GlobFS
+  fs.SubFS
+} = (*IOFS)(nil)
+
+// Returns an fs.FS of the whole tree, as proc sees it.
+func NewIOFS(proc *ProcState) *IOFS {
+  return &IOFS{proc: proc, dir: "/", mu: new(sync.Mutex)}
+}
+
+// Returns the GoFS path name names, or an fs.PathError for op if it's invalid.
+func (fsys *IOFS) path(op string, name string) (string, error) {
+  if !fs.ValidPath(name) { return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid} }
+  return path.Join(fsys.dir, name), nil
+}
+
+func (fsys *IOFS) Open(name string) (fs.File, error) {
+  full, err := fsys.path("open", name)
+  if err != nil { return nil, err }
+
+  fsys.mu.Lock()
+  defer fsys.mu.Unlock()
+
+  fd, err := fsys.proc.Open(full, O_RDONLY, UserMode())
+  if err != nil { return nil, &fs.PathError{Op: "open", Path: name, Err: err} }
+
+  file := &ioFile{fsys: fsys, fd: fd, name: name, path: full}
+  stat, err := fsys.proc.Fstat(fd)
+  if err != nil || (stat.Mode & S_IFMT) != S_IFDIR { return file, nil }
+
+  entries, err := fsys.proc.ReadDir(full)
+  if err != nil {
+    fsys.proc.Close(fd)
+    return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+  }
+
+  return &ioDir{ioFile: file, entries: entries}, nil
+}
+
+func (fsys *IOFS) Stat(name string) (fs.FileInfo, error) {
+  full, err := fsys.path("stat", name)
+  if err != nil { return nil, err }
+
+  fsys.mu.Lock()
+  defer fsys.mu.Unlock()
+
+  stat, err := fsys.proc.Stat(full)
+  if err != nil { return nil, &fs.PathError{Op: "stat", Path: name, Err: err} }
+  return FileInfoOf(path.Base(name), stat), nil
+}
+
+func (fsys *IOFS) ReadDir(name string) ([]fs.DirEntry, error) {
+  full, err := fsys.path("readdir", name)
+  if err != nil { return nil, err }
+
+  fsys.mu.Lock()
+  defer fsys.mu.Unlock()
+
+  entries, err := fsys.proc.ReadDir(full)
+  if err == nil { return fsys.dirEntries(full, entries) }
+  return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+}
+
+// Returns entries of the directory dir as fs.DirEntrys. fsys.mu must be held.
+func (fsys *IOFS) dirEntries(dir string, entries []Dirent) ([]fs.DirEntry, error) {
+  result := make([]fs.DirEntry, 0, len(entries))
+  for _, entry := range entries {
+    stat, err := fsys.proc.Lstat(path.Join(dir, entry.Name))
+    if err != nil { return result, &fs.PathError{Op: "readdir", Path: entry.Name, Err: err} }
+    result = append(result, fs.FileInfoToDirEntry(FileInfoOf(entry.Name, stat)))
+  }
+
+  return result, nil
+}
+
+func (fsys *IOFS) ReadFile(name string) ([]byte, error) {
+  file, err := fsys.Open(name)
+  if err != nil { return nil, err }
+  defer file.Close()
+
+  data, err := io.ReadAll(file)
+  if err != nil { return nil, &fs.PathError{Op: "read", Path: name, Err: err} }
+  return data, nil
+}
+
+func (fsys *IOFS) Glob(pattern string) ([]string, error) {
+  // Hide Glob from fs.Glob, which would otherwise call it right back.
+  return fs.Glob(struct{ fs.ReadDirFS }{fsys}, pattern)
+}
+
+// Returns an fs.FS of the directory dir names.
+func (fsys *IOFS) Sub(dir string) (fs.FS, error) {
+  full, err := fsys.path("sub", dir)
+  if err != nil { return nil, err }
+  return &IOFS{proc: fsys.proc, dir: full, mu: fsys.mu}, nil
+}
+
+// An fs.File open on a descriptor of the IOFS's process.
+type ioFile struct {
+  fsys *IOFS
+  fd FileDescriptor
+  name string
+  path string
+}
+
+func (file *ioFile) error(op string, err error) error {
+  if err == nil || err == io.EOF { return err }
+  return &fs.PathError{Op: op, Path: file.name, Err: err}
+}
+
+func (file *ioFile) Stat() (fs.FileInfo, error) {
+  file.fsys.mu.Lock()
+  defer file.fsys.mu.Unlock()
+
+  stat, err := file.fsys.proc.Fstat(file.fd)
+  if err != nil { return nil, file.error("stat", err) }
+  return FileInfoOf(path.Base(file.name), stat), nil
+}
+
+func (file *ioFile) Read(p []byte) (int, error) {
+  file.fsys.mu.Lock()
+  defer file.fsys.mu.Unlock()
+
+  n, err := file.fsys.proc.Read(file.fd, p)
+  return n, file.error("read", err)
+}
+
+func (file *ioFile) Seek(offset int64, whence int) (int64, error) {
+  if whence < io.SeekStart || whence > io.SeekEnd { return 0, file.error("seek", EINVAL) }
+
+  file.fsys.mu.Lock()
+  defer file.fsys.mu.Unlock()
+
+  offset, err := file.fsys.proc.Seek(file.fd, offset, whence)
+  return offset, file.error("seek", err)
+}
+
+func (file *ioFile) Close() error {
+  file.fsys.mu.Lock()
+  defer file.fsys.mu.Unlock()
+
+  if file.fd < 0 { return file.error("close", fs.ErrClosed) }
+  err := file.fsys.proc.Close(file.fd)
+  file.fd = -1
+  return file.error("close", err)
+}
+
+// An fs.ReadDirFile, which lists the directory as it was when opened.
+type ioDir struct {
+  *ioFile
+  entries []Dirent
+}
+
+func (dir *ioDir) ReadDir(n int) ([]fs.DirEntry, error) {
+  dir.fsys.mu.Lock()
+  defer dir.fsys.mu.Unlock()
+
+  if dir.fd < 0 { return nil, dir.error("readdir", fs.ErrClosed) }
+
+  entries := dir.entries
+  if n > 0 && len(entries) > n { entries = entries[:n] }
+  dir.entries = dir.entries[len(entries):]
+  if n > 0 && len(entries) == 0 { return nil, io.EOF }
+
+  return dir.fsys.dirEntries(dir.path, entries)
+}
+
+// Returns an fs.FileInfo for stat, of an entry called name.
+func FileInfoOf(name string, stat Stat_t) fs.FileInfo {
+  return &fileInfo{name: name, stat: stat}
+}
+
+type fileInfo struct {
+  name string
+  stat Stat_t
+}
+
+func (info *fileInfo) Name() string {
+  return info.name
+}
+
+func (info *fileInfo) Size() int64 {
+  return info.stat.Size
+}
+
+func (info *fileInfo) Mode() fs.FileMode {
+  mode := fs.FileMode(info.stat.Mode & 0777)
+  switch info.stat.Mode & S_IFMT {
+  case S_IFDIR:
+    mode |= fs.ModeDir
+  case S_IFLNK:
+    mode |= fs.ModeSymlink
+  case S_IFIFO:
+    mode |= fs.ModeNamedPipe
+  case S_IFCHR:
+    mode |= fs.ModeDevice | fs.ModeCharDevice
+  }
+
+  if (info.stat.Mode & S_ISUID) != 0 { mode |= fs.ModeSetuid }
+  if (info.stat.Mode & S_ISGID) != 0 { mode |= fs.ModeSetgid }
+  if (info.stat.Mode & S_ISVTX) != 0 { mode |= fs.ModeSticky }
+  return mode
+}
+
+func (info *fileInfo) ModTime() time.Time {
+  return info.stat.Mtime
+}
+
+func (info *fileInfo) IsDir() bool {
+  return info.Mode().IsDir()
+}
+
+// Returns the Stat_t the information came from.
+func (info *fileInfo) Sys() interface{} {
+  return info.stat
+}
@@ -0,0 +1,59 @@
+package gofs
+
+import (
+  "errors"
+  "io/fs"
+  "testing"
+  "testing/fstest"
+)
+
+func TestIOFS(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/site")
+  p.safeMkdir(t, "/site/static")
+  p.safeMkdir(t, "/site/empty")
+  p.writeFile(t, "/site/index.html", []byte("<h1>{{.}}</h1>"))
+  p.writeFile(t, "/site/static/app.js", randBytes(4096 * 2 + 12))
+  p.writeFile(t, "/site/static/style.css", []byte("body {}"))
+  AssertNoErr(t, p.Symlink("static/app.js", "/site/app.js"))
+
+  sub, err := NewIOFS(p).Sub("site")
+  AssertNoErr(t, err)
+  AssertNoErr(t, fstest.TestFS(sub, "index.html", "static/app.js",
+    "static/style.css", "empty", "app.js"))
+
+  data, err := fs.ReadFile(sub, "static/style.css")
+  AssertNoErr(t, err)
+  AssertTrue(t, string(data) == "body {}", "Read the wrong data.")
+  matches, err := fs.Glob(sub, "static/*.js")
+  AssertNoErr(t, err)
+  AssertTrue(t, len(matches) == 1 && matches[0] == "static/app.js", "Bad glob.")
+
+  info, err := fs.Stat(sub, "static")
+  AssertNoErr(t, err)
+  AssertTrue(t, info.IsDir() && info.Mode().Perm() == 0755, "Bad directory info.")
+  AssertTrue(t, info.Sys().(Stat_t).Mode & S_IFMT == S_IFDIR, "Bad Stat_t.")
+
+  // errors are PathErrors that match io/fs's
+  _, err = sub.Open("missing")
+  AssertTrue(t, errors.Is(err, fs.ErrNotExist), "Missing file exists.")
+  _, err = sub.Open("../site")
+  AssertTrue(t, errors.Is(err, fs.ErrInvalid), "Opened an invalid name.")
+
+  // names are looked up as the process
+  AssertNoErr(t, p.Chmod("/site/static", 0700))
+  user, err := NewProc(ProcOptions{Uid: 1000, Gid: 1000})
+  AssertNoErr(t, err)
+  _, err = fs.ReadFile(NewIOFS(user), "site/static/style.css")
+  AssertTrue(t, errors.Is(err, fs.ErrPermission), "Read past a directory without search.")
+  user.Exit()
+
+  // every descriptor is closed again
+  AssertTrue(t, len(p.openFds()) == 3, "Leaked a descriptor.")
+  for _, path := range []string{"/site/app.js", "/site/static/app.js",
+    "/site/static/style.css", "/site/static", "/site/empty", "/site/index.html", "/site"} {
+    p.safeUnlink(t, path)
+  }
+
+  p.Exit()
+}
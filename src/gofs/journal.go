@@ -0,0 +1,983 @@
+package gofs
+
+import (
+  "bytes"
+  "encoding/binary"
+  "errors"
+  "hash/crc32"
+  "io"
+  "os"
+  "sort"
+  "time"
+)
+
+/**
+* The journal makes GoFS durable on the host. Every mutating call is appended to
+* a journal file as a self-checking record and, every so often, the whole tree
+* is written out as a checkpoint next to it, after which the journal starts
+* over. Recovering is then a matter of loading the checkpoint and replaying the
+* records that follow it.
+*
+* Records are framed as [length u32][crc32 u32][payload]. A record that was only
+* partly written when the host went down fails its length or checksum test and
+* is dropped, along with anything after it, so the file system comes back as it
+* was after the last whole record. Each record is synced to the host's disk as
+* it's appended, so a call that has returned survives the host going down.
+*
+* Each journal starts with the epoch of the checkpoint it follows. Checkpoints
+* are written to the side and renamed into place before the journal is reset,
+* so a crash in between leaves a journal whose epoch is older than the
+* checkpoint's; its records are already in the checkpoint and are ignored.
+*
+* Paths in records are absolute so they don't depend on the cwd of the process
+* that made the call. They're taken from the directory the call resolved, not
+* from the path it was given, so they don't depend on its root or the symlinks
+* on the way either: an absolute symlink in a chroot leads somewhere else when
+* replayed from the root. Writes and changes to attributes name their inode by
+* number instead, since a file may be written long after it was renamed or
+* unlinked. Creating a file or directory records its number and attributes.
+*/
+
+const DEFAULT_CHECKPOINT_INTERVAL = 1024
+
+const journalMagic = "GOFSJRNL"
+const checkpointMagic = "GOFSCKPT"
+const checkpointVersion = 8
+const journalHeaderSize = len(journalMagic) + 8
+const recordHeaderSize = 8
+
+var errCorrupt = errors.New("Corrupt journal or checkpoint.")
+
+type recordOp uint8
+
+const (
+  recCreate recordOp = iota + 1
+  recWrite
+  recLink
+  recUnlink
+  recRename
+  recMkdir
+  recSymlink
+  recMkfifo
+  recMknod
+  recSetxattr
+  recRemovexattr
+  recSetattr
+  recTruncate
+  recMount
+  recUnmount
+  recCopyUp
+  recLinkOwner
+)
+
+// Entry kinds in a checkpoint's serialized tree.
+const (
+  entryEnd byte = iota
+  entryFile
+  entryDir
+  entrySymlink
+  entryFifo
+  entryDevice
+  entryHost
+  entryMount
+  entryZip
+)
+
+type journal struct {
+  file     *os.File
+  path     string
+  epoch    uint64
+  records  int
+  interval int
+}
+
+type recordBuffer struct {
+  bytes.Buffer
+}
+
+func (b *recordBuffer) putUint(v uint64) {
+  var tmp [binary.MaxVarintLen64]byte
+  n := binary.PutUvarint(tmp[:], v)
+  b.Write(tmp[:n])
+}
+
+func (b *recordBuffer) putBytes(p []byte) {
+  b.putUint(uint64(len(p)))
+  b.Write(p)
+}
+
+func (b *recordBuffer) putString(s string) {
+  b.putUint(uint64(len(s)))
+  b.WriteString(s)
+}
+
+type recordReader struct {
+  *bytes.Reader
+}
+
+func (r recordReader) uint() (uint64, error) {
+  v, err := binary.ReadUvarint(r.Reader)
+  if err != nil { return 0, errCorrupt }
+  return v, nil
+}
+
+func (r recordReader) bytes() ([]byte, error) {
+  n, err := r.uint()
+  if err != nil { return nil, err }
+  if n > uint64(r.Len()) { return nil, errCorrupt }
+
+  p := make([]byte, n)
+  _, err = io.ReadFull(r.Reader, p)
+  return p, err
+}
+
+func (r recordReader) string() (string, error) {
+  p, err := r.bytes()
+  return string(p), err
+}
+
+// Makes the file system durable by journaling to the host file at path, and
+// checkpointing to path.ckpt every interval records (never, if interval <= 0).
+// If a checkpoint is already there, the tree is recovered from it and the
+// journal, replacing the current root, so this should be called before any
+// process is created. Otherwise, the current tree is the first checkpoint.
+func EnableJournal(path string, interval int) error {
+  if globalState.journal != nil { return errors.New("Journal already enabled.") }
+
+  epoch, inodes, found, err := loadCheckpoint(path + ".ckpt")
+  if err != nil { return err }
+
+  file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+  if err != nil { return err }
+
+  j := &journal{file: file, path: path, epoch: epoch, interval: interval}
+  if !found {
+    err = j.checkpoint()
+  } else {
+    err = j.replay(inodes)
+  }
+
+  if err != nil {
+    file.Close()
+    return err
+  }
+
+  globalState.journal = j
+  return nil
+}
+
+// Stops journaling. What has been journaled so far is kept on the host.
+func DisableJournal() error {
+  if globalState.journal == nil { return errors.New("Journal not enabled.") }
+
+  err := globalState.journal.close()
+  globalState.journal = nil
+  return err
+}
+
+// Writes a checkpoint now and starts a fresh journal after it.
+func Checkpoint() error {
+  if globalState.journal == nil { return errors.New("Journal not enabled.") }
+  return globalState.journal.checkpoint()
+}
+
+func (j *journal) close() error {
+  if err := j.file.Sync(); err != nil {
+    j.file.Close()
+    return err
+  }
+
+  return j.file.Close()
+}
+
+func (j *journal) checkpoint() error {
+  epoch := j.epoch + 1
+  if err := writeCheckpoint(j.path + ".ckpt", epoch); err != nil { return err }
+
+  j.epoch = epoch
+  return j.reset()
+}
+
+// Empties the journal, leaving only the header for the current epoch.
+func (j *journal) reset() error {
+  if err := j.file.Truncate(0); err != nil { return err }
+  if _, err := j.file.Seek(0, io.SeekStart); err != nil { return err }
+
+  var header [journalHeaderSize]byte
+  copy(header[:], journalMagic)
+  binary.LittleEndian.PutUint64(header[len(journalMagic):], j.epoch)
+  if _, err := j.file.Write(header[:]); err != nil { return err }
+
+  j.records = 0
+  return j.file.Sync()
+}
+
+func (j *journal) append(payload []byte) error {
+  record := make([]byte, recordHeaderSize, recordHeaderSize + len(payload))
+  binary.LittleEndian.PutUint32(record[0:], uint32(len(payload)))
+  binary.LittleEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+  record = append(record, payload...)
+
+  // A single write, so that a crash leaves at most one torn record behind, and
+  // synced before the call it records returns.
+  if _, err := j.file.Write(record); err != nil { return err }
+  if err := j.file.Sync(); err != nil { return err }
+
+  j.records++
+  if j.interval > 0 && j.records >= j.interval { return j.checkpoint() }
+  return nil
+}
+
+// Replays the records following the checkpoint that was just loaded, then
+// cuts the journal off after the last whole one so appends continue from it.
+func (j *journal) replay(inodes map[uint64]*Inode) error {
+  data, err := io.ReadAll(j.file)
+  if err != nil { return err }
+
+  if len(data) < journalHeaderSize || string(data[:len(journalMagic)]) != journalMagic ||
+  binary.LittleEndian.Uint64(data[len(journalMagic):]) != j.epoch {
+    return j.reset()
+  }
+
+  // Records are replayed as root, by a process that's gone once they're done.
+  proc := InitProc()
+  defer proc.Exit()
+  good := journalHeaderSize
+  for len(data) - good >= recordHeaderSize {
+    length := int(binary.LittleEndian.Uint32(data[good:]))
+    sum := binary.LittleEndian.Uint32(data[good + 4:])
+    start := good + recordHeaderSize
+    if length > len(data) - start { break }
+
+    payload := data[start:start + length]
+    if crc32.ChecksumIEEE(payload) != sum { break }
+    if err := replayRecord(proc, inodes, payload); err != nil { return err }
+
+    good = start + length
+    j.records++
+  }
+
+  if err := j.file.Truncate(int64(good)); err != nil { return err }
+  _, err = j.file.Seek(int64(good), io.SeekStart)
+  return err
+}
+
+func replayRecord(proc *ProcState, inodes map[uint64]*Inode, payload []byte) error {
+  r := recordReader{bytes.NewReader(payload)}
+  op, err := r.ReadByte()
+  if err != nil { return errCorrupt }
+
+  switch recordOp(op) {
+  case recCreate:
+    path, err := r.string()
+    if err != nil { return err }
+    ino, err := r.uint()
+    if err != nil { return err }
+
+    file, err := proc.openFile(path, O_RDWR|O_CREAT, UserMode())
+    if err != nil { return err }
+
+    inode := file.(*DataFile).inode
+    inode.ino = ino
+    inodes[ino] = inode
+    if ino > globalState.nextIno { globalState.nextIno = ino }
+    if err := decodeAttrs(r, inode); err != nil { return err }
+    return file.Close()
+  case recWrite:
+    ino, err := r.uint()
+    if err != nil { return err }
+    offset, err := r.uint()
+    if err != nil { return err }
+    data, err := r.bytes()
+    if err != nil { return err }
+
+    // The inode may have been unreachable when the checkpoint was taken.
+    inode, ok := inodes[ino]
+    if !ok { return nil }
+
+    _, err = inode.write(int(offset), data)
+    inode.lastModTime = time.Now()
+    return err
+  case recLink, recRename:
+    src, err := r.string()
+    if err != nil { return err }
+    dst, err := r.string()
+    if err != nil { return err }
+    if recordOp(op) == recLink { return proc.Link(src, dst) }
+
+    // Renames with flags carry them after the paths.
+    var flags uint64
+    if r.Len() > 0 {
+      if flags, err = r.uint(); err != nil { return err }
+    }
+
+    return proc.Rename2(src, dst, RenameFlag(flags))
+  case recSymlink, recMknod:
+    target, err := r.string()
+    if err != nil { return err }
+    path, err := r.string()
+    if err != nil { return err }
+
+    if recordOp(op) == recSymlink { return proc.Symlink(target, path) }
+    return proc.Mknod(path, target)
+  case recMkdir:
+    path, err := r.string()
+    if err != nil { return err }
+    ino, err := r.uint()
+    if err != nil { return err }
+    if err := proc.Mkdir(path); err != nil { return err }
+
+    ref, err := proc.resolve(path, false)
+    if err != nil { return err }
+    inode := ref.entry.(Directory).inode()
+    inode.ino = ino
+    inodes[ino] = inode
+    if ino > globalState.nextIno { globalState.nextIno = ino }
+    return decodeAttrs(r, inode)
+  case recUnlink, recMkfifo:
+    path, err := r.string()
+    if err != nil { return err }
+
+    if recordOp(op) == recUnlink { return proc.Unlink(path) }
+    return proc.Mkfifo(path)
+  case recLinkOwner:
+    path, err := r.string()
+    if err != nil { return err }
+    owner, err := r.uint()
+    if err != nil { return err }
+    group, err := r.uint()
+    if err != nil { return err }
+    return proc.Lchown(path, int(owner), int(group))
+  case recSetattr:
+    ino, err := r.uint()
+    if err != nil { return err }
+
+    inode, ok := inodes[ino]
+    if !ok { return nil }
+    return decodeAttrs(r, inode)
+  case recMount:
+    var values [3]string
+    for i := range values {
+      if values[i], err = r.string(); err != nil { return err }
+    }
+    flags, err := r.uint()
+    if err != nil { return err }
+    size, err := r.uint()
+    if err != nil { return err }
+
+    fstype, source, target := values[0], values[1], values[2]
+    if fstype != "host" { return proc.Mount(source, target, fstype, MountFlag(flags), int64(size)) }
+
+    // The host directory may be gone by now; mount it all the same.
+    mnt := &fsMount{fstype: fstype, source: source, flags: MountFlag(flags)}
+    mnt.root = &HostDir{root: source, fs: mnt}
+    return proc.mount(target, mnt)
+  case recUnmount:
+    target, err := r.string()
+    if err != nil { return err }
+    _, err = proc.unmount(target)
+    return err
+  case recCopyUp:
+    path, err := r.string()
+    if err != nil { return err }
+    ino, err := r.uint()
+    if err != nil { return err }
+
+    ref, err := proc.resolve(path, false)
+    if err != nil { return err }
+    if err := proc.copyUp(&ref); err != nil { return err }
+    inode := inodeOf(ref.entry)
+    if inode == nil { return errCorrupt }
+    inode.ino = ino
+    inodes[ino] = inode
+    if ino > globalState.nextIno { globalState.nextIno = ino }
+    return nil
+  case recTruncate:
+    ino, err := r.uint()
+    if err != nil { return err }
+    size, err := r.uint()
+    if err != nil { return err }
+
+    inode, ok := inodes[ino]
+    if !ok { return nil }
+    inode.truncate(int64(size))
+    return nil
+  case recSetxattr, recRemovexattr:
+    ino, err := r.uint()
+    if err != nil { return err }
+    name, err := r.string()
+    if err != nil { return err }
+
+    inode, ok := inodes[ino]
+    if !ok { return nil }
+    if recordOp(op) == recRemovexattr { return inode.removexattr(name) }
+
+    value, err := r.bytes()
+    if err != nil { return err }
+    return inode.setxattr(name, value, 0)
+  }
+
+  return errCorrupt
+}
+
+// Returns the path from the root of the name ref resolved to, whatever is
+// there now: a directory renamed or unlinked by the call is still recorded by
+// its old name. This fails only when ref's directory has been unlinked, and
+// then nothing created in it can be reached by a checkpoint or replay anyway.
+func (ref pathRef) recordPath() (string, bool) {
+  if isEntryName(ref.name) { ref.entry = nil }
+  return ref.absPath()
+}
+
+// Journals a call that takes only paths, if journaling is enabled.
+func logPaths(op recordOp, refs ...pathRef) error {
+  if globalState.journal == nil { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(op))
+  for _, ref := range refs {
+    abs, ok := ref.recordPath()
+    if !ok { return nil }
+    b.putString(abs)
+  }
+
+  return globalState.journal.append(b.Bytes())
+}
+
+// Journals the creation of a file or directory along with its inode number.
+func logCreate(op recordOp, ref pathRef, inode *Inode) error {
+  if globalState.journal == nil { return nil }
+
+  abs, ok := ref.recordPath()
+  if !ok { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(op))
+  b.putString(abs)
+  b.putUint(inode.ino)
+  encodeAttrs(&b, inode)
+  return globalState.journal.append(b.Bytes())
+}
+
+func logRename(src pathRef, dst pathRef, flags RenameFlag) error {
+  if globalState.journal == nil { return nil }
+
+  absSrc, ok := src.recordPath()
+  if !ok { return nil }
+  absDst, ok := dst.recordPath()
+  if !ok { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(recRename))
+  b.putString(absSrc)
+  b.putString(absDst)
+  if flags != 0 { b.putUint(uint64(flags)) }
+  return globalState.journal.append(b.Bytes())
+}
+
+// Journals a call taking a string and a path, like Symlink or Mknod. The
+// string is kept as given: a symlink's relative target is resolved from
+// wherever the symlink ends up.
+func logWithPath(op recordOp, arg string, ref pathRef) error {
+  if globalState.journal == nil { return nil }
+
+  abs, ok := ref.recordPath()
+  if !ok { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(op))
+  b.putString(arg)
+  b.putString(abs)
+  return globalState.journal.append(b.Bytes())
+}
+
+func logWrite(inode *Inode, offset int, p []byte) error {
+  if globalState.journal == nil { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(recWrite))
+  b.putUint(inode.ino)
+  b.putUint(uint64(offset))
+  b.putBytes(p)
+  return globalState.journal.append(b.Bytes())
+}
+
+func logMount(mnt *fsMount) error {
+  if globalState.journal == nil { return nil }
+
+  abs, ok := mnt.point().recordPath()
+  if !ok { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(recMount))
+  b.putString(mnt.fstype)
+  b.putString(mnt.source)
+  b.putString(abs)
+  b.putUint(uint64(mnt.flags))
+  b.putUint(uint64(mnt.size))
+  return globalState.journal.append(b.Bytes())
+}
+
+// Journals the copy-up of what ref names, an inode now in an overlay's upper
+// layer, with the number it has there.
+func logCopyUp(ref pathRef, inode *Inode) error {
+  if globalState.journal == nil { return nil }
+
+  abs, ok := ref.absPath()
+  if !ok { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(recCopyUp))
+  b.putString(abs)
+  b.putUint(inode.ino)
+  return globalState.journal.append(b.Bytes())
+}
+
+func logTruncate(inode *Inode, size int64) error {
+  if globalState.journal == nil { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(recTruncate))
+  b.putUint(inode.ino)
+  b.putUint(uint64(size))
+  return globalState.journal.append(b.Bytes())
+}
+
+// Journals the owner and group of the symlink ref names.
+func logLinkOwner(ref pathRef, link *Symlink) error {
+  if globalState.journal == nil { return nil }
+
+  abs, ok := ref.recordPath()
+  if !ok { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(recLinkOwner))
+  b.putString(abs)
+  b.putUint(uint64(link.ownerId))
+  b.putUint(uint64(link.groupId))
+  return globalState.journal.append(b.Bytes())
+}
+
+func logSetattr(inode *Inode) error {
+  if globalState.journal == nil { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(recSetattr))
+  b.putUint(inode.ino)
+  encodeAttrs(&b, inode)
+  return globalState.journal.append(b.Bytes())
+}
+
+func logSetxattr(inode *Inode, name string, value []byte) error {
+  if globalState.journal == nil { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(recSetxattr))
+  b.putUint(inode.ino)
+  b.putString(name)
+  b.putBytes(value)
+  return globalState.journal.append(b.Bytes())
+}
+
+func logRemovexattr(inode *Inode, name string) error {
+  if globalState.journal == nil { return nil }
+
+  var b recordBuffer
+  b.WriteByte(byte(recRemovexattr))
+  b.putUint(inode.ino)
+  b.putString(name)
+  return globalState.journal.append(b.Bytes())
+}
+
+/**
+* A checkpoint is the tree from the root down, depth first. Each entry is its
+* kind and name. A directory follows with its inode, then its entries up to an
+* entryEnd; the root has only its inode, before its entries. A file follows
+* with its inode number and, the first time that inode is seen, its contents
+* and the rest of its inode. Later links to the same inode carry only the
+* number. Symlinks carry their target, owner and group, devices their driver's
+* name, and Fifos nothing more. A mount point is what the mount covers, as an
+* entry of the same name, then the mount's type, source, flags, size and place
+* in the mount table, then its root: a directory with its inode and entries,
+* for the host, entryHost alone, or for a zip mount, entryZip and the archive.
+*
+* The rest of an inode is its attributes, as records also carry them: mode,
+* owner, group, then access, modification, change and creation times. After
+* them come its extended attributes: their count, then each name and value.
+*/
+
+func writeCheckpoint(path string, epoch uint64) error {
+  var b recordBuffer
+  b.WriteString(checkpointMagic)
+  b.WriteByte(checkpointVersion)
+  b.putUint(epoch)
+  b.putUint(globalState.nextIno)
+  encodeDirInode(&b, globalState.root)
+  encodeDirectory(&b, globalState.root, make(map[*Inode]bool), true)
+
+  var sum [4]byte
+  binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(b.Bytes()))
+  b.Write(sum[:])
+
+  tmp := path + ".tmp"
+  file, err := os.Create(tmp)
+  if err != nil { return err }
+
+  _, err = file.Write(b.Bytes())
+  if err == nil { err = file.Sync() }
+  if cerr := file.Close(); err == nil { err = cerr }
+  if err != nil { return err }
+
+  return os.Rename(tmp, path)
+}
+
+func encodeAttrs(b *recordBuffer, inode *Inode) {
+  b.putUint(uint64(inode.perms))
+  b.putUint(uint64(inode.ownerId))
+  b.putUint(uint64(inode.groupId))
+  for _, t := range []time.Time{inode.lastAccessTime, inode.lastModTime,
+    inode.changeTime, inode.createTime} {
+    b.putUint(uint64(t.UnixNano()))
+  }
+
+  encodeACL(b, inode.acl)
+  encodeACL(b, inode.defaultACL)
+}
+
+func encodeACL(b *recordBuffer, acl ACL) {
+  b.putUint(uint64(len(acl)))
+  for _, entry := range acl {
+    b.putUint(uint64(entry.Tag))
+    b.putUint(uint64(entry.Id))
+    b.putUint(uint64(entry.Perms))
+  }
+}
+
+func decodeACL(r recordReader) (ACL, error) {
+  count, err := r.uint()
+  if err != nil { return nil, err }
+
+  var acl ACL
+  for i := uint64(0); i < count; i++ {
+    var values [3]uint64
+    for j := range values {
+      if values[j], err = r.uint(); err != nil { return nil, err }
+    }
+
+    acl = append(acl, ACLEntry{Tag: ACLTag(values[0]), Id: uint(values[1]),
+      Perms: FileMode(values[2])})
+  }
+
+  return acl, nil
+}
+
+func decodeAttrs(r recordReader, inode *Inode) error {
+  var values [7]uint64
+  for i := range values {
+    var err error
+    if values[i], err = r.uint(); err != nil { return err }
+  }
+
+  inode.perms, inode.ownerId, inode.groupId = uint(values[0]), uint(values[1]),
+    uint(values[2])
+  times := []*time.Time{&inode.lastAccessTime, &inode.lastModTime,
+    &inode.changeTime, &inode.createTime}
+  for i, t := range times {
+    *t = time.Unix(0, int64(values[3 + i]))
+  }
+
+  var err error
+  if inode.acl, err = decodeACL(r); err != nil { return err }
+  inode.defaultACL, err = decodeACL(r)
+  return err
+}
+
+func encodeInode(b *recordBuffer, inode *Inode) {
+  encodeAttrs(b, inode)
+  names := inode.listxattr()
+  b.putUint(uint64(len(names)))
+  for _, name := range names {
+    b.putString(name)
+    b.putBytes(inode.xattrs[name])
+  }
+}
+
+func encodeDirInode(b *recordBuffer, dir Directory) {
+  b.putUint(dir.inode().ino)
+  encodeInode(b, dir.inode())
+}
+
+func decodeInode(r recordReader, inode *Inode) error {
+  if err := decodeAttrs(r, inode); err != nil { return err }
+  count, err := r.uint()
+  if err != nil { return err }
+
+  for i := uint64(0); i < count; i++ {
+    name, err := r.string()
+    if err != nil { return err }
+    value, err := r.bytes()
+    if err != nil { return err }
+    if err := inode.setxattr(name, value, 0); err != nil { return errCorrupt }
+  }
+
+  return nil
+}
+
+func decodeDirInode(r recordReader, dir Directory, inodes map[uint64]*Inode) error {
+  ino, err := r.uint()
+  if err != nil { return err }
+
+  inode := dir.inode()
+  inode.ino = ino
+  inodes[ino] = inode
+  return decodeInode(r, inode)
+}
+
+// Writes out the entries of dir, and with mounts, what's mounted in it;
+// otherwise, what mounts there cover.
+func encodeDirectory(b *recordBuffer, dir Directory, seen map[*Inode]bool, mounts bool) {
+  for _, name := range dir.names() {
+    encodeEntry(b, dir, name, dir[name], seen, mounts)
+  }
+
+  b.WriteByte(entryEnd)
+}
+
+func encodeEntry(b *recordBuffer, dir Directory, name string, entry interface{},
+  seen map[*Inode]bool, mounts bool) {
+  if mnt := mountRootOf(entry); mnt != nil {
+    if !mounts {
+      encodeEntry(b, dir, name, mnt.covered, seen, mounts)
+      return
+    }
+
+    b.WriteByte(entryMount)
+    b.putString(name)
+    encodeEntry(b, dir, name, mnt.covered, seen, mounts)
+    b.putString(mnt.fstype)
+    b.putString(mnt.source)
+    b.putUint(uint64(mnt.flags))
+    b.putUint(uint64(mnt.size))
+    for i, other := range globalState.mounts {
+      if other == mnt { b.putUint(uint64(i)) }
+    }
+
+    switch root := mnt.root.(type) {
+    case Directory:
+      // What's been decompressed of a zip mount can be again.
+      if mnt.fstype == "zip" {
+        b.WriteByte(entryZip)
+        b.putBytes(mnt.archive)
+        break
+      }
+
+      b.WriteByte(entryDir)
+      encodeDirInode(b, root)
+      encodeDirectory(b, root, seen, mounts)
+    case *HostDir:
+      b.WriteByte(entryHost)
+    }
+
+    return
+  }
+
+  switch entry := entry.(type) {
+  case Directory:
+    // A linked directory would lead us around in circles.
+    if !sameDirectory(entry.parent(), dir) { return }
+
+    b.WriteByte(entryDir)
+    b.putString(name)
+    encodeDirInode(b, entry)
+    encodeDirectory(b, entry, seen, mounts)
+  case *Inode:
+    b.WriteByte(entryFile)
+    b.putString(name)
+    b.putUint(entry.ino)
+    if seen[entry] {
+      b.WriteByte(0)
+      return
+    }
+
+    seen[entry] = true
+    data := make([]byte, entry.data.Size())
+    if len(data) > 0 { entry.data.Read(0, data) }
+    b.WriteByte(1)
+    b.putBytes(data)
+    encodeInode(b, entry)
+  case *Symlink:
+    b.WriteByte(entrySymlink)
+    b.putString(name)
+    b.putString(entry.target)
+    b.putUint(uint64(entry.ownerId))
+    b.putUint(uint64(entry.groupId))
+  case *Fifo:
+    b.WriteByte(entryFifo)
+    b.putString(name)
+  case *Device:
+    b.WriteByte(entryDevice)
+    b.putString(name)
+    b.putString(entry.driver)
+  }
+}
+
+// Loads the checkpoint at path as the new root, returning its epoch and the
+// inodes it holds by number. found is false if there is no checkpoint.
+func loadCheckpoint(path string) (epoch uint64, inodes map[uint64]*Inode,
+found bool, err error) {
+  data, err := os.ReadFile(path)
+  if os.IsNotExist(err) { return 0, nil, false, nil }
+  if err != nil { return 0, nil, false, err }
+
+  header := len(checkpointMagic) + 1
+  if len(data) < header + 4 { return 0, nil, false, errCorrupt }
+
+  body, sum := data[:len(data) - 4], data[len(data) - 4:]
+  if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) ||
+  string(body[:len(checkpointMagic)]) != checkpointMagic ||
+  body[len(checkpointMagic)] != checkpointVersion {
+    return 0, nil, false, errCorrupt
+  }
+
+  r := recordReader{bytes.NewReader(body[header:])}
+  if epoch, err = r.uint(); err != nil { return }
+  nextIno, err := r.uint()
+  if err != nil { return }
+
+  // Decoding adds the mounts it finds to the table, which has to be put back
+  // if it fails.
+  mounts := globalState.mounts
+  defer func() {
+    if err != nil { globalState.mounts = mounts }
+  }()
+
+  mnt := &fsMount{fstype: "memfs", source: "none"}
+  root := mnt.newRoot(0755)
+  globalState.mounts = []*fsMount{mnt}
+  inodes = make(map[uint64]*Inode)
+  if err = decodeDirInode(r, root, inodes); err != nil { return }
+  if err = decodeDirectory(r, root, inodes); err != nil { return }
+
+  // The tree holds mounts in its order, not the table's.
+  sort.SliceStable(globalState.mounts, func(i, j int) bool {
+    return globalState.mounts[i].seq < globalState.mounts[j].seq
+  })
+  globalState.root = root
+  globalState.nextIno = nextIno
+  return epoch, inodes, true, nil
+}
+
+func decodeDirectory(r recordReader, dir Directory, inodes map[uint64]*Inode) error {
+  for {
+    kind, err := r.ReadByte()
+    if err != nil { return errCorrupt }
+    if kind == entryEnd { return nil }
+
+    name, err := r.string()
+    if err != nil { return err }
+    entry, err := decodeEntry(r, dir, kind, name, inodes)
+    if err != nil { return err }
+    dir[name] = entry
+  }
+}
+
+// Returns the entry of kind named name in dir, read from r.
+func decodeEntry(r recordReader, dir Directory, kind byte, name string,
+  inodes map[uint64]*Inode) (interface{}, error) {
+  switch kind {
+  case entryDir:
+    sub := initDirectory(dir, name)
+    if err := decodeDirInode(r, sub, inodes); err != nil { return nil, err }
+    if err := decodeDirectory(r, sub, inodes); err != nil { return nil, err }
+    return sub, nil
+  case entryFile:
+    ino, err := r.uint()
+    if err != nil { return nil, err }
+    first, err := r.ReadByte()
+    if err != nil { return nil, errCorrupt }
+
+    if first == 0 {
+      inode, ok := inodes[ino]
+      if !ok { return nil, errCorrupt }
+      inode.incrementLinkCount()
+      return inode, nil
+    }
+
+    data, err := r.bytes()
+    if err != nil { return nil, err }
+
+    inode := initInode()
+    inode.ino = ino
+    inode.fs = dir.inode().fs
+    if len(data) > 0 { inode.write(0, data) }
+    if err := decodeInode(r, inode); err != nil { return nil, err }
+    inodes[ino] = inode
+    return inode, nil
+  case entrySymlink:
+    target, err := r.string()
+    if err != nil { return nil, err }
+    owner, err := r.uint()
+    if err != nil { return nil, err }
+    group, err := r.uint()
+    if err != nil { return nil, err }
+    return &Symlink{target: target, ownerId: uint(owner), groupId: uint(group)}, nil
+  case entryFifo:
+    return &Fifo{pipe: initPipe()}, nil
+  case entryDevice:
+    driver, err := r.string()
+    if err != nil { return nil, err }
+    return &Device{driver: driver}, nil
+  case entryMount:
+    return decodeMount(r, dir, name, inodes)
+  }
+
+  return nil, errCorrupt
+}
+
+// Returns the root of the mount at dir[name], read from r, and adds the mount
+// to the table.
+func decodeMount(r recordReader, dir Directory, name string,
+  inodes map[uint64]*Inode) (interface{}, error) {
+  kind, err := r.ReadByte()
+  if err != nil { return nil, errCorrupt }
+  if _, err := r.string(); err != nil { return nil, err }
+  covered, err := decodeEntry(r, dir, kind, name, inodes)
+  if err != nil { return nil, err }
+
+  mnt := &fsMount{dir: dir, name: name, covered: covered}
+  if mnt.fstype, err = r.string(); err != nil { return nil, err }
+  if mnt.source, err = r.string(); err != nil { return nil, err }
+  flags, err := r.uint()
+  if err != nil { return nil, err }
+  size, err := r.uint()
+  if err != nil { return nil, err }
+  mnt.flags, mnt.size = MountFlag(flags), int64(size)
+  seq, err := r.uint()
+  if err != nil { return nil, err }
+  mnt.seq = int(seq)
+
+  kind, err = r.ReadByte()
+  if err != nil { return nil, errCorrupt }
+
+  switch kind {
+  case entryDir:
+    root := mnt.newRoot(0755)
+    root[".."] = dir
+    root.header().name = name
+    if err := decodeDirInode(r, root, inodes); err != nil { return nil, err }
+    if err := decodeDirectory(r, root, inodes); err != nil { return nil, err }
+  case entryHost:
+    mnt.root = &HostDir{root: mnt.source, fs: mnt}
+  case entryZip:
+    if mnt.archive, err = r.bytes(); err != nil { return nil, err }
+    if err := mnt.loadZip(); err != nil { return nil, errCorrupt }
+    root := mnt.root.(Directory)
+    root[".."] = dir
+    root.header().name = name
+  default:
+    return nil, errCorrupt
+  }
+
+  globalState.mounts = append(globalState.mounts, mnt)
+  return mnt.root, nil
+}
@@ -0,0 +1,249 @@
+package gofs
+
+import (
+  "bytes"
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+  "time"
+)
+
+func resetGlobalState() {
+  ClearGlobalState()
+  InitGlobalState()
+}
+
+func dumpXattrs(inode *Inode, out *strings.Builder) {
+  out.WriteString(fmt.Sprintf(" %o %d:%d", inode.perms, inode.ownerId, inode.groupId))
+  for _, name := range inode.listxattr() {
+    out.WriteString(" [" + name + "=" + string(inode.xattrs[name]) + "]")
+  }
+
+  if inode.acl != nil { out.WriteString(fmt.Sprintf(" acl:%v", inode.acl)) }
+  if inode.defaultACL != nil { out.WriteString(fmt.Sprintf(" default:%v", inode.defaultACL)) }
+}
+
+// Renders the whole tree, contents included, so two trees can be compared.
+func dumpTree(dir Directory, prefix string, out *strings.Builder) {
+  for _, name := range dir.names() {
+    switch entry := dir[name].(type) {
+    case Directory:
+      out.WriteString(prefix + name + "/")
+      dumpXattrs(entry.inode(), out)
+      out.WriteString("\n")
+      dumpTree(entry, prefix + name + "/", out)
+    case *Inode:
+      data := make([]byte, entry.data.Size())
+      if len(data) > 0 { entry.data.Read(0, data) }
+      out.WriteString(prefix + name + "=" + string(data))
+      dumpXattrs(entry, out)
+      out.WriteString("\n")
+    case *Symlink:
+      out.WriteString(fmt.Sprintf("%s%s -> %s %d:%d\n", prefix, name, entry.target, entry.ownerId, entry.groupId))
+    case *Fifo:
+      out.WriteString(prefix + name + "|\n")
+    case *Device:
+      out.WriteString(prefix + name + " @" + entry.driver + "\n")
+    case *HostDir:
+      out.WriteString(fmt.Sprintf("%s%s => %s %v\n", prefix, name, entry.root, entry.fs.flags))
+    }
+  }
+}
+
+func treeString() string {
+  var out strings.Builder
+  out.WriteString("/")
+  dumpXattrs(globalState.root.inode(), &out)
+  out.WriteString("\n")
+  dumpTree(globalState.root, "/", &out)
+  for _, mnt := range globalState.mounts {
+    out.WriteString(fmt.Sprintf("mount %s %s on %s %v %d %d\n", mnt.fstype, mnt.source,
+      mnt.name, mnt.flags, mnt.size, mnt.used))
+  }
+
+  return out.String()
+}
+
+func recoverFrom(t *testing.T, path string) string {
+  resetGlobalState()
+  AssertNoErr(t, EnableJournal(path, 0))
+  tree := treeString()
+  AssertNoErr(t, DisableJournal())
+  return tree
+}
+
+func TestJournalTornRecovery(t *testing.T) {
+  defer resetGlobalState()
+  resetGlobalState()
+
+  dir := t.TempDir()
+  path := filepath.Join(dir, "journal")
+  AssertNoErr(t, EnableJournal(path, 0))
+
+  // states[k] is the tree after k records, ends[k] the journal size then.
+  states := []string{treeString()}
+  ends := []int64{int64(journalHeaderSize)}
+  step := func() {
+    info, err := os.Stat(path)
+    AssertNoErr(t, err)
+    states = append(states, treeString())
+    ends = append(ends, info.Size())
+  }
+
+  p := InitProc()
+  p.safeMkdir(t, "/docs"); step()
+  p.safeChdir(t, "/docs/")
+  fd := p.safeOpen(t, "notes", O_RDWR|O_CREAT, UserMode()); step()
+  p.safeWrite(t, fd, []byte("Hello")); step()
+  p.safeWrite(t, fd, []byte(", world!")); step()
+  p.safeLink(t, "notes", "/copy"); step()
+  p.safeRename(t, "/copy", "/docs/moved"); step()
+  AssertNoErr(t, p.Fsetxattr(fd, "user.tag", []byte("x"), 0)); step()
+  AssertNoErr(t, p.Setxattr("/docs", "user.dir", []byte("y"), 0)); step()
+  AssertNoErr(t, p.Fchmod(fd, 0600)); step()
+  AssertNoErr(t, p.Chown("/docs", 10, 20)); step()
+  AssertNoErr(t, p.SetACL("/docs", ACL_TYPE_DEFAULT, testACL)); step()
+  p.safeUnlink(t, "notes"); step()
+  AssertNoErr(t, p.Removexattr("/docs/moved", "user.tag")); step()
+  AssertNoErr(t, p.Fsetxattr(fd, "user.tag", []byte("z"), 0)); step()
+  AssertNoErr(t, p.Symlink("moved", "/docs/link")); step()
+  AssertNoErr(t, p.Mknod("/docs/null", "null")); step()
+  p.safeMkdir(t, "/docs/host"); step()
+  AssertNoErr(t, p.MountHost("/docs/host", dir, false)); step()
+  p.safeMkdir(t, "/tmp"); step()
+  AssertNoErr(t, p.Mount("none", "/tmp", "tmpfs", MS_NOEXEC, 1 << 20)); step()
+  tmp := p.safeOpen(t, "/tmp/scratch", O_RDWR|O_CREAT, UserMode()); step()
+  p.safeWrite(t, tmp, []byte("scratch")); step()
+  p.safeClose(t, tmp)
+  AssertNoErr(t, p.Mount("none", "/tmp", "memfs", 0, 0)); step()
+  AssertNoErr(t, p.Unmount("/tmp")); step()
+  p.safeMkdir(t, "/over"); step()
+  AssertNoErr(t, p.Mount("/docs", "/over", "overlay", 0, 0)); step()
+  over := p.safeOpen(t, "/over/moved", O_WRONLY|O_APPEND, UserMode()); step()
+  p.safeWrite(t, over, []byte(" Upper.")); step()
+  p.safeClose(t, over)
+  p.safeUnlink(t, "/over/link"); step()
+  jailed, err := Fork(p)
+  AssertNoErr(t, err)
+  AssertNoErr(t, jailed.Chroot("/docs"))
+  jailed.safeMkdir(t, "/jailed"); step()
+  // absolute symlinks lead elsewhere from the real root
+  AssertNoErr(t, jailed.Symlink("/jailed", "/abs")); step()
+  jailed.safeClose(t, jailed.safeOpen(t, "/abs/file", O_RDWR|O_CREAT, UserMode())); step()
+  jailed.safeMkdir(t, "/abs/sub"); step()
+  jailed.Exit()
+  p.safeWrite(t, fd, []byte(" Bye.")); step()
+  AssertNoErr(t, p.Ftruncate(fd, 7)); step()
+  _, err = p.Pwrite(fd, []byte("!"), 9); AssertNoErr(t, err); step()
+  p.safeClose(t, fd)
+  AssertNoErr(t, DisableJournal())
+
+  journal, err := os.ReadFile(path)
+  AssertNoErr(t, err)
+  checkpoint, err := os.ReadFile(path + ".ckpt")
+  AssertNoErr(t, err)
+
+  torn := filepath.Join(dir, "torn")
+  for offset := 0; offset <= len(journal); offset++ {
+    AssertNoErr(t, os.WriteFile(torn, journal[:offset], 0644))
+    AssertNoErr(t, os.WriteFile(torn + ".ckpt", checkpoint, 0644))
+
+    k := 0
+    for k + 1 < len(ends) && ends[k + 1] <= int64(offset) { k++ }
+    AssertTrue(t, recoverFrom(t, torn) == states[k], "Bad recovery of torn journal.")
+  }
+
+  // Recovery drops the torn tail, so appending after it must work.
+  AssertNoErr(t, os.WriteFile(torn, journal[:ends[3] + 3], 0644))
+  AssertNoErr(t, os.WriteFile(torn + ".ckpt", checkpoint, 0644))
+  resetGlobalState()
+  AssertNoErr(t, EnableJournal(torn, 0))
+  p = InitProc()
+  p.safeMkdir(t, "/after")
+  expected := treeString()
+  AssertNoErr(t, DisableJournal())
+  AssertTrue(t, recoverFrom(t, torn) == expected, "Lost record appended after recovery.")
+}
+
+func TestJournalCheckpoint(t *testing.T) {
+  defer resetGlobalState()
+  resetGlobalState()
+
+  path := filepath.Join(t.TempDir(), "journal")
+  AssertNoErr(t, EnableJournal(path, 3))
+
+  p := InitProc()
+  content := randBytes(4096 * 3)
+  p.safeMkdir(t, "/a")
+  p.safeMkdir(t, "/a/b")
+  fd := p.safeOpen(t, "/a/b/file", O_RDWR|O_CREAT, UserMode())
+  p.safeWrite(t, fd, content)
+  p.safeLink(t, "/a/b/file", "/a/hard")
+  p.safeClose(t, fd)
+  p.safeRename(t, "/a/b/file", "/top")
+  AssertNoErr(t, p.Symlink("../top", "/a/b/link"))
+  AssertNoErr(t, p.Lchown("/a/b/link", 7, 8))
+  AssertNoErr(t, p.Mknod("/a/zero", "zero"))
+  p.safeMkdir(t, "/a/host")
+  AssertNoErr(t, p.MountHost("/a/host", t.TempDir(), true))
+  p.safeMkdir(t, "/a/tmp")
+  p.safeMkdir(t, "/a/tmp/covered")
+  AssertNoErr(t, p.Mount("none", "/a/tmp", "tmpfs", MS_NOEXEC, 1 << 20))
+  p.writeFile(t, "/a/tmp/scratch", content[:100])
+  p.safeMkdir(t, "/a/tmp/sub")
+  p.safeMkdir(t, "/a/b/sub")
+  p.safeMkdir(t, "/a/over")
+  AssertNoErr(t, p.Mount("/a/b", "/a/over", "overlay", 0, 0))
+  p.writeFile(t, "/a/over/sub/new", content[:10])
+  p.safeUnlink(t, "/a/over/link")
+  AssertNoErr(t, p.Chmod("/a/over/sub", 0700))
+  var archive bytes.Buffer
+  AssertNoErr(t, ExportZip(p, "/a/tmp", &archive))
+  p.writeFile(t, "/a/fixture.zip", archive.Bytes())
+  p.safeMkdir(t, "/a/zip")
+  AssertNoErr(t, p.Mount("/a/fixture.zip", "/a/zip", "zip", 0, 0))
+  AssertNoErr(t, p.Setxattr("/a/hard", "user.tag", []byte("file"), 0))
+  AssertNoErr(t, p.Setxattr("/a/b", "user.tag", []byte("dir"), 0))
+  AssertNoErr(t, p.Setxattr("/", "trusted.root", []byte("root"), 0))
+  AssertNoErr(t, p.Chmod("/a/b", 01777))
+  AssertNoErr(t, p.SetACL("/a/b", ACL_TYPE_DEFAULT, testACL))
+  AssertNoErr(t, p.SetACL("/a/hard", ACL_TYPE_ACCESS, testACL))
+  mtime := time.Unix(1000, 5)
+  AssertNoErr(t, p.Utimes("/top", [2]Timespec{{0, UTIME_OMIT}, TimespecOf(mtime)}))
+  expected := treeString()
+  AssertNoErr(t, DisableJournal())
+
+  AssertTrue(t, recoverFrom(t, path) == expected, "Bad recovery from checkpoint.")
+
+  // Hard links must come back as one inode, and replaying leaves no process.
+  resetGlobalState()
+  procs := len(globalState.procs)
+  AssertNoErr(t, EnableJournal(path, 3))
+  AssertTrue(t, len(globalState.procs) == procs, "Replay left a process behind.")
+  AssertTrue(t, globalState.root["top"] == globalState.root["a"].(Directory)["hard"],
+    "Hard link not preserved across checkpoint.")
+  AssertTrue(t, globalState.root["top"].(*Inode).lastModTime.Equal(mtime),
+    "Times not preserved across checkpoint.")
+  AssertNoErr(t, DisableJournal())
+}
+
+func TestJournalFailedAppend(t *testing.T) {
+  defer resetGlobalState()
+  resetGlobalState()
+
+  path := filepath.Join(t.TempDir(), "journal")
+  AssertNoErr(t, EnableJournal(path, 0))
+  p := InitProc()
+  defer p.Exit()
+
+  // What can't be journaled isn't made.
+  AssertNoErr(t, globalState.journal.file.Close())
+  AssertTrue(t, p.Mkdir("/lost") != nil, "Mkdir outran its journal.")
+  _, err := p.Open("/lost", O_RDWR|O_CREAT, UserMode())
+  AssertTrue(t, err != nil, "Open outran its journal.")
+  _, err = p.Lstat("/lost")
+  AssertTrue(t, err == ENOENT, "Left an unjournaled entry.")
+  DisableJournal()
+}
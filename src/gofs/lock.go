@@ -0,0 +1,380 @@
+package gofs
+
+import (
+  "math"
+  "sync"
+)
+
+/**
+* Advisory locks, of the two kinds Linux has, both held per inode so that hard
+* links share them. Neither kind stops anyone reading or writing; they only
+* make other lockers wait.
+*
+* Flock locks cover the whole file and belong to an open file: descriptors
+* made by Dup or Fork share them, and they go away when the last descriptor
+* for the open file is closed. Opening with O_SHLOCK or O_EXLOCK takes one
+* before the descriptor is handed out, as on BSD.
+*
+* Fcntl locks (SetLk, SetLkw and GetLk) cover byte ranges and belong to a
+* process. Locking a range a process already holds replaces its lock there,
+* splitting or merging ranges as needed. As POSIX has it, they all go away when
+* the process closes any descriptor for the inode, and they aren't inherited
+* by Fork. A SetLkw that would wait on a process that is itself waiting, in
+* the end, on the caller fails with EDEADLK instead.
+*
+* The two kinds never conflict with each other. Waits happen across
+* goroutines: a waiter wakes whenever any lock is released.
+*/
+
+type FlockOp int
+const (
+  LOCK_SH FlockOp = 1 << iota
+  LOCK_EX
+  LOCK_NB
+  LOCK_UN
+)
+
+type LockType int
+const (
+  F_RDLCK LockType = iota
+  F_WRLCK
+  F_UNLCK
+)
+
+// A byte-range lock, as for fcntl(2).
+type Lock struct {
+  Type LockType
+  Whence int // SEEK_SET, SEEK_CUR or SEEK_END, which Start is relative to
+  Start int64
+  Len int64 // 0 to lock through the end of the file, however large it grows
+  Pid Pid // set by GetLk to the process holding the conflicting lock
+}
+
+const lockEOF = math.MaxInt64
+
+// A lock held on an inode, by an open file for flock or a process for fcntl.
+type heldLock struct {
+  file *DataFile
+  pid Pid
+  write bool
+  start int64
+  end int64 // exclusive, lockEOF when the lock has no end
+}
+
+// What a process blocked in SetLkw is waiting for.
+type lockWait struct {
+  inode *Inode
+  lock *heldLock
+}
+
+var locks = struct {
+  sync.Mutex
+  cond *sync.Cond
+  waiting map[Pid]lockWait
+}{waiting: make(map[Pid]lockWait)}
+
+func init() {
+  locks.cond = sync.NewCond(&locks.Mutex)
+}
+
+func (l *heldLock) sameOwner(other *heldLock) bool {
+  if l.file != nil || other.file != nil { return l.file == other.file }
+  return l.pid == other.pid
+}
+
+func (l *heldLock) conflicts(other *heldLock) bool {
+  if (l.file == nil) != (other.file == nil) || l.sameOwner(other) { return false }
+  if l.end <= other.start || other.end <= l.start { return false }
+  return l.write || other.write
+}
+
+// Returns the first lock held on inode that conflicts with lock. Must hold locks.
+func (inode *Inode) conflictingLock(lock *heldLock) *heldLock {
+  for _, held := range inode.locks {
+    if held.conflicts(lock) { return held }
+  }
+
+  return nil
+}
+
+// Replaces whatever lock's owner holds over lock's range with lock, or with
+// nothing if unlock. Must hold locks.
+func (inode *Inode) replaceLock(lock *heldLock, unlock bool) {
+  kept := make([]*heldLock, 0, len(inode.locks) + 2)
+  for _, held := range inode.locks {
+    if !held.sameOwner(lock) || held.end <= lock.start || lock.end <= held.start {
+      kept = append(kept, held)
+      continue
+    }
+
+    // Keep what sticks out either side of the new range.
+    if held.start < lock.start {
+      before := *held
+      before.end = lock.start
+      kept = append(kept, &before)
+    }
+
+    if held.end > lock.end {
+      after := *held
+      after.start = lock.end
+      kept = append(kept, &after)
+    }
+  }
+
+  if unlock {
+    inode.locks = kept
+    locks.cond.Broadcast()
+    return
+  }
+
+  // Merge with the owner's locks of the same type that it touches.
+  merged := *lock
+  inode.locks = kept[:0]
+  for _, held := range kept {
+    touches := held.end == merged.start || held.start == merged.end
+    if held.sameOwner(&merged) && held.write == merged.write && touches {
+      if held.start < merged.start { merged.start = held.start }
+      if held.end > merged.end { merged.end = held.end }
+      continue
+    }
+
+    inode.locks = append(inode.locks, held)
+  }
+
+  inode.locks = append(inode.locks, &merged)
+  locks.cond.Broadcast()
+}
+
+// Drops every lock held on inode that pid or file owns. Must hold locks.
+func (inode *Inode) releaseLocks(pid Pid, file *DataFile) {
+  kept := inode.locks[:0]
+  for _, held := range inode.locks {
+    if held.file == file && (file != nil || held.pid == pid) { continue }
+    kept = append(kept, held)
+  }
+
+  inode.locks = kept
+  locks.cond.Broadcast()
+}
+
+// Moves the locks file holds on from to to, which has replaced it for file.
+func moveLocks(file *DataFile, from *Inode, to *Inode) {
+  locks.Lock()
+  defer locks.Unlock()
+
+  kept := from.locks[:0]
+  for _, held := range from.locks {
+    if held.file == file {
+      to.locks = append(to.locks, held)
+    } else {
+      kept = append(kept, held)
+    }
+  }
+
+  from.locks = kept
+  locks.cond.Broadcast()
+}
+
+// Reports whether waiting for lock would close a cycle of processes waiting
+// on each other's fcntl locks back to pid. Must hold locks.
+func wouldDeadlock(pid Pid, inode *Inode, lock *heldLock, seen map[Pid]bool) bool {
+  for _, held := range inode.locks {
+    if !held.conflicts(lock) { continue }
+    if held.pid == pid { return true }
+
+    wait, waiting := locks.waiting[held.pid]
+    if !waiting || seen[held.pid] { continue }
+    seen[held.pid] = true
+    if wouldDeadlock(pid, wait.inode, wait.lock, seen) { return true }
+  }
+
+  return false
+}
+
+// Takes lock on inode, waiting for conflicting locks to go if wait.
+func (inode *Inode) acquireLock(lock *heldLock, wait bool) error {
+  locks.Lock()
+  defer locks.Unlock()
+
+  for inode.conflictingLock(lock) != nil {
+    if !wait { return EAGAIN }
+    if lock.file != nil {
+      locks.cond.Wait()
+      continue
+    }
+
+    if wouldDeadlock(lock.pid, inode, lock, make(map[Pid]bool)) { return EDEADLK }
+    locks.waiting[lock.pid] = lockWait{inode, lock}
+    locks.cond.Wait()
+    delete(locks.waiting, lock.pid)
+  }
+
+  inode.replaceLock(lock, false)
+  return nil
+}
+
+func (file *DataFile) flock(op FlockOp) error {
+  wait := (op & LOCK_NB) == 0
+  lock := &heldLock{file: file, start: 0, end: lockEOF}
+  switch op &^ LOCK_NB {
+  case LOCK_SH:
+    return file.inode.acquireLock(lock, wait)
+  case LOCK_EX:
+    lock.write = true
+    return file.inode.acquireLock(lock, wait)
+  case LOCK_UN:
+    locks.Lock()
+    file.inode.replaceLock(lock, true)
+    locks.Unlock()
+    return nil
+  }
+
+  return EINVAL
+}
+
+// Drops the flock lock of a file that is being closed for good.
+func (file *DataFile) releaseFlock() {
+  locks.Lock()
+  file.inode.releaseLocks(0, file)
+  locks.Unlock()
+}
+
+// Returns the inode locks on file are held on, or nil if it can't be locked.
+func lockableInode(file interface{File}) *Inode {
+  data, ok := file.(*DataFile)
+  if !ok { return nil }
+  return data.inode
+}
+
+// Drops the fcntl locks proc holds on inode, if any. This comes after the
+// descriptor is closed so that waiters don't race with the close.
+func (proc *ProcState) releaseLocks(inode *Inode) {
+  if inode == nil { return }
+
+  locks.Lock()
+  inode.releaseLocks(proc.pid, nil)
+  locks.Unlock()
+}
+
+// Takes the flock lock O_SHLOCK or O_EXLOCK asks for, if either, on a file
+// just opened.
+func lockOnOpen(file interface{File}, flags AccessFlag) error {
+  op := LOCK_SH
+  switch flags & (O_SHLOCK | O_EXLOCK) {
+  case 0:
+    return nil
+  case O_EXLOCK:
+    op = LOCK_EX
+  case O_SHLOCK | O_EXLOCK:
+    return EINVAL
+  }
+
+  data, ok := file.(*DataFile)
+  if !ok { return EINVAL }
+  if (flags & O_NONBLOCK) != 0 { op |= LOCK_NB }
+  return data.flock(op)
+}
+
+// Returns the DataFile at fd, which is all locks can be taken on.
+func (proc *ProcState) lockableFile(fd FileDescriptor) (*DataFile, error) {
+  file, err := proc.getFile(fd)
+  if err != nil { return nil, err }
+
+  data, ok := file.(*DataFile)
+  if !ok { return nil, EINVAL }
+  return data, nil
+}
+
+// Applies or removes a flock lock on the file open at fd.
+func (proc *ProcState) Flock(fd FileDescriptor, op FlockOp) error {
+  file, err := proc.lockableFile(fd)
+  if err != nil { return err }
+  return file.flock(op)
+}
+
+// Turns a Lock into the range it covers on file, owned by proc.
+func (proc *ProcState) heldLockFor(file *DataFile, lock *Lock) (*heldLock, error) {
+  start := lock.Start
+  switch lock.Whence {
+  case SEEK_SET:
+  case SEEK_CUR:
+    start += int64(file.seek)
+  case SEEK_END:
+    start += int64(file.Size())
+  default:
+    return nil, EINVAL
+  }
+
+  end := int64(lockEOF)
+  switch {
+  case lock.Len > 0:
+    end = start + lock.Len
+  case lock.Len < 0:
+    start, end = start + lock.Len, start
+  }
+
+  if start < 0 { return nil, EINVAL }
+  return &heldLock{pid: proc.pid, write: lock.Type == F_WRLCK,
+    start: start, end: end}, nil
+}
+
+func (proc *ProcState) setLock(fd FileDescriptor, lock *Lock, wait bool) error {
+  file, err := proc.lockableFile(fd)
+  if err != nil { return err }
+
+  held, err := proc.heldLockFor(file, lock)
+  if err != nil { return err }
+
+  switch lock.Type {
+  case F_RDLCK:
+    if err := file.checkAccess(Read); err != nil { return err }
+  case F_WRLCK:
+    if err := file.checkAccess(Write); err != nil { return err }
+  case F_UNLCK:
+    locks.Lock()
+    file.inode.replaceLock(held, true)
+    locks.Unlock()
+    return nil
+  default:
+    return EINVAL
+  }
+
+  return file.inode.acquireLock(held, wait)
+}
+
+// Sets or clears a byte-range lock, failing with EAGAIN if another process
+// holds a conflicting one.
+func (proc *ProcState) SetLk(fd FileDescriptor, lock *Lock) error {
+  return proc.setLock(fd, lock, false)
+}
+
+// SetLk, but waiting for conflicting locks to be released.
+func (proc *ProcState) SetLkw(fd FileDescriptor, lock *Lock) error {
+  return proc.setLock(fd, lock, true)
+}
+
+// Replaces lock with the first lock that would stop it being taken, or sets
+// its Type to F_UNLCK if nothing would.
+func (proc *ProcState) GetLk(fd FileDescriptor, lock *Lock) error {
+  file, err := proc.lockableFile(fd)
+  if err != nil { return err }
+  if lock.Type != F_RDLCK && lock.Type != F_WRLCK { return EINVAL }
+
+  wanted, err := proc.heldLockFor(file, lock)
+  if err != nil { return err }
+
+  locks.Lock()
+  defer locks.Unlock()
+
+  held := file.inode.conflictingLock(wanted)
+  if held == nil {
+    lock.Type = F_UNLCK
+    return nil
+  }
+
+  lock.Type = F_RDLCK
+  if held.write { lock.Type = F_WRLCK }
+  lock.Whence, lock.Start, lock.Len, lock.Pid = SEEK_SET, held.start, 0, held.pid
+  if held.end != lockEOF { lock.Len = held.end - held.start }
+  return nil
+}
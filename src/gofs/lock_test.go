@@ -0,0 +1,136 @@
+package gofs
+
+import (
+  "testing"
+  "time"
+)
+
+func TestFlock(t *testing.T) {
+  p1, p2 := InitProc(), InitProc()
+  defer p1.Exit()
+  defer p2.Exit()
+  fd1 := p1.safeOpen(t, "/locked", O_RDWR|O_CREAT, UserMode())
+  fd2 := p2.safeOpen(t, "/locked", O_RDWR, UserMode())
+
+  AssertNoErr(t, p1.Flock(fd1, LOCK_EX))
+  AssertTrue(t, p2.Flock(fd2, LOCK_SH|LOCK_NB) == EAGAIN, "Expected EAGAIN.")
+  _, err := p2.Open("/locked", O_RDONLY|O_SHLOCK|O_NONBLOCK, UserMode())
+  AssertTrue(t, err == EAGAIN, "Opened with O_SHLOCK over an exclusive lock.")
+
+  // the lock belongs to the open file, so it lasts until its last descriptor
+  dup, err := p1.Dup(fd1)
+  AssertNoErr(t, err)
+  p1.safeClose(t, fd1)
+  AssertTrue(t, p2.Flock(fd2, LOCK_EX|LOCK_NB) == EAGAIN, "Lock lost with a dup open.")
+
+  done := make(chan error)
+  go func() {
+    fd, err := p2.Open("/locked", O_RDONLY|O_EXLOCK, UserMode())
+    if err == nil { err = p2.Close(fd) }
+    done <- err
+  }()
+
+  select {
+  case <-done:
+    t.Fatal("O_EXLOCK open didn't wait.")
+  case <-time.After(20 * time.Millisecond):
+  }
+
+  // Only the lock table is safe for concurrent use, so order the waiter's
+  // open before the close through it.
+  locks.Lock()
+  locks.Unlock()
+
+  p1.safeClose(t, dup)
+  AssertNoErr(t, <-done)
+
+  // shared locks coexist, and can be converted
+  AssertNoErr(t, p2.Flock(fd2, LOCK_SH))
+  fd1 = p1.safeOpen(t, "/locked", O_RDONLY|O_SHLOCK, UserMode())
+  AssertTrue(t, p2.Flock(fd2, LOCK_EX|LOCK_NB) == EAGAIN, "Expected EAGAIN.")
+  AssertNoErr(t, p1.Flock(fd1, LOCK_UN))
+  AssertNoErr(t, p2.Flock(fd2, LOCK_EX|LOCK_NB))
+  AssertTrue(t, p2.Flock(fd2, LOCK_SH|LOCK_EX) == EINVAL, "Expected EINVAL.")
+
+  p1.safeClose(t, fd1)
+  p2.safeClose(t, fd2)
+  p1.safeUnlink(t, "/locked")
+}
+
+func TestFcntlLocks(t *testing.T) {
+  p1, p2 := InitProc(), InitProc()
+  defer p1.Exit()
+  defer p2.Exit()
+  fd1 := p1.safeOpen(t, "/ranges", O_RDWR|O_CREAT, UserMode())
+  other := p1.safeOpen(t, "/ranges", O_RDONLY, UserMode())
+  fd2 := p2.safeOpen(t, "/ranges", O_RDWR, UserMode())
+  p1.safeWrite(t, fd1, []byte("data"))
+
+  AssertNoErr(t, p1.SetLk(fd1, &Lock{Type: F_WRLCK, Start: 0, Len: 10}))
+  AssertTrue(t, p2.SetLk(fd2, &Lock{Type: F_RDLCK, Start: 5, Len: 10}) == EAGAIN,
+    "Expected EAGAIN.")
+  AssertNoErr(t, p2.SetLk(fd2, &Lock{Type: F_RDLCK, Start: 10, Len: 10}))
+
+  lock := Lock{Type: F_RDLCK, Start: 5, Len: 10}
+  AssertNoErr(t, p2.GetLk(fd2, &lock))
+  AssertTrue(t, lock == Lock{Type: F_WRLCK, Start: 0, Len: 10, Pid: p1.Getpid()},
+    "GetLk didn't find the conflicting lock.")
+
+  // unlocking the middle splits the lock in two
+  AssertNoErr(t, p1.SetLk(fd1, &Lock{Type: F_UNLCK, Start: 3, Len: 4}))
+  AssertNoErr(t, p2.SetLk(fd2, &Lock{Type: F_RDLCK, Start: 3, Len: 4}))
+  lock = Lock{Type: F_WRLCK, Start: 2, Len: 3}
+  AssertNoErr(t, p1.GetLk(fd1, &lock))
+  AssertTrue(t, lock.Pid == p2.Getpid() && lock.Start == 3 && lock.Len == 4,
+    "Expected p2's lock in the gap.")
+
+  // write locks need a descriptor open for writing
+  AssertTrue(t, p1.SetLk(other, &Lock{Type: F_WRLCK, Start: 100}) == EBADF,
+    "Write locked a read-only descriptor.")
+
+  // closing any descriptor for the inode drops all of p1's locks
+  p1.safeClose(t, other)
+  AssertNoErr(t, p2.SetLk(fd2, &Lock{Type: F_WRLCK, Start: 0, Len: 0}))
+  lock = Lock{Type: F_RDLCK, Whence: SEEK_END, Start: -1, Len: 1}
+  AssertNoErr(t, p1.GetLk(fd1, &lock))
+  AssertTrue(t, lock.Type == F_WRLCK && lock.Len == 0, "Expected p2's lock to EOF.")
+
+  p1.safeClose(t, fd1)
+  p2.safeClose(t, fd2)
+  p1.safeUnlink(t, "/ranges")
+}
+
+func waitingOnLock(pid Pid) bool {
+  locks.Lock()
+  defer locks.Unlock()
+  _, waiting := locks.waiting[pid]
+  return waiting
+}
+
+func TestFcntlDeadlock(t *testing.T) {
+  p1, p2 := InitProc(), InitProc()
+  defer p2.Exit()
+  fd1 := p1.safeOpen(t, "/deadlock", O_RDWR|O_CREAT, UserMode())
+  fd2 := p2.safeOpen(t, "/deadlock", O_RDWR, UserMode())
+
+  AssertNoErr(t, p1.SetLk(fd1, &Lock{Type: F_WRLCK, Start: 0, Len: 1}))
+  AssertNoErr(t, p2.SetLk(fd2, &Lock{Type: F_WRLCK, Start: 1, Len: 1}))
+
+  done := make(chan error)
+  go func() {
+    done <- p1.SetLkw(fd1, &Lock{Type: F_WRLCK, Start: 1, Len: 1})
+  }()
+
+  for !waitingOnLock(p1.Getpid()) { time.Sleep(time.Millisecond) }
+  AssertTrue(t, p2.SetLkw(fd2, &Lock{Type: F_WRLCK, Start: 0, Len: 1}) == EDEADLK,
+    "Expected EDEADLK.")
+
+  AssertNoErr(t, p2.SetLk(fd2, &Lock{Type: F_UNLCK, Start: 1, Len: 1}))
+  AssertNoErr(t, <-done)
+
+  _, err := p1.Exit()
+  AssertNoErr(t, err)
+  AssertNoErr(t, p2.SetLk(fd2, &Lock{Type: F_WRLCK}))
+  p2.safeClose(t, fd2)
+  p2.safeUnlink(t, "/deadlock")
+}
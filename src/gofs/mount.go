@@ -0,0 +1,431 @@
+package gofs
+
+import (
+  "bytes"
+  "os"
+  "path/filepath"
+  "syscall"
+)
+
+/**
+* The tree is a stack of mounts, as in Linux. The root is a memfs mount made
+* with the global state; Mount puts the root of another file system over an
+* existing directory, which it covers until Unmount puts it back. Mounts can
+* cover mounts. Each mount is one of the types in filesystems:
+*
+*   memfs: directories and files in memory, like the root.
+*   tmpfs: memfs whose files may hold at most size bytes of data; writes past
+*          that are cut short, or fail with ENOSPC.
+*   host:  the host directory source, as in host.go.
+*   image: a read-only copy of the tree saved to the GoFS file source by
+*          MakeImage.
+*   overlay: a writable layer over the directory source, as in overlay.go.
+*   zip:   the zip archive in the GoFS file source, read-only, as in zip.go.
+*
+* Every inode knows the mount it's on. Its options apply to everything there:
+* MS_RDONLY fails changes with EROFS, MS_NOEXEC fails Access for X_OK on files.
+* Entries can't be linked or renamed from one mount to another (EXDEV), and
+* the root of a mount can't be unlinked or renamed at all while mounted (EBUSY).
+* Nor can a mount be unmounted while busy: while it has mounts on it, or some
+* process has its cwd or a file open there.
+*
+* Mounts are journaled with their options and checkpointed along with what they
+* cover; the contents of mounts in memory are checkpointed like the root's.
+*/
+
+type MountFlag uint
+const (
+  MS_RDONLY MountFlag = 1 << iota
+  MS_NOEXEC
+)
+
+type fsMount struct {
+  fstype string
+  source string
+  flags MountFlag
+  size int64 // the most bytes of data its files may hold, 0 if unlimited
+  used int64
+
+  root interface{} // a Directory, or a *HostDir
+  dir Directory // holding the mount point
+  name string
+  covered interface{} // what was at the mount point
+
+  seq int // its place in the mount table, as read from a checkpoint
+
+  lower Directory // an overlay's lower layer
+  archive []byte // a zip mount's archive
+  finding bool // whether lowerLayer is looking it up
+}
+
+// Makes the root of a new mount of source, which mnt describes.
+type mountFunc func(proc *ProcState, mnt *fsMount) error
+
+var filesystems = map[string]mountFunc{
+  "memfs": mountMemory,
+  "tmpfs": mountMemory,
+  "host": mountHostDir,
+  "image": mountImage,
+  "overlay": mountOverlay,
+  "zip": mountZip,
+}
+
+// Makes an empty directory the root of mnt, with mode perms.
+func (mnt *fsMount) newRoot(perms uint) Directory {
+  root := initDirectory(nil, "")
+  root.inode().fs = mnt
+  root.inode().perms = perms
+  mnt.root = root
+  return root
+}
+
+func mountMemory(proc *ProcState, mnt *fsMount) error {
+  // As with Linux, anyone may make files in a new tmpfs.
+  if mnt.fstype == "tmpfs" {
+    mnt.newRoot(01777)
+    return nil
+  }
+
+  if mnt.size != 0 { return EINVAL }
+  mnt.newRoot(0755)
+  return nil
+}
+
+func mountHostDir(proc *ProcState, mnt *fsMount) error {
+  if mnt.size != 0 { return EINVAL }
+
+  source, err := filepath.Abs(mnt.source)
+  if err != nil { return hostError(err) }
+  info, err := os.Stat(source)
+  if err != nil { return hostError(err) }
+  if !info.IsDir() { return ENOTDIR }
+
+  mnt.source = source
+  mnt.root = &HostDir{root: source, fs: mnt}
+  return nil
+}
+
+func (mnt *fsMount) readOnly() bool {
+  return (mnt.flags & MS_RDONLY) != 0
+}
+
+// Fails with EROFS if mnt is read-only.
+func (mnt *fsMount) checkWrite() error {
+  if mnt.readOnly() { return EROFS }
+  return nil
+}
+
+// Returns how many of grow more bytes of data mnt has room for.
+func (mnt *fsMount) room(grow int64) int64 {
+  if mnt.size == 0 { return grow }
+  return max(0, min(grow, mnt.size - mnt.used))
+}
+
+// Returns the mount entry is the root of, or nil if it isn't one.
+func mountRootOf(entry interface{}) *fsMount {
+  switch entry := entry.(type) {
+  case Directory:
+    if mnt := entry.inode().fs; sameEntry(mnt.root, entry) { return mnt }
+  case *HostDir:
+    return entry.fs
+  }
+
+  return nil
+}
+
+// Returns the mount entry, found in dir, is on.
+func mountOf(entry interface{}, dir Directory) *fsMount {
+  switch entry := entry.(type) {
+  case Directory:
+    return entry.inode().fs
+  case *Inode:
+    // Files an overlay finds below are on the overlay all the same.
+    if isOverlay(dir) { return dir.inode().fs }
+    return entry.fs
+  case *HostDir:
+    return entry.fs
+  case *hostEntry:
+    return entry.mount.fs
+  }
+
+  return dir.inode().fs
+}
+
+// Mounts a file system of type fstype from source over the directory target,
+// with flags, and for tmpfs, limited to size bytes of data if size isn't 0.
+// Only root may.
+func (proc *ProcState) Mount(source string, target string, fstype string,
+  flags MountFlag, size int64) error {
+  if proc.uid != 0 { return EPERM }
+  if (flags &^ (MS_RDONLY | MS_NOEXEC)) != 0 || size < 0 { return EINVAL }
+
+  create, ok := filesystems[fstype]
+  if !ok { return ENODEV }
+
+  mnt := &fsMount{fstype: fstype, source: source, flags: flags, size: size}
+  if err := create(proc, mnt); err != nil { return err }
+  if err := proc.mount(target, mnt); err != nil { return err }
+  return logMount(mnt)
+}
+
+// Mounts the host directory hostPath at path, read-only if readOnly.
+func (proc *ProcState) MountHost(path string, hostPath string, readOnly bool) error {
+  var flags MountFlag
+  if readOnly { flags = MS_RDONLY }
+  return proc.Mount(hostPath, path, "host", flags, 0)
+}
+
+// Puts mnt, its root made, over target.
+func (proc *ProcState) mount(target string, mnt *fsMount) error {
+  ref, err := proc.resolve(target, true)
+  if err != nil { return err }
+
+  switch entry := ref.entry.(type) {
+  case nil:
+    return ENOENT
+  case Directory:
+    if sameDirectory(entry, globalState.root) { return EBUSY }
+    // An overlay can't hide its own lower layer.
+    if mnt.lower != nil && entry.isAncestorOf(mnt.lower) { return EINVAL }
+
+    // For paths ending in '.' or '..', the mount point is the directory's
+    // name in its parent.
+    if !isEntryName(ref.name) { ref.dir, ref.name = entry.parent(), entry.header().name }
+  case *HostDir:
+  default:
+    return ENOTDIR
+  }
+
+  mnt.dir, mnt.name, mnt.covered = ref.dir, ref.name, ref.entry
+  if root, isDir := mnt.root.(Directory); isDir {
+    root[".."] = ref.dir
+    root.header().name = ref.name
+  }
+
+  ref.dir[ref.name] = mnt.root
+  globalState.mounts = append(globalState.mounts, mnt)
+  return nil
+}
+
+// Reports whether some process is using mnt, or another mount is on it.
+func (mnt *fsMount) busy() bool {
+  for _, other := range globalState.mounts {
+    if other != mnt && other.dir != nil && other.dir.inode().fs == mnt { return true }
+    if other.fstype == "overlay" {
+      if lower := other.lowerLayer(); lower != nil && lower.inode().fs == mnt { return true }
+    }
+  }
+
+  for _, proc := range globalState.procs {
+    if proc.cwd.inode().fs == mnt || proc.root.inode().fs == mnt { return true }
+    for _, file := range proc.fileDescriptorTable {
+      switch file := file.(type) {
+      case *DataFile:
+        if file.inode.fs == mnt || file.dir != nil && file.dir.inode().fs == mnt { return true }
+      case *DirFile:
+        if file.dir.inode().fs == mnt { return true }
+      case *hostFile:
+        if file.mount.fs == mnt { return true }
+      }
+    }
+  }
+
+  return false
+}
+
+// Unmounts the mount whose root target is, putting back what it covered. Only
+// root may.
+func (proc *ProcState) Unmount(target string) error {
+  if proc.uid != 0 { return EPERM }
+  mnt, err := proc.unmount(target)
+  if err != nil { return err }
+  return logPaths(recUnmount, mnt.point())
+}
+
+// Unmounts the mount whose root target is, and returns it.
+func (proc *ProcState) unmount(target string) (*fsMount, error) {
+  ref, err := proc.resolve(target, true)
+  if err != nil { return nil, err }
+  if ref.entry == nil { return nil, ENOENT }
+
+  mnt := mountRootOf(ref.entry)
+  if mnt == nil || mnt.dir == nil { return nil, EINVAL }
+  if mnt.busy() { return nil, EBUSY }
+
+  mnt.dir[mnt.name] = mnt.covered
+  for i, other := range globalState.mounts {
+    if other == mnt {
+      globalState.mounts = append(globalState.mounts[:i], globalState.mounts[i + 1:]...)
+      break
+    }
+  }
+
+  if root, isDir := mnt.root.(Directory); isDir { mnt.release(root) }
+  return mnt, nil
+}
+
+// Returns where mnt is, or was, mounted.
+func (mnt *fsMount) point() pathRef {
+  return pathRef{dir: mnt.dir, name: mnt.name}
+}
+
+// Drops the links dir, in the tree of mnt, which has been unmounted, holds to
+// its files, so that their pages go back to the arena. Nothing else can hold
+// them: unmounts wait for descriptors to close, and links don't cross mounts.
+func (mnt *fsMount) release(dir Directory) {
+  for _, name := range dir.names() {
+    switch entry := dir[name].(type) {
+    case Directory:
+      mnt.release(entry)
+    case *Inode:
+      if entry.fs == mnt { entry.decrementLinkCount() }
+    }
+  }
+}
+
+// A mount as Mounts lists it.
+type MountInfo struct {
+  Source string
+  Target string
+  Type string
+  Flags MountFlag
+  Size int64
+}
+
+// Returns the mounts that can be reached from proc's root, in the order they
+// were mounted, the root's first.
+func (proc *ProcState) Mounts() []MountInfo {
+  var mounts []MountInfo
+  for _, mnt := range globalState.mounts {
+    target, ok := pathRef{mnt.dir, mnt.name, mnt.root, false}.pathFrom(proc.root)
+    if !ok { continue }
+
+    mounts = append(mounts, MountInfo{Source: mnt.source, Target: target,
+      Type: mnt.fstype, Flags: mnt.flags, Size: mnt.size})
+  }
+
+  return mounts
+}
+
+// What Statfs reports of a mount.
+type Statfs_t struct {
+  Type string
+  Flags MountFlag
+  Size int64 // the most bytes of data it may hold, 0 if unlimited
+  Used int64 // bytes of data its files hold
+  Files int // inodes on it
+}
+
+// Returns the number of inodes reachable in dir, not counting those seen or on
+// other mounts.
+func countInodes(dir Directory, seen map[*Inode]bool) int {
+  count := 1
+  for _, name := range dir.names() {
+    switch entry := dir[name].(type) {
+    case Directory:
+      if sameDirectory(entry.parent(), dir) && mountRootOf(entry) == nil {
+        count += countInodes(entry, seen)
+      }
+    case *Inode:
+      if !seen[entry] { count++ }
+      seen[entry] = true
+    }
+  }
+
+  return count
+}
+
+// Returns the usage and options of the mount that what path names is on.
+func (proc *ProcState) Statfs(path string) (Statfs_t, error) {
+  ref, err := proc.resolveWithHost(path, true)
+  if err != nil { return Statfs_t{}, err }
+  if ref.entry == nil { return Statfs_t{}, ENOENT }
+  if host, isHost := ref.entry.(*hostEntry); isHost {
+    if _, err := host.stat(true); err != nil { return Statfs_t{}, err }
+  }
+
+  mnt := mountOf(ref.entry, ref.dir)
+  stat := Statfs_t{Type: mnt.fstype, Flags: mnt.flags, Size: mnt.size, Used: mnt.used}
+  switch root := mnt.root.(type) {
+  case Directory:
+    stat.Files = countInodes(root, make(map[*Inode]bool))
+  case *HostDir:
+    var host syscall.Statfs_t
+    if err := syscall.Statfs(root.root, &host); err != nil { return Statfs_t{}, hostError(err) }
+    stat.Size = int64(host.Blocks) * int64(host.Bsize)
+    stat.Used = int64(host.Blocks - host.Bfree) * int64(host.Bsize)
+    stat.Files = int(host.Files - host.Ffree)
+  }
+
+  return stat, nil
+}
+
+const imageMagic = "GOFSIMG"
+
+// Saves the tree at src, without what's mounted in it, to the file dst as an
+// image to mount. Only root may, since it copies what others may not read.
+func (proc *ProcState) MakeImage(src string, dst string) error {
+  if proc.uid != 0 { return EPERM }
+
+  ref, err := proc.resolve(src, true)
+  if err != nil { return err }
+  dir, isDir := ref.entry.(Directory)
+  if !isDir {
+    if ref.entry == nil { return ENOENT }
+    return ENOTDIR
+  }
+
+  var b recordBuffer
+  b.WriteString(imageMagic)
+  b.WriteByte(checkpointVersion)
+  encodeDirInode(&b, dir)
+  encodeDirectory(&b, dir, make(map[*Inode]bool), false)
+
+  fd, err := proc.Open(dst, O_WRONLY|O_CREAT|O_TRUNC, [3]FileMode{M_READ | M_WRITE, M_READ, M_READ})
+  if err != nil { return err }
+  _, err = proc.Write(fd, b.Bytes())
+  if cerr := proc.Close(fd); err == nil { err = cerr }
+  return err
+}
+
+// Returns the contents of the GoFS file a mount's source names.
+func (proc *ProcState) readSource(source string) ([]byte, error) {
+  file, err := proc.openFile(source, O_RDONLY, UserMode())
+  if err != nil { return nil, err }
+  defer file.Close()
+  data, isData := file.(*DataFile)
+  if !isData { return nil, EINVAL }
+
+  contents := make([]byte, data.Size())
+  _, err = data.ReadAt(contents, 0)
+  if len(contents) > 0 && err != nil { return nil, err }
+  return contents, nil
+}
+
+func mountImage(proc *ProcState, mnt *fsMount) error {
+  if mnt.size != 0 { return EINVAL }
+  mnt.flags |= MS_RDONLY
+
+  image, err := proc.readSource(mnt.source)
+  if err != nil { return err }
+
+  header := len(imageMagic) + 1
+  if len(image) < header || string(image[:len(imageMagic)]) != imageMagic ||
+  image[len(imageMagic)] != checkpointVersion {
+    return EINVAL
+  }
+
+  r := recordReader{bytes.NewReader(image[header:])}
+  root := mnt.newRoot(0755)
+  inodes := make(map[uint64]*Inode)
+  if err := decodeDirInode(r, root, inodes); err != nil { return EINVAL }
+  if err := decodeDirectory(r, root, inodes); err != nil { return EINVAL }
+
+  // The numbers saved are those of the tree the image was made from.
+  for _, inode := range inodes {
+    globalState.nextIno++
+    inode.ino = globalState.nextIno
+  }
+
+  return nil
+}
@@ -0,0 +1,197 @@
+package gofs
+
+import (
+  "archive/zip"
+  "bytes"
+  "gofs/dstore"
+  "testing"
+)
+
+func TestMountAndUnmount(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/m")
+  p.writeFile(t, "/m/covered", []byte("covered"))
+
+  AssertTrue(t, p.Mount("none", "/m", "nofs", 0, 0) == ENODEV, "Mounted an unknown type.")
+  AssertTrue(t, p.Mount("none", "/", "memfs", 0, 0) == EBUSY, "Mounted over the root.")
+  AssertTrue(t, p.Mount("none", "/m/covered", "memfs", 0, 0) == ENOTDIR, "Mounted on a file.")
+  AssertTrue(t, p.Mount("none", "/m", "memfs", 0, 100) == EINVAL, "Sized a memfs.")
+  AssertNoErr(t, p.Mount("none", "/m", "memfs", 0, 0))
+
+  // the mount hides what it covers until it's unmounted
+  entries, err := p.ReadDir("/m")
+  AssertTrue(t, err == nil && len(entries) == 0, "Mount didn't cover /m.")
+  p.safeMkdir(t, "/m/dir")
+  p.writeFile(t, "/m/dir/file", []byte("mounted"))
+  p.safeMkdir(t, "/other")
+
+  // nothing crosses mounts, and mount points stay put
+  AssertTrue(t, p.Link("/m/dir/file", "/other/file") == EXDEV, "Linked across mounts.")
+  AssertTrue(t, p.Rename("/m/dir/file", "/other/file") == EXDEV, "Renamed across mounts.")
+  AssertTrue(t, p.Rename("/m", "/other/m") == EBUSY, "Renamed a mount point.")
+  AssertTrue(t, p.Unlink("/m") == EBUSY, "Unlinked a mount point.")
+  p.safeRename(t, "/m/dir/file", "/m/file")
+
+  // '..' leaves the mount for the directory holding it
+  p.safeChdir(t, "/m/dir")
+  path, err := p.Realpath("../../other")
+  AssertTrue(t, err == nil && path == "/other", "Bad '..' from a mount: " + path)
+
+  // busy mounts stay
+  AssertTrue(t, p.Unmount("/m") == EBUSY, "Unmounted a cwd.")
+  p.safeChdir(t, "/")
+  fd := p.safeOpen(t, "/m/file", O_RDONLY, UserMode())
+  AssertTrue(t, p.Unmount("/m") == EBUSY, "Unmounted an open file.")
+  p.safeClose(t, fd)
+  other := InitProc()
+  other.safeChdir(t, "/m")
+  AssertTrue(t, p.Unmount("/m") == EBUSY, "Unmounted another's cwd.")
+  other.Exit()
+  AssertNoErr(t, p.Mount("none", "/m/dir", "memfs", 0, 0))
+  AssertTrue(t, p.Unmount("/m") == EBUSY, "Unmounted from under a mount.")
+  AssertNoErr(t, p.Unmount("/m/dir"))
+  AssertTrue(t, p.Unmount("/other") == EINVAL, "Unmounted a directory.")
+
+  mounts := p.Mounts()
+  AssertTrue(t, len(mounts) == 2 && mounts[0].Target == "/" &&
+    mounts[1] == MountInfo{Source: "none", Target: "/m", Type: "memfs"}, "Bad mount table.")
+
+  user, err := NewProc(ProcOptions{Uid: 1000, Gid: 1000})
+  AssertNoErr(t, err)
+  AssertTrue(t, user.Mount("none", "/other", "memfs", 0, 0) == EPERM, "Non-root mounted.")
+  AssertTrue(t, user.Unmount("/m") == EPERM, "Non-root unmounted.")
+  user.Exit()
+
+  AssertNoErr(t, p.Unmount("/m"))
+  AssertTrue(t, string(p.readFile(t, "/m/covered", 16)) == "covered", "Unmount lost /m.")
+  p.safeUnlink(t, "/m/covered")
+  p.safeUnlink(t, "/m")
+  p.safeUnlink(t, "/other")
+  p.Exit()
+}
+
+func TestMountOptions(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/tmp")
+  AssertNoErr(t, p.Mount("none", "/tmp", "tmpfs", MS_NOEXEC, 8192))
+
+  // writes stop at the size limit
+  fd := p.safeOpen(t, "/tmp/big", O_RDWR|O_CREAT, UserMode())
+  p.safeWrite(t, fd, randBytes(4096))
+  n, err := p.Write(fd, randBytes(8192))
+  AssertTrue(t, n == 4096 && err == nil, "Wrote past the size limit.")
+  _, err = p.Write(fd, []byte("x"))
+  AssertTrue(t, err == ENOSPC, "Full tmpfs took a write.")
+  AssertTrue(t, p.Ftruncate(fd, 8193) == ENOSPC, "Truncated past the size limit.")
+
+  stat, err := p.Statfs("/tmp/big")
+  AssertTrue(t, err == nil && stat == Statfs_t{Type: "tmpfs", Flags: MS_NOEXEC,
+    Size: 8192, Used: 8192, Files: 2}, "Bad Statfs of a full tmpfs.")
+
+  // space comes back when the last link and descriptor go
+  AssertNoErr(t, p.Ftruncate(fd, 4096))
+  p.safeUnlink(t, "/tmp/big")
+  stat, _ = p.Statfs("/tmp")
+  AssertTrue(t, stat.Used == 4096 && stat.Files == 1, "Unlinked open file lost its data.")
+  p.safeClose(t, fd)
+  stat, _ = p.Statfs("/tmp")
+  AssertTrue(t, stat.Used == 0, "Closed unlinked file kept its space.")
+
+  // noexec files can't be run, whatever their mode
+  fd = p.safeOpen(t, "/tmp/tool", O_RDWR|O_CREAT, UserMode())
+  p.safeClose(t, fd)
+  AssertTrue(t, p.Access("/tmp/tool", X_OK) == EACCES, "Ran a file on a noexec mount.")
+  AssertNoErr(t, p.Access("/tmp", X_OK))
+
+  // read-only mounts refuse every change
+  p.safeMkdir(t, "/tmp/ro")
+  AssertNoErr(t, p.Mount("none", "/tmp/ro", "memfs", MS_RDONLY, 0))
+  _, err = p.Open("/tmp/ro/file", O_RDWR|O_CREAT, UserMode())
+  AssertTrue(t, err == EROFS, "Created on a read-only mount.")
+  AssertTrue(t, p.Mkdir("/tmp/ro/dir") == EROFS, "Made a directory on a read-only mount.")
+  AssertTrue(t, p.Chmod("/tmp/ro", 0700) == EROFS, "Changed a read-only mount's root.")
+  AssertTrue(t, p.Setxattr("/tmp/ro", "user.a", []byte("a"), 0) == EROFS,
+    "Set an xattr on a read-only mount.")
+  AssertNoErr(t, p.Unmount("/tmp/ro"))
+
+  stat, err = p.Statfs("/")
+  AssertTrue(t, err == nil && stat.Type == "memfs" && stat.Size == 0, "Bad Statfs of the root.")
+  AssertNoErr(t, p.Unmount("/tmp"))
+  p.safeUnlink(t, "/tmp")
+  p.Exit()
+}
+
+func TestMountImage(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/base")
+  p.safeMkdir(t, "/base/etc")
+  content := randBytes(4096 + 12)
+  p.writeFile(t, "/base/etc/conf", content)
+  p.safeLink(t, "/base/etc/conf", "/base/conf")
+  AssertNoErr(t, p.Symlink("etc/conf", "/base/link"))
+  p.safeMkdir(t, "/base/mnt")
+  AssertNoErr(t, p.Mount("none", "/base/mnt", "memfs", 0, 0))
+  p.writeFile(t, "/base/mnt/skipped", []byte("skipped"))
+  AssertNoErr(t, p.MakeImage("/base", "/base.img"))
+
+  p.safeMkdir(t, "/image")
+  AssertNoErr(t, p.Mount("/base.img", "/image", "image", 0, 0))
+  AssertTrue(t, p.Mounts()[2].Flags == MS_RDONLY, "Image mounted writable.")
+  AssertEqualBytes(t, content, p.readFile(t, "/image/link", len(content)))
+
+  // copies of one inode stay one inode, numbered anew
+  a, err := p.Stat("/image/conf")
+  AssertNoErr(t, err)
+  b, err := p.Stat("/image/etc/conf")
+  AssertNoErr(t, err)
+  orig, err := p.Stat("/base/conf")
+  AssertNoErr(t, err)
+  AssertTrue(t, a.Ino == b.Ino && a.Nlink == 2 && a.Ino != orig.Ino, "Bad hard link in image.")
+
+  entries, err := p.ReadDir("/image/mnt")
+  AssertTrue(t, err == nil && len(entries) == 0, "Image crossed a mount.")
+  _, err = p.Open("/image/conf", O_WRONLY, UserMode())
+  AssertTrue(t, err == EROFS, "Opened an image file to write.")
+
+  p.writeFile(t, "/junk", []byte("junk"))
+  AssertTrue(t, p.Mount("/junk", "/image", "image", 0, 0) == EINVAL, "Mounted junk.")
+  AssertNoErr(t, p.Unmount("/image"))
+  AssertNoErr(t, p.Unmount("/base/mnt"))
+  for _, path := range []string{"/junk", "/base.img", "/image", "/base"} {
+    p.safeUnlink(t, path)
+  }
+
+  p.Exit()
+}
+
+func TestUnmountReleasesPages(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/m")
+  var archive bytes.Buffer
+  zw := zip.NewWriter(&archive)
+  w, err := zw.Create("big")
+  AssertNoErr(t, err)
+  w.Write(randBytes(256 << 10))
+  AssertNoErr(t, zw.Close())
+  p.writeFile(t, "/big.zip", archive.Bytes())
+
+  // the pages of what was in a mount go back when it goes
+  used := dstore.GlobalPageArena.Used()
+  for i := 0; i < 3; i++ {
+    AssertNoErr(t, p.Mount("none", "/m", "tmpfs", 0, 1 << 20))
+    p.safeMkdir(t, "/m/dir")
+    p.writeFile(t, "/m/dir/data", randBytes(256 << 10))
+    p.safeLink(t, "/m/dir/data", "/m/link")
+    AssertNoErr(t, p.Unmount("/m"))
+    AssertTrue(t, dstore.GlobalPageArena.Used() == used, "Unmounting a tmpfs leaked pages.")
+
+    AssertNoErr(t, p.Mount("/big.zip", "/m", "zip", 0, 0))
+    AssertTrue(t, len(p.readFile(t, "/m/big", 1 << 20)) == 256 << 10, "Bad zip read.")
+    AssertNoErr(t, p.Unmount("/m"))
+    AssertTrue(t, dstore.GlobalPageArena.Used() == used, "Unmounting a zip leaked pages.")
+  }
+
+  p.safeUnlink(t, "/big.zip")
+  p.safeUnlink(t, "/m")
+  p.Exit()
+}
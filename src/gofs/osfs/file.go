@@ -0,0 +1,185 @@
+package osfs
+
+import (
+  "gofs"
+  "io"
+  "io/fs"
+  "os"
+  "path"
+)
+
+// A file open on a descriptor of an FS's process, with *os.File's methods.
+type File struct {
+  fsys *FS
+  fd gofs.FileDescriptor
+  name string
+  flag int
+  closed bool
+
+  // What's left to list of a directory, once listing has begun.
+  entries []fs.FileInfo
+  listing bool
+}
+
+// Returns the name the file was opened with.
+func (file *File) Name() string {
+  return file.name
+}
+
+// Returns the descriptor the file holds.
+func (file *File) Fd() gofs.FileDescriptor {
+  return file.fd
+}
+
+func (file *File) check(op string) error {
+  if file == nil { return os.ErrInvalid }
+  if file.closed { return pathError(op, file.name, os.ErrClosed) }
+  return nil
+}
+
+// Wraps err as the os package would for op, leaving io.EOF as it is.
+func (file *File) error(op string, err error) error {
+  if err == nil || err == io.EOF { return err }
+  return pathError(op, file.name, err)
+}
+
+func (file *File) Read(b []byte) (int, error) {
+  if err := file.check("read"); err != nil { return 0, err }
+  if len(b) == 0 { return 0, nil }
+
+  n, err := file.fsys.proc.Read(file.fd, b)
+  return n, file.error("read", err)
+}
+
+// Reads len(b) bytes from offset off, or fails saying why it couldn't; io.EOF
+// if the file ends first.
+func (file *File) ReadAt(b []byte, off int64) (int, error) {
+  if err := file.check("read"); err != nil { return 0, err }
+  if off < 0 { return 0, file.error("readat", gofs.EINVAL) }
+
+  n := 0
+  for n < len(b) {
+    read, err := file.fsys.proc.Pread(file.fd, b[n:], off + int64(n))
+    n += read
+    if err != nil { return n, file.error("read", err) }
+  }
+
+  return n, nil
+}
+
+func (file *File) Write(b []byte) (int, error) {
+  if err := file.check("write"); err != nil { return 0, err }
+
+  n, err := file.fsys.proc.Write(file.fd, b)
+  if err == nil && n < len(b) { err = io.ErrShortWrite }
+  return n, file.error("write", err)
+}
+
+// Writes b at offset off, which files opened with O_APPEND don't allow.
+func (file *File) WriteAt(b []byte, off int64) (int, error) {
+  if err := file.check("write"); err != nil { return 0, err }
+  if (file.flag & os.O_APPEND) != 0 { return 0, errWriteAtInAppendMode }
+  if off < 0 { return 0, file.error("writeat", gofs.EINVAL) }
+
+  n := 0
+  for n < len(b) {
+    wrote, err := file.fsys.proc.Pwrite(file.fd, b[n:], off + int64(n))
+    n += wrote
+    if err != nil { return n, file.error("write", err) }
+    if wrote == 0 { return n, file.error("write", io.ErrShortWrite) }
+  }
+
+  return n, nil
+}
+
+func (file *File) WriteString(s string) (int, error) {
+  return file.Write([]byte(s))
+}
+
+func (file *File) Seek(offset int64, whence int) (int64, error) {
+  if err := file.check("seek"); err != nil { return 0, err }
+
+  ret, err := file.fsys.proc.Seek(file.fd, offset, whence)
+  if err == nil && ret < 0 { err = gofs.EINVAL }
+  return ret, file.error("seek", err)
+}
+
+func (file *File) Stat() (fs.FileInfo, error) {
+  if err := file.check("stat"); err != nil { return nil, err }
+
+  stat, err := file.fsys.proc.Fstat(file.fd)
+  if err != nil { return nil, file.error("stat", err) }
+  return gofs.FileInfoOf(path.Base(file.name), stat), nil
+}
+
+// Returns up to n more entries of the directory, or all of the rest if n <= 0.
+func (file *File) readdir(n int) ([]fs.FileInfo, error) {
+  if err := file.check("readdir"); err != nil { return nil, err }
+
+  // The directory is listed through the descriptor, so that a Chdir or a
+  // rename since it was opened doesn't change what's listed.
+  if !file.listing {
+    entries, stats, err := file.fsys.proc.FreadDir(file.fd)
+    if err != nil { return nil, file.error("readdir", err) }
+    for i, entry := range entries {
+      file.entries = append(file.entries, gofs.FileInfoOf(entry.Name, stats[i]))
+    }
+    file.listing = true
+  }
+
+  infos := file.entries
+  if n > 0 && len(infos) > n { infos = infos[:n] }
+  file.entries = file.entries[len(infos):]
+  if n > 0 && len(infos) == 0 { return nil, io.EOF }
+  return infos, nil
+}
+
+// Lists the directory as os.File.Readdir does: with n > 0, up to n entries and
+// io.EOF at the end; otherwise all that are left.
+func (file *File) Readdir(n int) ([]fs.FileInfo, error) {
+  return file.readdir(n)
+}
+
+// Readdir, but returning fs.DirEntrys, as os.File.ReadDir does.
+func (file *File) ReadDir(n int) ([]fs.DirEntry, error) {
+  infos, err := file.readdir(n)
+  entries := make([]fs.DirEntry, len(infos))
+  for i, info := range infos {
+    entries[i] = fs.FileInfoToDirEntry(info)
+  }
+
+  return entries, err
+}
+
+// Readdir, but returning only names.
+func (file *File) Readdirnames(n int) ([]string, error) {
+  infos, err := file.readdir(n)
+  names := make([]string, len(infos))
+  for i, info := range infos {
+    names[i] = info.Name()
+  }
+
+  return names, err
+}
+
+func (file *File) Truncate(size int64) error {
+  if err := file.check("truncate"); err != nil { return err }
+  return file.error("truncate", file.fsys.proc.Ftruncate(file.fd, size))
+}
+
+func (file *File) Sync() error {
+  if err := file.check("sync"); err != nil { return err }
+  return file.error("sync", file.fsys.proc.Fsync(file.fd))
+}
+
+func (file *File) Chmod(mode fs.FileMode) error {
+  if err := file.check("chmod"); err != nil { return err }
+  return file.error("chmod", file.fsys.proc.Fchmod(file.fd, modeBits(mode)))
+}
+
+func (file *File) Close() error {
+  if err := file.check("close"); err != nil { return err }
+
+  file.closed = true
+  return file.error("close", file.fsys.proc.Close(file.fd))
+}
@@ -0,0 +1,202 @@
+package osfs
+
+import (
+  "errors"
+  "gofs"
+  "io"
+  "io/fs"
+  "os"
+  "path"
+)
+
+/**
+* Package osfs offers the os package's file API over GoFS, so code written
+* against os.Create, os.OpenFile and *os.File can run on a GoFS tree with
+* little more than a change of receiver: fsys.Create(name) for os.Create(name).
+*
+* An FS is bound to one GoFS process, through which every call is made, with
+* its cwd, umask and credentials; a File holds one of its descriptors until
+* closed. Flags and modes are the os package's, and errors come back as
+* *fs.PathErrors around GoFS's errnos, so errors.Is(err, fs.ErrNotExist) and
+* the like work as they do with os. Like the process it's bound to, an FS is not
+* safe for concurrent use.
+*/
+
+type FS struct {
+  proc *gofs.ProcState
+}
+
+// Returns an FS making its calls as proc.
+func New(proc *gofs.ProcState) *FS {
+  return &FS{proc: proc}
+}
+
+var errWriteAtInAppendMode = errors.New("osfs: invalid use of WriteAt on file opened with O_APPEND")
+
+// Returns the GoFS flags for os flags.
+func accessFlags(flag int) gofs.AccessFlag {
+  var flags gofs.AccessFlag
+  switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+  case os.O_RDONLY:
+    flags = gofs.O_RDONLY
+  case os.O_WRONLY:
+    flags = gofs.O_WRONLY
+  default:
+    flags = gofs.O_RDWR
+  }
+
+  if (flag & os.O_APPEND) != 0 { flags |= gofs.O_APPEND }
+  if (flag & os.O_CREATE) != 0 { flags |= gofs.O_CREAT }
+  if (flag & os.O_EXCL) != 0 { flags |= gofs.O_EXCL }
+  if (flag & os.O_TRUNC) != 0 { flags |= gofs.O_TRUNC }
+  return flags
+}
+
+// Returns the mode bits of perm, setuid, setgid and sticky included.
+func modeBits(perm fs.FileMode) uint {
+  mode := uint(perm.Perm())
+  if (perm & fs.ModeSetuid) != 0 { mode |= gofs.S_ISUID }
+  if (perm & fs.ModeSetgid) != 0 { mode |= gofs.S_ISGID }
+  if (perm & fs.ModeSticky) != 0 { mode |= gofs.S_ISVTX }
+  return mode
+}
+
+func pathError(op string, name string, err error) error {
+  if err == nil { return nil }
+  return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// Opens name as os.OpenFile does, creating it with perm less the umask if
+// O_CREATE is given and it's missing.
+func (fsys *FS) OpenFile(name string, flag int, perm fs.FileMode) (*File, error) {
+  mode := uint(perm.Perm())
+  rwx := [3]gofs.FileMode{gofs.FileMode(mode >> 6), gofs.FileMode(mode >> 3 & 7),
+    gofs.FileMode(mode & 7)}
+
+  fd, err := fsys.proc.Open(name, accessFlags(flag), rwx)
+  if err != nil { return nil, pathError("open", name, err) }
+  return &File{fsys: fsys, fd: fd, name: name, flag: flag}, nil
+}
+
+// Opens name to read.
+func (fsys *FS) Open(name string) (*File, error) {
+  return fsys.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Creates name, or truncates it if it exists, and opens it to read and write.
+func (fsys *FS) Create(name string) (*File, error) {
+  return fsys.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+  stat, err := fsys.proc.Stat(name)
+  if err != nil { return nil, pathError("stat", name, err) }
+  return gofs.FileInfoOf(path.Base(name), stat), nil
+}
+
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+  stat, err := fsys.proc.Lstat(name)
+  if err != nil { return nil, pathError("lstat", name, err) }
+  return gofs.FileInfoOf(path.Base(name), stat), nil
+}
+
+// Makes the directory name with perm, less the umask.
+func (fsys *FS) Mkdir(name string, perm fs.FileMode) error {
+  if err := fsys.proc.Mkdir(name); err != nil { return pathError("mkdir", name, err) }
+  if perm.Perm() == 0777 && (perm & (fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)) == 0 {
+    return nil
+  }
+
+  // GoFS makes directories 0777 less the umask, or as a default ACL says;
+  // perm can only take bits away from that.
+  stat, err := fsys.proc.Stat(name)
+  if err == nil {
+    mode := stat.Mode & (uint(perm.Perm()) | gofs.S_ISGID) | modeBits(perm) &^ 0777
+    err = fsys.proc.Chmod(name, mode)
+  }
+
+  return pathError("mkdir", name, err)
+}
+
+// Makes the directory name and any missing parents, as os.MkdirAll does.
+func (fsys *FS) MkdirAll(name string, perm fs.FileMode) error {
+  stat, err := fsys.proc.Stat(name)
+  if err == nil {
+    if (stat.Mode & gofs.S_IFMT) == gofs.S_IFDIR { return nil }
+    return pathError("mkdir", name, gofs.ENOTDIR)
+  }
+
+  parent := path.Dir(path.Clean(name))
+  if parent != "." && parent != "/" && parent != path.Clean(name) {
+    if err := fsys.MkdirAll(parent, perm); err != nil { return err }
+  }
+
+  err = fsys.Mkdir(name, perm)
+  if err == nil { return nil }
+
+  // Someone may have made it meanwhile.
+  if stat, serr := fsys.proc.Lstat(name); serr == nil &&
+    (stat.Mode & gofs.S_IFMT) == gofs.S_IFDIR {
+    return nil
+  }
+
+  return err
+}
+
+// Removes the file or empty directory name.
+func (fsys *FS) Remove(name string) error {
+  stat, err := fsys.proc.Lstat(name)
+  if err != nil { return pathError("remove", name, err) }
+
+  if (stat.Mode & gofs.S_IFMT) == gofs.S_IFDIR {
+    entries, err := fsys.proc.ReadDir(name)
+    if err != nil { return pathError("remove", name, err) }
+    if len(entries) > 0 { return pathError("remove", name, gofs.ENOTEMPTY) }
+  }
+
+  return pathError("remove", name, fsys.proc.Unlink(name))
+}
+
+// Removes name and everything under it. A missing name is not an error.
+func (fsys *FS) RemoveAll(name string) error {
+  if name == "" { return nil }
+  if base := path.Base(name); base == "." || base == ".." {
+    return pathError("RemoveAll", name, gofs.EINVAL)
+  }
+
+  stat, err := fsys.proc.Lstat(name)
+  if errors.Is(err, gofs.ENOENT) { return nil }
+  if err != nil { return pathError("RemoveAll", name, err) }
+
+  if (stat.Mode & gofs.S_IFMT) == gofs.S_IFDIR {
+    entries, err := fsys.proc.ReadDir(name)
+    if err != nil { return pathError("RemoveAll", name, err) }
+    for _, entry := range entries {
+      if err := fsys.RemoveAll(path.Join(name, entry.Name)); err != nil { return err }
+    }
+  }
+
+  err = fsys.Remove(name)
+  if errors.Is(err, gofs.ENOENT) { return nil }
+  return err
+}
+
+// Returns the contents of the file name.
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+  file, err := fsys.Open(name)
+  if err != nil { return nil, err }
+  defer file.Close()
+
+  return io.ReadAll(file)
+}
+
+// Writes data to the file name, creating it with perm if it's missing and
+// truncating it otherwise.
+func (fsys *FS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+  file, err := fsys.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+  if err != nil { return err }
+
+  _, err = file.Write(data)
+  if cerr := file.Close(); err == nil { err = cerr }
+  return err
+}
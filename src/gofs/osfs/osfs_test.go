@@ -0,0 +1,128 @@
+package osfs
+
+import (
+  "errors"
+  "gofs"
+  "io"
+  "io/fs"
+  "os"
+  "strings"
+  "testing"
+)
+
+func check(t *testing.T, err error) {
+  t.Helper()
+  if err != nil { t.Fatal(err) }
+}
+
+func TestFile(t *testing.T) {
+  proc := gofs.InitProc()
+  defer proc.Exit()
+  fsys := New(proc)
+
+  f, err := fsys.Create("/notes")
+  check(t, err)
+  _, err = f.WriteString("hello, world")
+  check(t, err)
+  _, err = f.WriteAt([]byte("HELLO"), 0)
+  check(t, err)
+
+  buf := make([]byte, 5)
+  _, err = f.ReadAt(buf, 7)
+  check(t, err)
+  if string(buf) != "world" { t.Fatalf("ReadAt read %q", buf) }
+  if _, err = f.ReadAt(buf, 10); err != io.EOF { t.Fatalf("ReadAt past the end gave %v", err) }
+
+  _, err = f.Seek(0, io.SeekStart)
+  check(t, err)
+  data, err := io.ReadAll(f)
+  check(t, err)
+  if string(data) != "HELLO, world" { t.Fatalf("Read %q", data) }
+
+  check(t, f.Truncate(5))
+  check(t, f.Chmod(0600))
+  info, err := f.Stat()
+  check(t, err)
+  if info.Name() != "notes" || info.Size() != 5 || info.Mode() != 0600 {
+    t.Fatalf("Bad stat: %s %d %v", info.Name(), info.Size(), info.Mode())
+  }
+
+  check(t, f.Sync())
+  check(t, f.Close())
+  if err := f.Close(); !errors.Is(err, fs.ErrClosed) { t.Fatalf("Second close gave %v", err) }
+  if _, err := f.Read(buf); !errors.Is(err, fs.ErrClosed) { t.Fatalf("Read after close gave %v", err) }
+
+  f, err = fsys.OpenFile("/notes", os.O_WRONLY|os.O_APPEND, 0)
+  check(t, err)
+  _, err = f.Write([]byte("!"))
+  check(t, err)
+  if _, err := f.WriteAt([]byte("x"), 0); err == nil { t.Fatal("WriteAt in append mode.") }
+  check(t, f.Close())
+
+  data, err = fsys.ReadFile("/notes")
+  check(t, err)
+  if string(data) != "HELLO!" { t.Fatalf("ReadFile read %q", data) }
+  check(t, fsys.Remove("/notes"))
+}
+
+func TestDirectories(t *testing.T) {
+  proc := gofs.InitProc()
+  defer proc.Exit()
+  fsys := New(proc)
+
+  check(t, fsys.MkdirAll("/a/b/c", 0750))
+  check(t, fsys.MkdirAll("/a/b/c", 0750))
+  info, err := fsys.Stat("/a/b")
+  check(t, err)
+  if !info.IsDir() || info.Mode().Perm() != 0750 { t.Fatalf("Bad mode %v", info.Mode()) }
+
+  check(t, fsys.WriteFile("/a/b/one", []byte("1"), 0644))
+  check(t, fsys.WriteFile("/a/b/two", []byte("22"), 0644))
+  check(t, fsys.WriteFile("/a/b/two", []byte("2"), 0644))
+  data, err := fsys.ReadFile("/a/b/two")
+  check(t, err)
+  if string(data) != "2" { t.Fatalf("WriteFile didn't truncate: %q", data) }
+
+  if err := fsys.MkdirAll("/a/b/one/x", 0755); !errors.Is(err, gofs.ENOTDIR) {
+    t.Fatalf("MkdirAll through a file gave %v", err)
+  }
+
+  dir, err := fsys.Open("/a/b")
+  check(t, err)
+  infos, err := dir.Readdir(2)
+  check(t, err)
+  names, err := dir.Readdirnames(-1)
+  check(t, err)
+  if len(infos) != 2 || infos[0].Name() != "c" || !infos[0].IsDir() ||
+    len(names) != 1 || names[0] != "two" {
+    t.Fatalf("Bad listing: %v %v", infos, names)
+  }
+
+  if _, err := dir.Readdir(1); err != io.EOF { t.Fatalf("Listing didn't end: %v", err) }
+  check(t, dir.Close())
+
+  // what's listed is the directory opened, wherever it's gone since
+  check(t, proc.Chdir("/a"))
+  dir, err = fsys.Open("b")
+  check(t, err)
+  check(t, proc.Chdir("/"))
+  check(t, proc.Rename("/a/b", "/a/moved"))
+  names, err = dir.Readdirnames(-1)
+  if err != nil || strings.Join(names, " ") != "c one two" { t.Fatalf("Bad listing after a rename: %v %v", names, err) }
+  check(t, dir.Close())
+  check(t, proc.Rename("/a/moved", "/a/b"))
+
+  if err := fsys.Remove("/a/b"); !errors.Is(err, gofs.ENOTEMPTY) {
+    t.Fatalf("Removed a full directory: %v", err)
+  }
+
+  check(t, fsys.RemoveAll("/a"))
+  check(t, fsys.RemoveAll("/a"))
+  if _, err := fsys.Stat("/a"); !errors.Is(err, fs.ErrNotExist) { t.Fatalf("/a left: %v", err) }
+
+  _, err = fsys.Open("/missing")
+  var perr *fs.PathError
+  if !errors.As(err, &perr) || perr.Op != "open" || !errors.Is(err, fs.ErrNotExist) {
+    t.Fatalf("Bad error %v", err)
+  }
+}
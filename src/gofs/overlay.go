@@ -0,0 +1,235 @@
+package gofs
+
+import (
+  "sort"
+  "strings"
+)
+
+/**
+* An overlay mount lays a tree of its own, the upper layer, over a directory of
+* the tree, the lower layer, which its source names. The lower layer is never
+* changed through the overlay, so it can be the fixture a test starts from,
+* say, mounted read-only as an image. It works as Linux's overlayfs does:
+*
+*   Lookups look in the upper layer, then in the lower one.
+*   Changing a file of the lower layer first copies it up: its data and
+*   attributes, extended ones included, go to a new inode in the upper layer.
+*   Directories are copied up, empty, as soon as they're looked up, so that
+*   there is always an upper directory to make entries in.
+*   Unlinking or renaming away a name the lower layer has leaves a whiteout,
+*   a device node of the driver "whiteout", which hides it.
+*   A directory whose trusted.overlay.opaque attribute is "y" hides the lower
+*   directory of the same name. Directories made where a whiteout was, or moved
+*   over a lower directory, are made opaque.
+*   ReadDir lists both layers, less what's whited out or hidden.
+*
+* The upper layer is in memory, like a memfs, and goes with the mount. As in
+* Linux without redirect_dir, directories with something below them can't be
+* renamed (EXDEV). Descriptors keep the inode they opened, so one opened for
+* reading before a copy-up goes on reading the lower file, unless a change is
+* made through it, which copies it up and moves it to the copy. Copy-ups are
+* journaled, so that later records about the copy find it by its number.
+*/
+
+const overlayOpaque = "trusted.overlay.opaque"
+const whiteoutDriver = "whiteout"
+
+func mountOverlay(proc *ProcState, mnt *fsMount) error {
+  if mnt.size != 0 { return EINVAL }
+
+  ref, err := proc.resolve(mnt.source, true)
+  if err != nil { return err }
+  lower, isDir := ref.entry.(Directory)
+  if !isDir {
+    if ref.entry == nil { return ENOENT }
+    return ENOTDIR
+  }
+
+  source, ok := ref.absPath()
+  if !ok { return ENOENT }
+  mnt.source, mnt.lower = source, lower
+  copyAttrs(mnt.newRoot(0755).inode(), lower.inode())
+  return nil
+}
+
+func isOverlay(dir Directory) bool {
+  return dir.inode().fs.fstype == "overlay"
+}
+
+func isWhiteout(entry interface{}) bool {
+  dev, isDev := entry.(*Device)
+  return isDev && dev.driver == whiteoutDriver
+}
+
+// Returns the lower layer of the overlay mnt. A checkpoint only has its path,
+// and may hold the overlay before what that leads to, so it's looked up the
+// first time it's needed.
+func (mnt *fsMount) lowerLayer() Directory {
+  if mnt.lower != nil || mnt.finding { return mnt.lower }
+
+  // Lookups through the overlay itself find nothing below while it's found.
+  mnt.finding = true
+  links := 0
+  ref, err := (&ProcState{root: globalState.root}).walk(globalState.root, mnt.source, true, &links)
+  if lower, isDir := ref.entry.(Directory); err == nil && isDir { mnt.lower = lower }
+  mnt.finding = false
+  return mnt.lower
+}
+
+// Returns the directory of the lower layer under dir, an upper directory of an
+// overlay, or nil if there is none or dir is opaque.
+func lowerOf(dir Directory) Directory {
+  if !isOverlay(dir) { return nil }
+  if value, _ := dir.inode().getxattr(overlayOpaque); string(value) == "y" { return nil }
+
+  mnt := dir.inode().fs
+  if sameEntry(mnt.root, dir) { return mnt.lowerLayer() }
+
+  parent := lowerOf(dir.parent())
+  if parent == nil { return nil }
+  lower, _ := parent[dir.header().name].(Directory)
+  return lower
+}
+
+// Looks name up in dir, falling through to the lower layer on an overlay. A
+// directory found only there is copied up, so that lookups go on from it in
+// the upper layer.
+func lookup(dir Directory, name string) (interface{}, bool) {
+  entry, ok := dir[name]
+  if !isOverlay(dir) { return entry, ok }
+  if ok {
+    if isWhiteout(entry) { return nil, false }
+    return entry, true
+  }
+
+  lower := lowerOf(dir)
+  if lower == nil || !isEntryName(name) { return nil, false }
+  entry, ok = lower[name]
+  if !ok || isWhiteout(entry) { return nil, false }
+
+  if sub, isDir := entry.(Directory); isDir {
+    upper := initDirectory(dir, name)
+    copyAttrs(upper.inode(), sub.inode())
+    dir[name] = upper
+    return upper, true
+  }
+
+  return entry, true
+}
+
+// Returns the names lookups find in dir, sorted: on an overlay, those of both
+// layers, less what's whited out.
+func (dir Directory) visibleNames() []string {
+  names := dir.names()
+  if !isOverlay(dir) { return names }
+
+  upper := make(map[string]bool)
+  var visible []string
+  for _, name := range names {
+    upper[name] = true
+    if !isWhiteout(dir[name]) { visible = append(visible, name) }
+  }
+
+  if lower := lowerOf(dir); lower != nil {
+    for _, name := range lower.names() {
+      if !upper[name] && !isWhiteout(lower[name]) { visible = append(visible, name) }
+    }
+  }
+
+  sort.Strings(visible)
+  return visible
+}
+
+// Gives dst the attributes of src, but for the overlay's own.
+func copyAttrs(dst *Inode, src *Inode) {
+  dst.perms, dst.ownerId, dst.groupId = src.perms, src.ownerId, src.groupId
+  dst.lastAccessTime, dst.lastModTime = src.lastAccessTime, src.lastModTime
+  dst.changeTime, dst.createTime = src.changeTime, src.createTime
+  dst.acl = append(ACL(nil), src.acl...)
+  dst.defaultACL = append(ACL(nil), src.defaultACL...)
+
+  for name, value := range src.xattrs {
+    if !strings.HasPrefix(name, "trusted.overlay.") { dst.setxattr(name, value, 0) }
+  }
+}
+
+// If ref names a file an overlay found in its lower layer, copies it up so that
+// it can be changed, pointing ref at the copy.
+func (proc *ProcState) copyUp(ref *pathRef) error {
+  lower, isInode := ref.entry.(*Inode)
+  if !isInode || !isOverlay(ref.dir) { return nil }
+  mnt := ref.dir.inode().fs
+  if lower.fs == mnt { return nil }
+  if err := mnt.checkWrite(); err != nil { return err }
+
+  inode := initInode()
+  inode.fs = mnt
+  copyAttrs(inode, lower)
+  if size := lower.data.Size(); size > 0 {
+    data := make([]byte, size)
+    lower.data.Read(0, data)
+    inode.write(0, data)
+  }
+
+  ref.dir[ref.name] = inode
+  ref.entry = inode
+  return logCopyUp(*ref, inode)
+}
+
+// inodeAt, for calls that change the inode: on an overlay, it's copied up.
+func (proc *ProcState) changeableAt(path string, follow bool) (pathRef, *Inode, error) {
+  ref, inode, err := proc.inodeAt(path, follow)
+  if err != nil { return ref, nil, err }
+
+  // Directories are copied up by lookups, which aren't journaled, so records
+  // of changes to them need one to find them by.
+  if dir, isDir := ref.entry.(Directory); isDir && isOverlay(dir) {
+    return ref, inode, logCopyUp(ref, inode)
+  }
+
+  if err := proc.copyUp(&ref); err != nil { return ref, nil, err }
+  return ref, inodeOf(ref.entry), nil
+}
+
+// inodeOfFd, for calls that change the inode. A file an overlay opened from its
+// lower layer is copied up, as changeableAt would, and the descriptor goes on
+// with the copy; if its name has since gone to something else, there's nothing
+// to copy it up to, and the lower file can't be changed (EROFS).
+func (proc *ProcState) changeableOfFd(fd FileDescriptor) (pathRef, *Inode, error) {
+  ref, inode, err := proc.inodeOfFd(fd)
+  if err != nil { return ref, nil, err }
+  if dir, isDir := ref.entry.(Directory); isDir && isOverlay(dir) {
+    return ref, inode, logCopyUp(ref, inode)
+  }
+
+  file, _ := proc.getFile(fd)
+  data, isData := file.(*DataFile)
+  if !isData || data.dir == nil || !isOverlay(data.dir) || inode.fs == data.dir.inode().fs {
+    return ref, inode, nil
+  }
+  if entry, _ := lookup(data.dir, data.name); entry != inode { return ref, nil, EROFS }
+
+  if err := proc.copyUp(&ref); err != nil { return ref, nil, err }
+  data.inode = ref.entry.(*Inode)
+  moveLocks(data, inode, data.inode)
+  return ref, data.inode, nil
+}
+
+// Hides what the lower layer has at name, once dir, on an overlay, has
+// nothing there.
+func whiteout(dir Directory, name string) {
+  if lower := lowerOf(dir); lower != nil {
+    if _, below := lower[name]; below { dir[name] = &Device{driver: whiteoutDriver} }
+  }
+}
+
+// Makes the directory just put at name in dir opaque if there's a directory of
+// that name below, whose entries would otherwise show through.
+func makeOpaque(dir Directory, name string) {
+  sub, isDir := dir[name].(Directory)
+  if !isDir { return }
+
+  if lower := lowerOf(dir); lower != nil {
+    if _, below := lower[name].(Directory); below { sub.inode().setxattr(overlayOpaque, []byte("y"), 0) }
+  }
+}
@@ -0,0 +1,147 @@
+package gofs
+
+import (
+  "testing"
+)
+
+func direntNames(t *testing.T, p *ProcState, path string) []string {
+  entries, err := p.ReadDir(path)
+  AssertNoErr(t, err)
+
+  names := make([]string, len(entries))
+  for i, entry := range entries {
+    names[i] = entry.Name
+  }
+
+  return names
+}
+
+func sameNames(a []string, b ...string) bool {
+  if len(a) != len(b) { return false }
+  for i := range a {
+    if a[i] != b[i] { return false }
+  }
+
+  return true
+}
+
+func TestOverlay(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/fixture")
+  p.safeMkdir(t, "/fixture/etc")
+  p.writeFile(t, "/fixture/etc/conf", []byte("lower"))
+  p.writeFile(t, "/fixture/etc/hosts", []byte("hosts"))
+  p.safeMkdir(t, "/fixture/var")
+  p.writeFile(t, "/fixture/var/log", []byte("log"))
+  p.safeMkdir(t, "/fixture/cache")
+  p.writeFile(t, "/fixture/cache/old", []byte("old"))
+  AssertNoErr(t, p.Setxattr("/fixture/etc/conf", "user.tag", []byte("conf"), 0))
+  AssertNoErr(t, p.MakeImage("/fixture", "/fixture.img"))
+  p.safeMkdir(t, "/base")
+  AssertNoErr(t, p.Mount("/fixture.img", "/base", "image", 0, 0))
+
+  AssertTrue(t, p.Mount("/fixture.img", "/base", "overlay", 0, 0) == ENOTDIR,
+    "Laid an overlay over a file.")
+  AssertTrue(t, p.Mount("/base", "/", "overlay", 0, 0) == EBUSY, "Laid an overlay over the root.")
+  p.safeMkdir(t, "/work")
+  AssertNoErr(t, p.Mount("/base", "/work", "overlay", 0, 0))
+  AssertTrue(t, p.Unmount("/base") == EBUSY, "Unmounted an overlay's lower layer.")
+
+  // lookups fall through, and writes copy up
+  AssertTrue(t, string(p.readFile(t, "/work/etc/conf", 16)) == "lower", "Lookup didn't fall through.")
+  fd := p.safeOpen(t, "/work/etc/conf", O_RDWR|O_TRUNC, UserMode())
+  p.safeWrite(t, fd, []byte("upper"))
+  p.safeClose(t, fd)
+  AssertTrue(t, string(p.readFile(t, "/work/etc/conf", 16)) == "upper", "Write wasn't seen.")
+  AssertTrue(t, string(p.readFile(t, "/base/etc/conf", 16)) == "lower", "Write reached below.")
+  tag, err := p.Getxattr("/work/etc/conf", "user.tag")
+  AssertTrue(t, err == nil && string(tag) == "conf", "Copy-up lost an xattr.")
+  AssertNoErr(t, p.Chmod("/work/etc/hosts", 0600))
+  stat, err := p.Stat("/base/etc/hosts")
+  AssertTrue(t, err == nil && stat.Mode & 0777 != 0600, "Chmod reached below.")
+
+  // deletions leave whiteouts
+  p.safeUnlink(t, "/work/var/log")
+  _, err = p.Stat("/work/var/log")
+  AssertTrue(t, err == ENOENT, "Unlinked file still there.")
+  AssertTrue(t, sameNames(direntNames(t, p, "/work/var")), "Whiteout was listed.")
+  p.writeFile(t, "/work/var/log", []byte("new log"))
+  AssertTrue(t, string(p.readFile(t, "/work/var/log", 16)) == "new log", "Whiteout wasn't replaced.")
+
+  // directories made where one was, or marked so, hide what's below
+  p.safeUnlink(t, "/work/cache")
+  p.safeMkdir(t, "/work/cache")
+  AssertTrue(t, sameNames(direntNames(t, p, "/work/cache")), "New directory showed the old one.")
+  AssertNoErr(t, p.Setxattr("/work/etc", overlayOpaque, []byte("y"), 0))
+  AssertTrue(t, sameNames(direntNames(t, p, "/work/etc"), "conf", "hosts"), "Opaque hid copied-up files.")
+  AssertNoErr(t, p.Removexattr("/work/etc", overlayOpaque))
+
+  // ReadDir merges the layers
+  p.writeFile(t, "/work/etc/added", []byte("added"))
+  p.safeRename(t, "/work/etc/hosts", "/work/hosts")
+  AssertTrue(t, sameNames(direntNames(t, p, "/work/etc"), "added", "conf"), "Bad merged listing.")
+  AssertTrue(t, sameNames(direntNames(t, p, "/work"), "cache", "etc", "hosts", "var"),
+    "Bad merged root listing.")
+  AssertTrue(t, p.Rename("/work/etc", "/work/etc2") == EXDEV, "Renamed a merged directory.")
+  AssertTrue(t, p.Rename("/work/etc/added", "/work/etc/conf") == nil, "Couldn't replace a file.")
+  AssertTrue(t, p.Unlink("/work/etc/conf") == nil, "Couldn't unlink a replaced file.")
+  _, err = p.Stat("/work/etc/conf")
+  AssertTrue(t, err == ENOENT, "Unlinked copy let the lower file show.")
+
+  stat, err = p.Stat("/base/etc/hosts")
+  AssertTrue(t, err == nil && stat.Nlink == 1, "Rename changed the lower file.")
+  AssertTrue(t, sameNames(direntNames(t, p, "/base/etc"), "conf", "hosts"), "Changes reached below.")
+
+  // the upper layer goes with the mount
+  AssertNoErr(t, p.Unmount("/work"))
+  AssertNoErr(t, p.Mount("/base", "/work", "overlay", MS_RDONLY, 0))
+  AssertTrue(t, string(p.readFile(t, "/work/etc/conf", 16)) == "lower", "Upper layer outlived its mount.")
+  _, err = p.Open("/work/etc/conf", O_RDWR, UserMode())
+  AssertTrue(t, err == EROFS, "Copied up on a read-only overlay.")
+  AssertNoErr(t, p.Unmount("/work"))
+  AssertNoErr(t, p.Unmount("/base"))
+  for _, path := range []string{"/work", "/base", "/fixture.img", "/fixture"} {
+    p.safeUnlink(t, path)
+  }
+
+  p.Exit()
+}
+
+func TestOverlayDescriptorChanges(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/lo")
+  p.writeFile(t, "/lo/f", []byte("lower"))
+  p.writeFile(t, "/lo/g", []byte("gone"))
+  AssertNoErr(t, p.Chmod("/lo/f", 0644))
+  p.safeMkdir(t, "/ov")
+  AssertNoErr(t, p.Mount("/lo", "/ov", "overlay", 0, 0))
+
+  // changes through a descriptor opened for reading copy up too
+  fd := p.safeOpen(t, "/ov/f", O_RDONLY, UserMode())
+  AssertNoErr(t, p.Fchmod(fd, 0600))
+  AssertNoErr(t, p.Fsetxattr(fd, "user.tag", []byte("upper"), 0))
+  stat, err := p.Stat("/lo/f")
+  AssertTrue(t, err == nil && stat.Mode & 0777 == 0644, "Fchmod reached below.")
+  _, err = p.Getxattr("/lo/f", "user.tag")
+  AssertTrue(t, err == ENODATA, "Fsetxattr reached below.")
+  stat, err = p.Stat("/ov/f")
+  AssertTrue(t, err == nil && stat.Mode & 0777 == 0600, "Fchmod wasn't seen.")
+  fstat, err := p.Fstat(fd)
+  AssertTrue(t, err == nil && fstat.Ino == stat.Ino, "Descriptor stayed below.")
+  buf := make([]byte, 16)
+  n, err := p.Pread(fd, buf, 0)
+  AssertTrue(t, string(buf[:n]) == "lower", "Copy lost its data.")
+  p.safeClose(t, fd)
+
+  // once the name has gone elsewhere, there's nothing to copy up to
+  fd = p.safeOpen(t, "/ov/g", O_RDONLY, UserMode())
+  p.safeUnlink(t, "/ov/g")
+  AssertTrue(t, p.Fchmod(fd, 0600) == EROFS, "Changed a lower file with no name above.")
+  p.safeClose(t, fd)
+
+  AssertNoErr(t, p.Unmount("/ov"))
+  for _, path := range []string{"/ov", "/lo/f", "/lo/g", "/lo"} {
+    p.safeUnlink(t, path)
+  }
+  p.Exit()
+}
@@ -0,0 +1,356 @@
+package p9
+
+import (
+  "errors"
+  "io"
+  "net"
+  "sync"
+  "syscall"
+)
+
+// A connection to a 9P2000.L server. Its calls are made one at a time; errors
+// the server sends back are syscall.Errnos, so GoFS's, like gofs.ENOENT.
+type Client struct {
+  rw io.ReadWriteCloser
+  mu sync.Mutex
+  msize uint32
+  lastFid uint32
+}
+
+// A fid of a Client's.
+type Fid struct {
+  c *Client
+  num uint32
+}
+
+var errBadReply = errors.New("p9: bad reply")
+
+// Connects to the server at addr on network, "tcp" or "unix".
+func Dial(network string, addr string) (*Client, error) {
+  conn, err := net.Dial(network, addr)
+  if err != nil { return nil, err }
+  return NewClient(conn)
+}
+
+// Starts a session over rw, which the Client closes when it's closed.
+func NewClient(rw io.ReadWriteCloser) (*Client, error) {
+  c := &Client{rw: rw, msize: MaxMessageSize}
+
+  var b msgBuffer
+  b.put32(c.msize)
+  b.putString(Version)
+  r, err := c.rpc(tversion, b)
+  if err == nil {
+    c.msize = r.get32()
+    if r.getString() != Version || r.err != nil { err = errors.New("p9: server doesn't speak " + Version) }
+  }
+
+  if err != nil {
+    rw.Close()
+    return nil, err
+  }
+  return c, nil
+}
+
+func (c *Client) Close() error {
+  return c.rw.Close()
+}
+
+// Sends a message of type typ with body and returns the reply's body.
+func (c *Client) rpc(typ msgType, body msgBuffer) (*msgReader, error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+
+  tag := uint16(0)
+  if typ == tversion { tag = noTag }
+  if _, err := c.rw.Write(frame(typ, tag, body)); err != nil { return nil, err }
+
+  reply, replyTag, r, err := readMessage(c.rw, c.msize)
+  if err != nil { return nil, err }
+  if replyTag != tag { return nil, errBadReply }
+  if reply == rlerror {
+    errno := r.get32()
+    if r.err != nil { return nil, errBadReply }
+    return nil, syscall.Errno(errno)
+  }
+
+  if reply != typ + 1 { return nil, errBadReply }
+  return r, nil
+}
+
+// Returns an error if r was too short for what was read of it.
+func replied(r *msgReader) error {
+  if r.err != nil { return errBadReply }
+  return nil
+}
+
+func (c *Client) newFid() *Fid {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.lastFid++
+  return &Fid{c: c, num: c.lastFid}
+}
+
+// Attaches to the tree at aname on the server, "" for its root.
+func (c *Client) Attach(aname string) (*Fid, Qid, error) {
+  f := c.newFid()
+  var b msgBuffer
+  b.put32(f.num)
+  b.put32(NoFid)
+  b.putString("")
+  b.putString(aname)
+  b.put32(NoFid)
+
+  r, err := c.rpc(tattach, b)
+  if err != nil { return nil, Qid{}, err }
+  qid := r.getQid()
+  return f, qid, replied(r)
+}
+
+// Returns a new fid for what names lead to from f, and their Qids. If only
+// some are found, there is no fid, and the Qids are of those found.
+func (f *Fid) Walk(names ...string) (*Fid, []Qid, error) {
+  walked := f.c.newFid()
+  var b msgBuffer
+  b.put32(f.num)
+  b.put32(walked.num)
+  b.put16(uint16(len(names)))
+  for _, name := range names {
+    b.putString(name)
+  }
+
+  r, err := f.c.rpc(twalk, b)
+  if err != nil { return nil, nil, err }
+  qids := make([]Qid, r.get16())
+  for i := range qids {
+    qids[i] = r.getQid()
+  }
+  if err := replied(r); err != nil { return nil, nil, err }
+
+  if len(qids) < len(names) { return nil, qids, syscall.ENOENT }
+  return walked, qids, nil
+}
+
+// Opens what f names with flags, O_RDONLY and the like.
+func (f *Fid) Open(flags uint32) (Qid, error) {
+  var b msgBuffer
+  b.put32(f.num)
+  b.put32(flags)
+  return f.opened(tlopen, b)
+}
+
+// Creates name in the directory f names with flags and mode and opens it; f
+// then names it.
+func (f *Fid) Create(name string, flags uint32, mode uint32) (Qid, error) {
+  var b msgBuffer
+  b.put32(f.num)
+  b.putString(name)
+  b.put32(flags)
+  b.put32(mode)
+  b.put32(0)
+  return f.opened(tlcreate, b)
+}
+
+func (f *Fid) opened(typ msgType, b msgBuffer) (Qid, error) {
+  r, err := f.c.rpc(typ, b)
+  if err != nil { return Qid{}, err }
+  qid := r.getQid()
+  r.get32()
+  return qid, replied(r)
+}
+
+// Reads from offset off of what f has open, as io.ReaderAt does.
+func (f *Fid) ReadAt(p []byte, off int64) (int, error) {
+  read := 0
+  for read < len(p) {
+    var b msgBuffer
+    b.put32(f.num)
+    b.put64(uint64(off) + uint64(read))
+    b.put32(uint32(min(len(p) - read, int(f.c.msize) - 11)))
+
+    r, err := f.c.rpc(tread, b)
+    if err != nil { return read, err }
+    data := r.take(int(r.get32()))
+    if err := replied(r); err != nil { return read, err }
+    if len(data) == 0 { return read, io.EOF }
+    read += copy(p[read:], data)
+  }
+
+  return read, nil
+}
+
+// Writes at offset off of what f has open.
+func (f *Fid) WriteAt(p []byte, off int64) (int, error) {
+  wrote := 0
+  for wrote < len(p) {
+    chunk := p[wrote:][:min(len(p) - wrote, int(f.c.msize) - 23)]
+    var b msgBuffer
+    b.put32(f.num)
+    b.put64(uint64(off) + uint64(wrote))
+    b.put32(uint32(len(chunk)))
+    b = append(b, chunk...)
+
+    r, err := f.c.rpc(twrite, b)
+    if err != nil { return wrote, err }
+    n := r.get32()
+    if err := replied(r); err != nil { return wrote, err }
+    if n == 0 { return wrote, io.ErrShortWrite }
+    wrote += int(n)
+  }
+
+  return wrote, nil
+}
+
+// Returns the entries of the open directory f names, '.' and '..' included.
+func (f *Fid) Readdir() ([]Dirent, error) {
+  var dirents []Dirent
+  off := uint64(0)
+  for {
+    var b msgBuffer
+    b.put32(f.num)
+    b.put64(off)
+    b.put32(f.c.msize - 11)
+
+    r, err := f.c.rpc(treaddir, b)
+    if err != nil { return nil, err }
+    data := &msgReader{b: r.take(int(r.get32()))}
+    if err := replied(r); err != nil { return nil, err }
+    if len(data.b) == 0 { return dirents, nil }
+
+    for len(data.b) > 0 {
+      dirent := Dirent{Qid: data.getQid(), Offset: data.get64(), Type: data.get8(),
+        Name: data.getString()}
+      if err := replied(data); err != nil { return nil, err }
+      dirents = append(dirents, dirent)
+      off = dirent.Offset
+    }
+  }
+}
+
+// Returns the attributes of what f names.
+func (f *Fid) Getattr() (Attr, error) {
+  var b msgBuffer
+  b.put32(f.num)
+  b.put64(GETATTR_BASIC | GETATTR_BTIME)
+
+  r, err := f.c.rpc(tgetattr, b)
+  if err != nil { return Attr{}, err }
+  attr := Attr{Valid: r.get64(), Qid: r.getQid(), Mode: r.get32(), Uid: r.get32(),
+    Gid: r.get32(), Nlink: r.get64(), Rdev: r.get64(), Size: r.get64(),
+    BlockSize: r.get64(), Blocks: r.get64(), Atime: r.getTime(), Mtime: r.getTime(),
+    Ctime: r.getTime(), Btime: r.getTime()}
+  return attr, replied(r)
+}
+
+// Sets the attributes of what f names that attr.Valid says to.
+func (f *Fid) Setattr(attr SetAttr) error {
+  var b msgBuffer
+  b.put32(f.num)
+  b.put32(attr.Valid)
+  b.put32(attr.Mode)
+  b.put32(attr.Uid)
+  b.put32(attr.Gid)
+  b.put64(attr.Size)
+  b.putTime(attr.Atime)
+  b.putTime(attr.Mtime)
+
+  _, err := f.c.rpc(tsetattr, b)
+  return err
+}
+
+// Makes the directory name, with mode, in the directory f names.
+func (f *Fid) Mkdir(name string, mode uint32) (Qid, error) {
+  var b msgBuffer
+  b.put32(f.num)
+  b.putString(name)
+  b.put32(mode)
+  b.put32(0)
+  return f.c.made(tmkdir, b)
+}
+
+// Makes a symlink to target at name, in the directory f names.
+func (f *Fid) Symlink(name string, target string) (Qid, error) {
+  var b msgBuffer
+  b.put32(f.num)
+  b.putString(name)
+  b.putString(target)
+  b.put32(0)
+  return f.c.made(tsymlink, b)
+}
+
+func (c *Client) made(typ msgType, b msgBuffer) (Qid, error) {
+  r, err := c.rpc(typ, b)
+  if err != nil { return Qid{}, err }
+  qid := r.getQid()
+  return qid, replied(r)
+}
+
+// Returns the target of the symlink f names.
+func (f *Fid) Readlink() (string, error) {
+  var b msgBuffer
+  b.put32(f.num)
+
+  r, err := f.c.rpc(treadlink, b)
+  if err != nil { return "", err }
+  target := r.getString()
+  return target, replied(r)
+}
+
+// Links what target names as name, in the directory f names.
+func (f *Fid) Link(target *Fid, name string) error {
+  var b msgBuffer
+  b.put32(f.num)
+  b.put32(target.num)
+  b.putString(name)
+
+  _, err := f.c.rpc(tlink, b)
+  return err
+}
+
+// Renames oldName, in the directory f names, to newName in newDir's.
+func (f *Fid) Renameat(oldName string, newDir *Fid, newName string) error {
+  var b msgBuffer
+  b.put32(f.num)
+  b.putString(oldName)
+  b.put32(newDir.num)
+  b.putString(newName)
+
+  _, err := f.c.rpc(trenameat, b)
+  return err
+}
+
+// Unlinks name from the directory f names; flags must be AT_REMOVEDIR for a
+// directory, 0 otherwise.
+func (f *Fid) Unlinkat(name string, flags uint32) error {
+  var b msgBuffer
+  b.put32(f.num)
+  b.putString(name)
+  b.put32(flags)
+
+  _, err := f.c.rpc(tunlinkat, b)
+  return err
+}
+
+// Makes what's been written to what f has open durable.
+func (f *Fid) Fsync() error {
+  var b msgBuffer
+  b.put32(f.num)
+  _, err := f.c.rpc(tfsync, b)
+  return err
+}
+
+// Removes what f names, and lets f go.
+func (f *Fid) Remove() error {
+  var b msgBuffer
+  b.put32(f.num)
+  _, err := f.c.rpc(tremove, b)
+  return err
+}
+
+// Lets f go, closing what it has open.
+func (f *Fid) Clunk() error {
+  var b msgBuffer
+  b.put32(f.num)
+  _, err := f.c.rpc(tclunk, b)
+  return err
+}
@@ -0,0 +1,309 @@
+package p9
+
+import (
+  "encoding/binary"
+  "errors"
+  "gofs"
+  "io"
+)
+
+/**
+* Package p9 serves a GoFS tree over 9P2000.L, the dialect of 9P Linux's v9fs
+* speaks, so that other processes, and VMs through virtio or a socket, can
+* mount it: mount -t 9p -o trans=tcp,port=5640,version=9p2000.L host /mnt.
+* It also has a client, which tests and tools can use to reach a server.
+*
+* A message is its size, type and tag, then what its type holds, little-endian,
+* with strings as a 16-bit length and their bytes. Fids name files: Tattach
+* makes one for the root, Twalk one for what's found from another, and Tclunk
+* lets it go. A Server keeps, for each fid of a connection, the GoFS path it
+* names and, once Tlopen or Tlcreate has opened it, a descriptor; calls are
+* made as one ProcState, with its permissions, whatever user an attach names.
+* Renaming a file leaves fids walked to it with its old path. Paths aren't let
+* go through symlinks, which could lead out of what was attached: clients
+* follow them themselves, with Treadlink.
+*
+* Supported are Tversion, Tattach, Twalk, Tclunk, Tremove, Tflush, Tlopen,
+* Tlcreate, Tread, Twrite, Tfsync, Treaddir, Tgetattr, Tsetattr, Tmkdir,
+* Tsymlink, Treadlink, Tlink, Trenameat and Tunlinkat; anything else fails with
+* ENOTSUP. Errors go back in Rlerror as GoFS's errnos, which are Linux's.
+*/
+
+const Version = "9P2000.L"
+
+// The most a message may be, unless a Tversion asks for less.
+const MaxMessageSize = 1 << 16
+
+// The most fids a connection may have open at once; opening more fails with
+// EMFILE, so that one client can't take all the files GoFS can open.
+const MaxOpenFids = 32
+
+// The least a Tversion may ask for: room for a Tread's header and some data.
+const minMessageSize = 64
+
+// No fid, as the afid of an attach without authentication.
+const NoFid = ^uint32(0)
+
+const noTag = ^uint16(0)
+
+type msgType uint8
+
+const (
+  rlerror msgType = 7
+  tlopen msgType = 12
+  rlopen msgType = 13
+  tlcreate msgType = 14
+  rlcreate msgType = 15
+  tsymlink msgType = 16
+  rsymlink msgType = 17
+  treadlink msgType = 22
+  rreadlink msgType = 23
+  tgetattr msgType = 24
+  rgetattr msgType = 25
+  tsetattr msgType = 26
+  rsetattr msgType = 27
+  treaddir msgType = 40
+  rreaddir msgType = 41
+  tfsync msgType = 50
+  rfsync msgType = 51
+  tlink msgType = 70
+  rlink msgType = 71
+  tmkdir msgType = 72
+  rmkdir msgType = 73
+  trenameat msgType = 74
+  rrenameat msgType = 75
+  tunlinkat msgType = 76
+  runlinkat msgType = 77
+  tversion msgType = 100
+  rversion msgType = 101
+  tattach msgType = 104
+  rattach msgType = 105
+  tflush msgType = 108
+  rflush msgType = 109
+  twalk msgType = 110
+  rwalk msgType = 111
+  tread msgType = 116
+  rread msgType = 117
+  twrite msgType = 118
+  rwrite msgType = 119
+  tclunk msgType = 120
+  rclunk msgType = 121
+  tremove msgType = 122
+  rremove msgType = 123
+)
+
+// Open flags, as Linux has them.
+const (
+  O_RDONLY uint32 = 00
+  O_WRONLY uint32 = 01
+  O_RDWR uint32 = 02
+  O_CREAT uint32 = 0100
+  O_EXCL uint32 = 0200
+  O_TRUNC uint32 = 01000
+  O_APPEND uint32 = 02000
+)
+
+// The flag of Tunlinkat to remove a directory.
+const AT_REMOVEDIR uint32 = 0x200
+
+// Qid types.
+const (
+  QTDIR uint8 = 0x80
+  QTSYMLINK uint8 = 0x02
+  QTFILE uint8 = 0x00
+)
+
+// What a server knows a file by: its type and a number unique to it.
+type Qid struct {
+  Type uint8
+  Version uint32
+  Path uint64
+}
+
+// Bits of Tgetattr's request mask and Rgetattr's valid mask.
+const (
+  GETATTR_MODE uint64 = 1 << iota
+  GETATTR_NLINK
+  GETATTR_UID
+  GETATTR_GID
+  GETATTR_RDEV
+  GETATTR_ATIME
+  GETATTR_MTIME
+  GETATTR_CTIME
+  GETATTR_INO
+  GETATTR_SIZE
+  GETATTR_BLOCKS
+  GETATTR_BTIME
+  GETATTR_BASIC uint64 = 0x7ff
+)
+
+// What Tgetattr returns of a file.
+type Attr struct {
+  Valid uint64
+  Qid Qid
+  Mode uint32
+  Uid uint32
+  Gid uint32
+  Nlink uint64
+  Rdev uint64
+  Size uint64
+  BlockSize uint64
+  Blocks uint64
+  Atime, Mtime, Ctime, Btime Time
+}
+
+// A time as 9P has it.
+type Time struct {
+  Sec uint64
+  Nsec uint64
+}
+
+// Bits of Tsetattr's valid mask: which of the attributes it has to set. Times
+// are set to now unless the _SET bit goes with them.
+const (
+  SETATTR_MODE uint32 = 1 << iota
+  SETATTR_UID
+  SETATTR_GID
+  SETATTR_SIZE
+  SETATTR_ATIME
+  SETATTR_MTIME
+  SETATTR_CTIME
+  SETATTR_ATIME_SET
+  SETATTR_MTIME_SET
+)
+
+// What Tsetattr sets of a file.
+type SetAttr struct {
+  Valid uint32
+  Mode uint32
+  Uid uint32
+  Gid uint32
+  Size uint64
+  Atime, Mtime Time
+}
+
+// An entry of a directory, as Treaddir returns them.
+type Dirent struct {
+  Qid Qid
+  Offset uint64 // where the next entry is
+  Type uint8 // as in struct dirent's d_type
+  Name string
+}
+
+// d_type values.
+const (
+  DT_FIFO uint8 = 1
+  DT_CHR uint8 = 2
+  DT_DIR uint8 = 4
+  DT_REG uint8 = 8
+  DT_LNK uint8 = 10
+)
+
+var errShortMessage = errors.New("p9: short message")
+
+// A message being put together.
+type msgBuffer []byte
+
+func (b *msgBuffer) put8(v uint8) {
+  *b = append(*b, v)
+}
+
+func (b *msgBuffer) put16(v uint16) {
+  *b = binary.LittleEndian.AppendUint16(*b, v)
+}
+
+func (b *msgBuffer) put32(v uint32) {
+  *b = binary.LittleEndian.AppendUint32(*b, v)
+}
+
+func (b *msgBuffer) put64(v uint64) {
+  *b = binary.LittleEndian.AppendUint64(*b, v)
+}
+
+func (b *msgBuffer) putString(s string) {
+  b.put16(uint16(len(s)))
+  *b = append(*b, s...)
+}
+
+func (b *msgBuffer) putQid(qid Qid) {
+  b.put8(qid.Type)
+  b.put32(qid.Version)
+  b.put64(qid.Path)
+}
+
+func (b *msgBuffer) putTime(t Time) {
+  b.put64(t.Sec)
+  b.put64(t.Nsec)
+}
+
+// A message being taken apart. Reading past its end gives zeroes and sets err.
+type msgReader struct {
+  b []byte
+  err error
+}
+
+func (r *msgReader) take(n int) []byte {
+  if len(r.b) < n {
+    r.b, r.err = nil, errShortMessage
+    return make([]byte, n)
+  }
+
+  taken := r.b[:n]
+  r.b = r.b[n:]
+  return taken
+}
+
+func (r *msgReader) get8() uint8 {
+  return r.take(1)[0]
+}
+
+func (r *msgReader) get16() uint16 {
+  return binary.LittleEndian.Uint16(r.take(2))
+}
+
+func (r *msgReader) get32() uint32 {
+  return binary.LittleEndian.Uint32(r.take(4))
+}
+
+func (r *msgReader) get64() uint64 {
+  return binary.LittleEndian.Uint64(r.take(8))
+}
+
+// Returns EINVAL if the message was too short for what was read of it.
+func (r *msgReader) done() error {
+  if r.err != nil { return gofs.EINVAL }
+  return nil
+}
+
+func (r *msgReader) getString() string {
+  return string(r.take(int(r.get16())))
+}
+
+func (r *msgReader) getQid() Qid {
+  return Qid{Type: r.get8(), Version: r.get32(), Path: r.get64()}
+}
+
+func (r *msgReader) getTime() Time {
+  return Time{Sec: r.get64(), Nsec: r.get64()}
+}
+
+// Returns a message of type typ and tag with body, framed to be sent.
+func frame(typ msgType, tag uint16, body msgBuffer) []byte {
+  var b msgBuffer
+  b.put32(uint32(7 + len(body)))
+  b.put8(uint8(typ))
+  b.put16(tag)
+  return append(b, body...)
+}
+
+// Reads a message from r, of at most max bytes.
+func readMessage(r io.Reader, max uint32) (msgType, uint16, *msgReader, error) {
+  var size [4]byte
+  if _, err := io.ReadFull(r, size[:]); err != nil { return 0, 0, nil, err }
+  n := binary.LittleEndian.Uint32(size[:])
+  if n < 7 || n > max { return 0, 0, nil, errors.New("p9: bad message size") }
+
+  msg := make([]byte, n - 4)
+  if _, err := io.ReadFull(r, msg); err != nil { return 0, 0, nil, err }
+  return msgType(msg[0]), binary.LittleEndian.Uint16(msg[1:3]), &msgReader{b: msg[3:]}, nil
+}
@@ -0,0 +1,244 @@
+package p9
+
+import (
+  "bytes"
+  "fmt"
+  "gofs"
+  "io"
+  "net"
+  "path/filepath"
+  "testing"
+)
+
+func check(t *testing.T, err error) {
+  t.Helper()
+  if err != nil { t.Fatal(err) }
+}
+
+// Serves proc's tree on a listener on network, returning a client of it.
+func serve(t *testing.T, proc *gofs.ProcState, network string, addr string) *Client {
+  l, err := net.Listen(network, addr)
+  check(t, err)
+  t.Cleanup(func() { l.Close() })
+  go NewServer(proc).Serve(l)
+
+  c, err := Dial(network, l.Addr().String())
+  check(t, err)
+  t.Cleanup(func() { c.Close() })
+  return c
+}
+
+func direntNames(dirents []Dirent) []string {
+  var names []string
+  for _, dirent := range dirents {
+    names = append(names, dirent.Name)
+  }
+
+  return names
+}
+
+func sameNames(a []string, b ...string) bool {
+  if len(a) != len(b) { return false }
+  for i := range a {
+    if a[i] != b[i] { return false }
+  }
+
+  return true
+}
+
+func TestServer(t *testing.T) {
+  proc := gofs.InitProc()
+  defer proc.Exit()
+  c := serve(t, proc, "tcp", "127.0.0.1:0")
+  root, qid, err := c.Attach("")
+  check(t, err)
+  if qid.Type != QTDIR { t.Fatalf("Attached to a %#x", qid.Type) }
+
+  // files made remotely are there locally, and the other way around
+  _, err = root.Mkdir("share", 0750)
+  check(t, err)
+  dir, _, err := root.Walk("share")
+  check(t, err)
+  file, _, err := dir.Walk()
+  check(t, err)
+  _, err = file.Create("notes", O_RDWR, 0640)
+  check(t, err)
+  content := bytes.Repeat([]byte("0123456789"), 20000)
+  n, err := file.WriteAt(content, 0)
+  if n != len(content) || err != nil { t.Fatalf("Wrote %d: %v", n, err) }
+
+  stat, err := proc.Stat("/share/notes")
+  check(t, err)
+  if stat.Size != int64(len(content)) || stat.Mode != gofs.S_IFREG | 0640 {
+    t.Fatalf("Bad Stat of a remote file: %+v", stat)
+  }
+  read := make([]byte, len(content) + 10)
+  n, err = file.ReadAt(read, 0)
+  if n != len(content) || err != io.EOF || !bytes.Equal(read[:n], content) {
+    t.Fatalf("Read %d: %v", n, err)
+  }
+
+  attr, err := file.Getattr()
+  check(t, err)
+  if attr.Size != uint64(len(content)) || attr.Mode != uint32(stat.Mode) || attr.Qid.Path != stat.Ino {
+    t.Fatalf("Bad Getattr: %+v", attr)
+  }
+  check(t, file.Setattr(SetAttr{Valid: SETATTR_MODE | SETATTR_SIZE | SETATTR_MTIME | SETATTR_MTIME_SET,
+    Mode: 0600, Size: 10, Mtime: Time{Sec: 1000, Nsec: 5}}))
+  stat, err = proc.Stat("/share/notes")
+  check(t, err)
+  if stat.Size != 10 || stat.Mode != gofs.S_IFREG | 0600 || stat.Mtime.UnixNano() != 1000000000005 {
+    t.Fatalf("Setattr didn't take: %+v", stat)
+  }
+  check(t, file.Fsync())
+  check(t, file.Clunk())
+
+  // links, symlinks and renames
+  notes, _, err := dir.Walk("notes")
+  check(t, err)
+  check(t, dir.Link(notes, "hard"))
+  _, err = dir.Symlink("link", "notes")
+  check(t, err)
+  link, _, err := dir.Walk("link")
+  check(t, err)
+  target, err := link.Readlink()
+  if target != "notes" || err != nil { t.Fatalf("Readlink gave %q: %v", target, err) }
+  check(t, dir.Renameat("hard", root, "moved"))
+  stat, err = proc.Stat("/moved")
+  if err != nil || stat.Nlink != 2 { t.Fatalf("Bad rename: %+v %v", stat, err) }
+
+  // listings
+  listed, _, err := dir.Walk()
+  check(t, err)
+  _, err = listed.Open(O_RDONLY)
+  check(t, err)
+  dirents, err := listed.Readdir()
+  check(t, err)
+  if !sameNames(direntNames(dirents), ".", "..", "link", "notes") || dirents[3].Type != DT_REG {
+    t.Fatalf("Bad listing: %+v", dirents)
+  }
+
+  // errors come back as errnos
+  if _, _, err := root.Walk("missing"); err != gofs.ENOENT { t.Fatalf("Walked to nothing: %v", err) }
+  _, qids, err := root.Walk("share", "missing")
+  if err != gofs.ENOENT || len(qids) != 1 { t.Fatalf("Bad partial walk: %v", err) }
+  if err := root.Unlinkat("share", 0); err != gofs.EISDIR { t.Fatalf("Unlinked a directory: %v", err) }
+  if err := dir.Unlinkat("notes", AT_REMOVEDIR); err != gofs.ENOTDIR {
+    t.Fatalf("Removed a file as a directory: %v", err)
+  }
+  if _, err := dir.Mkdir("../up", 0755); err != gofs.EINVAL { t.Fatalf("Made a path: %v", err) }
+
+  if err := root.Unlinkat("share", AT_REMOVEDIR); err != gofs.ENOTEMPTY { t.Fatalf("Removed a full directory: %v", err) }
+  share, _, err := root.Walk("share")
+  check(t, err)
+  if err := share.Remove(); err != gofs.ENOTEMPTY { t.Fatalf("Removed a full directory: %v", err) }
+  check(t, dir.Unlinkat("link", 0))
+  check(t, dir.Unlinkat("notes", 0))
+  check(t, listed.Clunk())
+  if err := root.Unlinkat("share", AT_REMOVEDIR); err != nil { t.Fatal(err) }
+  moved, _, err := root.Walk("moved")
+  check(t, err)
+  check(t, moved.Remove())
+  if _, err := proc.Stat("/moved"); err != gofs.ENOENT { t.Fatalf("Remove left the file: %v", err) }
+}
+
+func TestServerUnixSocket(t *testing.T) {
+  proc := gofs.InitProc()
+  defer proc.Exit()
+  check(t, proc.Mkdir("/export"))
+  check(t, proc.Mkdir("/export/sub"))
+  c := serve(t, proc, "unix", filepath.Join(t.TempDir(), "9p.sock"))
+
+  // '..' doesn't leave where it was attached
+  root, _, err := c.Attach("/export")
+  check(t, err)
+  up, qids, err := root.Walk("sub", "..", "..")
+  check(t, err)
+  _, err = up.Open(O_RDONLY)
+  check(t, err)
+  dirents, err := up.Readdir()
+  check(t, err)
+  if len(qids) != 3 || !sameNames(direntNames(dirents), ".", "..", "sub") {
+    t.Fatalf("Walked out of the attach: %v", direntNames(dirents))
+  }
+
+  if _, _, err := c.Attach("/missing"); err != gofs.ENOENT { t.Fatalf("Attached to nothing: %v", err) }
+
+  // nor does a symlink, however it's reached
+  check(t, proc.Mkdir("/secret"))
+  fd, err := proc.Open("/secret/key", gofs.O_WRONLY | gofs.O_CREAT, gofs.UserMode())
+  check(t, err)
+  check(t, proc.Close(fd))
+  _, err = root.Symlink("out", "/secret")
+  check(t, err)
+  if _, qids, err := root.Walk("out", "key"); err == nil || len(qids) != 1 {
+    t.Fatalf("Walked through a symlink: %v", err)
+  }
+  out, _, err := root.Walk("out")
+  check(t, err)
+  if _, err := out.Open(O_RDONLY); err != gofs.ELOOP { t.Fatalf("Opened a symlink: %v", err) }
+  if _, err := out.Create("made", O_RDWR, 0644); err != gofs.ELOOP { t.Fatalf("Created through a symlink: %v", err) }
+  if _, err := out.Mkdir("made", 0755); err != gofs.ELOOP { t.Fatalf("Made a directory through a symlink: %v", err) }
+  if err := out.Unlinkat("key", 0); err != gofs.ELOOP { t.Fatalf("Unlinked through a symlink: %v", err) }
+  if err := out.Setattr(SetAttr{Valid: SETATTR_MODE, Mode: 0777}); err != gofs.ELOOP {
+    t.Fatalf("Chmodded through a symlink: %v", err)
+  }
+  if target, err := out.Readlink(); err != nil || target != "/secret" { t.Fatalf("Readlink gave %q: %v", target, err) }
+  check(t, out.Remove())
+  if _, err := proc.Stat("/secret/key"); err != nil { t.Fatal(err) }
+  check(t, proc.Unlink("/secret/key"))
+  check(t, proc.Unlink("/secret"))
+  check(t, up.Clunk())
+  if err := up.Clunk(); err != gofs.EBADF { t.Fatalf("Clunked twice: %v", err) }
+  check(t, root.Clunk())
+  check(t, proc.Unlink("/export/sub"))
+  check(t, proc.Unlink("/export"))
+}
+
+func TestServerOpenLimit(t *testing.T) {
+  proc := gofs.InitProc()
+  defer proc.Exit()
+  check(t, proc.Mkdir("/limit"))
+  c := serve(t, proc, "tcp", "127.0.0.1:0")
+  root, _, err := c.Attach("/limit")
+  check(t, err)
+
+  // a connection can only hold so many files open
+  var fids []*Fid
+  for i := 0; i < MaxOpenFids; i++ {
+    f, _, err := root.Walk()
+    check(t, err)
+    _, err = f.Create(fmt.Sprint(i), O_RDWR, 0644)
+    check(t, err)
+    fids = append(fids, f)
+  }
+  extra, _, err := root.Walk()
+  check(t, err)
+  if _, err := extra.Create("extra", O_RDWR, 0644); err != gofs.EMFILE { t.Fatalf("Opened past the limit: %v", err) }
+  check(t, fids[0].Clunk())
+  _, err = extra.Create("extra", O_RDWR, 0644)
+  check(t, err)
+  check(t, extra.Clunk())
+
+  // and when GoFS runs out of files, the call fails and the server goes on
+  var fds []gofs.FileDescriptor
+  for {
+    fd, err := proc.Open("/limit/extra", gofs.O_RDONLY, gofs.UserMode())
+    if err == gofs.ENFILE { break }
+    check(t, err)
+    fds = append(fds, fd)
+  }
+  f, _, err := root.Walk("extra")
+  check(t, err)
+  if _, err := f.Open(O_RDONLY); err != gofs.ENFILE { t.Fatalf("Opened with no files left: %v", err) }
+  for _, fd := range fds {
+    check(t, proc.Close(fd))
+  }
+  _, err = f.Open(O_RDONLY)
+  check(t, err)
+  check(t, f.Clunk())
+
+  for _, f := range fids[1:] {
+    check(t, f.Clunk())
+  }
+}
@@ -0,0 +1,691 @@
+package p9
+
+import (
+  "errors"
+  "gofs"
+  "hash/fnv"
+  "io"
+  "net"
+  "path"
+  "strings"
+  "sync"
+  "syscall"
+)
+
+// Serves a GoFS tree over 9P2000.L, making its calls as one process.
+type Server struct {
+  proc *gofs.ProcState
+  mu sync.Mutex // held for each call, as a ProcState makes one at a time
+}
+
+// Returns a Server making its calls as proc.
+func NewServer(proc *gofs.ProcState) *Server {
+  return &Server{proc: proc}
+}
+
+// Serves the connections l accepts, each in its own goroutine, until Accept
+// fails, as it does once l is closed.
+func (srv *Server) Serve(l net.Listener) error {
+  for {
+    conn, err := l.Accept()
+    if err != nil { return err }
+    go srv.ServeConn(conn)
+  }
+}
+
+// What a fid names, and what it has open.
+type fid struct {
+  path string
+  root string // where it was attached, which '..' doesn't leave
+  fd gofs.FileDescriptor
+  open bool
+  dirents []Dirent // a listing read by a Treaddir from the start
+}
+
+// A connection being served, and its fids.
+type conn struct {
+  srv *Server
+  proc *gofs.ProcState
+  msize uint32
+  fids map[uint32]*fid
+  opens int // how many of the fids are open
+}
+
+// Serves rw until it fails or a message it sends is bad, then closes it and
+// what its fids hold open.
+func (srv *Server) ServeConn(rw io.ReadWriteCloser) {
+  c := &conn{srv: srv, proc: srv.proc, msize: MaxMessageSize, fids: make(map[uint32]*fid)}
+  defer rw.Close()
+  defer c.clunkAll()
+
+  for {
+    typ, tag, r, err := readMessage(rw, c.msize)
+    if err != nil { return }
+
+    body, err := c.call(typ, r)
+
+    reply := typ + 1
+    if err != nil {
+      reply, body = rlerror, nil
+      body.put32(errno(err))
+    }
+    if _, err := rw.Write(frame(reply, tag, body)); err != nil { return }
+  }
+}
+
+// Handles a message holding srv.mu, which is let go however the call ends.
+func (c *conn) call(typ msgType, r *msgReader) (msgBuffer, error) {
+  c.srv.mu.Lock()
+  defer c.srv.mu.Unlock()
+  return c.handle(typ, r)
+}
+
+func (c *conn) clunkAll() {
+  c.srv.mu.Lock()
+  defer c.srv.mu.Unlock()
+  for num := range c.fids {
+    c.clunk(num)
+  }
+}
+
+// Returns the errno err is, or EIO.
+func errno(err error) uint32 {
+  var errno syscall.Errno
+  if errors.As(err, &errno) { return uint32(errno) }
+  return uint32(syscall.EIO)
+}
+
+// Returns the Qid of what's at p, with attributes stat.
+func qidOf(stat gofs.Stat_t, p string) Qid {
+  qid := Qid{Type: QTFILE, Path: stat.Ino}
+  switch stat.Mode & gofs.S_IFMT {
+  case gofs.S_IFDIR:
+    qid.Type = QTDIR
+  case gofs.S_IFLNK:
+    qid.Type = QTSYMLINK
+  }
+
+  // Entries without an inode are known by their path.
+  if qid.Path == 0 {
+    h := fnv.New64a()
+    h.Write([]byte(p))
+    qid.Path = h.Sum64() | 1 << 63
+  }
+
+  return qid
+}
+
+func (c *conn) qidAt(p string) (Qid, error) {
+  if err := c.confined(p, false); err != nil { return Qid{}, err }
+  stat, err := c.proc.Lstat(p)
+  if err != nil { return Qid{}, err }
+  return qidOf(stat, p), nil
+}
+
+// Returns the fid numbered num.
+func (c *conn) fid(num uint32) (*fid, error) {
+  f, ok := c.fids[num]
+  if !ok { return nil, gofs.EBADF }
+  return f, nil
+}
+
+// Returns the path of name in the directory dir. name must be an entry's name,
+// not a path.
+func childPath(dir string, name string) (string, error) {
+  if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+    return "", gofs.EINVAL
+  }
+
+  return path.Join(dir, name), nil
+}
+
+// Returns the path of name in the directory dir, as childPath does, if dir is
+// reached without going through a symlink.
+func (c *conn) child(dir string, name string) (string, error) {
+  p, err := childPath(dir, name)
+  if err != nil { return "", err }
+  return p, c.confined(dir, true)
+}
+
+// Returns ELOOP if reaching p, or what it names if follow, goes through a
+// symlink, which could lead out of the tree a fid was attached to. Fids name
+// paths without symlinks on the way, so p must be its own real path.
+func (c *conn) confined(p string, follow bool) error {
+  dir := p
+  if !follow { dir = path.Dir(p) }
+  real, err := c.proc.Realpath(dir)
+  if err != nil { return err }
+  if real != dir { return gofs.ELOOP }
+  return nil
+}
+
+func (c *conn) clunk(num uint32) {
+  if f := c.fids[num]; f != nil && f.open {
+    c.proc.Close(f.fd)
+    c.opens--
+  }
+  delete(c.fids, num)
+}
+
+// Returns the GoFS flags for Linux open flags.
+func accessFlags(flags uint32) gofs.AccessFlag {
+  var access gofs.AccessFlag
+  switch flags & 3 {
+  case O_RDONLY:
+    access = gofs.O_RDONLY
+  case O_WRONLY:
+    access = gofs.O_WRONLY
+  default:
+    access = gofs.O_RDWR
+  }
+
+  if (flags & O_APPEND) != 0 { access |= gofs.O_APPEND }
+  if (flags & O_CREAT) != 0 { access |= gofs.O_CREAT }
+  if (flags & O_EXCL) != 0 { access |= gofs.O_EXCL }
+  if (flags & O_TRUNC) != 0 { access |= gofs.O_TRUNC }
+  return access
+}
+
+// Returns the GoFS mode for permission bits.
+func rwx(mode uint32) [3]gofs.FileMode {
+  return [3]gofs.FileMode{gofs.FileMode(mode >> 6 & 7), gofs.FileMode(mode >> 3 & 7),
+    gofs.FileMode(mode & 7)}
+}
+
+func timespecOf(t Time) gofs.Timespec {
+  return gofs.Timespec{Sec: int64(t.Sec), Nsec: int64(t.Nsec)}
+}
+
+// Does what the message of type typ in r asks, returning the body of the reply.
+func (c *conn) handle(typ msgType, r *msgReader) (msgBuffer, error) {
+  switch typ {
+  case tversion:
+    return c.version(r)
+  case tattach:
+    return c.attach(r)
+  case tflush:
+    // Requests are done one at a time, so none is left to flush.
+    r.get16()
+    return nil, r.done()
+  case twalk:
+    return c.walk(r)
+  case tclunk:
+    num := r.get32()
+    if err := r.done(); err != nil { return nil, err }
+    if _, err := c.fid(num); err != nil { return nil, err }
+    c.clunk(num)
+    return nil, nil
+  case tremove:
+    num := r.get32()
+    if err := r.done(); err != nil { return nil, err }
+    f, err := c.fid(num)
+    if err != nil { return nil, err }
+
+    // The fid goes, whether or not what it names does.
+    c.clunk(num)
+    if err := c.confined(f.path, false); err != nil { return nil, err }
+    return nil, c.remove(f.path)
+  case tlopen:
+    return c.lopen(r)
+  case tlcreate:
+    return c.lcreate(r)
+  case tread:
+    return c.read(r)
+  case twrite:
+    return c.write(r)
+  case tfsync:
+    f, err := c.fid(r.get32())
+    if err := r.done(); err != nil { return nil, err }
+    if err != nil { return nil, err }
+    if !f.open { return nil, nil }
+    return nil, c.proc.Fsync(f.fd)
+  case treaddir:
+    return c.readdir(r)
+  case tgetattr:
+    return c.getattr(r)
+  case tsetattr:
+    return nil, c.setattr(r)
+  case tmkdir:
+    return c.mkdir(r)
+  case tsymlink:
+    return c.symlink(r)
+  case treadlink:
+    f, err := c.fid(r.get32())
+    if err := r.done(); err != nil { return nil, err }
+    if err != nil { return nil, err }
+    if err := c.confined(f.path, false); err != nil { return nil, err }
+    target, err := c.proc.Readlink(f.path)
+    if err != nil { return nil, err }
+
+    var b msgBuffer
+    b.putString(target)
+    return b, nil
+  case tlink:
+    return nil, c.link(r)
+  case trenameat:
+    return nil, c.renameat(r)
+  case tunlinkat:
+    return nil, c.unlinkat(r)
+  }
+
+  return nil, gofs.ENOTSUP
+}
+
+func (c *conn) version(r *msgReader) (msgBuffer, error) {
+  msize, version := r.get32(), r.getString()
+  if err := r.done(); err != nil { return nil, err }
+
+  // A new session: what the last one had goes.
+  for num := range c.fids {
+    c.clunk(num)
+  }
+
+  if msize < minMessageSize { return nil, gofs.EINVAL }
+  c.msize = min(msize, MaxMessageSize)
+  reply := "unknown"
+  if strings.HasPrefix(version, Version) { reply = Version }
+
+  var b msgBuffer
+  b.put32(c.msize)
+  b.putString(reply)
+  return b, nil
+}
+
+func (c *conn) attach(r *msgReader) (msgBuffer, error) {
+  num, _, _, aname, _ := r.get32(), r.get32(), r.getString(), r.getString(), r.get32()
+  if err := r.done(); err != nil { return nil, err }
+  if _, used := c.fids[num]; used { return nil, gofs.EINVAL }
+
+  root, err := c.proc.Realpath(path.Clean("/" + aname))
+  if err != nil { return nil, err }
+  qid, err := c.qidAt(root)
+  if err != nil { return nil, err }
+  if qid.Type != QTDIR { return nil, gofs.ENOTDIR }
+
+  c.fids[num] = &fid{path: root, root: root}
+  var b msgBuffer
+  b.putQid(qid)
+  return b, nil
+}
+
+func (c *conn) walk(r *msgReader) (msgBuffer, error) {
+  num, newNum := r.get32(), r.get32()
+  names := make([]string, r.get16())
+  for i := range names {
+    names[i] = r.getString()
+  }
+  if err := r.done(); err != nil { return nil, err }
+
+  f, err := c.fid(num)
+  if err != nil { return nil, err }
+  if _, used := c.fids[newNum]; used && newNum != num { return nil, gofs.EINVAL }
+
+  // Only a walk of every name makes the new fid; otherwise, the Qids of the
+  // names found tell how far it got.
+  p := f.path
+  var qids []Qid
+  for i, name := range names {
+    next, err := childPath(p, name)
+    if name == ".." {
+      next, err = path.Dir(p), nil
+      if p == f.root { next = p }
+    }
+
+    var qid Qid
+    if err == nil { qid, err = c.qidAt(next) }
+    if err != nil {
+      if i == 0 { return nil, err }
+      break
+    }
+
+    p = next
+    qids = append(qids, qid)
+  }
+
+  if len(qids) == len(names) {
+    if newNum == num {
+      f.path, f.dirents = p, nil
+    } else {
+      c.fids[newNum] = &fid{path: p, root: f.root}
+    }
+  }
+
+  var b msgBuffer
+  b.put16(uint16(len(qids)))
+  for _, qid := range qids {
+    b.putQid(qid)
+  }
+  return b, nil
+}
+
+// Replies to an open of f with its Qid and no iounit, so that the client
+// goes by the message size.
+func (c *conn) opened(f *fid) (msgBuffer, error) {
+  qid, err := c.qidAt(f.path)
+  if err != nil { return nil, err }
+
+  var b msgBuffer
+  b.putQid(qid)
+  b.put32(0)
+  return b, nil
+}
+
+func (c *conn) lopen(r *msgReader) (msgBuffer, error) {
+  f, err := c.fid(r.get32())
+  flags := r.get32()
+  if err := r.done(); err != nil { return nil, err }
+  if err != nil { return nil, err }
+  if f.open { return nil, gofs.EBADF }
+  if c.opens >= MaxOpenFids { return nil, gofs.EMFILE }
+
+  // Clients follow symlinks themselves, so opening one is an error.
+  if err := c.confined(f.path, false); err != nil { return nil, err }
+  fd, err := c.proc.Open(f.path, accessFlags(flags &^ O_CREAT) | gofs.O_NOFOLLOW, gofs.UserMode())
+  if err != nil { return nil, err }
+  f.fd, f.open = fd, true
+  c.opens++
+  return c.opened(f)
+}
+
+func (c *conn) lcreate(r *msgReader) (msgBuffer, error) {
+  f, err := c.fid(r.get32())
+  name, flags, mode, _ := r.getString(), r.get32(), r.get32(), r.get32()
+  if err := r.done(); err != nil { return nil, err }
+  if err != nil { return nil, err }
+  if f.open { return nil, gofs.EBADF }
+  if c.opens >= MaxOpenFids { return nil, gofs.EMFILE }
+  p, err := c.child(f.path, name)
+  if err != nil { return nil, err }
+
+  fd, err := c.proc.Open(p, accessFlags(flags) | gofs.O_CREAT | gofs.O_NOFOLLOW, rwx(mode))
+  if err != nil { return nil, err }
+
+  // The fid now names what it made.
+  f.path, f.fd, f.open, f.dirents = p, fd, true, nil
+  c.opens++
+  return c.opened(f)
+}
+
+func (c *conn) read(r *msgReader) (msgBuffer, error) {
+  f, err := c.fid(r.get32())
+  off, count := r.get64(), r.get32()
+  if err := r.done(); err != nil { return nil, err }
+  if err != nil { return nil, err }
+  if !f.open { return nil, gofs.EBADF }
+
+  data := make([]byte, min(count, c.msize - 11))
+  n, err := c.proc.Pread(f.fd, data, int64(off))
+  if err != nil && err != io.EOF { return nil, err }
+
+  var b msgBuffer
+  b.put32(uint32(n))
+  return append(b, data[:n]...), nil
+}
+
+func (c *conn) write(r *msgReader) (msgBuffer, error) {
+  f, err := c.fid(r.get32())
+  off := r.get64()
+  data := r.take(int(r.get32()))
+  if err := r.done(); err != nil { return nil, err }
+  if err != nil { return nil, err }
+  if !f.open { return nil, gofs.EBADF }
+
+  n, err := c.proc.Pwrite(f.fd, data, int64(off))
+  if n == 0 && err != nil { return nil, err }
+
+  var b msgBuffer
+  b.put32(uint32(n))
+  return b, nil
+}
+
+// The d_type of what has mode.
+func direntType(mode uint) uint8 {
+  switch mode & gofs.S_IFMT {
+  case gofs.S_IFDIR:
+    return DT_DIR
+  case gofs.S_IFLNK:
+    return DT_LNK
+  case gofs.S_IFIFO:
+    return DT_FIFO
+  case gofs.S_IFCHR:
+    return DT_CHR
+  }
+
+  return DT_REG
+}
+
+// Returns the entries of the directory f names, '.' and '..' first, each with
+// the offset of the next.
+func (c *conn) listing(f *fid) ([]Dirent, error) {
+  if err := c.confined(f.path, true); err != nil { return nil, err }
+  entries, err := c.proc.ReadDir(f.path)
+  if err != nil { return nil, err }
+
+  parent := path.Dir(f.path)
+  if f.path == f.root { parent = f.path }
+  var dirents []Dirent
+  for _, dot := range [][2]string{{".", f.path}, {"..", parent}} {
+    qid, err := c.qidAt(dot[1])
+    if err != nil { return nil, err }
+    dirents = append(dirents, Dirent{Qid: qid, Type: DT_DIR, Name: dot[0]})
+  }
+
+  for _, entry := range entries {
+    p := path.Join(f.path, entry.Name)
+    qid := qidOf(gofs.Stat_t{Ino: entry.Ino, Mode: entry.Type}, p)
+    dirents = append(dirents, Dirent{Qid: qid, Type: direntType(entry.Type), Name: entry.Name})
+  }
+
+  for i := range dirents {
+    dirents[i].Offset = uint64(i + 1)
+  }
+  return dirents, nil
+}
+
+func (c *conn) readdir(r *msgReader) (msgBuffer, error) {
+  f, err := c.fid(r.get32())
+  off, count := r.get64(), r.get32()
+  if err := r.done(); err != nil { return nil, err }
+  if err != nil { return nil, err }
+  if !f.open { return nil, gofs.EBADF }
+
+  // Reading from the start reads the directory anew.
+  if off == 0 || f.dirents == nil {
+    if f.dirents, err = c.listing(f); err != nil { return nil, err }
+  }
+
+  var data msgBuffer
+  count = min(count, c.msize - 11)
+  for _, dirent := range f.dirents[min(off, uint64(len(f.dirents))):] {
+    if len(data) + 24 + len(dirent.Name) > int(count) { break }
+    data.putQid(dirent.Qid)
+    data.put64(dirent.Offset)
+    data.put8(dirent.Type)
+    data.putString(dirent.Name)
+  }
+
+  var b msgBuffer
+  b.put32(uint32(len(data)))
+  return append(b, data...), nil
+}
+
+func timeOf(sec int64, nsec int64) Time {
+  return Time{Sec: uint64(sec), Nsec: uint64(nsec)}
+}
+
+func (c *conn) getattr(r *msgReader) (msgBuffer, error) {
+  f, err := c.fid(r.get32())
+  r.get64() // everything is returned, whatever's asked for
+  if err := r.done(); err != nil { return nil, err }
+  if err != nil { return nil, err }
+  if err := c.confined(f.path, false); err != nil { return nil, err }
+  stat, err := c.proc.Lstat(f.path)
+  if err != nil { return nil, err }
+
+  var b msgBuffer
+  b.put64(GETATTR_BASIC | GETATTR_BTIME)
+  b.putQid(qidOf(stat, f.path))
+  b.put32(uint32(stat.Mode))
+  b.put32(uint32(stat.Uid))
+  b.put32(uint32(stat.Gid))
+  b.put64(uint64(stat.Nlink))
+  b.put64(0) // rdev
+  b.put64(uint64(stat.Size))
+  b.put64(4096) // blksize
+  b.put64(uint64(stat.Blocks))
+  for _, t := range []gofs.Timespec{gofs.TimespecOf(stat.Atime), gofs.TimespecOf(stat.Mtime),
+    gofs.TimespecOf(stat.Ctime), gofs.TimespecOf(stat.Btime)} {
+    b.putTime(timeOf(t.Sec, t.Nsec))
+  }
+  b.put64(0) // gen
+  b.put64(0) // data_version
+  return b, nil
+}
+
+// Returns the Timespec Utimes takes for a time Tsetattr may set: now, or
+// what it gives with set.
+func setTime(valid uint32, bit uint32, set uint32, t Time) gofs.Timespec {
+  switch {
+  case (valid & bit) == 0:
+    return gofs.Timespec{Nsec: gofs.UTIME_OMIT}
+  case (valid & set) == 0:
+    return gofs.Timespec{Nsec: gofs.UTIME_NOW}
+  }
+
+  return timespecOf(t)
+}
+
+func (c *conn) setattr(r *msgReader) error {
+  f, err := c.fid(r.get32())
+  attr := SetAttr{Valid: r.get32(), Mode: r.get32(), Uid: r.get32(), Gid: r.get32(),
+    Size: r.get64(), Atime: r.getTime(), Mtime: r.getTime()}
+  if err := r.done(); err != nil { return err }
+  if err != nil { return err }
+
+  // A symlink's owner may be changed, but not what the rest would follow it to.
+  if err := c.confined(f.path, false); err != nil { return err }
+  if (attr.Valid &^ (SETATTR_UID | SETATTR_GID | SETATTR_CTIME)) != 0 {
+    if err := c.confined(f.path, true); err != nil { return err }
+  }
+
+  if (attr.Valid & SETATTR_MODE) != 0 {
+    if err := c.proc.Chmod(f.path, uint(attr.Mode) & 07777); err != nil { return err }
+  }
+
+  if (attr.Valid & (SETATTR_UID | SETATTR_GID)) != 0 {
+    uid, gid := -1, -1
+    if (attr.Valid & SETATTR_UID) != 0 { uid = int(attr.Uid) }
+    if (attr.Valid & SETATTR_GID) != 0 { gid = int(attr.Gid) }
+    if err := c.proc.Lchown(f.path, uid, gid); err != nil { return err }
+  }
+
+  if (attr.Valid & SETATTR_SIZE) != 0 {
+    if err := c.proc.Truncate(f.path, int64(attr.Size)); err != nil { return err }
+  }
+
+  // The change time changes with the rest, so asking for it alone does nothing.
+  if (attr.Valid & (SETATTR_ATIME | SETATTR_MTIME)) != 0 {
+    times := [2]gofs.Timespec{
+      setTime(attr.Valid, SETATTR_ATIME, SETATTR_ATIME_SET, attr.Atime),
+      setTime(attr.Valid, SETATTR_MTIME, SETATTR_MTIME_SET, attr.Mtime),
+    }
+    if err := c.proc.Utimes(f.path, times); err != nil { return err }
+  }
+
+  return nil
+}
+
+// Replies with the Qid of what's been made at p.
+func (c *conn) made(p string) (msgBuffer, error) {
+  qid, err := c.qidAt(p)
+  if err != nil { return nil, err }
+
+  var b msgBuffer
+  b.putQid(qid)
+  return b, nil
+}
+
+func (c *conn) mkdir(r *msgReader) (msgBuffer, error) {
+  f, err := c.fid(r.get32())
+  name, mode, _ := r.getString(), r.get32(), r.get32()
+  if err := r.done(); err != nil { return nil, err }
+  if err != nil { return nil, err }
+  p, err := c.child(f.path, name)
+  if err != nil { return nil, err }
+
+  if err := c.proc.Mkdir(p); err != nil { return nil, err }
+  if err := c.proc.Chmod(p, uint(mode) & 07777); err != nil { return nil, err }
+  return c.made(p)
+}
+
+func (c *conn) symlink(r *msgReader) (msgBuffer, error) {
+  f, err := c.fid(r.get32())
+  name, target, _ := r.getString(), r.getString(), r.get32()
+  if err := r.done(); err != nil { return nil, err }
+  if err != nil { return nil, err }
+  p, err := c.child(f.path, name)
+  if err != nil { return nil, err }
+
+  if err := c.proc.Symlink(target, p); err != nil { return nil, err }
+  return c.made(p)
+}
+
+func (c *conn) link(r *msgReader) error {
+  dir, err := c.fid(r.get32())
+  target, terr := c.fid(r.get32())
+  name := r.getString()
+  if err := r.done(); err != nil { return err }
+  if err != nil { return err }
+  if terr != nil { return terr }
+  p, err := c.child(dir.path, name)
+  if err != nil { return err }
+
+  if err := c.confined(target.path, false); err != nil { return err }
+  return c.proc.Link(target.path, p)
+}
+
+func (c *conn) renameat(r *msgReader) error {
+  oldDir, err := c.fid(r.get32())
+  oldName := r.getString()
+  newDir, nerr := c.fid(r.get32())
+  newName := r.getString()
+  if err := r.done(); err != nil { return err }
+  if err != nil { return err }
+  if nerr != nil { return nerr }
+
+  src, err := c.child(oldDir.path, oldName)
+  if err != nil { return err }
+  dst, err := c.child(newDir.path, newName)
+  if err != nil { return err }
+  return c.proc.Rename(src, dst)
+}
+
+func (c *conn) unlinkat(r *msgReader) error {
+  dir, err := c.fid(r.get32())
+  name, flags := r.getString(), r.get32()
+  if err := r.done(); err != nil { return err }
+  if err != nil { return err }
+  p, err := c.child(dir.path, name)
+  if err != nil { return err }
+
+  stat, err := c.proc.Lstat(p)
+  if err != nil { return err }
+  isDir := stat.Mode & gofs.S_IFMT == gofs.S_IFDIR
+  if (flags & AT_REMOVEDIR) != 0 && !isDir { return gofs.ENOTDIR }
+  if (flags & AT_REMOVEDIR) == 0 && isDir { return gofs.EISDIR }
+  return c.remove(p)
+}
+
+// Unlinks p, which, as with rmdir(2), must be empty if it's a directory.
+func (c *conn) remove(p string) error {
+  stat, err := c.proc.Lstat(p)
+  if err != nil { return err }
+
+  if (stat.Mode & gofs.S_IFMT) == gofs.S_IFDIR {
+    entries, err := c.proc.ReadDir(p)
+    if err != nil { return err }
+    if len(entries) > 0 { return gofs.ENOTEMPTY }
+  }
+
+  return c.proc.Unlink(p)
+}
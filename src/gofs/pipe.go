@@ -0,0 +1,278 @@
+package gofs
+
+import (
+  "gofs/dstore"
+  "io"
+  "sync"
+)
+
+/**
+* Pipes are the IPC the essay in file.go has in mind: things that aren't
+* inodes but that can be opened, closed, read and written, and so are Files.
+*
+* A pipe is a bounded ring buffer of PIPE_PAGES arena pages. Readers block
+* while it's empty and writers while it's full, and either can be in another
+* goroutine. Reading an empty pipe with no writers left gives io.EOF; writing
+* to a pipe with no readers left gives EPIPE. With O_NONBLOCK, calls that
+* would block fail with EAGAIN instead. Writes of at most PIPE_BUF bytes are
+* atomic: they are never interleaved with other writes.
+*
+* Pipe() makes an anonymous pipe. Mkfifo() makes a named one, a Fifo in a
+* Directory, whose buffer exists only while some end of it is open. Opening a
+* Fifo to read blocks until there is a writer, and to write until there is a
+* reader, unless O_NONBLOCK is given; then opening to write without a reader
+* fails with ENXIO. Opening to read and write never blocks.
+*/
+
+const PIPE_PAGES = 16
+const PIPE_BUF = dstore.PAGE_SIZE
+
+type pipe struct {
+  mu      sync.Mutex
+  cond    *sync.Cond
+  pages   [][]byte
+  head    int // offset of the first unread byte
+  count   int // number of unread bytes
+  readers int
+  writers int
+
+  // How many times each end was ever opened, for Fifo opens to wait on.
+  readOpens  int
+  writeOpens int
+}
+
+// One end of a pipe, or both for a Fifo opened O_RDWR.
+type pipeEnd struct {
+  pipe     *pipe
+  read     bool
+  write    bool
+  nonblock bool
+  refs     int // guarded by pipe.mu
+}
+
+// A named pipe, as made by Mkfifo.
+type Fifo struct {
+  pipe *pipe
+}
+
+func initPipe() *pipe {
+  p := new(pipe)
+  p.cond = sync.NewCond(&p.mu)
+  return p
+}
+
+func (p *pipe) capacity() int {
+  return PIPE_PAGES * dstore.PAGE_SIZE
+}
+
+// Must hold p.mu.
+func (p *pipe) allocatePages() {
+  if p.pages != nil { return }
+
+  p.pages = make([][]byte, PIPE_PAGES)
+  for i := range p.pages {
+    p.pages[i] = dstore.GlobalPageArena.AllocatePage()
+  }
+}
+
+// Must hold p.mu.
+func (p *pipe) releasePages() {
+  for _, page := range p.pages {
+    dstore.GlobalPageArena.ReturnPage(page)
+  }
+
+  p.pages, p.head, p.count = nil, 0, 0
+}
+
+// Copies from the ring into b. Must hold p.mu.
+func (p *pipe) take(b []byte) int {
+  n := 0
+  for n < len(b) && p.count > 0 {
+    page, off := p.head / dstore.PAGE_SIZE, p.head % dstore.PAGE_SIZE
+    end := dstore.PAGE_SIZE
+    if end - off > p.count { end = off + p.count }
+    chunk := copy(b[n:], p.pages[page][off:end])
+
+    n += chunk
+    p.count -= chunk
+    p.head = (p.head + chunk) % p.capacity()
+  }
+
+  return n
+}
+
+// Copies from b into the ring, as much as fits. Must hold p.mu.
+func (p *pipe) put(b []byte) int {
+  n := 0
+  for n < len(b) && p.count < p.capacity() {
+    tail := (p.head + p.count) % p.capacity()
+    page, off := tail / dstore.PAGE_SIZE, tail % dstore.PAGE_SIZE
+    end := dstore.PAGE_SIZE
+    if space := p.capacity() - p.count; end - off > space { end = off + space }
+    chunk := copy(p.pages[page][off:end], b[n:])
+
+    n += chunk
+    p.count += chunk
+  }
+
+  return n
+}
+
+// Attaches a new end to p. Must hold p.mu.
+func (p *pipe) attach(read bool, write bool, nonblock bool) *pipeEnd {
+  p.allocatePages()
+  if read {
+    p.readers++
+    p.readOpens++
+  }
+
+  if write {
+    p.writers++
+    p.writeOpens++
+  }
+
+  p.cond.Broadcast()
+  return &pipeEnd{pipe: p, read: read, write: write, nonblock: nonblock, refs: 1}
+}
+
+func (end *pipeEnd) Read(b []byte) (int, error) {
+  if !end.read { return 0, EBADF }
+
+  p := end.pipe
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  for p.count == 0 {
+    if p.writers == 0 { return 0, io.EOF }
+    if end.nonblock { return 0, EAGAIN }
+    p.cond.Wait()
+  }
+
+  n := p.take(b)
+  p.cond.Broadcast()
+  return n, nil
+}
+
+func (end *pipeEnd) Write(b []byte) (int, error) {
+  if !end.write { return 0, EBADF }
+
+  p := end.pipe
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  // Small writes wait for room for all of b, so they go in at once.
+  atomic := len(b) <= PIPE_BUF
+  n := 0
+  for n < len(b) {
+    if p.readers == 0 { return n, EPIPE }
+
+    space := p.capacity() - p.count
+    if space == 0 || (atomic && space < len(b)) {
+      if end.nonblock && n > 0 { return n, nil }
+      if end.nonblock { return 0, EAGAIN }
+      p.cond.Wait()
+      continue
+    }
+
+    n += p.put(b[n:])
+    p.cond.Broadcast()
+  }
+
+  return n, nil
+}
+
+func (end *pipeEnd) Seek(offset int64, whence int) (int64, error) {
+  return 0, ESPIPE
+}
+
+func (end *pipeEnd) retain() {
+  end.pipe.mu.Lock()
+  defer end.pipe.mu.Unlock()
+  end.refs++
+}
+
+func (end *pipeEnd) Close() error {
+  p := end.pipe
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  end.refs--
+  if end.refs > 0 { return nil }
+  if end.read { p.readers-- }
+  if end.write { p.writers-- }
+  if p.readers == 0 && p.writers == 0 { p.releasePages() }
+  p.cond.Broadcast()
+  return nil
+}
+
+// Opens an end of the Fifo as flags say, waiting for the other end if needed.
+func (fifo *Fifo) open(flags AccessFlag) (*pipeEnd, error) {
+  read := (flags & (O_RDONLY | O_RDWR)) != 0
+  write := (flags & (O_WRONLY | O_RDWR)) != 0
+  if !read && !write { read, write = true, true }
+  nonblock := (flags & O_NONBLOCK) != 0
+
+  p := fifo.pipe
+  p.mu.Lock()
+  defer p.mu.Unlock()
+
+  if write && !read && nonblock && p.readers == 0 { return nil, ENXIO }
+
+  end := p.attach(read, write, nonblock)
+  if (read && write) || nonblock { return end, nil }
+
+  // Wait for the other end to be opened; it needn't still be open by then.
+  if read {
+    opens := p.writeOpens
+    for p.writers == 0 && p.writeOpens == opens { p.cond.Wait() }
+  } else {
+    opens := p.readOpens
+    for p.readers == 0 && p.readOpens == opens { p.cond.Wait() }
+  }
+
+  return end, nil
+}
+
+// Returns a pair of descriptors for a new pipe: one to read, one to write.
+func (proc *ProcState) Pipe() (FileDescriptor, FileDescriptor, error) {
+  return proc.Pipe2(0)
+}
+
+// Pipe, with O_NONBLOCK and O_CLOEXEC as the allowed flags.
+func (proc *ProcState) Pipe2(flags AccessFlag) (FileDescriptor, FileDescriptor, error) {
+  if (flags & ^(O_NONBLOCK | O_CLOEXEC)) != 0 { return -1, -1, EINVAL }
+
+  r, err := proc.getUnusedFd()
+  if err != nil { return -1, -1, err }
+  w, err := proc.getUnusedFd()
+  if err != nil {
+    proc.returnFd(r)
+    return -1, -1, err
+  }
+
+  nonblock := (flags & O_NONBLOCK) != 0
+  p := initPipe()
+  p.mu.Lock()
+  reader := p.attach(true, false, nonblock)
+  writer := p.attach(false, true, nonblock)
+  p.mu.Unlock()
+
+  proc.fileDescriptorTable[r] = reader
+  proc.fileDescriptorTable[w] = writer
+  proc.closeOnExec[r] = (flags & O_CLOEXEC) != 0
+  proc.closeOnExec[w] = (flags & O_CLOEXEC) != 0
+  return r, w, nil
+}
+
+// Creates a named pipe at path.
+func (proc *ProcState) Mkfifo(path string) error {
+  ref, err := proc.resolve(path, false)
+  if err != nil { return err }
+  if ref.entry != nil { return EEXIST }
+  if ref.slash { return ENOENT }
+  if err := proc.checkCreate(ref.dir); err != nil { return err }
+
+  ref.dir[ref.name] = &Fifo{pipe: initPipe()}
+  notify(ref.dir, ref.name, nil, IN_CREATE, 0)
+  return logPaths(recMkfifo, ref)
+}
@@ -0,0 +1,186 @@
+package gofs
+
+import (
+  "gofs/dstore"
+  "io"
+  "testing"
+)
+
+func TestPipeReadWrite(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  r, w, err := p.Pipe()
+  AssertNoErr(t, err)
+
+  content := []byte("Hello, pipe!")
+  p.safeWrite(t, w, content)
+  buffer := make([]byte, 24)
+  n := p.safeRead(t, r, buffer)
+  AssertEqualBytes(t, buffer[:n], content)
+
+  _, err = p.Read(w, buffer)
+  AssertTrue(t, err == EBADF, "Expected EBADF reading the write end.")
+  _, err = p.Seek(r, 0, SEEK_SET)
+  AssertTrue(t, err == ESPIPE, "Expected ESPIPE seeking a pipe.")
+
+  // EOF once every writer is gone, dups included
+  dup, err := p.Dup(w)
+  AssertNoErr(t, err)
+  p.safeClose(t, w)
+  p.safeWrite(t, dup, content[:5])
+  p.safeClose(t, dup)
+  n = p.safeRead(t, r, buffer)
+  AssertEqualBytes(t, buffer[:n], content[:5])
+  _, err = p.Read(r, buffer)
+  AssertTrue(t, err == io.EOF, "Expected EOF with no writers.")
+  p.safeClose(t, r)
+
+  // EPIPE once every reader is gone
+  r, w, err = p.Pipe()
+  AssertNoErr(t, err)
+  p.safeClose(t, r)
+  _, err = p.Write(w, content)
+  AssertTrue(t, err == EPIPE, "Expected EPIPE with no readers.")
+  p.safeClose(t, w)
+}
+
+func TestPipeBlocking(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  r, w, err := p.Pipe()
+  AssertNoErr(t, err)
+
+  // several times the capacity, so the writer has to wait on the reader
+  content := randBytes(PIPE_PAGES * 4096 * 5 + 12)
+  child, err := Fork(p)
+  AssertNoErr(t, err)
+  p.safeClose(t, w)
+
+  done := make(chan error)
+  go func() {
+    _, err := child.Write(w, content)
+    child.Exit()
+    done <- err
+  }()
+
+  received := make([]byte, 0, len(content))
+  buffer := make([]byte, 3000)
+  for {
+    n, err := p.Read(r, buffer)
+    if err == io.EOF { break }
+    AssertNoErr(t, err)
+    received = append(received, buffer[:n]...)
+  }
+
+  AssertNoErr(t, <-done)
+  AssertEqualBytes(t, received, content)
+  p.safeClose(t, r)
+}
+
+func TestPipesConcurrently(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  used := dstore.GlobalPageArena.Used()
+
+  // each pipe takes its ring from the one arena
+  done := make(chan error)
+  var children []*ProcState
+  for i := 0; i < 4; i++ {
+    child, err := Fork(p)
+    AssertNoErr(t, err)
+    children = append(children, child)
+    go func() {
+      for j := 0; j < 50; j++ {
+        r, w, err := child.Pipe()
+        if err == nil { _, err = child.Write(w, []byte("ring")) }
+        if err != nil {
+          done <- err
+          return
+        }
+        child.Close(r)
+        child.Close(w)
+      }
+      done <- nil
+    }()
+  }
+
+  for range children {
+    AssertNoErr(t, <-done)
+  }
+  for _, child := range children {
+    child.Exit()
+  }
+  AssertTrue(t, dstore.GlobalPageArena.Used() == used, "Pipes kept their pages.")
+}
+
+func TestPipeNonblocking(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  r, w, err := p.Pipe2(O_NONBLOCK)
+  AssertNoErr(t, err)
+
+  buffer := make([]byte, 4096)
+  _, err = p.Read(r, buffer)
+  AssertTrue(t, err == EAGAIN, "Expected EAGAIN reading an empty pipe.")
+
+  // fill it up: the last write is partial, the next one can't go at all
+  big := make([]byte, PIPE_PAGES * 4096 - 100)
+  p.safeWrite(t, w, big)
+  n, err := p.Write(w, randBytes(4096 * 2))
+  AssertTrue(t, err == nil && n == 100, "Expected a partial write.")
+  _, err = p.Write(w, buffer[:1])
+  AssertTrue(t, err == EAGAIN, "Expected EAGAIN writing a full pipe.")
+
+  p.safeClose(t, r)
+  p.safeClose(t, w)
+
+  _, _, err = p.Pipe2(O_APPEND)
+  AssertTrue(t, err == EINVAL, "Expected EINVAL from Pipe2 with bad flags.")
+}
+
+func TestFifo(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  p.safeMkdir(t, "/fifodir")
+  AssertNoErr(t, p.Mkfifo("/fifodir/fifo"))
+  AssertTrue(t, p.Mkfifo("/fifodir/fifo") == EEXIST, "Expected EEXIST.")
+
+  // without a reader, a non-blocking open to write fails
+  _, err := p.Open("/fifodir/fifo", O_WRONLY|O_NONBLOCK, UserMode())
+  AssertTrue(t, err == ENXIO, "Expected ENXIO.")
+
+  // opening to write waits for the reader below
+  content := randBytes(4096 * 40)
+  writer, err := Fork(p)
+  AssertNoErr(t, err)
+  done := make(chan error)
+  go func() {
+    fd, err := writer.Open("/fifodir/fifo", O_WRONLY, UserMode())
+    if err == nil { _, err = writer.Write(fd, content) }
+    writer.Exit()
+    done <- err
+  }()
+
+  fd := p.safeOpen(t, "/fifodir/fifo", O_RDONLY, UserMode())
+  received := make([]byte, 0, len(content))
+  buffer := make([]byte, 5000)
+  for {
+    n, err := p.Read(fd, buffer)
+    if err == io.EOF { break }
+    AssertNoErr(t, err)
+    received = append(received, buffer[:n]...)
+  }
+
+  AssertNoErr(t, <-done)
+  AssertEqualBytes(t, received, content)
+  p.safeClose(t, fd)
+
+  // a non-blocking reader doesn't wait and reads nothing yet
+  fd = p.safeOpen(t, "/fifodir/fifo", O_RDONLY|O_NONBLOCK, UserMode())
+  _, err = p.Read(fd, buffer)
+  AssertTrue(t, err == io.EOF, "Expected EOF from a writerless FIFO.")
+  p.safeClose(t, fd)
+
+  p.safeUnlink(t, "/fifodir/fifo")
+  p.safeUnlink(t, "/fifodir")
+}
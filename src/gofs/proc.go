@@ -16,27 +16,24 @@ func UserMode() [3]FileMode {
   return [3]FileMode{M_READ | M_WRITE | M_EXEC, M_READ, M_READ}
 }
 
-// Sets up the initial file table to point to std out, in, and err.
+// Sets up an empty file table, with every descriptor free.
 func (proc *ProcState) initFileDescriptorTableAndLastFD() {
-  table := make(FileDescriptorTable)
-  table[0] = globalState.stdIn
-  table[1] = globalState.stdOut
-  table[2] = globalState.stdErr
-  proc.fileDescriptorTable = table;
+  proc.fileDescriptorTable = make(FileDescriptorTable)
 
-  // lastFd keeps track of the index of the last used FD
+  // freeDescriptors[lastFd:] are the unused FDs
   proc.lastFd = 0
   for i := 0; i < MAX_DESCRIPTORS; i++ {
-    proc.freeDescriptors[i] = FileDescriptor(i + 3); // since 0, 1, 2 are taken
+    proc.freeDescriptors[i] = FileDescriptor(i);
   }
 }
 
-// Allocates a new file descriptor (not) atomically.
-func (proc *ProcState) getUnusedFd() (fd FileDescriptor) {
+// Allocates a new file descriptor (not) atomically, or fails with EMFILE once
+// MAX_DESCRIPTORS are open.
+func (proc *ProcState) getUnusedFd() (fd FileDescriptor, err error) {
   // Below is what we used to do for the atomic stuff
   // var thing *int64 = (*int64)(&proc.lastFd)
   // newthing := atomic.AddInt64(thing, 1)
-  if proc.lastFd >= MAX_DESCRIPTORS { panic("Out of FDs!") }
+  if proc.lastFd >= MAX_DESCRIPTORS { return FileDescriptor(-1), EMFILE }
   fd = proc.freeDescriptors[proc.lastFd]
   proc.lastFd += 1
   return
@@ -46,105 +43,482 @@ func (proc *ProcState) returnFd(fd FileDescriptor) {
   if proc.lastFd <= 0 { panic("Overfreeing FDs!") }
   proc.lastFd -= 1
   proc.freeDescriptors[proc.lastFd] = fd;
+  proc.closeOnExec[fd] = false
+}
+
+// Allocates the given unused file descriptor, as Dup2 needs.
+func (proc *ProcState) claimFd(fd FileDescriptor) {
+  for i := proc.lastFd; i < MAX_DESCRIPTORS; i++ {
+    if proc.freeDescriptors[i] == fd {
+      proc.freeDescriptors[i] = proc.freeDescriptors[proc.lastFd]
+      proc.freeDescriptors[proc.lastFd] = fd
+      proc.lastFd += 1
+      return
+    }
+  }
+
+  panic("Claiming a used FD!")
 }
 
 // Fetches the file object given a file descriptor
 func (proc *ProcState) getFile(fd FileDescriptor) (interface{File}, error) {
   file, present := proc.fileDescriptorTable[fd]
-  if present { return file, nil } 
-  return nil, errors.New("fd not found")
+  if present { return file, nil }
+  return nil, EBADF
 }
 
 // Opens a file without returning a file descriptor.
-// What happens if the filename in path is empty? IE: path = a/b/c/
 func (proc *ProcState) openFile(path string, flags AccessFlag,
 mode [3]FileMode) (interface{File}, error) {
-  var err error; var inode *Inode
-  dir, filename, _ := proc.resolveDirPath(path)
-  file, ok := dir[filename]
+  var inode *Inode
+  ref, err := proc.resolveWithHost(path, (flags & O_NOFOLLOW) == 0)
+  if err != nil { return nil, err }
+  if host, isHost := hostOf(ref.entry); isHost { return proc.openHost(host, flags, mode) }
+
+  // O_EXCL fails on whatever is there, a directory too.
+  if ref.entry != nil && (flags & O_CREAT) != 0 && (flags & O_EXCL) != 0 { return nil, EEXIST }
 
   // Finding our *Inode, if possible.
-  if ok {
-    switch file.(type) {
-    case *Inode:
-      inode = file.(*Inode)
-    default:
-      return nil, errors.New("Cannot open file of this type.")
+  switch file := ref.entry.(type) {
+  case *Inode:
+    if err := proc.checkPermission(file, openWants(flags)); err != nil { return nil, err }
+    // Checked before anything is truncated or copied up, as it's after that
+    // that the DataFile is taken.
+    if err := checkFileArena(); err != nil { return nil, err }
+    inode = file
+
+    writable := (openWants(flags) & M_WRITE) != 0
+    if writable || (flags & O_TRUNC) != 0 {
+      if err := proc.copyUp(&ref); err != nil { return nil, err }
+      inode = ref.entry.(*Inode)
+      if err := inode.fs.checkWrite(); err != nil { return nil, err }
     }
-  } else {
-    switch {
-      case (flags & O_CREAT) != 0:
-        inode = initInode()
-        dir[filename] = inode
-      default:
-        return nil, errors.New("File not found.")
+
+    if (flags & O_TRUNC) != 0 && writable && inode.data.Size() > 0 {
+      if err := proc.truncate(ref, inode, 0); err != nil { return nil, err }
     }
+  case Directory:
+    if (flags & (O_WRONLY | O_RDWR | O_CREAT)) != 0 { return nil, EISDIR }
+    if err := proc.checkPermission(file, M_READ); err != nil { return nil, err }
+    return &DirFile{dir: file}, nil
+  case *Symlink:
+    // Only left unfollowed with O_NOFOLLOW.
+    return nil, ELOOP
+  case *Fifo:
+    return file.open(flags)
+  case *Device:
+    return file.open(flags)
+  case nil:
+    if (flags & O_CREAT) == 0 { return nil, ENOENT }
+    if ref.slash { return nil, EISDIR }
+    if err := proc.checkCreate(ref.dir); err != nil { return nil, err }
+    if err := checkFileArena(); err != nil { return nil, err }
+
+    inode = initInode()
+    proc.setupNew(inode, ref.dir, modeBits(mode), false)
+    // Journaled first, so that a file is never there without its record.
+    if err = logCreate(recCreate, ref, inode); err != nil { return nil, err }
+    ref.dir[ref.name] = inode
+    notify(ref.dir, ref.name, inode, IN_CREATE, 0)
+  default:
+    return nil, errors.New("Cannot open file of this type.")
   }
 
   // We're here? We found it! Otherwise, would have err.
-  file = initDataFile(inode)
-  return file.(interface{File}), err
+  file, err := initDataFile(inode, flags)
+  if err != nil { return nil, err }
+  file.dir, file.name = ref.dir, ref.name
+  return file, nil
 }
 
 func (proc *ProcState) Mkdir(path string) error {
-  parentDir, dirName, err := proc.resolveDirPath(path)
-  if (err != nil) { return err }
-
-  _, exists := parentDir[dirName]
-  if exists { return errors.New("Destination already exists.") }
-
-  parentDir[dirName] = initDirectory(parentDir)
+  ref, err := proc.resolveWithHost(path, false)
+  if err != nil { return err }
+  if host, isHost := ref.entry.(*hostEntry); isHost { return proc.mkdirHost(host) }
+  if ref.entry != nil { return EEXIST }
+  if err := proc.checkCreate(ref.dir); err != nil { return err }
+
+  dir := initDirectory(ref.dir, ref.name)
+  proc.setupNew(dir.inode(), ref.dir, 0777, true)
+  if err := logCreate(recMkdir, ref, dir.inode()); err != nil { return err }
+  ref.dir[ref.name] = dir
+  makeOpaque(ref.dir, ref.name)
+  notify(ref.dir, ref.name, dir, IN_CREATE, 0)
   return nil
 }
 
 func (proc *ProcState) Chdir(path string) error {
-  dir, _, err := proc.resolveDirPath(path)
+  ref, err := proc.resolve(path, true)
+  if err != nil { return err }
+
+  switch dir := ref.entry.(type) {
+  case Directory:
+    if err := proc.checkPermission(dir, M_EXEC); err != nil { return err }
+    proc.cwd = dir
+    return nil
+  case nil:
+    return ENOENT
+  }
+
+  return ENOTDIR
+}
+
+// Changes the cwd to the directory open at fd.
+func (proc *ProcState) Fchdir(fd FileDescriptor) error {
+  file, err := proc.getFile(fd)
   if err != nil { return err }
 
-  proc.cwd = dir
+  dir, isDir := file.(*DirFile)
+  if !isDir { return ENOTDIR }
+  if err := proc.checkPermission(dir.dir, M_EXEC); err != nil { return err }
+
+  proc.cwd = dir.dir
   return nil
 }
 
-func (proc *ProcState) Link(src string, dst string) error {
-  var err error
+// Returns the absolute path of the cwd, from proc's root. Fails with ENOENT if
+// the cwd has been unlinked, or is outside that root.
+func (proc *ProcState) Getcwd() (string, error) {
+  path, ok := proc.cwd.pathFrom(proc.root)
+  if !ok { return "", ENOENT }
+  return path, nil
+}
+
+// Returns the absolute path of what path names, with no symlinks, '.', '..'
+// or repeated slashes in it.
+func (proc *ProcState) Realpath(path string) (string, error) {
+  ref, err := proc.resolve(path, true)
+  if err != nil { return "", err }
+  if ref.entry == nil { return "", ENOENT }
+
+  abs, ok := ref.pathFrom(proc.root)
+  if !ok { return "", ENOENT }
+  return abs, nil
+}
+
+// Makes the directory path names proc's root: what '/' names for it from then
+// on, and where '..' stops, even through symlinks. Nothing outside can be
+// named, but the cwd stays where it is, so a process confined this way should
+// Chdir("/") too, as in Linux. Only root may.
+func (proc *ProcState) Chroot(path string) error {
+  if proc.uid != 0 { return EPERM }
 
-  _, file, err := proc.resolveFilePath(src)
+  ref, err := proc.resolve(path, true)
   if err != nil { return err }
 
-  dstDir, baseName, err := proc.resolveDirPath(dst)
+  switch dir := ref.entry.(type) {
+  case Directory:
+    if err := proc.checkPermission(dir, M_EXEC); err != nil { return err }
+    proc.root = dir
+    return nil
+  case nil:
+    return ENOENT
+  }
+
+  return ENOTDIR
+}
+
+// Creates a symlink at path pointing to target, which needn't exist.
+func (proc *ProcState) Symlink(target string, path string) error {
+  if len(target) == 0 { return ENOENT }
+
+  ref, err := proc.resolve(path, false)
   if err != nil { return err }
+  if ref.entry != nil { return EEXIST }
+  if ref.slash { return ENOENT }
+  if err := proc.checkCreate(ref.dir); err != nil { return err }
+
+  link := &Symlink{target: target, ownerId: proc.uid, groupId: proc.gid}
+  if parent := ref.dir.inode(); (parent.perms & S_ISGID) != 0 { link.groupId = parent.groupId }
+  ref.dir[ref.name] = link
+  notify(ref.dir, ref.name, nil, IN_CREATE, 0)
+  if err := logWithPath(recSymlink, target, ref); err != nil { return err }
+  // Replays run as root, so any other owner is journaled as well.
+  if link.ownerId == 0 && link.groupId == 0 { return nil }
+  return logLinkOwner(ref, link)
+}
+
+// Returns the target of the symlink at path.
+func (proc *ProcState) Readlink(path string) (string, error) {
+  ref, err := proc.resolve(path, false)
+  if err != nil { return "", err }
+
+  switch link := ref.entry.(type) {
+  case *Symlink:
+    return link.target, nil
+  case nil:
+    return "", ENOENT
+  }
 
-  _, exists := dstDir[baseName]
-  if exists { return errors.New("Destination file already exists.") }
+  return "", EINVAL
+}
 
-  switch inode := file.(type) {
+func (proc *ProcState) Link(src string, dst string) error {
+  srcRef, err := proc.resolve(src, false)
+  if err != nil { return err }
+  if srcRef.entry == nil { return ENOENT }
+  dstRef, err := proc.resolve(dst, false)
+  if err != nil { return err }
+
+  if err := proc.link(srcRef, dstRef); err != nil { return err }
+  return logPaths(recLink, srcRef, dstRef)
+}
+
+func (proc *ProcState) link(srcRef pathRef, dstRef pathRef) error {
+  if dstRef.entry != nil { return EEXIST }
+  if dstRef.slash { return ENOENT }
+  if mountOf(srcRef.entry, srcRef.dir) != dstRef.dir.inode().fs || mountRootOf(srcRef.entry) != nil {
+    return EXDEV
+  }
+  if err := proc.checkCreate(dstRef.dir); err != nil { return err }
+
+  switch srcRef.entry.(type) {
   case *Inode:
-    inode.incrementLinkCount()
+    if err := proc.copyUp(&srcRef); err != nil { return err }
+    srcRef.entry.(*Inode).incrementLinkCount()
+  case Directory:
+    // Directories have one parent, which their '..' names.
+    return EPERM
   }
 
-  dstDir[baseName] = file
+  dstRef.dir[dstRef.name] = srcRef.entry
+  notify(nil, "", srcRef.entry, IN_ATTRIB, 0)
+  notify(dstRef.dir, dstRef.name, srcRef.entry, IN_CREATE, 0)
   return nil
 }
 
+// Moves src to dst, replacing dst if it exists, as rename(2) does.
 func (proc *ProcState) Rename(src string, dst string) error {
-  err := proc.Link(src, dst)
+  return proc.Rename2(src, dst, 0)
+}
+
+// Rename with renameat2(2)'s flags: RENAME_NOREPLACE fails with EEXIST rather
+// than replace dst, and RENAME_EXCHANGE swaps src and dst, which must both
+// exist.
+func (proc *ProcState) Rename2(src string, dst string, flags RenameFlag) error {
+  if (flags & RENAME_EXCHANGE) != 0 && (flags & RENAME_NOREPLACE) != 0 { return EINVAL }
+  srcRef, err := proc.resolve(src, false)
+  if err != nil { return err }
+  dstRef, err := proc.resolve(dst, false)
   if err != nil { return err }
 
-  err = proc.Unlink(src)
-  return err
+  if err := proc.rename(srcRef, dstRef, flags); err != nil { return err }
+  return logRename(srcRef, dstRef, flags)
+}
+
+func (proc *ProcState) rename(srcRef pathRef, dstRef pathRef, flags RenameFlag) error {
+  exchange := (flags & RENAME_EXCHANGE) != 0
+  if !isEntryName(srcRef.name) || !isEntryName(dstRef.name) { return EINVAL }
+
+  srcDir, srcName, srcEntry := srcRef.dir, srcRef.name, srcRef.entry
+  dstDir, dstName, dstEntry := dstRef.dir, dstRef.name, dstRef.entry
+  if srcEntry == nil { return ENOENT }
+  exists := dstEntry != nil
+  if exchange && !exists { return ENOENT }
+  if exists && (flags & RENAME_NOREPLACE) != 0 { return EEXIST }
+
+  // Renaming something onto itself, or onto another link to the same inode,
+  // leaves everything as it was.
+  if exists && sameEntry(srcEntry, dstEntry) { return nil }
+
+  // Mount points stay put while mounted, and entries stay on their mount.
+  if mountRootOf(srcEntry) != nil || mountRootOf(dstEntry) != nil { return EBUSY }
+  if srcDir.inode().fs != dstDir.inode().fs { return EXDEV }
+
+  // On an overlay, directories with anything below stay where they are.
+  srcSub, srcIsDir := srcEntry.(Directory)
+  dstSub, dstIsDir := dstEntry.(Directory)
+  if srcIsDir && lowerOf(srcSub) != nil || exchange && dstIsDir && lowerOf(dstSub) != nil {
+    return EXDEV
+  }
+
+  // Only a directory can be renamed to a path ending in a slash.
+  if !srcIsDir && dstRef.slash { return ENOTDIR }
+
+  // A directory can't be moved under itself; it'd be cut off from the root.
+  if srcIsDir && srcSub.isAncestorOf(dstDir) { return EINVAL }
+  if exchange && dstIsDir && dstSub.isAncestorOf(srcDir) { return EINVAL }
+
+  if err := proc.checkRemove(srcDir, srcEntry); err != nil { return err }
+  var err error
+  if exists {
+    err = proc.checkRemove(dstDir, dstEntry)
+  } else {
+    err = proc.checkCreate(dstDir)
+  }
+  if err != nil { return err }
+
+  // Moving a directory elsewhere rewrites its '..'.
+  if srcIsDir && !sameDirectory(srcDir, dstDir) {
+    if err := proc.checkPermission(srcSub, M_WRITE); err != nil { return err }
+  }
+
+  if exists && !exchange {
+    switch {
+    case srcIsDir && !dstIsDir:
+      return ENOTDIR
+    case !srcIsDir && dstIsDir:
+      return EISDIR
+    case dstIsDir && len(dstSub.visibleNames()) > 0:
+      return ENOTEMPTY
+    }
+  }
+
+  // Files an overlay has below are copied up to be moved or replaced.
+  if err := proc.copyUp(&srcRef); err != nil { return err }
+  if err := proc.copyUp(&dstRef); err != nil { return err }
+  srcEntry, dstEntry = srcRef.entry, dstRef.entry
+
+  // Nothing fails past this point, so no one sees the rename half done.
+  dstDir[dstName] = srcEntry
+  makeOpaque(dstDir, dstName)
+  if exchange {
+    srcDir[srcName] = dstEntry
+    makeOpaque(srcDir, srcName)
+  } else {
+    delete(srcDir, srcName)
+    whiteout(srcDir, srcName)
+  }
+
+  if srcIsDir {
+    srcSub[".."] = dstDir
+    srcSub.header().name = dstName
+  }
+
+  if dstIsDir && exchange {
+    dstSub[".."] = srcDir
+    dstSub.header().name = srcName
+  }
+
+  if inode, ok := dstEntry.(*Inode); ok && !exchange {
+    inode.decrementLinkCount()
+    notify(nil, "", inode, IN_ATTRIB, 0)
+  }
+
+  cookie := newCookie()
+  notify(srcDir, srcName, srcEntry, IN_MOVED_FROM, cookie)
+  notify(dstDir, dstName, srcEntry, IN_MOVED_TO, cookie)
+  if exchange {
+    cookie = newCookie()
+    notify(dstDir, dstName, dstEntry, IN_MOVED_FROM, cookie)
+    notify(srcDir, srcName, dstEntry, IN_MOVED_TO, cookie)
+  }
+
+  return nil
 }
 
 // Opens a file and returns a file descriptor.
 func (proc *ProcState) Open(path string, flags AccessFlag,
 mode [3]FileMode) (FileDescriptor, error) {
+  // The descriptor is taken first, so that nothing is made without one.
+  fd, err := proc.getUnusedFd()
+  if err != nil { return fd, err }
   file, err := proc.openFile(path, flags, mode)
-  if err != nil { return FileDescriptor(-1), err }
+  if err != nil {
+    proc.returnFd(fd)
+    return FileDescriptor(-1), err
+  }
+  if err := lockOnOpen(file, flags); err != nil {
+    file.Close()
+    proc.returnFd(fd)
+    return FileDescriptor(-1), err
+  }
 
-  fd := proc.getUnusedFd()
   proc.fileDescriptorTable[fd] = file
+  proc.closeOnExec[fd] = (flags & O_CLOEXEC) != 0
   return fd, nil
 }
 
+/**
+* Duplicated descriptors share one open file, seek offset and flags included,
+* which is only closed when the last of them is. Files that keep count of
+* their descriptors implement retain(); those that don't, like Files from
+* drivers, have a count wrapped around them when first shared.
+*/
+
+type shareable interface {
+  retain()
+}
+
+type countedFile struct {
+  File
+  refs int
+}
+
+func (file *countedFile) retain() {
+  file.refs++
+}
+
+func (file *countedFile) Close() error {
+  file.refs--
+  if file.refs > 0 { return nil }
+  return file.File.Close()
+}
+
+// Returns the file at fd, ready to be shared with another descriptor.
+func (proc *ProcState) shareFile(fd FileDescriptor) (interface{File}, error) {
+  file, err := proc.getFile(fd)
+  if err != nil { return nil, err }
+
+  shared, ok := file.(shareable)
+  if !ok {
+    counted := &countedFile{File: file, refs: 1}
+    proc.fileDescriptorTable[fd] = counted
+    shared, file = counted, counted
+  }
+
+  shared.retain()
+  return file, nil
+}
+
+// Returns a new descriptor for the file open at fd.
+func (proc *ProcState) Dup(fd FileDescriptor) (FileDescriptor, error) {
+  newFd, err := proc.getUnusedFd()
+  if err != nil { return newFd, err }
+  file, err := proc.shareFile(fd)
+  if err != nil {
+    proc.returnFd(newFd)
+    return FileDescriptor(-1), err
+  }
+
+  proc.fileDescriptorTable[newFd] = file
+  return newFd, nil
+}
+
+// Makes newFd a descriptor for the file open at fd, closing whatever newFd was
+// open to first. Does nothing if the two are the same.
+func (proc *ProcState) Dup2(fd FileDescriptor, newFd FileDescriptor) (FileDescriptor, error) {
+  if fd == newFd {
+    if _, err := proc.getFile(fd); err != nil { return FileDescriptor(-1), err }
+    return newFd, nil
+  }
+
+  return proc.dupTo(fd, newFd, false)
+}
+
+// Dup2, but with O_CLOEXEC as the only allowed flag, and fd == newFd an error.
+func (proc *ProcState) Dup3(fd FileDescriptor, newFd FileDescriptor,
+flags AccessFlag) (FileDescriptor, error) {
+  if fd == newFd || (flags & ^O_CLOEXEC) != 0 { return FileDescriptor(-1), EINVAL }
+  return proc.dupTo(fd, newFd, (flags & O_CLOEXEC) != 0)
+}
+
+func (proc *ProcState) dupTo(fd FileDescriptor, newFd FileDescriptor,
+cloexec bool) (FileDescriptor, error) {
+  if newFd < 0 || newFd >= MAX_DESCRIPTORS { return FileDescriptor(-1), EBADF }
+
+  file, err := proc.shareFile(fd)
+  if err != nil { return FileDescriptor(-1), err }
+
+  // As in dup2(2), errors closing newFd are silently dropped.
+  if _, open := proc.fileDescriptorTable[newFd]; open { proc.Close(newFd) }
+
+  proc.claimFd(newFd)
+  proc.fileDescriptorTable[newFd] = file
+  proc.closeOnExec[newFd] = cloexec
+  return newFd, nil
+}
+
 func (proc *ProcState) Read(fd FileDescriptor, p []byte) (n int, err error) {
   file, err := proc.getFile(fd)
   if err != nil { return 0, err }
@@ -154,7 +528,21 @@ func (proc *ProcState) Read(fd FileDescriptor, p []byte) (n int, err error) {
 func (proc *ProcState) Write(fd FileDescriptor, p []byte) (n int, err error) {
   file, err := proc.getFile(fd)
   if err != nil { return 0, err }
-  return file.Write(p)
+
+  data, isData := file.(*DataFile)
+  if !isData { return file.Write(p) }
+
+  // With O_APPEND, where the write lands is only known after it's done.
+  n, err = file.Write(p)
+  if lerr := proc.wrote(data, data.seek - n, p[:n]); lerr != nil { return n, lerr }
+  return n, err
+}
+
+// Journals what was written to file at offset, and drops privileges for it.
+func (proc *ProcState) wrote(file *DataFile, offset int, p []byte) error {
+  if len(p) == 0 { return nil }
+  if err := logWrite(file.inode, offset, p); err != nil { return err }
+  return proc.dropPrivileges(file.ref(), file.inode)
 }
 
 func (proc *ProcState) Seek(fd FileDescriptor, offset int64, whence int) (int64, error) {
@@ -163,6 +551,103 @@ func (proc *ProcState) Seek(fd FileDescriptor, offset int64, whence int) (int64,
   return file.Seek(offset, whence)
 }
 
+// Returns the DataFile open at fd, or ESPIPE if something else is, as for the
+// calls that only make sense on a file with an offset.
+func (proc *ProcState) getDataFile(fd FileDescriptor) (*DataFile, error) {
+  file, err := proc.getFile(fd)
+  if err != nil { return nil, err }
+
+  switch file := file.(type) {
+  case *DataFile:
+    return file, nil
+  case *DirFile:
+    return nil, EISDIR
+  }
+
+  return nil, ESPIPE
+}
+
+// Reads from offset off of the file open at fd, leaving its offset alone.
+func (proc *ProcState) Pread(fd FileDescriptor, p []byte, off int64) (int, error) {
+  if host, isHost := proc.fileDescriptorTable[fd].(*hostFile); isHost {
+    return host.ReadAt(p, off)
+  }
+
+  file, err := proc.getDataFile(fd)
+  if err != nil { return 0, err }
+  return file.ReadAt(p, off)
+}
+
+// Writes at offset off of the file open at fd, leaving its offset alone.
+func (proc *ProcState) Pwrite(fd FileDescriptor, p []byte, off int64) (int, error) {
+  if host, isHost := proc.fileDescriptorTable[fd].(*hostFile); isHost {
+    return host.WriteAt(p, off)
+  }
+
+  file, err := proc.getDataFile(fd)
+  if err != nil { return 0, err }
+
+  n, err := file.WriteAt(p, off)
+  if lerr := proc.wrote(file, int(off), p[:n]); lerr != nil { return n, lerr }
+  return n, err
+}
+
+func (proc *ProcState) truncate(ref pathRef, inode *Inode, size int64) error {
+  if size < 0 { return EINVAL }
+  if err := inode.fs.checkWrite(); err != nil { return err }
+  if grow := size - int64(inode.data.Size()); grow > 0 && inode.fs.room(grow) < grow {
+    return ENOSPC
+  }
+
+  inode.truncate(size)
+  notify(ref.dir, ref.name, ref.entry, IN_MODIFY, 0)
+  if err := logTruncate(inode, size); err != nil { return err }
+  return proc.dropPrivileges(ref, inode)
+}
+
+// Cuts the file path names off at size, or extends it there with zeroes.
+func (proc *ProcState) Truncate(path string, size int64) error {
+  ref, err := proc.resolve(path, true)
+  if err != nil { return err }
+
+  switch entry := ref.entry.(type) {
+  case *Inode:
+    if err := proc.checkPermission(entry, M_WRITE); err != nil { return err }
+    if err := proc.copyUp(&ref); err != nil { return err }
+    return proc.truncate(ref, ref.entry.(*Inode), size)
+  case Directory:
+    return EISDIR
+  case nil:
+    return ENOENT
+  }
+
+  return EINVAL
+}
+
+// Truncate, but of the file open at fd, which must be open for writing.
+func (proc *ProcState) Ftruncate(fd FileDescriptor, size int64) error {
+  if host, isHost := proc.fileDescriptorTable[fd].(*hostFile); isHost {
+    return fileError(host.file.Truncate(size))
+  }
+
+  file, err := proc.getDataFile(fd)
+  if err == ESPIPE || err == EISDIR { return EINVAL }
+  if err != nil { return err }
+  if file.checkAccess(Write) != nil { return EINVAL }
+  return proc.truncate(file.ref(), file.inode, size)
+}
+
+// Makes everything written to fd so far durable: on the host for a file there,
+// or in the journal, if it's enabled. As everything goes through one journal,
+// that syncs more than just fd.
+func (proc *ProcState) Fsync(fd FileDescriptor) error {
+  file, err := proc.getFile(fd)
+  if err != nil { return err }
+  if host, isHost := file.(*hostFile); isHost { return fileError(host.file.Sync()) }
+  if globalState.journal == nil { return nil }
+  return globalState.journal.file.Sync()
+}
+
 /**
  * Resource freeing happens below. The memory of an inode is freed after it is
  * referenced by no open files and unlinked from all directories. This is
@@ -171,37 +656,52 @@ func (proc *ProcState) Seek(fd FileDescriptor, offset int64, whence int) (int64,
  */
 
 func (proc *ProcState) Unlink(path string) error {
-  dir, name, err := proc.resolveDirPath(path)
+  ref, err := proc.resolveWithHost(path, false)
   if err != nil { return err }
+  if host, isHost := ref.entry.(*hostEntry); isHost { return host.remove() }
 
-  file, ok := dir[name]
-  if !ok { return errors.New("Cannot unlink nonexisting file.") }
+  if err := proc.unlink(ref); err != nil { return err }
+  return logPaths(recUnlink, ref)
+}
 
-  switch inode := file.(type) {
-  case *Inode:
+func (proc *ProcState) unlink(ref pathRef) error {
+  if ref.entry == nil { return ENOENT }
+  if !isEntryName(ref.name) { return EINVAL }
+  if mountRootOf(ref.entry) != nil { return EBUSY }
+  if err := proc.checkRemove(ref.dir, ref.entry); err != nil { return err }
+
+  // What an overlay has below is only hidden.
+  if inode, isInode := ref.entry.(*Inode); isInode && sameEntry(ref.dir[ref.name], inode) {
     inode.decrementLinkCount()
   }
 
-  delete(dir, name)
+  delete(ref.dir, ref.name)
+  whiteout(ref.dir, ref.name)
+  notify(nil, "", ref.entry, IN_ATTRIB, 0)
+  notify(ref.dir, ref.name, ref.entry, IN_DELETE, 0)
   return nil
 }
 
 func (proc *ProcState) Close(fd FileDescriptor) error {
   file, err := proc.getFile(fd)
-  if err != nil { return errors.New("fd not found") }
+  if err != nil { return err }
 
   proc.returnFd(fd)
   delete(proc.fileDescriptorTable, fd)
-  return file.Close()
+  inode := lockableInode(file)
+  err = file.Close()
+  proc.releaseLocks(inode)
+  return err
 }
 
 func init() {
   InitGlobalState()
 }
 
+// Returns a new process whose standard streams are the host's. It has to Exit
+// once it's done with.
 func InitProc() *ProcState {
-  state := new(ProcState)
-  state.cwd = globalState.root
-  state.initFileDescriptorTableAndLastFD()
-  return state
+  proc, err := NewProc(ProcOptions{})
+  if err != nil { panic(err) }
+  return proc
 }
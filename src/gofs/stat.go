@@ -0,0 +1,170 @@
+package gofs
+
+import (
+  "gofs/dstore"
+  "time"
+)
+
+/**
+* Stat reports what kind of entry a path names along with its inode's
+* attributes, the way stat(2) does: the type is in the S_IFMT bits of Mode,
+* beside the permission bits. Entries without an inode have no number, times
+* or owner to report; they show as owned by root, with the mode permission
+* checks give them.
+*/
+
+const (
+  S_IFMT uint = 0170000
+  S_IFIFO uint = 0010000
+  S_IFCHR uint = 0020000
+  S_IFDIR uint = 0040000
+  S_IFREG uint = 0100000
+  S_IFLNK uint = 0120000
+)
+
+type Stat_t struct {
+  Ino uint64
+  Mode uint
+  Nlink int
+  Uid uint
+  Gid uint
+  Size int64
+  Blocks int64 // 512-byte blocks the data takes; holes take none
+  Atime time.Time
+  Mtime time.Time
+  Ctime time.Time
+  Btime time.Time
+}
+
+// An entry of a directory, as ReadDir returns them.
+type Dirent struct {
+  Name string
+  Ino uint64
+  Type uint // the S_IFMT bits of the entry's mode
+}
+
+func statInode(inode *Inode, kind uint, size int64) Stat_t {
+  return Stat_t{
+    Ino: inode.ino,
+    Mode: kind | inode.perms,
+    Nlink: inode.linkCount,
+    Uid: inode.ownerId,
+    Gid: inode.groupId,
+    Size: size,
+    Atime: inode.lastAccessTime,
+    Mtime: inode.lastModTime,
+    Ctime: inode.changeTime,
+    Btime: inode.createTime,
+  }
+}
+
+func statEntry(entry interface{}) Stat_t {
+  switch entry := entry.(type) {
+  case Directory:
+    return statInode(entry.inode(), S_IFDIR, 0)
+  case *Inode:
+    stat := statInode(entry, S_IFREG, int64(entry.data.Size()))
+    if pages, isPages := entry.data.(*dstore.PageStore); isPages {
+      stat.Blocks = int64(pages.Allocated() * dstore.PAGE_SIZE / 512)
+    }
+    return stat
+  case *Symlink:
+    return Stat_t{Mode: S_IFLNK | 0777, Nlink: 1, Uid: entry.ownerId, Gid: entry.groupId,
+      Size: int64(len(entry.target))}
+  case *Fifo:
+    return Stat_t{Mode: S_IFIFO | 0666, Nlink: 1}
+  case *HostDir:
+    // A mount whose directory is gone still shows as one.
+    stat, err := (&hostEntry{mount: entry, rel: "."}).stat(true)
+    if err != nil { return Stat_t{Mode: S_IFDIR | 0755, Nlink: 1} }
+    return stat
+  }
+
+  return Stat_t{Mode: S_IFCHR | 0666, Nlink: 1}
+}
+
+// Returns the attributes of what path names, following a final symlink.
+func (proc *ProcState) Stat(path string) (Stat_t, error) {
+  return proc.stat(path, true)
+}
+
+// Stat, but of a symlink itself rather than what it points to.
+func (proc *ProcState) Lstat(path string) (Stat_t, error) {
+  return proc.stat(path, false)
+}
+
+func (proc *ProcState) stat(path string, follow bool) (Stat_t, error) {
+  ref, err := proc.resolveWithHost(path, follow)
+  if err != nil { return Stat_t{}, err }
+  if host, isHost := ref.entry.(*hostEntry); isHost { return host.stat(follow) }
+  if ref.entry == nil { return Stat_t{}, ENOENT }
+  return statEntry(ref.entry), nil
+}
+
+// Returns the attributes of what is open at fd.
+func (proc *ProcState) Fstat(fd FileDescriptor) (Stat_t, error) {
+  file, err := proc.getFile(fd)
+  if err != nil { return Stat_t{}, err }
+
+  switch file := file.(type) {
+  case *DataFile:
+    return statEntry(file.inode), nil
+  case *DirFile:
+    return statEntry(file.dir), nil
+  case *pipeEnd:
+    return Stat_t{Mode: S_IFIFO | 0600, Nlink: 1}, nil
+  case *hostFile:
+    info, err := file.file.Stat()
+    if err != nil { return Stat_t{}, fileError(err) }
+    return hostStat(info), nil
+  }
+
+  return statEntry(nil), nil
+}
+
+// Returns the entries of the directory path names, sorted by name, without
+// '.' and '..'. Reading a directory needs read permission on it.
+func (proc *ProcState) ReadDir(path string) ([]Dirent, error) {
+  ref, err := proc.resolveWithHost(path, true)
+  if err != nil { return nil, err }
+  if host, isHost := hostOf(ref.entry); isHost { return host.readDir() }
+  if ref.entry == nil { return nil, ENOENT }
+
+  dir, isDir := ref.entry.(Directory)
+  if !isDir { return nil, ENOTDIR }
+  if err := proc.checkPermission(dir, M_READ); err != nil { return nil, err }
+
+  names := dir.visibleNames()
+  entries := make([]Dirent, len(names))
+  for i, name := range names {
+    entry, _ := lookup(dir, name)
+    stat := statEntry(entry)
+    entries[i] = Dirent{Name: name, Ino: stat.Ino, Type: stat.Mode & S_IFMT}
+  }
+
+  return entries, nil
+}
+
+// Lists the directory open at fd as ReadDir does, with the attributes of each
+// entry, as Lstat gives them. It's the directory that was opened that's
+// listed, wherever it's been renamed to since.
+func (proc *ProcState) FreadDir(fd FileDescriptor) ([]Dirent, []Stat_t, error) {
+  file, err := proc.getFile(fd)
+  if err != nil { return nil, nil, err }
+
+  switch file := file.(type) {
+  case *DirFile:
+    names := file.dir.visibleNames()
+    entries, stats := make([]Dirent, len(names)), make([]Stat_t, len(names))
+    for i, name := range names {
+      entry, _ := lookup(file.dir, name)
+      stats[i] = statEntry(entry)
+      entries[i] = Dirent{Name: name, Ino: stats[i].Ino, Type: stats[i].Mode & S_IFMT}
+    }
+    return entries, stats, nil
+  case *hostFile:
+    return file.readDir()
+  }
+
+  return nil, nil, ENOTDIR
+}
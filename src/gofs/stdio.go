@@ -0,0 +1,113 @@
+package gofs
+
+import (
+  "io"
+)
+
+/**
+* A process starts with descriptors 0, 1 and 2 open on its standard streams.
+* By default these are the host's, but NewProc can be given any io.Reader and
+* io.Writers instead, so a test can feed a process its input and capture what
+* it prints, or paths in GoFS to open instead, FIFOs included. Either way they
+* are ordinary descriptors: they can be Dup'd, closed and reused like any
+* other. Closing the last descriptor for a supplied stream doesn't close the
+* stream itself; whoever supplied it still owns it.
+*/
+
+// Options for NewProc. For each stream, at most one of the io.Reader or
+// io.Writer and the path may be given; with neither, the host's is used.
+type ProcOptions struct {
+  Stdin io.Reader
+  Stdout io.Writer
+  Stderr io.Writer
+
+  // Paths opened in the new process, like a shell's redirections: stdin is
+  // opened to read, stdout and stderr to append, creating them if missing.
+  StdinPath string
+  StdoutPath string
+  StderrPath string
+
+  // Who the process acts for; see cred.go. The zero values make it root.
+  Uid uint
+  Gid uint
+  Groups []uint
+}
+
+// A File for a standard stream supplied from outside GoFS. It's never closed,
+// so it needn't count its descriptors, and the host's is shared by every
+// process that uses it.
+type stream struct {
+  reader io.Reader
+  writer io.Writer
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+  if s.reader == nil { return 0, EBADF }
+  return s.reader.Read(p)
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+  if s.writer == nil { return 0, EBADF }
+  return s.writer.Write(p)
+}
+
+func (s *stream) Seek(offset int64, whence int) (int64, error) {
+  return 0, ESPIPE
+}
+
+// Streams are shareable, so that Dup doesn't wrap them in a countedFile.
+func (s *stream) retain() {}
+
+func (s *stream) Close() error {
+  return nil
+}
+
+// Opens the next free descriptor on a standard stream: on path if it's given,
+// else on reader or writer, else on the host's stream.
+func (proc *ProcState) openStream(path string, flags AccessFlag,
+  reader io.Reader, writer io.Writer, host *stream) error {
+  if path != "" {
+    if reader != nil || writer != nil { return EINVAL }
+    _, err := proc.Open(path, flags, UserMode())
+    return err
+  }
+
+  file := host
+  if reader != nil || writer != nil { file = &stream{reader: reader, writer: writer} }
+  fd, err := proc.getUnusedFd()
+  if err != nil { return err }
+  proc.fileDescriptorTable[fd] = file
+  return nil
+}
+
+// Returns a new process with its standard streams set up as opts says. It has
+// to Exit once it's done with.
+func NewProc(opts ProcOptions) (*ProcState, error) {
+  proc := new(ProcState)
+  proc.cwd, proc.root = globalState.root, globalState.root
+  proc.umask = DEFAULT_UMASK
+  proc.uid, proc.gid = opts.Uid, opts.Gid
+  proc.groups = append([]uint(nil), opts.Groups...)
+  proc.initFileDescriptorTableAndLastFD()
+
+  output := O_WRONLY | O_CREAT | O_APPEND
+  err := proc.openStream(opts.StdinPath, O_RDONLY, opts.Stdin, nil,
+    &stream{reader: globalState.stdIn})
+  if err == nil {
+    err = proc.openStream(opts.StdoutPath, output, nil, opts.Stdout,
+      &stream{writer: globalState.stdOut})
+  }
+
+  if err == nil {
+    err = proc.openStream(opts.StderrPath, output, nil, opts.Stderr,
+      &stream{writer: globalState.stdErr})
+  }
+
+  if err != nil {
+    for _, fd := range proc.openFds() { proc.Close(fd) }
+    return nil, err
+  }
+
+  registerProc(proc)
+  return proc, nil
+}
@@ -0,0 +1,70 @@
+package gofs
+
+import (
+  "bytes"
+  "io"
+  "strings"
+  "testing"
+)
+
+func TestCapturedStdio(t *testing.T) {
+  var stdout, stderr bytes.Buffer
+  p, err := NewProc(ProcOptions{
+    Stdin: strings.NewReader("input"),
+    Stdout: &stdout,
+    Stderr: &stderr,
+  })
+  AssertNoErr(t, err)
+
+  buffer := make([]byte, 5)
+  AssertTrue(t, p.safeRead(t, 0, buffer) == 5, "Short read from stdin.")
+  AssertEqualBytes(t, buffer, []byte("input"))
+  _, err = p.Write(0, buffer)
+  AssertTrue(t, err == EBADF, "Wrote to stdin.")
+
+  p.safeWrite(t, 1, []byte("out"))
+  p.safeWrite(t, 2, []byte("err"))
+
+  // stdio descriptors are ordinary ones: Dup'd, closed and reused
+  fd, err := p.Dup(1)
+  AssertNoErr(t, err)
+  p.safeClose(t, 1)
+  p.safeWrite(t, fd, []byte("put"))
+  AssertTrue(t, stdout.String() == "output", "Bad stdout: " + stdout.String())
+  AssertTrue(t, stderr.String() == "err", "Bad stderr: " + stderr.String())
+
+  p.safeClose(t, 0)
+  reused := p.safeOpen(t, "/dev/null", O_RDONLY, UserMode())
+  AssertTrue(t, reused == 0, "fd 0 wasn't reused.")
+  _, err = p.Read(0, buffer)
+  AssertTrue(t, err == io.EOF, "fd 0 isn't /dev/null.")
+
+  leaked, err := p.Exit()
+  AssertNoErr(t, err)
+  AssertTrue(t, len(leaked) == 1 && leaked[0] == fd, "Wrong leaked descriptors.")
+}
+
+func TestStdioPaths(t *testing.T) {
+  setup := InitProc()
+  defer setup.Exit()
+  setup.writeFile(t, "/stdin", []byte("from a file"))
+
+  p, err := NewProc(ProcOptions{StdinPath: "/stdin", StdoutPath: "/stdout",
+    StderrPath: "/stdout"})
+  AssertNoErr(t, err)
+
+  buffer := make([]byte, 11)
+  p.safeRead(t, 0, buffer)
+  p.safeWrite(t, 1, buffer)
+  p.safeWrite(t, 2, []byte("!"))
+  AssertEqualBytes(t, setup.readFile(t, "/stdout", 12), []byte("from a file!"))
+  p.Exit()
+
+  _, err = NewProc(ProcOptions{StdinPath: "/missing"})
+  AssertTrue(t, err == ENOENT, "Expected ENOENT.")
+  _, err = NewProc(ProcOptions{Stdin: strings.NewReader(""), StdinPath: "/stdin"})
+  AssertTrue(t, err == EINVAL, "Expected EINVAL.")
+
+  setup.safeUnlink(t, "/stdin")
+  setup.safeUnlink(t, "/stdout")
+}
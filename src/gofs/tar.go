@@ -0,0 +1,324 @@
+package gofs
+
+import (
+  "archive/tar"
+  "bytes"
+  "gofs/dstore"
+  "io"
+  "path"
+  "strings"
+  "time"
+)
+
+/**
+* ImportTar and ExportTar move trees in and out of GoFS as tar archives, so a
+* test can start from a fixture made with tar(1) and leave behind one to look
+* at. Both work through a ProcState like any other caller, with its permissions,
+* so what they do is journaled like the calls they're made of.
+*
+* Archives are written in the PAX format, which holds what a tree has:
+*   Directories, files, symlinks and FIFOs, with modes and owners.
+*   Times to the nanosecond: access, change and modification.
+*   Hard links: the second name of an inode links to the first.
+*   Extended attributes, as SCHILY.xattr records, as GNU tar writes them.
+*   Device nodes, as character devices with their driver in a GOFS.driver
+*   record; the standard devices also get the numbers Linux gives them.
+*
+* Sparse archives, of either GNU format, are read, and a file's pages of zeroes
+* are left as holes. archive/tar can't write sparse entries, so holes are
+* written out as zeroes; they become holes again when the archive is imported.
+*
+* Import takes names as relative to dest, as tar does, and refuses those that
+* would climb out of it. Symlinks are made last, so that nothing the archive
+* holds is made through one. Directories get their modes and times once all
+* that's in them is in, so that a read-only one can be filled and its time is
+* the archive's. Only root gives entries the owners the archive has, and only
+* root makes device nodes; anyone else skips them.
+*/
+
+const paxXattr = "SCHILY.xattr."
+const paxDriver = "GOFS.driver"
+
+// The numbers Linux gives the standard devices.
+var deviceNumbers = map[string][2]int64{
+  "null": {1, 3},
+  "zero": {1, 5},
+  "full": {1, 7},
+  "urandom": {1, 9},
+}
+
+// Writes the tree at src to w as a tar archive, with names relative to src.
+func ExportTar(proc *ProcState, src string, w io.Writer) error {
+  stat, err := proc.Stat(src)
+  if err != nil { return err }
+  if stat.Mode & S_IFMT != S_IFDIR { return ENOTDIR }
+
+  tw := tar.NewWriter(w)
+  seen := make(map[uint64]string) // the names inodes were first written under
+  err = walkArchive(proc, src, "", func(full string, name string, stat Stat_t) error {
+    hdr, err := tarHeader(proc, full, name, stat, seen)
+    if err != nil { return err }
+    if err := tw.WriteHeader(hdr); err != nil { return err }
+    if hdr.Typeflag == tar.TypeReg { return exportData(proc, tw, full) }
+    return nil
+  })
+  if err != nil { return err }
+  return tw.Close()
+}
+
+// Calls visit for what's in the directory dir and below, depth first, with its
+// path and its name in an archive, under prefix. Directories' names end in '/'.
+func walkArchive(proc *ProcState, dir string, prefix string,
+  visit func(full string, name string, stat Stat_t) error) error {
+  entries, err := proc.ReadDir(dir)
+  if err != nil { return err }
+
+  for _, entry := range entries {
+    full, name := path.Join(dir, entry.Name), prefix + entry.Name
+    stat, err := proc.Lstat(full)
+    if err != nil { return err }
+
+    isDir := stat.Mode & S_IFMT == S_IFDIR
+    if isDir { name += "/" }
+    if err := visit(full, name, stat); err != nil { return err }
+    if isDir {
+      if err := walkArchive(proc, full, name, visit); err != nil { return err }
+    }
+  }
+
+  return nil
+}
+
+// Returns the header for what's at full, with attributes stat, to be named
+// name.
+func tarHeader(proc *ProcState, full string, name string, stat Stat_t,
+  seen map[uint64]string) (*tar.Header, error) {
+  hdr := &tar.Header{Name: name, Mode: int64(stat.Mode &^ S_IFMT), Uid: int(stat.Uid),
+    Gid: int(stat.Gid), ModTime: time.Unix(0, 0), Format: tar.FormatPAX}
+  // Entries without an inode have no times.
+  if !stat.Mtime.IsZero() {
+    hdr.ModTime, hdr.AccessTime, hdr.ChangeTime = stat.Mtime, stat.Atime, stat.Ctime
+  }
+
+  switch stat.Mode & S_IFMT {
+  case S_IFDIR:
+    hdr.Typeflag = tar.TypeDir
+  case S_IFREG:
+    if first, linked := seen[stat.Ino]; linked && stat.Nlink > 1 {
+      hdr.Typeflag, hdr.Linkname = tar.TypeLink, first
+      return hdr, nil
+    }
+    seen[stat.Ino] = name
+    hdr.Typeflag, hdr.Size = tar.TypeReg, stat.Size
+  case S_IFLNK:
+    target, err := proc.Readlink(full)
+    if err != nil { return nil, err }
+    hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, target
+    return hdr, nil
+  case S_IFIFO:
+    hdr.Typeflag = tar.TypeFifo
+    return hdr, nil
+  default:
+    hdr.Typeflag = tar.TypeChar
+    ref, err := proc.resolve(full, false)
+    if err != nil { return nil, err }
+    if dev, isDev := ref.entry.(*Device); isDev {
+      hdr.PAXRecords = map[string]string{paxDriver: dev.driver}
+      hdr.Devmajor, hdr.Devminor = deviceNumbers[dev.driver][0], deviceNumbers[dev.driver][1]
+    }
+    return hdr, nil
+  }
+
+  names, err := proc.Listxattr(full)
+  if err != nil { return nil, err }
+  for _, xattr := range names {
+    value, err := proc.Getxattr(full, xattr)
+    if err != nil { return nil, err }
+    if hdr.PAXRecords == nil { hdr.PAXRecords = make(map[string]string) }
+    hdr.PAXRecords[paxXattr + xattr] = string(value)
+  }
+
+  return hdr, nil
+}
+
+// Copies the data of the file at full to w.
+func exportData(proc *ProcState, w io.Writer, full string) error {
+  fd, err := proc.Open(full, O_RDONLY, UserMode())
+  if err != nil { return err }
+  defer proc.Close(fd)
+
+  buf := make([]byte, 32 * 1024)
+  for {
+    n, err := proc.Read(fd, buf)
+    if n > 0 {
+      if _, err := w.Write(buf[:n]); err != nil { return err }
+    }
+    if err == io.EOF || n == 0 && err == nil { return nil }
+    if err != nil { return err }
+  }
+}
+
+// An entry whose attributes are set once everything else is in.
+type pendingEntry struct {
+  path string
+  hdr *tar.Header
+}
+
+// Makes what the tar archive r holds under the directory dest.
+func ImportTar(proc *ProcState, r io.Reader, dest string) error {
+  stat, err := proc.Stat(dest)
+  if err != nil { return err }
+  if stat.Mode & S_IFMT != S_IFDIR { return ENOTDIR }
+
+  tr := tar.NewReader(r)
+  var dirs, symlinks []pendingEntry
+  for {
+    hdr, err := tr.Next()
+    if err == io.EOF { break }
+    if err != nil { return err }
+    full, err := archivePath(dest, hdr.Name)
+    if err != nil { return err }
+    if err := makeParents(proc, dest, full); err != nil { return err }
+
+    switch hdr.Typeflag {
+    case tar.TypeDir:
+      dirs = append(dirs, pendingEntry{full, hdr})
+      err = importDir(proc, full)
+    case tar.TypeSymlink:
+      symlinks = append(symlinks, pendingEntry{full, hdr})
+    case tar.TypeReg, tar.TypeGNUSparse:
+      err = importData(proc, full, hdr, tr)
+    case tar.TypeLink:
+      err = importLink(proc, dest, full, hdr)
+    case tar.TypeFifo:
+      err = makeWay(proc, full)
+      if err == nil { err = proc.Mkfifo(full) }
+    case tar.TypeChar:
+      err = importDevice(proc, full, hdr)
+    default:
+      err = EINVAL
+    }
+    if err != nil { return err }
+  }
+
+  for _, link := range symlinks {
+    if err := makeWay(proc, link.path); err != nil { return err }
+    if err := proc.Symlink(link.hdr.Linkname, link.path); err != nil { return err }
+    if proc.uid != 0 { continue }
+    if err := proc.Lchown(link.path, link.hdr.Uid, link.hdr.Gid); err != nil { return err }
+  }
+
+  // Inner directories come later in the archive, and are done first.
+  for i := len(dirs) - 1; i >= 0; i-- {
+    if err := importAttrs(proc, dirs[i].path, dirs[i].hdr); err != nil { return err }
+  }
+
+  return nil
+}
+
+// Returns where the archive's name goes under dest, as tar does.
+func archivePath(dest string, name string) (string, error) {
+  for _, elem := range strings.Split(name, "/") {
+    if elem == ".." { return "", EINVAL }
+  }
+
+  return path.Join(dest, name), nil
+}
+
+// Makes the directories between dest and full the archive has no entries for.
+func makeParents(proc *ProcState, dest string, full string) error {
+  parent := path.Dir(full)
+  if len(parent) <= len(dest) { return nil }
+  if _, err := proc.Lstat(parent); err != ENOENT { return err }
+
+  if err := makeParents(proc, dest, parent); err != nil { return err }
+  return proc.Mkdir(parent)
+}
+
+// Removes what's at full, as tar does to put an entry there.
+func makeWay(proc *ProcState, full string) error {
+  if err := proc.Unlink(full); err != nil && err != ENOENT { return err }
+  return nil
+}
+
+func importDir(proc *ProcState, full string) error {
+  err := proc.Mkdir(full)
+  if err != EEXIST { return err }
+
+  stat, err := proc.Lstat(full)
+  if err != nil { return err }
+  if stat.Mode & S_IFMT != S_IFDIR { return EEXIST }
+  return nil
+}
+
+func importData(proc *ProcState, full string, hdr *tar.Header, r io.Reader) error {
+  if err := makeWay(proc, full); err != nil { return err }
+  fd, err := proc.Open(full, O_WRONLY|O_CREAT|O_EXCL, UserMode())
+  if err != nil { return err }
+
+  err = writeSparse(proc, fd, r, hdr.Size)
+  if cerr := proc.Close(fd); err == nil { err = cerr }
+  if err != nil { return err }
+  return importAttrs(proc, full, hdr)
+}
+
+// Copies size bytes from r to fd, leaving its pages of zeroes as holes.
+func writeSparse(proc *ProcState, fd FileDescriptor, r io.Reader, size int64) error {
+  page, zeroes := make([]byte, dstore.PAGE_SIZE), make([]byte, dstore.PAGE_SIZE)
+  for off := int64(0); off < size; off += int64(len(page)) {
+    n, err := io.ReadFull(r, page[:min(int64(len(page)), size - off)])
+    if err != nil { return err }
+    if bytes.Equal(page[:n], zeroes[:n]) { continue }
+
+    wrote, err := proc.Pwrite(fd, page[:n], off)
+    if err != nil { return err }
+    if wrote < n { return ENOSPC }
+  }
+
+  return proc.Ftruncate(fd, size)
+}
+
+func importLink(proc *ProcState, dest string, full string, hdr *tar.Header) error {
+  target, err := archivePath(dest, hdr.Linkname)
+  if err != nil { return err }
+  if err := makeWay(proc, full); err != nil { return err }
+  return proc.Link(target, full)
+}
+
+func importDevice(proc *ProcState, full string, hdr *tar.Header) error {
+  if proc.uid != 0 { return nil }
+  driver := hdr.PAXRecords[paxDriver]
+  for name, numbers := range deviceNumbers {
+    if driver == "" && numbers == [2]int64{hdr.Devmajor, hdr.Devminor} { driver = name }
+  }
+  if driver == "" { return ENXIO }
+
+  if err := makeWay(proc, full); err != nil { return err }
+  return proc.Mknod(full, driver)
+}
+
+// Gives what's at full the attributes hdr has.
+func importAttrs(proc *ProcState, full string, hdr *tar.Header) error {
+  for key, value := range hdr.PAXRecords {
+    if name, isXattr := strings.CutPrefix(key, paxXattr); isXattr {
+      if err := proc.Setxattr(full, name, []byte(value), 0); err != nil { return err }
+    }
+  }
+
+  // Chown clears the set-id bits, so it goes first.
+  if proc.uid == 0 {
+    if err := proc.Chown(full, hdr.Uid, hdr.Gid); err != nil { return err }
+  }
+
+  atime := hdr.AccessTime
+  if atime.IsZero() { atime = hdr.ModTime }
+  return restoreAttrs(proc, full, uint(hdr.Mode), atime, hdr.ModTime)
+}
+
+// Gives what's at full the permission bits of mode and the times an archive
+// has for it.
+func restoreAttrs(proc *ProcState, full string, mode uint, atime time.Time,
+  mtime time.Time) error {
+  if err := proc.Chmod(full, mode & 07777); err != nil { return err }
+  return proc.Utimes(full, [2]Timespec{TimespecOf(atime), TimespecOf(mtime)})
+}
@@ -0,0 +1,172 @@
+package gofs
+
+import (
+  "archive/tar"
+  "bytes"
+  "fmt"
+  "gofs/dstore"
+  "testing"
+  "time"
+)
+
+func TestTar(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/t")
+  AssertNoErr(t, p.Mount("none", "/t", "memfs", 0, 0))
+  p.safeMkdir(t, "/t/src")
+  p.safeMkdir(t, "/t/src/sub")
+  content := randBytes(dstore.PAGE_SIZE + 12)
+  p.writeFile(t, "/t/src/sub/file", content)
+  p.safeLink(t, "/t/src/sub/file", "/t/src/hard")
+  AssertNoErr(t, p.Symlink("sub/file", "/t/src/link"))
+  AssertNoErr(t, p.Lchown("/t/src/link", 1000, 1000))
+  AssertNoErr(t, p.Mkfifo("/t/src/fifo"))
+  AssertNoErr(t, p.Mknod("/t/src/null", "null"))
+  AssertNoErr(t, p.Setxattr("/t/src/sub/file", "user.tag", []byte("file"), 0))
+  AssertNoErr(t, p.Chown("/t/src/sub/file", 1000, 1000))
+  AssertNoErr(t, p.Chmod("/t/src/sub/file", 0640))
+  mtime := time.Unix(1000000000, 123456789)
+  AssertNoErr(t, p.Utimes("/t/src/sub/file", [2]Timespec{TimespecOf(mtime), TimespecOf(mtime)}))
+  AssertNoErr(t, p.Chmod("/t/src/sub", 0550))
+
+  // a page of data between holes
+  fd := p.safeOpen(t, "/t/src/sparse", O_RDWR|O_CREAT, UserMode())
+  _, err := p.Pwrite(fd, content[:dstore.PAGE_SIZE], 3 * dstore.PAGE_SIZE)
+  AssertNoErr(t, err)
+  AssertNoErr(t, p.Ftruncate(fd, 6 * dstore.PAGE_SIZE))
+  p.safeClose(t, fd)
+  stat, err := p.Stat("/t/src/sparse")
+  AssertTrue(t, err == nil && stat.Blocks == dstore.PAGE_SIZE / 512, "Holes took pages.")
+
+  var archive bytes.Buffer
+  AssertNoErr(t, ExportTar(p, "/t/src", &archive))
+  AssertTrue(t, ExportTar(p, "/t/src/hard", &archive) == ENOTDIR, "Exported a file.")
+
+  // the archive is one tar(1) can read
+  tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+  headers := make(map[string]*tar.Header)
+  for hdr, err := tr.Next(); err == nil; hdr, err = tr.Next() {
+    headers[hdr.Name] = hdr
+  }
+  AssertTrue(t, headers["sub/"] != nil && headers["sub/file"].Typeflag == tar.TypeLink &&
+    headers["sub/file"].Linkname == "hard", "Bad hard link in archive.")
+  AssertTrue(t, headers["hard"].PAXRecords["SCHILY.xattr.user.tag"] == "file",
+    "Xattr missing from archive.")
+  AssertTrue(t, headers["null"].Typeflag == tar.TypeChar && headers["null"].Devminor == 3,
+    "Bad device in archive.")
+
+  p.safeMkdir(t, "/t/dst")
+  AssertNoErr(t, ImportTar(p, bytes.NewReader(archive.Bytes()), "/t/dst"))
+  AssertEqualBytes(t, content, p.readFile(t, "/t/dst/link", len(content)))
+
+  // links stay links, and attributes come along
+  a, err := p.Stat("/t/dst/hard")
+  AssertNoErr(t, err)
+  b, err := p.Stat("/t/dst/sub/file")
+  AssertNoErr(t, err)
+  AssertTrue(t, a.Ino == b.Ino && a.Nlink == 2, "Hard link came back as a copy.")
+  AssertTrue(t, a.Mode == S_IFREG | 0640 && a.Uid == 1000 && a.Gid == 1000 && a.Mtime.Equal(mtime),
+    "Lost a file's attributes.")
+  tag, err := p.Getxattr("/t/dst/hard", "user.tag")
+  AssertTrue(t, err == nil && string(tag) == "file", "Lost an xattr.")
+  target, err := p.Readlink("/t/dst/link")
+  AssertTrue(t, err == nil && target == "sub/file", "Bad symlink: " + target)
+  stat, err = p.Lstat("/t/dst/link")
+  AssertTrue(t, err == nil && stat.Uid == 1000 && stat.Gid == 1000, "Lost a symlink's owner.")
+  stat, err = p.Lstat("/t/dst/fifo")
+  AssertTrue(t, err == nil && stat.Mode & S_IFMT == S_IFIFO, "Lost a FIFO.")
+  stat, err = p.Lstat("/t/dst/null")
+  AssertTrue(t, err == nil && stat.Mode & S_IFMT == S_IFCHR, "Lost a device.")
+  stat, err = p.Stat("/t/dst/sub")
+  AssertTrue(t, err == nil && stat.Mode == S_IFDIR | 0550, "Lost a directory's mode.")
+
+  // zeroes come back as holes
+  stat, err = p.Stat("/t/dst/sparse")
+  AssertTrue(t, err == nil && stat.Size == 6 * dstore.PAGE_SIZE &&
+    stat.Blocks == dstore.PAGE_SIZE / 512, "Holes were filled in.")
+  AssertEqualBytes(t, p.readFile(t, "/t/src/sparse", 6 * dstore.PAGE_SIZE),
+    p.readFile(t, "/t/dst/sparse", 6 * dstore.PAGE_SIZE))
+
+  // anyone but root leaves devices out
+  user, err := NewProc(ProcOptions{Uid: 1000, Gid: 1000})
+  AssertNoErr(t, err)
+  p.safeMkdir(t, "/t/user")
+  AssertNoErr(t, p.Chown("/t/user", 1000, 1000))
+  AssertNoErr(t, ImportTar(user, bytes.NewReader(archive.Bytes()), "/t/user"))
+  _, err = p.Lstat("/t/user/null")
+  AssertTrue(t, err == ENOENT, "A user imported a device.")
+  AssertEqualBytes(t, content, p.readFile(t, "/t/user/link", len(content)))
+  user.Exit()
+
+  // names can't climb out, and missing directories are made
+  var crafted bytes.Buffer
+  tw := tar.NewWriter(&crafted)
+  AssertNoErr(t, tw.WriteHeader(&tar.Header{Name: "deep/er/file", Mode: 0644, Size: 4}))
+  _, err = tw.Write([]byte("deep"))
+  AssertNoErr(t, err)
+  AssertNoErr(t, tw.WriteHeader(&tar.Header{Name: "../escape", Mode: 0644}))
+  AssertNoErr(t, tw.Close())
+  err = ImportTar(p, bytes.NewReader(crafted.Bytes()), "/t/dst")
+  AssertTrue(t, err == EINVAL, "Imported a name outside dest.")
+  _, err = p.Stat("/t/escape")
+  AssertTrue(t, err == ENOENT, "Wrote outside dest.")
+  AssertTrue(t, string(p.readFile(t, "/t/dst/deep/er/file", 8)) == "deep", "Missing directories not made.")
+
+  AssertNoErr(t, p.Unmount("/t"))
+  p.safeUnlink(t, "/t")
+  p.Exit()
+}
+
+// Returns an archive holding one old GNU sparse file, as tar(1) writes with
+// --sparse: size bytes long, with data at offset and holes elsewhere. The
+// archive/tar package can read these but not write them.
+func gnuSparseTar(name string, data []byte, offset int64, size int64) []byte {
+  hdr := make([]byte, 512)
+  octal := func(field []byte, v int64) {
+    copy(field, fmt.Sprintf("%0*o", len(field) - 1, v))
+  }
+
+  copy(hdr[0:100], name)
+  octal(hdr[100:108], 0644)
+  octal(hdr[108:116], 0)
+  octal(hdr[116:124], 0)
+  octal(hdr[124:136], int64(len(data)))
+  octal(hdr[136:148], 1000000000)
+  hdr[156] = tar.TypeGNUSparse
+  copy(hdr[257:265], "ustar  \x00")
+  // the first of four sparse entries, then the file's real size
+  octal(hdr[386:398], offset)
+  octal(hdr[398:410], int64(len(data)))
+  octal(hdr[483:495], size)
+
+  copy(hdr[148:156], "        ")
+  sum := 0
+  for _, b := range hdr {
+    sum += int(b)
+  }
+  copy(hdr[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+  archive := append(hdr, data...)
+  archive = append(archive, make([]byte, (512 - len(data) % 512) % 512)...)
+  return append(archive, make([]byte, 1024)...)
+}
+
+func TestTarGNUSparse(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/sparse")
+  content := randBytes(dstore.PAGE_SIZE)
+  archive := gnuSparseTar("holes", content, 3 * dstore.PAGE_SIZE, 6 * dstore.PAGE_SIZE)
+  AssertNoErr(t, ImportTar(p, bytes.NewReader(archive), "/sparse"))
+
+  // only the data takes pages; the holes read as zeroes
+  stat, err := p.Stat("/sparse/holes")
+  AssertTrue(t, err == nil && stat.Size == 6 * dstore.PAGE_SIZE &&
+    stat.Blocks == dstore.PAGE_SIZE / 512, "Sparse file's holes were filled in.")
+  expected := append(make([]byte, 3 * dstore.PAGE_SIZE), content...)
+  expected = append(expected, make([]byte, 2 * dstore.PAGE_SIZE)...)
+  AssertEqualBytes(t, p.readFile(t, "/sparse/holes", 6 * dstore.PAGE_SIZE), expected)
+
+  p.safeUnlink(t, "/sparse/holes")
+  p.safeUnlink(t, "/sparse")
+  p.Exit()
+}
@@ -38,3 +38,159 @@ func TestSplitPath(t *testing.T) {
     if exp1 != actual1 { t.Error("Expected:", exp1, "Got:", actual1) }
   }
 }
+
+// Builds /rp with: a/b/file, f, link -> a/b, abs -> /rp/a, toF -> f,
+// loop1 <-> loop2, and dangling -> nowhere.
+func setupResolveTree(t *testing.T, p *ProcState) {
+  for _, dir := range []string{"/rp", "/rp/a", "/rp/a/b"} {
+    AssertNoErr(t, p.Mkdir(dir))
+  }
+
+  for _, file := range []string{"/rp/a/b/file", "/rp/f"} {
+    fd, err := p.Open(file, O_CREAT, UserMode())
+    AssertNoErr(t, err)
+    AssertNoErr(t, p.Close(fd))
+  }
+
+  links := [][2]string{
+    {"a/b", "/rp/link"},
+    {"/rp/a", "/rp/abs"},
+    {"f", "/rp/toF"},
+    {"loop2", "/rp/loop1"},
+    {"loop1", "/rp/loop2"},
+    {"nowhere", "/rp/dangling"},
+  }
+
+  for _, link := range links {
+    AssertNoErr(t, p.Symlink(link[0], link[1]))
+  }
+}
+
+func TestRealpath(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  setupResolveTree(t, p)
+  defer removeTree(p, "/rp")
+
+  tests := []struct {
+    path string
+    real string
+    err  error
+  }{
+    {"/", "/", nil},
+    {"//", "/", nil},
+    {"/..", "/", nil},
+    {"/../rp/./a", "/rp/a", nil},
+    {"/rp/a/b/file", "/rp/a/b/file", nil},
+    {"/rp//a///b/./file", "/rp/a/b/file", nil},
+    {"/rp/a/b/../b/file", "/rp/a/b/file", nil},
+    {"/rp/a/b/", "/rp/a/b", nil},
+    {"/rp/link/file", "/rp/a/b/file", nil},
+    {"/rp/link", "/rp/a/b", nil},
+    {"/rp/link/", "/rp/a/b", nil},
+    {"/rp/abs/b", "/rp/a/b", nil},
+    {"/rp/toF", "/rp/f", nil},
+    // '..' applies to where a symlink led, not to the path written.
+    {"/rp/link/../..", "/rp", nil},
+    {"/rp/a/b/file/", "", ENOTDIR},
+    {"/rp/a/b/file/..", "", ENOTDIR},
+    {"/rp/f/.", "", ENOTDIR},
+    {"/rp/toF/", "", ENOTDIR},
+    {"/rp/missing", "", ENOENT},
+    {"/rp/missing/file", "", ENOENT},
+    {"/rp/dangling", "", ENOENT},
+    {"/rp/dangling/x", "", ENOENT},
+    {"/rp/loop1", "", ELOOP},
+    {"/rp/loop1/x", "", ELOOP},
+    {"", "", ENOENT},
+  }
+
+  for _, test := range tests {
+    real, err := p.Realpath(test.path)
+    if err != test.err || real != test.real {
+      t.Errorf("Realpath(%q) = %q, %v; expected %q, %v",
+        test.path, real, err, test.real, test.err)
+    }
+  }
+
+  // relative paths start from the cwd
+  AssertNoErr(t, p.Chdir("/rp/link"))
+  cwd, err := p.Getcwd()
+  AssertNoErr(t, err)
+  AssertTrue(t, cwd == "/rp/a/b", "Getcwd should show where symlinks led.")
+
+  real, err := p.Realpath("../../f")
+  AssertNoErr(t, err)
+  AssertTrue(t, real == "/rp/f", "Bad relative Realpath.")
+  AssertNoErr(t, p.Chdir("/"))
+}
+
+func TestResolveErrors(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  setupResolveTree(t, p)
+  defer removeTree(p, "/rp")
+
+  open := func(path string, flags AccessFlag) error {
+    fd, err := p.Open(path, flags, UserMode())
+    if err == nil { p.Close(fd) }
+    return err
+  }
+
+  tests := []struct {
+    name string
+    err  error
+    got  error
+  }{
+    {"open file/", ENOTDIR, open("/rp/f/", O_RDONLY)},
+    {"open dir", nil, open("/rp/a", O_RDONLY)},
+    {"write dir", EISDIR, open("/rp/a", O_RDWR)},
+    {"write dir/", EISDIR, open("/rp/a/", O_WRONLY)},
+    {"create new/", EISDIR, open("/rp/new/", O_RDWR|O_CREAT)},
+    {"create in file", ENOTDIR, open("/rp/f/new", O_RDWR|O_CREAT)},
+    {"create excl", EEXIST, open("/rp/f", O_RDWR|O_CREAT|O_EXCL)},
+    {"create excl dir", EEXIST, open("/rp/a", O_RDWR|O_CREAT|O_EXCL)},
+    {"open nofollow", ELOOP, open("/rp/toF", O_RDONLY|O_NOFOLLOW)},
+    {"open missing", ENOENT, open("/rp/nothing", O_RDONLY)},
+    {"open empty", ENOENT, open("", O_RDWR|O_CREAT)},
+    {"mkdir in file", ENOTDIR, p.Mkdir("/rp/f/d")},
+    {"mkdir existing", EEXIST, p.Mkdir("/rp/a/")},
+    {"mkdir dot", EEXIST, p.Mkdir("/rp/a/.")},
+    {"mkdir symlink", EEXIST, p.Mkdir("/rp/dangling")},
+    {"unlink dot", EINVAL, p.Unlink("/rp/a/.")},
+    {"unlink dotdot", EINVAL, p.Unlink("/rp/a/..")},
+    {"unlink file/", ENOTDIR, p.Unlink("/rp/f/")},
+    {"link to existing", EEXIST, p.Link("/rp/f", "/rp/toF")},
+    {"link to new/", ENOENT, p.Link("/rp/f", "/rp/g/")},
+    {"rename to new/", ENOTDIR, p.Rename("/rp/f", "/rp/g/")},
+    {"rename root", EINVAL, p.Rename("/", "/rp/root")},
+    {"chdir file", ENOTDIR, p.Chdir("/rp/f")},
+    {"readlink file", EINVAL, func() error { _, err := p.Readlink("/rp/f"); return err }()},
+  }
+
+  for _, test := range tests {
+    if test.got != test.err {
+      t.Errorf("%s: got %v, expected %v", test.name, test.got, test.err)
+    }
+  }
+
+  // O_CREAT through a dangling symlink creates its target
+  AssertNoErr(t, open("/rp/dangling", O_RDWR|O_CREAT))
+  real, err := p.Realpath("/rp/dangling")
+  AssertNoErr(t, err)
+  AssertTrue(t, real == "/rp/nowhere", "Expected dangling symlink target created.")
+}
+
+// Unlinks everything under path, then path itself.
+func removeTree(p *ProcState, path string) {
+  ref, err := p.resolve(path, false)
+  if err != nil { return }
+
+  if dir, isDir := ref.entry.(Directory); isDir {
+    for _, name := range dir.names() {
+      removeTree(p, path + "/" + name)
+    }
+  }
+
+  p.Unlink(path)
+}
@@ -2,8 +2,6 @@ package gofs
 
 import (
   "strings"
-  "errors"
-  "fmt"
 )
 
 func splitPath(path string) (dir string, base string) {
@@ -19,47 +17,121 @@ func splitPath(path string) (dir string, base string) {
   return path[:index], path[index + 1:]
 }
 
-func (proc *ProcState) resolveFilePath(path string) (Directory, interface{}, error) {
-  dir, fileName, err := proc.resolveDirPath(path)
-  if err != nil { return dir, nil, err }
+// The most symlinks followed while resolving one path, as in Linux.
+const MAXSYMLINKS = 40
 
-  file, ok := dir[fileName]
-  if !ok { return dir, nil, errors.New("File not found") }
+// What a path resolves to: the Directory holding its final component, the
+// name of that component, and the entry it names, or nil if there is none yet.
+// When the path ends in '.' or '..', or is just '/', entry is that Directory.
+// slash records a trailing '/', which only a directory may satisfy.
+type pathRef struct {
+  dir   Directory
+  name  string
+  entry interface{}
+  slash bool
+}
+
+// Resolves path the POSIX way (see path_resolution(7)). Empty components, as
+// from repeated slashes, are skipped; '.' and '..' are looked up like any other
+// name, '..' at proc's root being that root; every component but the last must be
+// a directory or a symlink to one. Symlinks in the final component are only
+// followed if follow is set, or if the path ends in a slash.
+func (proc *ProcState) resolve(path string, follow bool) (pathRef, error) {
+  ref, err := proc.resolveWithHost(path, follow)
+  if _, isHost := ref.entry.(*hostEntry); isHost { return pathRef{}, EXDEV }
+  return ref, err
+}
 
-  return dir, file, nil
+// Like resolve, but paths below a host mount give a *hostEntry; see host.go.
+func (proc *ProcState) resolveWithHost(path string, follow bool) (pathRef, error) {
+  links := 0
+  return proc.walk(proc.cwd, path, follow, &links)
 }
 
-// Returns the directory for a given path and the filename in that path.
-// Example: a/b/c.txt returns the Directory for b in a and the string 'c.txt'
-// Example: a/b/c/ return the c Directory and the string ""
-// This isn't perfect yet: 
-//  should handle multiple // in path ... it might do this
-func (proc *ProcState) resolveDirPath(path string) (Directory, string, error) {
-  // shouldn't do anything in this case
-  if len(path) == 0 { return proc.cwd, "", nil }
-  if strings.Count(path, "/") <= 0 { return proc.cwd, path, nil }
-
-  dirPath, fileName := splitPath(path)
-  dirs := strings.Split(dirPath, "/")
-
-  cwd := proc.cwd
-  if path[0] == '/' {
-    cwd = globalState.root
-    dirs = dirs[1:]
+func (proc *ProcState) walk(dir Directory, path string, follow bool,
+links *int) (pathRef, error) {
+  if len(path) == 0 { return pathRef{}, ENOENT }
+  if path[0] == '/' { dir = proc.root }
+
+  names := make([]string, 0, strings.Count(path, "/") + 1)
+  for _, name := range strings.Split(path, "/") {
+    if name != "" { names = append(names, name) }
   }
 
-  for _, name := range dirs {
-    if name == "" { continue }
+  slash := path[len(path) - 1] == '/'
+  if len(names) == 0 { return pathRef{dir, ".", dir, slash}, nil }
+
+  for i, name := range names {
+    if err := proc.checkPermission(dir, M_EXEC); err != nil { return pathRef{}, err }
+
+    last := i == len(names) - 1
+    entry, ok := lookup(dir, name)
+    // Nothing is above proc's root, so there's no way out of a chroot.
+    if name == ".." && sameDirectory(dir, proc.root) { entry = dir }
+    if !ok {
+      if last { return pathRef{dir, name, nil, slash}, nil }
+      return pathRef{}, ENOENT
+    }
+
+    if link, isLink := entry.(*Symlink); isLink && (!last || follow || slash) {
+      *links++
+      if *links > MAXSYMLINKS { return pathRef{}, ELOOP }
+
+      target, err := proc.walk(dir, link.target, true, links)
+      if err != nil { return pathRef{}, err }
+      if last {
+        target.slash = slash
+        return target, target.checkSlash()
+      }
+
+      entry = target.entry
+      if entry == nil { return pathRef{}, ENOENT }
+    }
+
+    if last {
+      ref := pathRef{dir, name, entry, slash}
+      return ref, ref.checkSlash()
+    }
 
-    dir := cwd[name]
-    switch dir.(type) {
-      case Directory:
-        cwd = dir.(Directory)
-      default:
-        errString := fmt.Sprintf("Invalid path: %s in %s", name, path)
-        return nil, "", errors.New(errString)
+    // The rest of the path is the host's to look up.
+    switch host := entry.(type) {
+    case *HostDir:
+      return hostRef(dir, name, host, ".", names[i + 1:], slash, links)
+    case *hostEntry:
+      return hostRef(dir, name, host.mount, host.rel, names[i + 1:], slash, links)
     }
+
+    sub, isDir := entry.(Directory)
+    if !isDir { return pathRef{}, ENOTDIR }
+    dir = sub
+  }
+
+  panic("unreachable")
+}
+
+func (ref pathRef) checkSlash() error {
+  if !ref.slash || ref.entry == nil { return nil }
+
+  switch ref.entry.(type) {
+  case Directory, *HostDir, *hostEntry:
+    return nil
   }
 
-  return cwd, fileName, nil
+  return ENOTDIR
+}
+
+// Returns the absolute path of what ref names, which must exist.
+func (ref pathRef) absPath() (string, bool) {
+  return ref.pathFrom(globalState.root)
+}
+
+// Returns the path of what ref names from root, as absPath would for a process
+// whose root it is.
+func (ref pathRef) pathFrom(root Directory) (string, bool) {
+  if dir, isDir := ref.entry.(Directory); isDir { return dir.pathFrom(root) }
+
+  dir, ok := ref.dir.pathFrom(root)
+  if !ok { return "", false }
+  if dir == "/" { return "/" + ref.name, true }
+  return dir + "/" + ref.name, true
 }
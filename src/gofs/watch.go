@@ -0,0 +1,161 @@
+package gofs
+
+import (
+  "sync"
+)
+
+/**
+* Watches report changes as inotify does, so that callers needn't poll. A Watch
+* on a directory hears about its entries: those created, deleted, moved in or
+* out, and files under it that are modified, have their attributes changed or
+* are closed after writing. A Watch on a file hears about the file itself.
+* Events name the entry they are about, or nothing when they are about the
+* watched file itself, and a rename's IN_MOVED_FROM and IN_MOVED_TO share a
+* Cookie no other rename has.
+*
+* Changes to a file's data are reported to the directory it was opened
+* through, under the name it was opened by, as inotify does through the dentry
+* of an open file.
+*
+* Each Watch queues at most MAX_WATCH_EVENTS events. Events that come while the
+* queue is full are dropped, and IN_Q_OVERFLOW is queued in their place.
+*/
+
+const MAX_WATCH_EVENTS = 1024
+
+type WatchMask uint32
+const (
+  IN_MODIFY WatchMask = 1 << iota
+  IN_ATTRIB
+  IN_CLOSE_WRITE
+  IN_MOVED_FROM
+  IN_MOVED_TO
+  IN_CREATE
+  IN_DELETE
+
+  // Set in events, never needed in a mask.
+  IN_ISDIR
+  IN_Q_OVERFLOW
+)
+
+const IN_MOVE = IN_MOVED_FROM | IN_MOVED_TO
+const IN_ALL_EVENTS = IN_MODIFY | IN_ATTRIB | IN_CLOSE_WRITE | IN_MOVE |
+  IN_CREATE | IN_DELETE
+
+type WatchEvent struct {
+  Mask WatchMask
+  Name string
+  Cookie uint32
+}
+
+type Watch struct {
+  Events <-chan WatchEvent
+
+  events chan WatchEvent
+  mask WatchMask
+  list *[]*Watch // the list of watches on the watched entry
+  overflowed bool
+}
+
+var watches struct {
+  sync.Mutex
+  lastCookie uint32
+}
+
+// Starts watching path, following symlinks, for the events in mask.
+func (proc *ProcState) Watch(path string, mask WatchMask) (*Watch, error) {
+  ref, err := proc.resolve(path, true)
+  if err != nil { return nil, err }
+  if (mask & IN_ALL_EVENTS) == 0 || (mask & ^IN_ALL_EVENTS) != 0 { return nil, EINVAL }
+
+  var list *[]*Watch
+  switch entry := ref.entry.(type) {
+  case Directory:
+    list = &entry.header().watches
+  case *Inode:
+    list = &entry.watches
+  case nil:
+    return nil, ENOENT
+  default:
+    return nil, EINVAL
+  }
+
+  // One more than the limit, to leave room for IN_Q_OVERFLOW.
+  events := make(chan WatchEvent, MAX_WATCH_EVENTS + 1)
+  watch := &Watch{Events: events, events: events, mask: mask, list: list}
+
+  watches.Lock()
+  *list = append(*list, watch)
+  watches.Unlock()
+  return watch, nil
+}
+
+// Stops the watch and closes its Events.
+func (watch *Watch) Close() error {
+  watches.Lock()
+  defer watches.Unlock()
+
+  if watch.list == nil { return EINVAL }
+  list := *watch.list
+  for i, other := range list {
+    if other == watch {
+      *watch.list = append(list[:i:i], list[i + 1:]...)
+      break
+    }
+  }
+
+  watch.list = nil
+  close(watch.events)
+  return nil
+}
+
+// Queues event if the watch wants it. Must hold watches.
+func (watch *Watch) send(event WatchEvent) {
+  if (event.Mask & watch.mask) == 0 { return }
+
+  if len(watch.events) >= MAX_WATCH_EVENTS {
+    if !watch.overflowed { watch.events <- WatchEvent{Mask: IN_Q_OVERFLOW} }
+    watch.overflowed = true
+    return
+  }
+
+  watch.overflowed = false
+  watch.events <- event
+}
+
+// Returns a cookie to pair the two halves of a rename.
+func newCookie() uint32 {
+  watches.Lock()
+  defer watches.Unlock()
+
+  watches.lastCookie++
+  return watches.lastCookie
+}
+
+// Reports a change to the entry name in dir to dir's watches, and if it's a
+// change to the entry itself rather than to dir, to entry's own watches.
+func notify(dir Directory, name string, entry interface{}, mask WatchMask,
+  cookie uint32) {
+  watches.Lock()
+  defer watches.Unlock()
+
+  var own []*Watch
+  switch entry := entry.(type) {
+  case Directory:
+    mask |= IN_ISDIR
+    own = entry.header().watches
+  case *Inode:
+    own = entry.watches
+  }
+
+  if dir != nil {
+    for _, watch := range dir.header().watches {
+      watch.send(WatchEvent{Mask: mask, Name: name, Cookie: cookie})
+    }
+  }
+
+  if (mask & (IN_MODIFY | IN_ATTRIB | IN_CLOSE_WRITE)) == 0 { return }
+  for _, watch := range own {
+    watch.send(WatchEvent{Mask: mask, Cookie: cookie})
+  }
+}
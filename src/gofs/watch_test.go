@@ -0,0 +1,134 @@
+package gofs
+
+import (
+  "strconv"
+  "testing"
+)
+
+func nextEvent(t *testing.T, watch *Watch, mask WatchMask, name string) WatchEvent {
+  select {
+  case event := <-watch.Events:
+    if event.Mask != mask || event.Name != name {
+      printStack(t, 3)
+      t.Fatalf("Expected event %x %q, got %x %q.", mask, name, event.Mask, event.Name)
+    }
+    return event
+  default:
+    printStack(t, 3)
+    t.Fatalf("Expected event %x %q, got none.", mask, name)
+  }
+
+  return WatchEvent{}
+}
+
+func assertNoEvents(t *testing.T, watch *Watch) {
+  select {
+  case event := <-watch.Events:
+    t.Fatalf("Unexpected event %x %q.", event.Mask, event.Name)
+  default:
+  }
+}
+
+func TestWatchDirectory(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  p.safeMkdir(t, "/watched")
+  p.safeMkdir(t, "/other")
+  dir, err := p.Watch("/watched", IN_ALL_EVENTS)
+  AssertNoErr(t, err)
+  other, err := p.Watch("/other", IN_MOVE)
+  AssertNoErr(t, err)
+
+  fd := p.safeOpen(t, "/watched/file", O_RDWR|O_CREAT, UserMode())
+  nextEvent(t, dir, IN_CREATE, "file")
+  p.safeWrite(t, fd, []byte("data"))
+  nextEvent(t, dir, IN_MODIFY, "file")
+  p.safeClose(t, fd)
+  nextEvent(t, dir, IN_CLOSE_WRITE, "file")
+
+  fd = p.safeOpen(t, "/watched/file", O_RDONLY, UserMode())
+  p.safeClose(t, fd)
+  assertNoEvents(t, dir)
+
+  p.safeMkdir(t, "/watched/sub")
+  nextEvent(t, dir, IN_CREATE|IN_ISDIR, "sub")
+
+  // renames pair up by cookie, across directories too
+  p.safeRename(t, "/watched/file", "/watched/renamed")
+  from := nextEvent(t, dir, IN_MOVED_FROM, "file")
+  to := nextEvent(t, dir, IN_MOVED_TO, "renamed")
+  AssertTrue(t, from.Cookie != 0 && from.Cookie == to.Cookie, "Cookies don't pair.")
+
+  p.safeRename(t, "/watched/renamed", "/other/moved")
+  first := from.Cookie
+  from = nextEvent(t, dir, IN_MOVED_FROM, "renamed")
+  to = nextEvent(t, other, IN_MOVED_TO, "moved")
+  AssertTrue(t, from.Cookie == to.Cookie && from.Cookie != first, "Cookies don't pair.")
+
+  p.safeLink(t, "/other/moved", "/watched/link")
+  nextEvent(t, dir, IN_CREATE, "link")
+  p.safeUnlink(t, "/watched/link")
+  nextEvent(t, dir, IN_DELETE, "link")
+  assertNoEvents(t, other)
+
+  AssertNoErr(t, dir.Close())
+  _, open := <-dir.Events
+  AssertTrue(t, !open, "Events still open after Close.")
+  AssertTrue(t, dir.Close() == EINVAL, "Closed a watch twice.")
+  AssertNoErr(t, other.Close())
+
+  p.safeUnlink(t, "/other/moved")
+  p.safeUnlink(t, "/watched/sub")
+  p.safeUnlink(t, "/watched")
+  p.safeUnlink(t, "/other")
+}
+
+func TestWatchFile(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  fd := p.safeOpen(t, "/watched-file", O_RDWR|O_CREAT, UserMode())
+  watch, err := p.Watch("/watched-file", IN_MODIFY|IN_ATTRIB)
+  AssertNoErr(t, err)
+
+  p.safeWrite(t, fd, []byte("data"))
+  nextEvent(t, watch, IN_MODIFY, "")
+  p.safeClose(t, fd)
+  assertNoEvents(t, watch)
+
+  p.safeLink(t, "/watched-file", "/watched-link")
+  nextEvent(t, watch, IN_ATTRIB, "")
+  p.safeUnlink(t, "/watched-link")
+  nextEvent(t, watch, IN_ATTRIB, "")
+
+  _, err = p.Watch("/watched-file", IN_Q_OVERFLOW)
+  AssertTrue(t, err == EINVAL, "Expected EINVAL.")
+  _, err = p.Watch("/missing", IN_MODIFY)
+  AssertTrue(t, err == ENOENT, "Expected ENOENT.")
+
+  watch.Close()
+  p.safeUnlink(t, "/watched-file")
+}
+
+func TestWatchOverflow(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  p.safeMkdir(t, "/busy")
+  watch, err := p.Watch("/busy", IN_CREATE)
+  AssertNoErr(t, err)
+
+  for i := 0; i < MAX_WATCH_EVENTS + 10; i++ {
+    p.safeMkdir(t, "/busy/" + strconv.Itoa(i))
+  }
+
+  for i := 0; i < MAX_WATCH_EVENTS; i++ {
+    nextEvent(t, watch, IN_CREATE|IN_ISDIR, strconv.Itoa(i))
+  }
+
+  nextEvent(t, watch, IN_Q_OVERFLOW, "")
+  assertNoEvents(t, watch)
+
+  // with room again, events are queued as before
+  p.safeMkdir(t, "/busy/last")
+  nextEvent(t, watch, IN_CREATE|IN_ISDIR, "last")
+  watch.Close()
+}
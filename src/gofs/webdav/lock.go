@@ -0,0 +1,237 @@
+package webdav
+
+import (
+  "crypto/rand"
+  "encoding/xml"
+  "fmt"
+  "gofs"
+  "io"
+  "net/http"
+  "path"
+  "strconv"
+  "strings"
+  "time"
+)
+
+/**
+* LOCK takes an exclusive write lock on a resource and, unless its Depth is 0,
+* what's under it, and replies with its token; a LOCK without a body, with a
+* token in its If header, refreshes that lock's timeout instead. LOCK of what
+* doesn't exist makes it, as an empty file. UNLOCK lets a lock go.
+*
+* While a lock is held, PUT, DELETE, MKCOL, MOVE and COPY to what it covers
+* fail with 423 Locked unless the request's If header has its token. A lock on
+* a collection covers the names in it, so making or removing an entry of a
+* locked collection takes its token too, whatever the lock's depth. If headers
+* are only searched for tokens, not evaluated as the conditions they may be.
+*
+* Locks are the Handler's, not GoFS's: other users of the tree don't see them,
+* and they're gone when the Handler is. A lock without a Timeout lasts until
+* it's let go; one with a timeout goes once the timeout passes unrefreshed.
+*/
+
+// A lock a LOCK took.
+type davLock struct {
+  token string
+  root string
+  deep bool // whether what's under root is locked too
+  owner string // the XML the LOCK gave as its owner, passed back as is
+  timeout time.Duration // 0 for none
+  expires time.Time
+}
+
+// The body of a LOCK.
+type lockInfo struct {
+  XMLName xml.Name `xml:"DAV: lockinfo"`
+  Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+  Shared *struct{} `xml:"DAV: lockscope>shared"`
+  Write *struct{} `xml:"DAV: locktype>write"`
+  Owner struct {
+    Inner string `xml:",innerxml"`
+  } `xml:"DAV: owner"`
+}
+
+func (h *Handler) lock(w http.ResponseWriter, req *http.Request, p string) (int, error) {
+  timeout, ok := timeoutOf(req.Header.Get("Timeout"))
+  if !ok { return http.StatusBadRequest, nil }
+  body, err := io.ReadAll(req.Body)
+  if err != nil { return http.StatusBadRequest, nil }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if len(strings.TrimSpace(string(body))) == 0 { return h.refresh(w, req, p, timeout) }
+
+  var info lockInfo
+  if err := xml.Unmarshal(body, &info); err != nil { return http.StatusBadRequest, nil }
+  if info.Exclusive == nil || info.Write == nil { return http.StatusNotImplemented, nil }
+  depth, ok := depthOf(req, infinite)
+  if !ok || depth == 1 { return http.StatusBadRequest, nil }
+
+  deep := depth == infinite
+  if len(h.locksOn(p)) > 0 { return http.StatusLocked, nil }
+  for _, held := range h.locks {
+    if deep && under(held.root, p) { return http.StatusLocked, nil }
+  }
+
+  status := http.StatusOK
+  if _, err := h.proc.Lstat(p); err == gofs.ENOENT {
+    fd, err := h.proc.Open(p, gofs.O_WRONLY | gofs.O_CREAT, fileMode)
+    if err == gofs.ENOENT { return http.StatusConflict, nil }
+    if err != nil { return 0, err }
+    if err := h.proc.Close(fd); err != nil { return 0, err }
+    status = http.StatusCreated
+  }
+
+  lock := &davLock{token: newToken(), root: p, deep: deep, owner: info.Owner.Inner, timeout: timeout}
+  if timeout != 0 { lock.expires = time.Now().Add(timeout) }
+  h.locks[lock.token] = lock
+
+  w.Header().Set("Lock-Token", "<" + lock.token + ">")
+  h.writeLock(w, lock, status)
+  return 0, nil
+}
+
+// Refreshes the lock on p that req's If header has the token of.
+func (h *Handler) refresh(w http.ResponseWriter, req *http.Request, p string, timeout time.Duration) (int, error) {
+  tokens := ifTokens(req.Header.Get("If"))
+  for _, lock := range h.locksOn(p) {
+    if !tokens[lock.token] { continue }
+
+    lock.timeout, lock.expires = timeout, time.Time{}
+    if timeout != 0 { lock.expires = time.Now().Add(timeout) }
+    h.writeLock(w, lock, http.StatusOK)
+    return 0, nil
+  }
+
+  return http.StatusPreconditionFailed, nil
+}
+
+func (h *Handler) writeLock(w http.ResponseWriter, lock *davLock, status int) {
+  w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+  w.WriteHeader(status)
+  fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+    `<D:prop xmlns:D="DAV:"><D:lockdiscovery>%s</D:lockdiscovery></D:prop>` + "\n", h.activeLock(lock))
+}
+
+func (h *Handler) unlock(req *http.Request, p string) (int, error) {
+  token := strings.TrimSuffix(strings.TrimPrefix(req.Header.Get("Lock-Token"), "<"), ">")
+  if token == "" { return http.StatusBadRequest, nil }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  for _, lock := range h.locksOn(p) {
+    if lock.token == token {
+      delete(h.locks, token)
+      return http.StatusNoContent, nil
+    }
+  }
+
+  return http.StatusConflict, nil
+}
+
+// Returns the activelock element of lock.
+func (h *Handler) activeLock(lock *davLock) string {
+  depth := "0"
+  if lock.deep { depth = "infinity" }
+  timeout := "Infinite"
+  if lock.timeout != 0 { timeout = fmt.Sprintf("Second-%d", int64(time.Until(lock.expires).Seconds() + 0.5)) }
+
+  owner := ""
+  if lock.owner != "" { owner = "<D:owner>" + lock.owner + "</D:owner>" }
+  return "<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>" +
+    "<D:depth>" + depth + "</D:depth>" + owner + "<D:timeout>" + timeout + "</D:timeout>" +
+    "<D:locktoken><D:href>" + lock.token + "</D:href></D:locktoken>" +
+    "<D:lockroot><D:href>" + escape(h.href(lock.root, false)) + "</D:href></D:lockroot></D:activelock>"
+}
+
+// Returns the locks that cover p: those on it, and the deep ones on what it's
+// under. Locks that have timed out are let go. h.mu must be held.
+func (h *Handler) locksOn(p string) []*davLock {
+  var locks []*davLock
+  now := time.Now()
+  for token, lock := range h.locks {
+    if lock.timeout != 0 && now.After(lock.expires) {
+      delete(h.locks, token)
+      continue
+    }
+    if lock.root == p || (lock.deep && under(p, lock.root)) { locks = append(locks, lock) }
+  }
+
+  return locks
+}
+
+// Returns 423 Locked unless req's If header has the tokens of the locks that
+// cover p and, if deep, what's under it. h.mu must be held.
+func (h *Handler) checkLocks(req *http.Request, p string, deep bool) int {
+  tokens := ifTokens(req.Header.Get("If"))
+  for _, lock := range h.locksOn(p) {
+    if !tokens[lock.token] { return http.StatusLocked }
+  }
+  if !deep { return 0 }
+
+  for _, lock := range h.locks {
+    if under(lock.root, p) && !tokens[lock.token] { return http.StatusLocked }
+  }
+
+  return 0
+}
+
+// Returns 423 Locked unless req may make, replace or remove the entry p: it
+// takes the tokens of the locks on its directory, and of those on p and under
+// it. h.mu must be held.
+func (h *Handler) checkEntry(req *http.Request, p string) int {
+  if status := h.checkLocks(req, p, true); status != 0 { return status }
+
+  tokens := ifTokens(req.Header.Get("If"))
+  for _, lock := range h.locks {
+    if lock.root == path.Dir(p) && !tokens[lock.token] { return http.StatusLocked }
+  }
+
+  return 0
+}
+
+// Lets go the locks on p and under it, which is gone. h.mu must be held.
+func (h *Handler) dropLocks(p string) {
+  for token, lock := range h.locks {
+    if lock.root == p || under(lock.root, p) { delete(h.locks, token) }
+  }
+}
+
+// Returns the tokens an If header has: whatever's in angle brackets.
+func ifTokens(header string) map[string]bool {
+  tokens := make(map[string]bool)
+  for {
+    start := strings.IndexByte(header, '<')
+    if start < 0 { return tokens }
+    end := strings.IndexByte(header[start:], '>')
+    if end < 0 { return tokens }
+
+    tokens[header[start + 1:start + end]] = true
+    header = header[start + end + 1:]
+  }
+}
+
+// Returns the duration a Timeout header asks for, 0 for none, and false if it
+// can't be read. Of several, the first is taken.
+func timeoutOf(header string) (time.Duration, bool) {
+  first, _, _ := strings.Cut(header, ",")
+  first = strings.TrimSpace(first)
+  if first == "" || first == "Infinite" { return 0, true }
+
+  secs, ok := strings.CutPrefix(first, "Second-")
+  if !ok { return 0, false }
+  n, err := strconv.ParseUint(secs, 10, 32)
+  if err != nil || n == 0 { return 0, false }
+  return time.Duration(n) * time.Second, true
+}
+
+// Returns a new lock token, a random UUID in an opaquelocktoken URI.
+func newToken() string {
+  var b [16]byte
+  rand.Read(b[:])
+  b[6] = b[6] & 0x0f | 0x40
+  b[8] = b[8] & 0x3f | 0x80
+  return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
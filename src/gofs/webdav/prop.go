@@ -0,0 +1,225 @@
+package webdav
+
+import (
+  "encoding/xml"
+  "fmt"
+  "gofs"
+  "io"
+  "mime"
+  "net/http"
+  "path"
+  "strings"
+  "time"
+)
+
+/**
+* PROPFIND replies with a multistatus: a response for each resource the
+* request's depth reaches, holding the properties asked for that the resource
+* has, then, with a 404 status, those it hasn't. The properties are the live
+* ones of RFC 4918, taken from a Stat of the file: resourcetype,
+* displayname, getcontentlength, getcontenttype (from the name's extension),
+* getlastmodified, creationdate (its birth time), getetag (from its
+* modification time and size), supportedlock and lockdiscovery.
+*/
+
+// The names of properties a PROPFIND asks for.
+type propNames []xml.Name
+
+func (names *propNames) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+  for {
+    tok, err := d.Token()
+    if err != nil { return err }
+
+    switch tok := tok.(type) {
+    case xml.StartElement:
+      *names = append(*names, tok.Name)
+      if err := d.Skip(); err != nil { return err }
+    case xml.EndElement:
+      return nil
+    }
+  }
+}
+
+// The body of a PROPFIND; without one, it's an allprop.
+type propfind struct {
+  XMLName xml.Name `xml:"DAV: propfind"`
+  Propname *struct{} `xml:"DAV: propname"`
+  Prop propNames `xml:"DAV: prop"`
+}
+
+// A property of a resource, with its value as XML.
+type property struct {
+  name string
+  value string
+}
+
+var propertyNames = []string{"resourcetype", "displayname", "getcontentlength",
+  "getcontenttype", "getlastmodified", "creationdate", "getetag", "supportedlock",
+  "lockdiscovery"}
+
+const supportedLock = "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope>" +
+  "<D:locktype><D:write/></D:locktype></D:lockentry>"
+
+func (h *Handler) propfind(w http.ResponseWriter, req *http.Request, p string) (int, error) {
+  depth, ok := depthOf(req, infinite)
+  if !ok { return http.StatusBadRequest, nil }
+  var pf propfind
+  if err := xml.NewDecoder(req.Body).Decode(&pf); err != nil && err != io.EOF {
+    return http.StatusBadRequest, nil
+  }
+
+  var b strings.Builder
+  b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">` + "\n")
+  h.mu.Lock()
+  err := h.walk(p, depth, func(p string, stat gofs.Stat_t) {
+    h.writeResponse(&b, p, stat, pf)
+  })
+  h.mu.Unlock()
+  if err != nil { return 0, err }
+  b.WriteString("</D:multistatus>\n")
+
+  w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+  w.WriteHeader(http.StatusMultiStatus)
+  io.WriteString(w, b.String())
+  return 0, nil
+}
+
+// Calls visit for p and what's under it, to depth. Directories reached through
+// symlinks aren't gone down into. h.mu must be held.
+func (h *Handler) walk(p string, depth int, visit func(p string, stat gofs.Stat_t)) error {
+  stat, err := h.proc.Stat(p)
+  if err != nil { return err }
+  visit(p, stat)
+  if !isDir(stat) || depth == 0 { return nil }
+
+  entries, err := h.proc.ReadDir(p)
+  if err != nil { return err }
+  for _, entry := range entries {
+    child := path.Join(p, entry.Name)
+    stat, err := h.proc.Stat(child)
+    // A dangling symlink is still listed, as itself.
+    if err == gofs.ENOENT { stat, err = h.proc.Lstat(child) }
+    if err != nil { return err }
+
+    if depth == infinite && entry.Type == gofs.S_IFDIR {
+      if err := h.walk(child, infinite, visit); err != nil { return err }
+      continue
+    }
+    visit(child, stat)
+  }
+
+  return nil
+}
+
+// Writes the response for p, with attributes stat, to what pf asks for.
+func (h *Handler) writeResponse(b *strings.Builder, p string, stat gofs.Stat_t, pf propfind) {
+  props := h.properties(p, stat)
+  fmt.Fprintf(b, "<D:response><D:href>%s</D:href>", escape(h.href(p, isDir(stat))))
+
+  var found []string
+  var missing []xml.Name
+  switch {
+  case pf.Propname != nil:
+    for _, prop := range props {
+      found = append(found, "<D:" + prop.name + "/>")
+    }
+  case len(pf.Prop) == 0:
+    for _, prop := range props {
+      found = append(found, element(prop))
+    }
+  default:
+    for _, name := range pf.Prop {
+      prop, ok := lookup(props, name)
+      if ok {
+        found = append(found, element(prop))
+      } else {
+        missing = append(missing, name)
+      }
+    }
+  }
+
+  writePropstat(b, strings.Join(found, ""), http.StatusOK)
+  if len(missing) > 0 {
+    var names strings.Builder
+    for i, name := range missing {
+      if name.Space == "DAV:" {
+        fmt.Fprintf(&names, "<D:%s/>", name.Local)
+      } else {
+        fmt.Fprintf(&names, `<ns%d:%s xmlns:ns%d="%s"/>`, i, name.Local, i, escape(name.Space))
+      }
+    }
+    writePropstat(b, names.String(), http.StatusNotFound)
+  }
+  b.WriteString("</D:response>\n")
+}
+
+func writePropstat(b *strings.Builder, props string, status int) {
+  fmt.Fprintf(b, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 %d %s</D:status></D:propstat>",
+    props, status, http.StatusText(status))
+}
+
+func lookup(props []property, name xml.Name) (property, bool) {
+  if name.Space != "DAV:" { return property{}, false }
+  for _, prop := range props {
+    if prop.name == name.Local { return prop, true }
+  }
+
+  return property{}, false
+}
+
+func element(prop property) string {
+  if prop.value == "" { return "<D:" + prop.name + "/>" }
+  return "<D:" + prop.name + ">" + prop.value + "</D:" + prop.name + ">"
+}
+
+func escape(s string) string {
+  var b strings.Builder
+  xml.EscapeText(&b, []byte(s))
+  return b.String()
+}
+
+// Returns the properties the resource p, with attributes stat, has. h.mu must
+// be held.
+func (h *Handler) properties(p string, stat gofs.Stat_t) []property {
+  var props []property
+  for _, name := range propertyNames {
+    value, ok := "", true
+    switch name {
+    case "resourcetype":
+      if isDir(stat) { value = "<D:collection/>" }
+    case "displayname":
+      if p != "/" { value = escape(path.Base(p)) }
+    case "getcontentlength":
+      ok = !isDir(stat)
+      value = fmt.Sprint(stat.Size)
+    case "getcontenttype":
+      ok = !isDir(stat)
+      value = mime.TypeByExtension(path.Ext(p))
+      if value == "" { value = "application/octet-stream" }
+      value = escape(value)
+    case "getlastmodified":
+      value = stat.Mtime.UTC().Format(http.TimeFormat)
+    case "creationdate":
+      ok = !stat.Btime.IsZero()
+      value = stat.Btime.UTC().Format(time.RFC3339)
+    case "getetag":
+      ok = !isDir(stat)
+      value = escape(etag(stat))
+    case "supportedlock":
+      value = supportedLock
+    case "lockdiscovery":
+      for _, lock := range h.locksOn(p) {
+        value += h.activeLock(lock)
+      }
+    }
+
+    if ok { props = append(props, property{name, value}) }
+  }
+
+  return props
+}
+
+// Returns the entity tag of a file with attributes stat.
+func etag(stat gofs.Stat_t) string {
+  return fmt.Sprintf(`"%x%x"`, stat.Mtime.UnixNano(), stat.Size)
+}
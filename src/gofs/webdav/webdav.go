@@ -0,0 +1,474 @@
+package webdav
+
+import (
+  "fmt"
+  "gofs"
+  "html"
+  "io"
+  "net/http"
+  "net/url"
+  "path"
+  "strings"
+  "sync"
+)
+
+/**
+* Package webdav serves a GoFS tree over WebDAV (RFC 4918), so that it can be
+* looked through and edited with curl, cadaver, davfs2 or a file manager while
+* a test or tool has it: http.ListenAndServe(":8080", webdav.NewHandler(proc)).
+* A Handler makes its calls as one ProcState, with its permissions, under a lock
+* taken for each call, so requests may come at once; GET and PUT take it for
+* each read and write rather than while the data goes over the network. As each
+* of those holds a file open while it goes, no more than MaxStreams of them run
+* at once; past that, and when GoFS can't open any more files, they get 503.
+*
+* Supported are OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, COPY, MOVE, PROPFIND,
+* LOCK and UNLOCK; anything else, PROPPATCH included, is 405 Method Not
+* Allowed. PROPFIND reports the properties GoFS has of a file, as in prop.go;
+* there are no dead properties to set. GET of a collection lists it as HTML.
+* Symlinks are followed, except that COPY, MOVE and DELETE act on the links
+* themselves and a Depth: infinity PROPFIND doesn't go down through them.
+*
+* Locks, as in lock.go, are exclusive write locks the Handler keeps in memory.
+* While one is held, changing what it covers takes its token in an If header.
+*/
+
+// Serves the tree a ProcState sees over WebDAV.
+type Handler struct {
+  // Stripped from the paths of requests, and of Destination headers, to give
+  // GoFS paths, and put back on the hrefs of replies.
+  Prefix string
+
+  proc *gofs.ProcState
+  mu sync.Mutex // held for each call, as a ProcState makes one at a time
+  locks map[string]*davLock // by token
+  streams chan struct{} // a slot for each GET or PUT going
+}
+
+// The most GETs and PUTs a Handler has going at once.
+const MaxStreams = 16
+
+// Returns a Handler making its calls as proc.
+func NewHandler(proc *gofs.ProcState) *Handler {
+  return &Handler{
+    proc: proc,
+    locks: make(map[string]*davLock),
+    streams: make(chan struct{}, MaxStreams),
+  }
+}
+
+const allowed = "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, COPY, MOVE, PROPFIND, LOCK, UNLOCK"
+
+// Files PUT makes get rw-r--r--.
+var fileMode = [3]gofs.FileMode{gofs.M_READ | gofs.M_WRITE, gofs.M_READ, gofs.M_READ}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  p, ok := h.path(req.URL.Path)
+  if !ok {
+    reply(w, http.StatusNotFound)
+    return
+  }
+
+  var status int
+  var err error
+  switch req.Method {
+  case "OPTIONS":
+    w.Header().Set("DAV", "1, 2")
+    w.Header().Set("Allow", allowed)
+    w.Header().Set("MS-Author-Via", "DAV")
+    status = http.StatusOK
+  case "GET", "HEAD":
+    status, err = h.get(w, req, p)
+  case "PUT":
+    status, err = h.put(req, p)
+  case "DELETE":
+    status, err = h.delete(req, p)
+  case "MKCOL":
+    status, err = h.mkcol(req, p)
+  case "COPY":
+    status, err = h.copyMove(req, p, false)
+  case "MOVE":
+    status, err = h.copyMove(req, p, true)
+  case "PROPFIND":
+    status, err = h.propfind(w, req, p)
+  case "LOCK":
+    status, err = h.lock(w, req, p)
+  case "UNLOCK":
+    status, err = h.unlock(req, p)
+  default:
+    w.Header().Set("Allow", allowed)
+    status = http.StatusMethodNotAllowed
+  }
+
+  if err != nil { status = statusOf(err) }
+  if status != 0 { reply(w, status) }
+}
+
+// Replies with nothing but status, and its text if it's an error.
+func reply(w http.ResponseWriter, status int) {
+  if status >= 400 {
+    http.Error(w, http.StatusText(status), status)
+    return
+  }
+
+  w.WriteHeader(status)
+}
+
+// Returns the HTTP status for a GoFS error.
+func statusOf(err error) int {
+  switch err {
+  case gofs.ENOENT:
+    return http.StatusNotFound
+  case gofs.EPERM, gofs.EACCES, gofs.EROFS:
+    return http.StatusForbidden
+  case gofs.EEXIST, gofs.EISDIR:
+    return http.StatusMethodNotAllowed
+  case gofs.ENOTDIR, gofs.ENOTEMPTY, gofs.EBUSY:
+    return http.StatusConflict
+  case gofs.ENOSPC:
+    return http.StatusInsufficientStorage
+  case gofs.ENFILE, gofs.EMFILE:
+    return http.StatusServiceUnavailable
+  case gofs.ENOTSUP:
+    return http.StatusNotImplemented
+  }
+
+  return http.StatusInternalServerError
+}
+
+// Returns the GoFS path of the URL path urlPath, or false if it's not under
+// h.Prefix: /dav/x and /dav are under /dav, but /davx isn't.
+func (h *Handler) path(urlPath string) (string, bool) {
+  rest, ok := strings.CutPrefix(urlPath, strings.TrimSuffix(h.Prefix, "/"))
+  if !ok || (rest != "" && rest[0] != '/') { return "", false }
+  return path.Clean("/" + rest), true
+}
+
+// Returns the href of the GoFS path p, which ends in a slash if it's a
+// collection.
+func (h *Handler) href(p string, isDir bool) string {
+  href := path.Join("/", h.Prefix, p)
+  if isDir && !strings.HasSuffix(href, "/") { href += "/" }
+  return (&url.URL{Path: href}).EscapedPath()
+}
+
+// Returns whether p is under the directory dir.
+func under(p string, dir string) bool {
+  if dir == "/" { return p != "/" }
+  return strings.HasPrefix(p, dir + "/")
+}
+
+func isDir(stat gofs.Stat_t) bool {
+  return (stat.Mode & gofs.S_IFMT) == gofs.S_IFDIR
+}
+
+// Takes a slot for a GET or PUT, returning false if they're all taken.
+func (h *Handler) startStream() bool {
+  select {
+  case h.streams <- struct{}{}:
+    return true
+  default:
+    return false
+  }
+}
+
+func (h *Handler) endStream() {
+  <-h.streams
+}
+
+func (h *Handler) get(w http.ResponseWriter, req *http.Request, p string) (int, error) {
+  if !h.startStream() { return http.StatusServiceUnavailable, nil }
+  defer h.endStream()
+
+  stat, entries, fd, err := h.openGet(p)
+  if err != nil { return 0, err }
+  if isDir(stat) {
+    h.list(w, req, p, entries)
+    return 0, nil
+  }
+
+  file := &davFile{h: h, fd: fd}
+  defer file.Close()
+  w.Header().Set("ETag", etag(stat))
+  http.ServeContent(w, req, path.Base(p), stat.Mtime, file)
+  return 0, nil
+}
+
+// Returns the stat of p for a GET, with its entries if it's a collection and
+// otherwise a descriptor it's open on.
+func (h *Handler) openGet(p string) (gofs.Stat_t, []gofs.Dirent, gofs.FileDescriptor, error) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  stat, err := h.proc.Stat(p)
+  if err != nil { return stat, nil, 0, err }
+  if isDir(stat) {
+    entries, err := h.proc.ReadDir(p)
+    return stat, entries, 0, err
+  }
+
+  if (stat.Mode & gofs.S_IFMT) != gofs.S_IFREG { return stat, nil, 0, gofs.EISDIR }
+  fd, err := h.proc.Open(p, gofs.O_RDONLY, gofs.UserMode())
+  return stat, nil, fd, err
+}
+
+// Writes a page listing the collection p, which holds entries.
+func (h *Handler) list(w http.ResponseWriter, req *http.Request, p string, entries []gofs.Dirent) {
+  w.Header().Set("Content-Type", "text/html; charset=utf-8")
+  if req.Method == "HEAD" { return }
+
+  title := html.EscapeString(p)
+  fmt.Fprintf(w, "<!DOCTYPE html>\n<title>%s</title>\n<h1>%s</h1>\n<ul>\n", title, title)
+  for _, entry := range entries {
+    name := entry.Name
+    if entry.Type == gofs.S_IFDIR { name += "/" }
+    href := (&url.URL{Path: name}).EscapedPath()
+    fmt.Fprintf(w, "<li><a href=\"./%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+  }
+  io.WriteString(w, "</ul>\n")
+}
+
+func (h *Handler) put(req *http.Request, p string) (int, error) {
+  if !h.startStream() { return http.StatusServiceUnavailable, nil }
+  defer h.endStream()
+
+  fd, created, status, err := h.openPut(req, p)
+  if status != 0 { return status, nil }
+  // Without a directory to go in, a file can't be made.
+  if err == gofs.ENOENT { return http.StatusConflict, nil }
+  if err != nil { return 0, err }
+
+  file := &davFile{h: h, fd: fd}
+  _, err = io.Copy(file, req.Body)
+  if cerr := file.Close(); err == nil { err = cerr }
+  if err != nil { return 0, err }
+
+  if created { return http.StatusCreated, nil }
+  return http.StatusNoContent, nil
+}
+
+// Opens p for a PUT, returning whether it's new, or a status if its locks or
+// its entry keep it from being written.
+func (h *Handler) openPut(req *http.Request, p string) (gofs.FileDescriptor, bool, int, error) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  _, err := h.proc.Lstat(p)
+  created := err == gofs.ENOENT
+  status := h.checkLocks(req, p, false)
+  if created { status = h.checkEntry(req, p) }
+  if status != 0 { return 0, created, status, nil }
+
+  fd, err := h.proc.Open(p, gofs.O_WRONLY | gofs.O_CREAT | gofs.O_TRUNC, fileMode)
+  return fd, created, 0, err
+}
+
+func (h *Handler) delete(req *http.Request, p string) (int, error) {
+  if p == "/" { return http.StatusForbidden, nil }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if _, err := h.proc.Lstat(p); err != nil { return 0, err }
+  if status := h.checkEntry(req, p); status != 0 { return status, nil }
+  if err := removeAll(h.proc, p); err != nil { return 0, err }
+  h.dropLocks(p)
+  return http.StatusNoContent, nil
+}
+
+func (h *Handler) mkcol(req *http.Request, p string) (int, error) {
+  // MKCOL bodies are for extensions of WebDAV, which aren't supported.
+  if n, _ := req.Body.Read(make([]byte, 1)); n > 0 { return http.StatusUnsupportedMediaType, nil }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if status := h.checkEntry(req, p); status != 0 { return status, nil }
+  err := h.proc.Mkdir(p)
+  if err == gofs.ENOENT { return http.StatusConflict, nil }
+  if err != nil { return 0, err }
+  return http.StatusCreated, nil
+}
+
+// Copies or moves p to the Destination of req.
+func (h *Handler) copyMove(req *http.Request, p string, move bool) (int, error) {
+  dst, status := h.destination(req)
+  if status != 0 { return status, nil }
+  // Neither may go into itself, nor replace what it's in, which would remove it
+  // first.
+  if dst == p || under(dst, p) || under(p, dst) { return http.StatusForbidden, nil }
+
+  overwrite := req.Header.Get("Overwrite")
+  if overwrite != "" && overwrite != "T" && overwrite != "F" { return http.StatusBadRequest, nil }
+  depth, ok := depthOf(req, infinite)
+  // A collection is moved whole, but may be copied without what's in it.
+  if !ok || depth == 1 || (move && depth == 0) { return http.StatusBadRequest, nil }
+
+  h.mu.Lock()
+  defer h.mu.Unlock()
+
+  if _, err := h.proc.Lstat(p); err != nil { return 0, err }
+  if move { status = h.checkEntry(req, p) }
+  if status == 0 { status = h.checkEntry(req, dst) }
+  if status != 0 { return status, nil }
+  if stat, err := h.proc.Stat(path.Dir(dst)); err != nil || !isDir(stat) {
+    return http.StatusConflict, nil
+  }
+
+  _, err := h.proc.Lstat(dst)
+  replaced := err == nil
+  if replaced {
+    if overwrite == "F" { return http.StatusPreconditionFailed, nil }
+    if err := removeAll(h.proc, dst); err != nil { return 0, err }
+    h.dropLocks(dst)
+  }
+
+  if move {
+    err = h.proc.Rename(p, dst)
+    // Between mounts, a move is a copy, then a delete.
+    if err == gofs.EXDEV {
+      err = copyTree(h.proc, p, dst, true)
+      if err == nil { err = removeAll(h.proc, p) }
+    }
+    // Locks stay with the URLs they were taken on, so they don't move.
+    if err == nil { h.dropLocks(p) }
+  } else {
+    err = copyTree(h.proc, p, dst, depth == infinite)
+  }
+  if err != nil { return 0, err }
+
+  if replaced { return http.StatusNoContent, nil }
+  return http.StatusCreated, nil
+}
+
+// Returns the GoFS path of req's Destination header, or the status to reply
+// with if it's missing or names another server.
+func (h *Handler) destination(req *http.Request) (string, int) {
+  header := req.Header.Get("Destination")
+  if header == "" { return "", http.StatusBadRequest }
+  u, err := url.Parse(header)
+  if err != nil { return "", http.StatusBadRequest }
+  if u.Host != "" && u.Host != req.Host { return "", http.StatusBadGateway }
+
+  dst, ok := h.path(u.Path)
+  if !ok { return "", http.StatusBadGateway }
+  return dst, 0
+}
+
+// Depths of Depth headers; infinite is "infinity".
+const infinite = -1
+
+// Returns the depth req's Depth header asks for, or def if it has none, and
+// false if it's not 0, 1 or infinity.
+func depthOf(req *http.Request, def int) (int, bool) {
+  switch req.Header.Get("Depth") {
+  case "":
+    return def, true
+  case "0":
+    return 0, true
+  case "1":
+    return 1, true
+  case "infinity":
+    return infinite, true
+  }
+
+  return 0, false
+}
+
+// Removes p and, if it's a directory, what's under it.
+func removeAll(proc *gofs.ProcState, p string) error {
+  stat, err := proc.Lstat(p)
+  if err != nil { return err }
+
+  if isDir(stat) {
+    entries, err := proc.ReadDir(p)
+    if err != nil { return err }
+    for _, entry := range entries {
+      if err := removeAll(proc, path.Join(p, entry.Name)); err != nil { return err }
+    }
+  }
+
+  return proc.Unlink(p)
+}
+
+// Copies src to dst, which mustn't exist, with what's under src if deep.
+func copyTree(proc *gofs.ProcState, src string, dst string, deep bool) error {
+  stat, err := proc.Lstat(src)
+  if err != nil { return err }
+
+  switch stat.Mode & gofs.S_IFMT {
+  case gofs.S_IFDIR:
+    if err := proc.Mkdir(dst); err != nil { return err }
+    if deep {
+      entries, err := proc.ReadDir(src)
+      if err != nil { return err }
+      for _, entry := range entries {
+        err := copyTree(proc, path.Join(src, entry.Name), path.Join(dst, entry.Name), true)
+        if err != nil { return err }
+      }
+    }
+  case gofs.S_IFREG:
+    if err := copyData(proc, src, dst); err != nil { return err }
+  case gofs.S_IFLNK:
+    target, err := proc.Readlink(src)
+    if err != nil { return err }
+    return proc.Symlink(target, dst)
+  case gofs.S_IFIFO:
+    return proc.Mkfifo(dst)
+  default:
+    return gofs.ENOTSUP
+  }
+
+  return proc.Chmod(dst, stat.Mode & 07777)
+}
+
+func copyData(proc *gofs.ProcState, src string, dst string) error {
+  in, err := proc.Open(src, gofs.O_RDONLY, gofs.UserMode())
+  if err != nil { return err }
+  defer proc.Close(in)
+
+  out, err := proc.Open(dst, gofs.O_WRONLY | gofs.O_CREAT | gofs.O_EXCL, fileMode)
+  if err != nil { return err }
+
+  buf := make([]byte, 32 << 10)
+  for err == nil {
+    var n int
+    n, err = proc.Read(in, buf)
+    if n > 0 {
+      if _, werr := proc.Write(out, buf[:n]); werr != nil { err = werr }
+    }
+  }
+  if err == io.EOF { err = nil }
+
+  if cerr := proc.Close(out); err == nil { err = cerr }
+  return err
+}
+
+// A file open on a descriptor of the Handler's process, which GET and PUT
+// stream through, taking the Handler's lock for each call.
+type davFile struct {
+  h *Handler
+  fd gofs.FileDescriptor
+}
+
+func (file *davFile) Read(p []byte) (int, error) {
+  file.h.mu.Lock()
+  defer file.h.mu.Unlock()
+  return file.h.proc.Read(file.fd, p)
+}
+
+func (file *davFile) Write(p []byte) (int, error) {
+  file.h.mu.Lock()
+  defer file.h.mu.Unlock()
+  return file.h.proc.Write(file.fd, p)
+}
+
+func (file *davFile) Seek(offset int64, whence int) (int64, error) {
+  file.h.mu.Lock()
+  defer file.h.mu.Unlock()
+  return file.h.proc.Seek(file.fd, offset, whence)
+}
+
+func (file *davFile) Close() error {
+  file.h.mu.Lock()
+  defer file.h.mu.Unlock()
+  return file.h.proc.Close(file.fd)
+}
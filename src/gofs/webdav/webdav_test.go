@@ -0,0 +1,209 @@
+package webdav
+
+import (
+  "encoding/xml"
+  "gofs"
+  "io"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+func check(t *testing.T, err error) {
+  t.Helper()
+  if err != nil { t.Fatal(err) }
+}
+
+// Makes a request of srv, with headers as name, value pairs, and returns the
+// reply's status and body.
+func do(t *testing.T, srv *httptest.Server, method string, p string, body string,
+headers ...string) (int, string, http.Header) {
+  t.Helper()
+  req, err := http.NewRequest(method, srv.URL + p, strings.NewReader(body))
+  check(t, err)
+  for i := 0; i + 1 < len(headers); i += 2 {
+    req.Header.Set(headers[i], headers[i + 1])
+  }
+
+  resp, err := srv.Client().Do(req)
+  check(t, err)
+  defer resp.Body.Close()
+  data, err := io.ReadAll(resp.Body)
+  check(t, err)
+  return resp.StatusCode, string(data), resp.Header
+}
+
+func expect(t *testing.T, srv *httptest.Server, want int, method string, p string, body string,
+headers ...string) string {
+  t.Helper()
+  status, data, _ := do(t, srv, method, p, body, headers...)
+  if status != want { t.Fatalf("%s %s: got %d, not %d: %s", method, p, status, want, data) }
+  return data
+}
+
+type multistatus struct {
+  Responses []struct {
+    Href string `xml:"DAV: href"`
+    Propstats []struct {
+      Prop struct {
+        Length string `xml:"DAV: getcontentlength"`
+        Collection *struct{} `xml:"DAV: resourcetype>collection"`
+        Lock string `xml:"DAV: lockdiscovery>activelock>locktoken>href"`
+        Inner string `xml:",innerxml"`
+      } `xml:"DAV: prop"`
+      Status string `xml:"DAV: status"`
+    } `xml:"DAV: propstat"`
+  } `xml:"DAV: response"`
+}
+
+func TestHandler(t *testing.T) {
+  proc := gofs.InitProc()
+  defer proc.Exit()
+  h := NewHandler(proc)
+  h.Prefix = "/dav"
+  srv := httptest.NewServer(h)
+  defer srv.Close()
+
+  status, _, header := do(t, srv, "OPTIONS", "/dav/", "")
+  if status != http.StatusOK || header.Get("DAV") != "1, 2" { t.Fatalf("Bad OPTIONS: %d %v", status, header) }
+
+  // collections and files
+  expect(t, srv, http.StatusCreated, "MKCOL", "/dav/webdav", "")
+  expect(t, srv, http.StatusMethodNotAllowed, "MKCOL", "/dav/webdav", "")
+  expect(t, srv, http.StatusConflict, "MKCOL", "/dav/webdav/a/b", "")
+  expect(t, srv, http.StatusCreated, "PUT", "/dav/webdav/notes.txt", "hello, world")
+  expect(t, srv, http.StatusNoContent, "PUT", "/dav/webdav/notes.txt", "hello")
+  expect(t, srv, http.StatusConflict, "PUT", "/dav/webdav/missing/notes.txt", "")
+  expect(t, srv, http.StatusMethodNotAllowed, "PUT", "/dav/webdav", "")
+  stat, err := proc.Stat("/webdav/notes.txt")
+  if err != nil || stat.Size != 5 || stat.Mode != gofs.S_IFREG | 0644 { t.Fatalf("Bad PUT: %+v %v", stat, err) }
+
+  if data := expect(t, srv, http.StatusOK, "GET", "/dav/webdav/notes.txt", ""); data != "hello" {
+    t.Fatalf("GET gave %q", data)
+  }
+  if data := expect(t, srv, http.StatusPartialContent, "GET", "/dav/webdav/notes.txt", "", "Range", "bytes=1-3"); data != "ell" {
+    t.Fatalf("Ranged GET gave %q", data)
+  }
+  expect(t, srv, http.StatusNotFound, "GET", "/dav/webdav/missing", "")
+  expect(t, srv, http.StatusNotFound, "GET", "/elsewhere", "")
+  expect(t, srv, http.StatusNotFound, "GET", "/davwebdav/notes.txt", "")
+  expect(t, srv, http.StatusOK, "GET", "/dav", "")
+
+  // listings
+  expect(t, srv, http.StatusCreated, "MKCOL", "/dav/webdav/sub", "")
+  expect(t, srv, http.StatusCreated, "PUT", "/dav/webdav/sub/deep", "deeper")
+  check(t, proc.Symlink("sub", "/webdav/link"))
+  if data := expect(t, srv, http.StatusOK, "GET", "/dav/webdav/", ""); !strings.Contains(data, `href="./sub/"`) {
+    t.Fatalf("Bad listing: %s", data)
+  }
+
+  data := expect(t, srv, http.StatusMultiStatus, "PROPFIND", "/dav/webdav", `<?xml version="1.0"?>
+<propfind xmlns="DAV:" xmlns:x="urn:x"><prop><getcontentlength/><resourcetype/><x:color/></prop></propfind>`,
+    "Depth", "1")
+  var ms multistatus
+  check(t, xml.Unmarshal([]byte(data), &ms))
+  var hrefs []string
+  for _, resp := range ms.Responses {
+    hrefs = append(hrefs, resp.Href)
+  }
+  if strings.Join(hrefs, " ") != "/dav/webdav/ /dav/webdav/link/ /dav/webdav/notes.txt /dav/webdav/sub/" {
+    t.Fatalf("PROPFIND found %v", hrefs)
+  }
+  notes := ms.Responses[2]
+  if len(notes.Propstats) != 2 || notes.Propstats[0].Prop.Length != "5" || notes.Propstats[0].Prop.Collection != nil ||
+  !strings.Contains(notes.Propstats[1].Status, "404") || !strings.Contains(notes.Propstats[1].Prop.Inner, "color") {
+    t.Fatalf("Bad properties: %+v", notes)
+  }
+  if ms.Responses[0].Propstats[0].Prop.Collection == nil { t.Fatalf("Collection isn't one: %+v", ms.Responses[0]) }
+
+  // the link isn't followed down, but its target is found on its own
+  data = expect(t, srv, http.StatusMultiStatus, "PROPFIND", "/dav/webdav/", "", "Depth", "infinity")
+  if strings.Count(data, "<D:response>") != 5 || !strings.Contains(data, "getlastmodified") {
+    t.Fatalf("Bad allprop: %s", data)
+  }
+
+  // copies and moves
+  expect(t, srv, http.StatusCreated, "COPY", "/dav/webdav/sub", "", "Destination", srv.URL + "/dav/webdav/copy")
+  if data := expect(t, srv, http.StatusOK, "GET", "/dav/webdav/copy/deep", ""); data != "deeper" {
+    t.Fatalf("Copy has %q", data)
+  }
+  expect(t, srv, http.StatusPreconditionFailed, "COPY", "/dav/webdav/notes.txt", "",
+    "Destination", "/dav/webdav/copy", "Overwrite", "F")
+  expect(t, srv, http.StatusForbidden, "COPY", "/dav/webdav/sub", "", "Destination", "/dav/webdav/sub/in")
+  expect(t, srv, http.StatusForbidden, "COPY", "/dav/webdav/sub/deep", "", "Destination", "/dav/webdav")
+  expect(t, srv, http.StatusForbidden, "MOVE", "/dav/webdav/sub/deep", "", "Destination", "/dav/webdav/sub")
+  if _, err := proc.Stat("/webdav/sub/deep"); err != nil { t.Fatalf("Moving over a parent removed it: %v", err) }
+  expect(t, srv, http.StatusBadGateway, "COPY", "/dav/webdav/sub", "", "Destination", "http://elsewhere/dav/x")
+  expect(t, srv, http.StatusNoContent, "MOVE", "/dav/webdav/notes.txt", "", "Destination", "/dav/webdav/copy")
+  if _, err := proc.Stat("/webdav/notes.txt"); err != gofs.ENOENT { t.Fatalf("Move left its source: %v", err) }
+  if data := expect(t, srv, http.StatusOK, "GET", "/dav/webdav/copy", ""); data != "hello" {
+    t.Fatalf("Move gave %q", data)
+  }
+
+  // locks
+  lockinfo := `<?xml version="1.0"?><lockinfo xmlns="DAV:"><lockscope><exclusive/></lockscope>
+<locktype><write/></locktype><owner><href>me</href></owner></lockinfo>`
+  status, data, header = do(t, srv, "LOCK", "/dav/webdav/sub", lockinfo, "Timeout", "Second-600")
+  token := header.Get("Lock-Token")
+  if status != http.StatusOK || !strings.HasPrefix(token, "<opaquelocktoken:") || !strings.Contains(data, "<href>me</href>") {
+    t.Fatalf("Bad LOCK: %d %q %s", status, token, data)
+  }
+  expect(t, srv, http.StatusLocked, "LOCK", "/dav/webdav/sub/deep", lockinfo)
+  expect(t, srv, http.StatusLocked, "PUT", "/dav/webdav/sub/deep", "changed")
+  expect(t, srv, http.StatusLocked, "DELETE", "/dav/webdav/sub", "")
+  expect(t, srv, http.StatusLocked, "MOVE", "/dav/webdav/copy", "", "Destination", "/dav/webdav/sub/copy")
+  expect(t, srv, http.StatusNoContent, "PUT", "/dav/webdav/sub/deep", "changed", "If", "(" + token + ")")
+  expect(t, srv, http.StatusOK, "LOCK", "/dav/webdav/sub", "", "If", "(" + token + ")", "Timeout", "Infinite")
+  data = expect(t, srv, http.StatusMultiStatus, "PROPFIND", "/dav/webdav/sub/deep", "", "Depth", "0")
+  ms = multistatus{}
+  check(t, xml.Unmarshal([]byte(data), &ms))
+  if "<" + ms.Responses[0].Propstats[0].Prop.Lock + ">" != token { t.Fatalf("Lock not discovered: %s", data) }
+
+  expect(t, srv, http.StatusConflict, "UNLOCK", "/dav/webdav/copy", "", "Lock-Token", token)
+  expect(t, srv, http.StatusNoContent, "UNLOCK", "/dav/webdav/sub/deep", "", "Lock-Token", token)
+  expect(t, srv, http.StatusNoContent, "PUT", "/dav/webdav/sub/deep", "unlocked")
+
+  // locking what isn't there makes it
+  status, _, header = do(t, srv, "LOCK", "/dav/webdav/new", lockinfo, "Depth", "0")
+  if status != http.StatusCreated { t.Fatalf("LOCK of nothing gave %d", status) }
+  if stat, err := proc.Stat("/webdav/new"); err != nil || stat.Size != 0 { t.Fatalf("LOCK didn't make a file: %v", err) }
+
+  expect(t, srv, http.StatusLocked, "DELETE", "/dav/webdav", "")
+  expect(t, srv, http.StatusLocked, "DELETE", "/dav/webdav/new", "", "If", "(<" + newToken() + ">)")
+  expect(t, srv, http.StatusNoContent, "DELETE", "/dav/webdav/new", "", "If", "(" + header.Get("Lock-Token") + ")")
+  expect(t, srv, http.StatusNoContent, "DELETE", "/dav/webdav", "")
+  if _, err := proc.Stat("/webdav"); err != gofs.ENOENT { t.Fatalf("DELETE left the collection: %v", err) }
+  expect(t, srv, http.StatusMethodNotAllowed, "PROPPATCH", "/dav/", "")
+}
+
+func TestHandlerLimits(t *testing.T) {
+  proc := gofs.InitProc()
+  defer proc.Exit()
+  h := NewHandler(proc)
+  srv := httptest.NewServer(h)
+  defer srv.Close()
+  expect(t, srv, http.StatusCreated, "PUT", "/limits.txt", "hello")
+
+  // With every slot taken, GETs and PUTs wait for none of them.
+  for i := 0; i < MaxStreams; i++ { h.startStream() }
+  expect(t, srv, http.StatusServiceUnavailable, "GET", "/limits.txt", "")
+  expect(t, srv, http.StatusServiceUnavailable, "PUT", "/limits.txt", "bye")
+  for i := 0; i < MaxStreams; i++ { h.endStream() }
+  expect(t, srv, http.StatusOK, "GET", "/limits.txt", "")
+
+  // Nor do they when GoFS can't open another file.
+  var fds []gofs.FileDescriptor
+  for {
+    fd, err := proc.Open("/limits.txt", gofs.O_RDONLY, gofs.UserMode())
+    if err == gofs.ENFILE { break }
+    check(t, err)
+    fds = append(fds, fd)
+  }
+  expect(t, srv, http.StatusServiceUnavailable, "GET", "/limits.txt", "")
+  expect(t, srv, http.StatusServiceUnavailable, "PUT", "/limits.txt", "bye")
+  for _, fd := range fds { check(t, proc.Close(fd)) }
+  if data := expect(t, srv, http.StatusOK, "GET", "/limits.txt", ""); data != "hello" {
+    t.Fatalf("GET gave %q", data)
+  }
+}
@@ -0,0 +1,222 @@
+package gofs
+
+import (
+  "sort"
+  "strings"
+  "time"
+)
+
+/**
+* Extended attributes are name-value pairs kept on an inode, beside its data,
+* for callers to tag files with. Files and directories have them; other
+* entries have no inode to keep them on, and calls on those fail with EPERM.
+*
+* Names must start with one of the namespaces below and are at most
+* XATTR_NAME_MAX bytes long; values are at most XATTR_SIZE_MAX bytes, and all
+* the names and values of one inode together at most XATTR_INODE_MAX. Like
+* writes, changes are journaled by inode number, so those made through a
+* descriptor are recovered even if the file was renamed since it was opened.
+*
+* Reading user. attributes needs read permission on the inode and changing them
+* write permission; the other namespaces are for root, as xattrPermission says.
+*/
+
+const XATTR_NAME_MAX = 255
+const XATTR_SIZE_MAX = 64 * 1024
+const XATTR_INODE_MAX = 1024 * 1024
+
+var xattrNamespaces = []string{"user.", "trusted.", "security."}
+
+type XattrFlag int
+const (
+  XATTR_CREATE XattrFlag = 1 << iota // fail with EEXIST if the name is set
+  XATTR_REPLACE // fail with ENODATA if the name isn't set
+)
+
+// Returns the inode holding entry's metadata, or nil if it has none.
+func inodeOf(entry interface{}) *Inode {
+  switch entry := entry.(type) {
+  case *Inode:
+    return entry
+  case Directory:
+    return entry.inode()
+  }
+
+  return nil
+}
+
+func checkXattrName(name string) error {
+  if len(name) > XATTR_NAME_MAX { return ERANGE }
+  for _, namespace := range xattrNamespaces {
+    if strings.HasPrefix(name, namespace) && len(name) > len(namespace) { return nil }
+  }
+
+  return ENOTSUP
+}
+
+func (inode *Inode) xattrSize() int {
+  size := 0
+  for name, value := range inode.xattrs {
+    size += len(name) + len(value)
+  }
+
+  return size
+}
+
+func (inode *Inode) setxattr(name string, value []byte, flags XattrFlag) error {
+  if err := checkXattrName(name); err != nil { return err }
+  if len(value) > XATTR_SIZE_MAX { return E2BIG }
+  if flags & ^(XATTR_CREATE | XATTR_REPLACE) != 0 { return EINVAL }
+
+  old, exists := inode.xattrs[name]
+  if exists && (flags & XATTR_CREATE) != 0 { return EEXIST }
+  if !exists && (flags & XATTR_REPLACE) != 0 { return ENODATA }
+
+  size := inode.xattrSize() + len(value)
+  if exists { size -= len(old) } else { size += len(name) }
+  if size > XATTR_INODE_MAX { return ENOSPC }
+
+  if inode.xattrs == nil { inode.xattrs = make(map[string][]byte) }
+  inode.xattrs[name] = append([]byte(nil), value...)
+  return nil
+}
+
+func (inode *Inode) getxattr(name string) ([]byte, error) {
+  if err := checkXattrName(name); err != nil { return nil, err }
+
+  value, exists := inode.xattrs[name]
+  if !exists { return nil, ENODATA }
+  return append([]byte(nil), value...), nil
+}
+
+func (inode *Inode) listxattr() []string {
+  names := make([]string, 0, len(inode.xattrs))
+  for name := range inode.xattrs {
+    names = append(names, name)
+  }
+
+  sort.Strings(names)
+  return names
+}
+
+func (inode *Inode) removexattr(name string) error {
+  if err := checkXattrName(name); err != nil { return err }
+  if _, exists := inode.xattrs[name]; !exists { return ENODATA }
+
+  delete(inode.xattrs, name)
+  return nil
+}
+
+// Checks that proc may read, or write, the attribute name of inode. Only root
+// may write trusted. and security. attributes, and only root sees trusted.
+// ones at all; user. attributes follow the inode's mode.
+func (proc *ProcState) xattrPermission(inode *Inode, name string, write bool) error {
+  if err := checkXattrName(name); err != nil { return err }
+  if proc.uid == 0 { return nil }
+
+  switch {
+  case strings.HasPrefix(name, "trusted.") && write:
+    return EPERM
+  case strings.HasPrefix(name, "trusted."):
+    return ENODATA
+  case strings.HasPrefix(name, "security."):
+    if write { return EPERM }
+    return nil
+  case write:
+    return proc.checkPermission(inode, M_WRITE)
+  }
+
+  return proc.checkPermission(inode, M_READ)
+}
+
+func (proc *ProcState) setxattr(ref pathRef, inode *Inode, name string,
+  value []byte, flags XattrFlag) error {
+  if err := proc.xattrPermission(inode, name, true); err != nil { return err }
+  if err := inode.fs.checkWrite(); err != nil { return err }
+  if err := inode.setxattr(name, value, flags); err != nil { return err }
+
+  inode.changeTime = time.Now()
+  notify(ref.dir, ref.name, ref.entry, IN_ATTRIB, 0)
+  return logSetxattr(inode, name, value)
+}
+
+func (proc *ProcState) removexattr(ref pathRef, inode *Inode, name string) error {
+  if err := proc.xattrPermission(inode, name, true); err != nil { return err }
+  if err := inode.fs.checkWrite(); err != nil { return err }
+  if err := inode.removexattr(name); err != nil { return err }
+
+  inode.changeTime = time.Now()
+  notify(ref.dir, ref.name, ref.entry, IN_ATTRIB, 0)
+  return logRemovexattr(inode, name)
+}
+
+func (proc *ProcState) getxattr(inode *Inode, name string) ([]byte, error) {
+  if err := proc.xattrPermission(inode, name, false); err != nil { return nil, err }
+  return inode.getxattr(name)
+}
+
+func (proc *ProcState) listxattr(inode *Inode) []string {
+  names := inode.listxattr()
+  if proc.uid == 0 { return names }
+
+  visible := names[:0]
+  for _, name := range names {
+    if !strings.HasPrefix(name, "trusted.") { visible = append(visible, name) }
+  }
+
+  return visible
+}
+
+// Sets the extended attribute name of what path names to value.
+func (proc *ProcState) Setxattr(path string, name string, value []byte,
+  flags XattrFlag) error {
+  ref, inode, err := proc.changeableAt(path, true)
+  if err != nil { return err }
+  return proc.setxattr(ref, inode, name, value, flags)
+}
+
+func (proc *ProcState) Fsetxattr(fd FileDescriptor, name string, value []byte,
+  flags XattrFlag) error {
+  ref, inode, err := proc.changeableOfFd(fd)
+  if err != nil { return err }
+  return proc.setxattr(ref, inode, name, value, flags)
+}
+
+// Returns the value of the extended attribute name of what path names.
+func (proc *ProcState) Getxattr(path string, name string) ([]byte, error) {
+  _, inode, err := proc.inodeAt(path, true)
+  if err != nil { return nil, err }
+  return proc.getxattr(inode, name)
+}
+
+func (proc *ProcState) Fgetxattr(fd FileDescriptor, name string) ([]byte, error) {
+  _, inode, err := proc.inodeOfFd(fd)
+  if err != nil { return nil, err }
+  return proc.getxattr(inode, name)
+}
+
+// Returns the names of the extended attributes of what path names, in order.
+func (proc *ProcState) Listxattr(path string) ([]string, error) {
+  _, inode, err := proc.inodeAt(path, true)
+  if err != nil { return nil, err }
+  return proc.listxattr(inode), nil
+}
+
+func (proc *ProcState) Flistxattr(fd FileDescriptor) ([]string, error) {
+  _, inode, err := proc.inodeOfFd(fd)
+  if err != nil { return nil, err }
+  return proc.listxattr(inode), nil
+}
+
+// Removes the extended attribute name from what path names.
+func (proc *ProcState) Removexattr(path string, name string) error {
+  ref, inode, err := proc.changeableAt(path, true)
+  if err != nil { return err }
+  return proc.removexattr(ref, inode, name)
+}
+
+func (proc *ProcState) Fremovexattr(fd FileDescriptor, name string) error {
+  ref, inode, err := proc.changeableOfFd(fd)
+  if err != nil { return err }
+  return proc.removexattr(ref, inode, name)
+}
@@ -0,0 +1,105 @@
+package gofs
+
+import (
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestXattrs(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  p.safeMkdir(t, "/tagged")
+  fd := p.safeOpen(t, "/tagged/file", O_RDWR|O_CREAT, UserMode())
+
+  AssertNoErr(t, p.Setxattr("/tagged/file", "user.origin", []byte("upload"), 0))
+  AssertNoErr(t, p.Fsetxattr(fd, "security.label", []byte("secret"), XATTR_CREATE))
+  AssertNoErr(t, p.Setxattr("/tagged", "trusted.owner", nil, 0))
+
+  value, err := p.Fgetxattr(fd, "user.origin")
+  AssertNoErr(t, err)
+  AssertEqualBytes(t, value, []byte("upload"))
+  names, err := p.Listxattr("/tagged/file")
+  AssertNoErr(t, err)
+  AssertTrue(t, strings.Join(names, ",") == "security.label,user.origin",
+    "Bad list: " + strings.Join(names, ","))
+
+  // the flags make setting fail if the name is, or isn't, already set
+  AssertTrue(t, p.Setxattr("/tagged/file", "user.origin", nil, XATTR_CREATE) == EEXIST,
+    "Expected EEXIST.")
+  AssertTrue(t, p.Setxattr("/tagged/file", "user.new", nil, XATTR_REPLACE) == ENODATA,
+    "Expected ENODATA.")
+  AssertNoErr(t, p.Setxattr("/tagged/file", "user.origin", []byte("copy"), XATTR_REPLACE))
+
+  // changing them changes the ctime
+  inode := p.fileDescriptorTable[fd].(*DataFile).inode
+  inode.changeTime = time.Time{}
+  AssertNoErr(t, p.Setxattr("/tagged/file", "user.stamp", nil, 0))
+  AssertTrue(t, !inode.changeTime.IsZero(), "Setxattr left the ctime.")
+  inode.changeTime = time.Time{}
+  AssertNoErr(t, p.Fremovexattr(fd, "user.stamp"))
+  AssertTrue(t, !inode.changeTime.IsZero(), "Removexattr left the ctime.")
+
+  // attributes belong to the inode, so links and open files see the same ones
+  p.safeLink(t, "/tagged/file", "/tagged/link")
+  AssertNoErr(t, p.Removexattr("/tagged/link", "security.label"))
+  _, err = p.Fgetxattr(fd, "security.label")
+  AssertTrue(t, err == ENODATA, "Expected ENODATA.")
+  AssertTrue(t, p.Fremovexattr(fd, "security.label") == ENODATA, "Expected ENODATA.")
+
+  dir := p.safeOpen(t, "/tagged", O_RDONLY, UserMode())
+  names, err = p.Flistxattr(dir)
+  AssertNoErr(t, err)
+  AssertTrue(t, len(names) == 1 && names[0] == "trusted.owner", "Bad directory list.")
+  p.safeClose(t, dir)
+
+  AssertNoErr(t, p.Symlink("file", "/tagged/symlink"))
+  value, err = p.Getxattr("/tagged/symlink", "user.origin")
+  AssertNoErr(t, err)
+  AssertEqualBytes(t, value, []byte("copy"))
+
+  p.safeClose(t, fd)
+  p.safeUnlink(t, "/tagged/symlink")
+  p.safeUnlink(t, "/tagged/link")
+  p.safeUnlink(t, "/tagged/file")
+  p.safeUnlink(t, "/tagged")
+}
+
+func TestXattrErrors(t *testing.T) {
+  p := InitProc()
+  defer p.Exit()
+  fd := p.safeOpen(t, "/limits", O_RDWR|O_CREAT, UserMode())
+
+  cases := []struct {
+    name string
+    size int
+    err error
+  }{
+    {"system.posix_acl_access", 0, ENOTSUP},
+    {"user.", 0, ENOTSUP},
+    {"origin", 0, ENOTSUP},
+    {"user." + strings.Repeat("x", XATTR_NAME_MAX), 0, ERANGE},
+    {"user.big", XATTR_SIZE_MAX + 1, E2BIG},
+    {"user.max", XATTR_SIZE_MAX, nil},
+  }
+
+  for _, c := range cases {
+    err := p.Fsetxattr(fd, c.name, make([]byte, c.size), 0)
+    AssertTrue(t, err == c.err, "Wrong error setting " + c.name)
+  }
+
+  // all of an inode's attributes together are limited too
+  var err error
+  for i := 0; err == nil; i++ {
+    err = p.Fsetxattr(fd, "user." + strings.Repeat("n", i + 1), make([]byte, XATTR_SIZE_MAX), 0)
+  }
+  AssertTrue(t, err == ENOSPC, "Expected ENOSPC.")
+
+  _, err = p.Getxattr("/dev/null", "user.x")
+  AssertTrue(t, err == EPERM, "Expected EPERM on a device.")
+  _, err = p.Getxattr("/missing", "user.x")
+  AssertTrue(t, err == ENOENT, "Expected ENOENT.")
+
+  p.safeClose(t, fd)
+  p.safeUnlink(t, "/limits")
+}
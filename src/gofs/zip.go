@@ -0,0 +1,269 @@
+package gofs
+
+import (
+  "archive/zip"
+  "bytes"
+  "gofs/dstore"
+  "io"
+  "io/fs"
+  "path"
+  "strings"
+  "time"
+)
+
+/**
+* ImportZip and ExportZip do for zip archives what ImportTar and ExportTar do
+* for tar ones, with what zip can hold: directories, files and symlinks, with
+* their permission bits and modification times. Hard links are written as
+* copies; owners, extended attributes, FIFOs and devices are left out.
+*
+* A zip mount serves an archive as a read-only tree without extracting it. Its
+* source is a GoFS file, read when it's mounted. The tree is made from the
+* archive's directory, and each file is decompressed into pages the first time
+* it's read, so that a big archive can be looked through for the few files a
+* test needs. Checkpoints hold the archive, not what's been decompressed.
+*/
+
+// Writes the tree at src to w as a zip archive, with names relative to src.
+func ExportZip(proc *ProcState, src string, w io.Writer) error {
+  stat, err := proc.Stat(src)
+  if err != nil { return err }
+  if stat.Mode & S_IFMT != S_IFDIR { return ENOTDIR }
+
+  zw := zip.NewWriter(w)
+  err = walkArchive(proc, src, "", func(full string, name string, stat Stat_t) error {
+    hdr, err := zip.FileInfoHeader(FileInfoOf(name, stat))
+    if err != nil { return err }
+    hdr.Name = name
+
+    switch stat.Mode & S_IFMT {
+    case S_IFDIR:
+      _, err = zw.CreateHeader(hdr)
+      return err
+    case S_IFREG:
+      hdr.Method = zip.Deflate
+      fw, err := zw.CreateHeader(hdr)
+      if err != nil { return err }
+      return exportData(proc, fw, full)
+    case S_IFLNK:
+      target, err := proc.Readlink(full)
+      if err != nil { return err }
+      fw, err := zw.CreateHeader(hdr)
+      if err != nil { return err }
+      _, err = io.WriteString(fw, target)
+      return err
+    }
+
+    return nil
+  })
+  if err != nil { return err }
+  return zw.Close()
+}
+
+// An entry of a zip archive to finish once everything else is in.
+type pendingZip struct {
+  path string
+  file *zip.File
+}
+
+// Makes what the zip archive r, size bytes long, holds under the directory
+// dest.
+func ImportZip(proc *ProcState, r io.ReaderAt, size int64, dest string) error {
+  stat, err := proc.Stat(dest)
+  if err != nil { return err }
+  if stat.Mode & S_IFMT != S_IFDIR { return ENOTDIR }
+
+  zr, err := zip.NewReader(r, size)
+  if err != nil { return err }
+
+  var dirs, symlinks []pendingZip
+  for _, file := range zr.File {
+    full, err := archivePath(dest, file.Name)
+    if err != nil { return err }
+    if err := makeParents(proc, dest, full); err != nil { return err }
+
+    switch mode := file.Mode(); {
+    case mode.IsDir():
+      dirs = append(dirs, pendingZip{full, file})
+      err = importDir(proc, full)
+    case (mode & fs.ModeSymlink) != 0:
+      symlinks = append(symlinks, pendingZip{full, file})
+    case mode.IsRegular():
+      err = importZipFile(proc, full, file)
+    default:
+      err = EINVAL
+    }
+    if err != nil { return err }
+  }
+
+  for _, link := range symlinks {
+    target, err := readZipEntry(link.file)
+    if err != nil { return err }
+    if err := makeWay(proc, link.path); err != nil { return err }
+    if err := proc.Symlink(string(target), link.path); err != nil { return err }
+  }
+
+  for i := len(dirs) - 1; i >= 0; i-- {
+    mtime := dirs[i].file.Modified
+    if err := restoreAttrs(proc, dirs[i].path, zipPerms(dirs[i].file.Mode()), mtime, mtime); err != nil {
+      return err
+    }
+  }
+
+  return nil
+}
+
+func importZipFile(proc *ProcState, full string, file *zip.File) error {
+  r, err := file.Open()
+  if err != nil { return err }
+  defer r.Close()
+
+  if err := makeWay(proc, full); err != nil { return err }
+  fd, err := proc.Open(full, O_WRONLY|O_CREAT|O_EXCL, UserMode())
+  if err != nil { return err }
+
+  err = writeSparse(proc, fd, r, int64(file.UncompressedSize64))
+  if cerr := proc.Close(fd); err == nil { err = cerr }
+  if err != nil { return err }
+  return restoreAttrs(proc, full, zipPerms(file.Mode()), file.Modified, file.Modified)
+}
+
+// Returns the permission bits of mode as GoFS has them.
+func zipPerms(mode fs.FileMode) uint {
+  perms := uint(mode.Perm())
+  if (mode & fs.ModeSetuid) != 0 { perms |= S_ISUID }
+  if (mode & fs.ModeSetgid) != 0 { perms |= S_ISGID }
+  if (mode & fs.ModeSticky) != 0 { perms |= S_ISVTX }
+  return perms
+}
+
+func readZipEntry(file *zip.File) ([]byte, error) {
+  r, err := file.Open()
+  if err != nil { return nil, err }
+  defer r.Close()
+  return io.ReadAll(r)
+}
+
+func mountZip(proc *ProcState, mnt *fsMount) error {
+  if mnt.size != 0 { return EINVAL }
+  mnt.flags |= MS_RDONLY
+
+  archive, err := proc.readSource(mnt.source)
+  if err != nil { return err }
+  mnt.archive = archive
+  return mnt.loadZip()
+}
+
+// Makes the tree of the zip mount mnt from the directory of its archive.
+func (mnt *fsMount) loadZip() error {
+  zr, err := zip.NewReader(bytes.NewReader(mnt.archive), int64(len(mnt.archive)))
+  if err != nil { return EINVAL }
+
+  root := mnt.newRoot(0755)
+  for _, file := range zr.File {
+    // Names can't climb out of the tree, whatever they hold.
+    name := path.Clean("/" + file.Name)
+    if name == "/" { continue }
+    dir := zipDirectory(root, path.Dir(name))
+    if dir == nil { continue }
+
+    mode, base := file.Mode(), path.Base(name)
+    if mode.IsDir() {
+      if sub := zipDirectory(dir, base); sub != nil { setZipAttrs(sub.inode(), file) }
+      continue
+    }
+
+    // The first entry of a name is the one served.
+    if _, exists := dir[base]; exists { continue }
+    if (mode & fs.ModeSymlink) != 0 {
+      target, err := readZipEntry(file)
+      if err != nil { return EINVAL }
+      dir[base] = &Symlink{target: string(target)}
+      continue
+    }
+
+    inode := initInode()
+    inode.fs = mnt
+    inode.data = &zipData{file: file}
+    setZipAttrs(inode, file)
+    dir[base] = inode
+  }
+
+  return nil
+}
+
+// Returns the directory at rel under dir, in a zip mount's tree, making what
+// isn't there yet, or nil if something other than a directory is in the way.
+func zipDirectory(dir Directory, rel string) Directory {
+  for _, name := range strings.Split(rel, "/") {
+    if name == "" { continue }
+
+    switch entry := dir[name].(type) {
+    case nil:
+      sub := initDirectory(dir, name)
+      dir[name] = sub
+      dir = sub
+    case Directory:
+      dir = entry
+    default:
+      return nil
+    }
+  }
+
+  return dir
+}
+
+func setZipAttrs(inode *Inode, file *zip.File) {
+  inode.perms = zipPerms(file.Mode())
+  mtime := file.Modified
+  if mtime.IsZero() { mtime = time.Unix(0, 0) }
+  inode.lastAccessTime, inode.lastModTime = mtime, mtime
+  inode.changeTime, inode.createTime = mtime, mtime
+}
+
+// The data of a file on a zip mount: its entry in the archive, decompressed
+// into pages when it's first read.
+type zipData struct {
+  file *zip.File
+  pages *dstore.PageStore
+}
+
+func (data *zipData) Size() int {
+  if data.pages != nil { return data.pages.Size() }
+  return int(data.file.UncompressedSize64)
+}
+
+func (data *zipData) Read(o int, p []byte) (int, error) {
+  if data.pages == nil {
+    r, err := data.file.Open()
+    if err != nil { return 0, EIO }
+    defer r.Close()
+
+    pages := dstore.InitPageStore()
+    if _, err := io.Copy(&pageWriter{pages: pages}, r); err != nil {
+      pages.ReleasePages()
+      return 0, EIO
+    }
+    data.pages = pages
+  }
+
+  if o >= data.pages.Size() { return 0, io.EOF }
+  return data.pages.Read(o, p)
+}
+
+// Zip mounts are read-only, so nothing writes or truncates their files.
+func (data *zipData) Write(o int, p []byte) (int, error) {
+  return 0, EROFS
+}
+
+func (data *zipData) Truncate(size int) {
+}
+
+// Appends what's written to pages.
+type pageWriter struct {
+  pages *dstore.PageStore
+}
+
+func (w *pageWriter) Write(p []byte) (int, error) {
+  return w.pages.Write(w.pages.Size(), p)
+}
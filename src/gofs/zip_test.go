@@ -0,0 +1,68 @@
+package gofs
+
+import (
+  "archive/zip"
+  "bytes"
+  "testing"
+  "time"
+)
+
+func TestZip(t *testing.T) {
+  p := InitProc()
+  p.safeMkdir(t, "/t")
+  AssertNoErr(t, p.Mount("none", "/t", "memfs", 0, 0))
+  p.safeMkdir(t, "/t/src")
+  p.safeMkdir(t, "/t/src/sub")
+  content := randBytes(3 * 4096 + 12)
+  p.writeFile(t, "/t/src/sub/file", content)
+  AssertNoErr(t, p.Symlink("sub/file", "/t/src/link"))
+  AssertNoErr(t, p.Mkfifo("/t/src/fifo"))
+  AssertNoErr(t, p.Chmod("/t/src/sub/file", 0640))
+  mtime := time.Unix(1000000000, 0)
+  AssertNoErr(t, p.Utimes("/t/src/sub", [2]Timespec{TimespecOf(mtime), TimespecOf(mtime)}))
+  AssertNoErr(t, p.Chmod("/t/src/sub", 0550))
+
+  var archive bytes.Buffer
+  AssertNoErr(t, ExportZip(p, "/t/src", &archive))
+  zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+  AssertNoErr(t, err)
+  var names []string
+  for _, file := range zr.File {
+    names = append(names, file.Name)
+  }
+  AssertTrue(t, sameNames(names, "link", "sub/", "sub/file"), "Bad names in archive.")
+
+  p.safeMkdir(t, "/t/dst")
+  AssertNoErr(t, ImportZip(p, bytes.NewReader(archive.Bytes()), int64(archive.Len()), "/t/dst"))
+  AssertEqualBytes(t, content, p.readFile(t, "/t/dst/link", len(content)))
+  stat, err := p.Stat("/t/dst/sub/file")
+  AssertTrue(t, err == nil && stat.Mode == S_IFREG | 0640, "Lost a file's mode.")
+  stat, err = p.Stat("/t/dst/sub")
+  AssertTrue(t, err == nil && stat.Mode == S_IFDIR | 0550 && stat.Mtime.Equal(mtime),
+    "Lost a directory's attributes.")
+
+  // a mounted archive is decompressed a file at a time, as it's read
+  p.writeFile(t, "/t/fixture.zip", archive.Bytes())
+  p.safeMkdir(t, "/t/zip")
+  AssertTrue(t, p.Mount("/t/src", "/t/zip", "zip", 0, 0) == EINVAL, "Mounted a directory.")
+  AssertNoErr(t, p.Mount("/t/fixture.zip", "/t/zip", "zip", 0, 0))
+  ref, err := p.resolve("/t/zip/sub/file", false)
+  AssertNoErr(t, err)
+  data := ref.entry.(*Inode).data.(*zipData)
+  stat, err = p.Stat("/t/zip/sub/file")
+  AssertTrue(t, err == nil && stat.Size == int64(len(content)) && stat.Mode == S_IFREG | 0640,
+    "Bad Stat of a mounted file.")
+  AssertTrue(t, data.pages == nil, "Stat decompressed a file.")
+  AssertEqualBytes(t, content, p.readFile(t, "/t/zip/link", len(content)))
+  AssertTrue(t, data.pages != nil, "Read didn't decompress.")
+  AssertTrue(t, sameNames(direntNames(t, p, "/t/zip"), "link", "sub"), "Bad listing of a mount.")
+
+  _, err = p.Open("/t/zip/sub/file", O_RDWR, UserMode())
+  AssertTrue(t, err == EROFS, "Opened a mounted file to write.")
+  AssertTrue(t, p.Mkdir("/t/zip/new") == EROFS, "Made a directory in a zip mount.")
+
+  AssertNoErr(t, p.Unmount("/t/zip"))
+  AssertNoErr(t, p.Unmount("/t"))
+  p.safeUnlink(t, "/t")
+  p.Exit()
+}
@@ -65,6 +65,7 @@ func BenchmarkOWbC(reps int) {
   size := 40960
 
   p := newProc()
+  defer p.Exit()
   for j := 0; j < reps; j++ {
     content := randBytes(size)
     openManyC(p, NUM, func(fd gofs.FileDescriptor, _ string) {
@@ -79,6 +80,7 @@ func BenchmarkOWbCU(reps int) {
   size := 40960
 
   p := newProc()
+  defer p.Exit()
   for j := 0; j < reps; j++ {
     content := randBytes(size)
     openManyC(p, NUM, func(fd gofs.FileDescriptor, s string) {